@@ -22,10 +22,10 @@ import (
 	"strconv"
 
 	"github.com/op/go-logging"
-	"github.com/spf13/viper"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
 	"github.com/hyperledger/fabric/core/peer"
 	"github.com/hyperledger/fabric/protos/utils"
 )
@@ -141,7 +141,8 @@ func getQueryResult(vledger ledger.PeerLedger, query []byte) (ret []byte, err er
 	}
 	defer ri.Close()
 
-	limit := viper.GetInt("ledger.state.couchDBConfig.queryLimit")
+	// a limit of 0 or less means unlimited
+	limit := ledgerconfig.GetCouchDBQueryLimit()
 
 	// buffer is a JSON array containing QueryRecords
 	var buffer bytes.Buffer
@@ -149,7 +150,7 @@ func getQueryResult(vledger ledger.PeerLedger, query []byte) (ret []byte, err er
 
 	var qresult ledger.QueryResult
 	qresult, err = ri.Next()
-	for r := 0; qresult != nil && err == nil && r < limit; r++ {
+	for r := 0; qresult != nil && err == nil && (limit <= 0 || r < limit); r++ {
 		if qr, ok := qresult.(*ledger.QueryRecord); ok {
 			collectRecord(&buffer, qr)
 		}
@@ -18,6 +18,7 @@ package kvledger
 
 import (
 	"errors"
+	"os"
 
 	"github.com/hyperledger/fabric/core/ledger"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
@@ -107,6 +108,25 @@ func (provider *Provider) List() ([]string, error) {
 	return provider.idStore.getAllLedgerIds()
 }
 
+// Delete implements the corresponding method from interface ledger.PeerLedgerProvider
+// The ledger id is removed last, so that a delete interrupted midway can be retried
+func (provider *Provider) Delete(ledgerID string) error {
+	exists, err := provider.idStore.ledgerIDExists(ledgerID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNonExistingLedgerID
+	}
+	if err := provider.vdbProvider.DeleteDB(ledgerID); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(ledgerconfig.GetLedgerPath(ledgerID)); err != nil {
+		return err
+	}
+	return provider.idStore.deleteLedgerID(ledgerID)
+}
+
 // Close implements the corresponding method from interface ledger.PeerLedgerProvider
 func (provider *Provider) Close() {
 	provider.vdbProvider.Close()
@@ -136,6 +156,10 @@ func (s *idStore) createLedgerID(ledgerID string) error {
 	return s.db.Put(key, val, true)
 }
 
+func (s *idStore) deleteLedgerID(ledgerID string) error {
+	return s.db.Delete([]byte(ledgerID), true)
+}
+
 func (s *idStore) ledgerIDExists(ledgerID string) (bool, error) {
 	key := []byte(ledgerID)
 	val := []byte{}
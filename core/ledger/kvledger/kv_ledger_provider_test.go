@@ -18,9 +18,11 @@ package kvledger
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
 	"github.com/hyperledger/fabric/core/ledger/testutil"
 )
 
@@ -56,6 +58,46 @@ func TestLedgerProvider(t *testing.T) {
 	testutil.AssertEquals(t, err, ErrNonExistingLedgerID)
 }
 
+func TestLedgerProviderDelete(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.cleanup()
+	provider, _ := NewProvider()
+	defer provider.Close()
+	for i := 0; i < 2; i++ {
+		l, err := provider.Create(constructTestLedgerID(i))
+		testutil.AssertNoError(t, err, "")
+		s, _ := l.NewTxSimulator()
+		s.SetState("ns", "key", []byte("value"))
+		s.Done()
+		res, _ := s.GetTxSimulationResults()
+		testutil.AssertNoError(t, l.Commit(testutil.ConstructBlock(t, [][]byte{res}, false)), "")
+		l.Close()
+	}
+
+	testutil.AssertNoError(t, provider.Delete(constructTestLedgerID(0)), "")
+	testutil.AssertEquals(t, provider.Delete(constructTestLedgerID(0)), ErrNonExistingLedgerID)
+	exists, _ := provider.Exists(constructTestLedgerID(0))
+	testutil.AssertEquals(t, exists, false)
+	_, err := os.Stat(ledgerconfig.GetLedgerPath(constructTestLedgerID(0)))
+	testutil.AssertEquals(t, os.IsNotExist(err), true)
+
+	// the state of the deleted ledger is gone when it is recreated, while the other ledger is untouched
+	l, err := provider.Create(constructTestLedgerID(0))
+	testutil.AssertNoError(t, err, "")
+	defer l.Close()
+	qe, _ := l.NewQueryExecutor()
+	value, _ := qe.GetState("ns", "key")
+	qe.Done()
+	testutil.AssertNil(t, value)
+
+	l, _ = provider.Open(constructTestLedgerID(1))
+	defer l.Close()
+	qe, _ = l.NewQueryExecutor()
+	value, _ = qe.GetState("ns", "key")
+	qe.Done()
+	testutil.AssertEquals(t, value, []byte("value"))
+}
+
 func TestMultipleLedgerBasicRW(t *testing.T) {
 	env := newTestEnv(t)
 	defer env.cleanup()
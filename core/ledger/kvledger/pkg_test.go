@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
 	"github.com/spf13/viper"
 )
 
@@ -38,4 +39,21 @@ func newTestEnv(t testing.TB) *testEnv {
 func (env *testEnv) cleanup() {
 	path := ledgerconfig.GetRootPath()
 	os.RemoveAll(path)
+	if ledgerconfig.IsCouchDBEnabled() == true {
+		cleanupCouchDB("testledger")
+	}
+}
+
+// cleanupCouchDB drops the state database of a test ledger, which is not removed with the file system path, so
+// that the blocks the test commits are not skipped as below the savepoint left by a previous test
+func cleanupCouchDB(dbName string) {
+	couchDBDef := ledgerconfig.GetCouchDBDefinition()
+	couchInstance, err := couchdb.CreateCouchInstance(couchDBDef.URL, couchDBDef.Username, couchDBDef.Password)
+	if err != nil {
+		return
+	}
+	couchDB, err := couchdb.CreateCouchDatabase(*couchInstance, dbName)
+	if err == nil {
+		couchDB.DropDatabase()
+	}
 }
@@ -60,6 +60,34 @@ func TestBasicRW(t *testing.T, dbProvider statedb.VersionedDBProvider) {
 	testutil.AssertEquals(t, sp, savePoint)
 }
 
+// TestReadOnlyHandle tests that a read-only handle reads the state but does not modify it
+func TestReadOnlyHandle(t *testing.T, dbProvider statedb.VersionedDBProvider) {
+	db, err := dbProvider.GetDBHandle("TestDB")
+	testutil.AssertNoError(t, err, "")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	readOnlyDB, err := dbProvider.GetReadOnlyDBHandle("TestDB")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNoError(t, readOnlyDB.Open(), "")
+	defer readOnlyDB.Close()
+	vv, err := readOnlyDB.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte("value1"))
+	sp, err := readOnlyDB.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte("value2"), version.NewHeight(2, 1))
+	testutil.AssertEquals(t, readOnlyDB.ApplyUpdates(batch, version.NewHeight(2, 1)), statedb.ErrReadOnly)
+	vv, _ = db.GetState("ns1", "key1")
+	testutil.AssertEquals(t, vv.Value, []byte("value1"))
+	sp, _ = db.GetLatestSavePoint()
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+}
+
 // TestMultiDBBasicRW tests basic read-write on multiple dbs
 func TestMultiDBBasicRW(t *testing.T, dbProvider statedb.VersionedDBProvider) {
 	db1, err := dbProvider.GetDBHandle("TestDB1")
@@ -165,6 +193,26 @@ func TestIterator(t *testing.T, dbProvider statedb.VersionedDBProvider) {
 	testItr(t, itr4, []string{"key5", "key6"})
 }
 
+// TestGetStateMultipleKeysDuplicates tests that the values of duplicate keys are returned at each of their positions
+func TestGetStateMultipleKeysDuplicates(t *testing.T, dbProvider statedb.VersionedDBProvider) {
+	db, err := dbProvider.GetDBHandle("TestDB")
+	testutil.AssertNoError(t, err, "")
+	db.Open()
+	defer db.Close()
+	vv1 := statedb.VersionedValue{Value: []byte("value1"), Version: version.NewHeight(1, 1)}
+	vv2 := statedb.VersionedValue{Value: []byte("value2"), Version: version.NewHeight(1, 2)}
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", vv1.Value, vv1.Version)
+	batch.Put("ns1", "key2", vv2.Value, vv2.Version)
+	db.ApplyUpdates(batch, version.NewHeight(1, 2))
+
+	vals, err := db.GetStateMultipleKeys("ns1", []string{"key1", "key2", "key1", "key3", "key3", "key1"})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vals, []*statedb.VersionedValue{&vv1, &vv2, &vv1, nil, nil, &vv1})
+	testutil.AssertSame(t, vals[0], vals[2])
+	testutil.AssertSame(t, vals[0], vals[5])
+}
+
 func testItr(t *testing.T, itr statedb.ResultsIterator, expectedKeys []string) {
 	defer itr.Close()
 	for _, expectedKey := range expectedKeys {
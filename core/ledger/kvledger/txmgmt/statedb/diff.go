@@ -0,0 +1,153 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+)
+
+// DiffKind is the kind of a difference found between the state of two VersionedDBs
+type DiffKind int
+
+const (
+	// DiffMissing is a key present in the source db only
+	DiffMissing DiffKind = iota
+	// DiffExtra is a key present in the target db only
+	DiffExtra
+	// DiffValue is a key whose value differs between the dbs
+	DiffValue
+	// DiffVersion is a key with the same value but a different version in the dbs
+	DiffVersion
+)
+
+// Diff is a difference found for a key between the state of two VersionedDBs. Source and Target are the
+// versioned values of the key in the source and the target db, nil where the key is missing
+type Diff struct {
+	Namespace string
+	Key       string
+	Kind      DiffKind
+	Source    *VersionedValue
+	Target    *VersionedValue
+}
+
+// reservedJSONFields are the fields that a db may add to the JSON values it returns, e.g. the id and the
+// revision of the CouchDB documents, and that are not compared
+var reservedJSONFields = []string{"_id", "_rev"}
+
+// DiffAgainst compares the state of the given namespaces in the source db, e.g. a LevelDB state being migrated,
+// against the target db, e.g. the CouchDB state it is migrated to. The differences are reported one at a time
+// as they are found, so that the report is streamed rather than held in memory, and the comparison stops at
+// the first error returned by report. The dbs are only read, and can be of different backend types: JSON values
+// are compared as JSON so that the format of the documents does not matter. The number of differences is returned
+func DiffAgainst(source VersionedDB, target VersionedDB, namespaces []string, report func(*Diff) error) (int, error) {
+	diffs := 0
+	for _, ns := range namespaces {
+		n, err := diffKeys(source, target, ns, false, report)
+		diffs += n
+		if err != nil {
+			return diffs, err
+		}
+		// the keys of the target that are also in the source were compared above
+		n, err = diffKeys(target, source, ns, true, report)
+		diffs += n
+		if err != nil {
+			return diffs, err
+		}
+	}
+	return diffs, nil
+}
+
+// diffKeys compares the keys in the namespace of db against other. The keys are enumerated by a range scan,
+// and both values are then read with GetState, since a range scan may not return the full versioned value.
+// With extraOnly, only the keys missing in other are reported, as DiffExtra
+func diffKeys(db VersionedDB, other VersionedDB, ns string, extraOnly bool, report func(*Diff) error) (int, error) {
+	itr, err := db.GetStateRangeScanIterator(ns, "", "")
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+	diffs := 0
+	for {
+		result, err := itr.Next()
+		if err != nil {
+			return diffs, err
+		}
+		if result == nil {
+			return diffs, nil
+		}
+		key := result.(*VersionedKV).Key
+		otherValue, err := other.GetState(ns, key)
+		if err != nil {
+			return diffs, err
+		}
+		var diff *Diff
+		switch {
+		case otherValue == nil && extraOnly:
+			diff = &Diff{Namespace: ns, Key: key, Kind: DiffExtra, Target: &result.(*VersionedKV).VersionedValue}
+		case otherValue == nil:
+			diff = &Diff{Namespace: ns, Key: key, Kind: DiffMissing, Source: &result.(*VersionedKV).VersionedValue}
+		case !extraOnly:
+			value, err := db.GetState(ns, key)
+			if err != nil {
+				return diffs, err
+			}
+			diff = compareValues(ns, key, value, otherValue)
+		}
+		if diff == nil {
+			continue
+		}
+		diffs++
+		if err := report(diff); err != nil {
+			return diffs, err
+		}
+	}
+}
+
+// compareValues returns the difference between the source and the target value of a key, nil if they are the same
+func compareValues(ns string, key string, source *VersionedValue, target *VersionedValue) *Diff {
+	if source == nil {
+		return nil
+	}
+	if !sameValue(source.Value, target.Value) {
+		return &Diff{Namespace: ns, Key: key, Kind: DiffValue, Source: source, Target: target}
+	}
+	if !version.AreSame(source.Version, target.Version) {
+		return &Diff{Namespace: ns, Key: key, Kind: DiffVersion, Source: source, Target: target}
+	}
+	return nil
+}
+
+// sameValue compares two values, as JSON objects without the reserved fields if both are JSON objects
+func sameValue(value []byte, other []byte) bool {
+	if bytes.Equal(value, other) {
+		return true
+	}
+	fields := map[string]interface{}{}
+	otherFields := map[string]interface{}{}
+	if json.Unmarshal(value, &fields) != nil || json.Unmarshal(other, &otherFields) != nil {
+		return false
+	}
+	for _, field := range reservedJSONFields {
+		delete(fields, field)
+		delete(otherFields, field)
+	}
+	return reflect.DeepEqual(fields, otherFields)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statedb
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/core/ledger/testutil"
+)
+
+// mockVersionedDB is an in-memory VersionedDB holding the values of the batches applied to it
+type mockVersionedDB struct {
+	VersionedDB
+	kvs map[CompositeKey]*VersionedValue
+}
+
+func newMockVersionedDB() *mockVersionedDB {
+	return &mockVersionedDB{kvs: make(map[CompositeKey]*VersionedValue)}
+}
+
+func (db *mockVersionedDB) GetState(namespace string, key string) (*VersionedValue, error) {
+	return db.kvs[CompositeKey{namespace, key}], nil
+}
+
+func (db *mockVersionedDB) GetStateRangeScanIterator(namespace string, startKey string, endKey string) (ResultsIterator, error) {
+	var keys []string
+	for ck := range db.kvs {
+		if ck.Namespace == namespace {
+			keys = append(keys, ck.Key)
+		}
+	}
+	sort.Strings(keys)
+	itr := &mockIterator{}
+	for _, key := range keys {
+		ck := CompositeKey{namespace, key}
+		itr.kvs = append(itr.kvs, &VersionedKV{ck, *db.kvs[ck]})
+	}
+	return itr, nil
+}
+
+func (db *mockVersionedDB) ApplyUpdates(batch *UpdateBatch, height *version.Height) error {
+	for ck, vv := range batch.KVs {
+		if vv.Value == nil {
+			delete(db.kvs, ck)
+		} else {
+			db.kvs[ck] = vv
+		}
+	}
+	return nil
+}
+
+type mockIterator struct {
+	kvs []*VersionedKV
+}
+
+func (itr *mockIterator) Next() (QueryResult, error) {
+	if len(itr.kvs) == 0 {
+		return nil, nil
+	}
+	kv := itr.kvs[0]
+	itr.kvs = itr.kvs[1:]
+	return kv, nil
+}
+
+func (itr *mockIterator) Close() {
+}
+
+func TestDiffAgainst(t *testing.T) {
+	source := newMockVersionedDB()
+	target := newMockVersionedDB()
+
+	batch := NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2","size":2}`), version.NewHeight(1, 2))
+	batch.Put("ns2", "key1", []byte("value1"), version.NewHeight(1, 3))
+	source.ApplyUpdates(batch, version.NewHeight(1, 3))
+	// the JSON documents of the target have the same fields in another order, along with reserved fields
+	batch = NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"_id":"ns1\u0000key2","size":2,"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	batch.Put("ns2", "key1", []byte("value1"), version.NewHeight(1, 3))
+	target.ApplyUpdates(batch, version.NewHeight(1, 3))
+
+	diffs, err := DiffAgainst(source, target, []string{"ns1", "ns2"}, func(diff *Diff) error {
+		t.Fatalf("Unexpected difference for key %s in namespace %s", diff.Key, diff.Namespace)
+		return nil
+	})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, diffs, 0)
+
+	batch = NewUpdateBatch()
+	batch.Put("ns1", "key3", []byte("value3"), version.NewHeight(2, 1))
+	batch.Put("ns2", "key2", []byte("value2"), version.NewHeight(2, 2))
+	source.ApplyUpdates(batch, version.NewHeight(2, 2))
+	batch = NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(2, 3))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2","size":3}`), version.NewHeight(1, 2))
+	batch.Put("ns1", "key4", []byte("value4"), version.NewHeight(2, 4))
+	target.ApplyUpdates(batch, version.NewHeight(2, 4))
+
+	var reported []*Diff
+	diffs, err = DiffAgainst(source, target, []string{"ns1", "ns2"}, func(diff *Diff) error {
+		reported = append(reported, diff)
+		return nil
+	})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, diffs, 5)
+	testutil.AssertEquals(t, reported, []*Diff{
+		{"ns1", "key1", DiffVersion, &VersionedValue{[]byte("value1"), version.NewHeight(1, 1)},
+			&VersionedValue{[]byte("value1"), version.NewHeight(2, 3)}},
+		{"ns1", "key2", DiffValue, &VersionedValue{[]byte(`{"asset_name":"marble2","size":2}`), version.NewHeight(1, 2)},
+			&VersionedValue{[]byte(`{"asset_name":"marble2","size":3}`), version.NewHeight(1, 2)}},
+		{"ns1", "key3", DiffMissing, &VersionedValue{[]byte("value3"), version.NewHeight(2, 1)}, nil},
+		{"ns1", "key4", DiffExtra, nil, &VersionedValue{[]byte("value4"), version.NewHeight(2, 4)}},
+		{"ns2", "key2", DiffMissing, &VersionedValue{[]byte("value2"), version.NewHeight(2, 2)}, nil},
+	})
+
+	// the comparison stops at the first error of the report
+	reportErr := errors.New("report failed")
+	diffs, err = DiffAgainst(source, target, []string{"ns1", "ns2"}, func(diff *Diff) error {
+		return reportErr
+	})
+	testutil.AssertEquals(t, err, reportErr)
+	testutil.AssertEquals(t, diffs, 1)
+}
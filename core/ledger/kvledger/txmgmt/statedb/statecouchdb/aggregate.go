@@ -0,0 +1,229 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+)
+
+// AggregateFunction is the function aggregating the values of the documents of a group, one of the built-in
+// reduce functions of CouchDB
+type AggregateFunction string
+
+const (
+	// AggregateSum sums the values of the value field of the documents of each group. The documents whose value
+	// field is not a number are not aggregated
+	AggregateSum AggregateFunction = "_sum"
+	// AggregateCount counts the documents of each group
+	AggregateCount AggregateFunction = "_count"
+)
+
+// aggregateDesignDocPrefix is the prefix of the design documents holding the aggregate views of a namespace,
+// followed by the namespace
+const aggregateDesignDocPrefix = "fabric_agg_"
+
+// aggregateDesignDoc returns the name of the design document holding the aggregate views of the namespace
+func aggregateDesignDoc(namespace string) string {
+	return aggregateDesignDocPrefix + namespace
+}
+
+// AggregateView defines an aggregate of the JSON values of a namespace, computed by a CouchDB view: the values are
+// grouped by the values of GroupFields, and the values of ValueField of each group are aggregated by Function.
+// The fields are named as in the selectors of the rich queries, with a dot separating the fields of nested objects.
+// A value missing a group field is grouped under null for the field. The values stored as attachments, i.e. the
+// binary values and the JSON values stored compressed, are not aggregated
+type AggregateView struct {
+	Name        string
+	GroupFields []string
+	ValueField  string
+	Function    AggregateFunction
+}
+
+// AggregateRecord is a result of an aggregate query: the values of the group fields of a group, as a JSON array,
+// and the aggregate of the values of the group, as JSON
+type AggregateRecord struct {
+	GroupKey []byte
+	Value    []byte
+}
+
+// aggregateMapFunction returns the map function of the view of the aggregate, which emits, for each document of
+// the namespace storing a JSON value, the values of its group fields as key and the value of its value field as value
+func aggregateMapFunction(namespace string, view *AggregateView) (string, error) {
+	prefix, err := json.Marshal(string(constructNamespaceStartKey(namespace)))
+	if err != nil {
+		return "", err
+	}
+	groupKeys := make([]string, len(view.GroupFields))
+	for i, field := range view.GroupFields {
+		path, err := json.Marshal(strings.Split(field, "."))
+		if err != nil {
+			return "", err
+		}
+		groupKeys[i] = fmt.Sprintf("field(%s)", path)
+	}
+	value := "null"
+	skip := "false"
+	if view.Function == AggregateSum {
+		path, err := json.Marshal(strings.Split(view.ValueField, "."))
+		if err != nil {
+			return "", err
+		}
+		value = fmt.Sprintf("field(%s)", path)
+		skip = `typeof value !== "number"`
+	}
+	return fmt.Sprintf(`function(doc) {
+  var prefix = %s;
+  if (doc._id.substring(0, prefix.length) !== prefix) { return; }
+  if (doc._attachments && doc._attachments[%q]) { return; }
+  function field(path) {
+    var value = doc;
+    for (var i = 0; i < path.length; i++) {
+      if (value === null || typeof value !== "object") { return null; }
+      value = value[path[i]];
+    }
+    return value === undefined ? null : value;
+  }
+  var value = %s;
+  if (%s) { return; }
+  emit([%s], value);
+}`, prefix, valueAttachmentName, value, skip, strings.Join(groupKeys, ", ")), nil
+}
+
+// DefineAggregateView creates the view computing the aggregate of the namespace, or replaces the view of the same
+// name. The views of a namespace are held by its design document fabric_agg_<namespace>. CouchDB builds the view
+// when it is first queried, and rebuilds all the views of the namespace when any of them is replaced
+func (vdb *VersionedDB) DefineAggregateView(namespace string, view *AggregateView) error {
+	if err := checkNamespace(namespace); err != nil {
+		return err
+	}
+	if view.Name == "" {
+		return fmt.Errorf("Invalid aggregate view: the name is missing")
+	}
+	switch view.Function {
+	case AggregateSum:
+		if view.ValueField == "" {
+			return fmt.Errorf("Invalid aggregate view %s: the value field is missing", view.Name)
+		}
+	case AggregateCount:
+	default:
+		return fmt.Errorf("Invalid aggregate view %s: unsupported function %s", view.Name, view.Function)
+	}
+	mapFunction, err := aggregateMapFunction(namespace, view)
+	if err != nil {
+		return err
+	}
+
+	return vdb.updateAggregateViews(namespace, func(views map[string]interface{}) {
+		views[view.Name] = map[string]interface{}{"map": mapFunction, "reduce": string(view.Function)}
+	})
+}
+
+// DropAggregateView drops the view of the aggregate of the namespace with the given name, if any
+func (vdb *VersionedDB) DropAggregateView(namespace string, name string) error {
+	if err := checkNamespace(namespace); err != nil {
+		return err
+	}
+	return vdb.updateAggregateViews(namespace, func(views map[string]interface{}) {
+		delete(views, name)
+	})
+}
+
+// updateAggregateViews applies the update to the views of the design document of the aggregates of the namespace,
+// creating the design document if missing
+func (vdb *VersionedDB) updateAggregateViews(namespace string, update func(views map[string]interface{})) error {
+	designDocID := "_design/" + aggregateDesignDoc(namespace)
+	designDocJSON, rev, err := vdb.db.ReadDoc(designDocID)
+	if err != nil {
+		return err
+	}
+	designDoc := map[string]interface{}{"language": "javascript"}
+	if designDocJSON != nil {
+		if err := json.Unmarshal(designDocJSON, &designDoc); err != nil {
+			return err
+		}
+	}
+	delete(designDoc, "_id")
+	delete(designDoc, "_rev")
+	views, ok := designDoc["views"].(map[string]interface{})
+	if !ok {
+		views = map[string]interface{}{}
+	}
+	update(views)
+	designDoc["views"] = views
+
+	if designDocJSON, err = json.Marshal(designDoc); err != nil {
+		return err
+	}
+	if _, err := vdb.db.SaveDoc(designDocID, rev, designDocJSON, nil); err != nil {
+		vdb.logger.Errorf("Failed to save the aggregate views of namespace [%s]: %s", namespace, err.Error())
+		return err
+	}
+	vdb.logger.Debugf("Saved the aggregate views of namespace [%s]: %s", namespace, designDocJSON)
+	return nil
+}
+
+// ExecuteAggregateQuery returns the aggregates of the view of the namespace with the given name, as defined by
+// DefineAggregateView, grouped by the first groupLevel group fields of the view, in the order of the groups. The
+// results are of type *AggregateRecord. A groupLevel of 0 aggregates all the values of the namespace in a single
+// result, whose group key is null. The view is built first if it is not up to date, which takes as long as
+// reading the documents written since it was last queried
+func (vdb *VersionedDB) ExecuteAggregateQuery(namespace string, name string, groupLevel int) (statedb.ResultsIterator, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if groupLevel < 0 {
+		return nil, fmt.Errorf("Invalid group level %d", groupLevel)
+	}
+	rows, err := vdb.db.QueryReducedView(aggregateDesignDoc(namespace), name, groupLevel)
+	if err != nil {
+		vdb.logger.Debugf("Error calling QueryReducedView(): %s\n", err.Error())
+		return nil, err
+	}
+	records := make([]*AggregateRecord, len(rows))
+	for i, row := range rows {
+		records[i] = &AggregateRecord{GroupKey: []byte(row.Key), Value: []byte(row.Value)}
+	}
+	return newAggregateScanner(records), nil
+}
+
+type aggregateScanner struct {
+	cursor  int
+	records []*AggregateRecord
+}
+
+func newAggregateScanner(records []*AggregateRecord) *aggregateScanner {
+	return &aggregateScanner{-1, records}
+}
+
+func (scanner *aggregateScanner) Next() (statedb.QueryResult, error) {
+	scanner.cursor++
+	if scanner.cursor >= len(scanner.records) {
+		return nil, nil
+	}
+	return scanner.records[scanner.cursor], nil
+}
+
+func (scanner *aggregateScanner) Close() {
+	scanner = nil
+}
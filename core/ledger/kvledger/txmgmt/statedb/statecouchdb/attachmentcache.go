@@ -0,0 +1,144 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// attachmentCache is an LRU cache of the value attachments of the documents, keyed by document id, along with the
+// digest CouchDB reported for each attachment. The least recently used attachments are evicted once the total size
+// of the cached attachments exceeds the size of the cache
+type attachmentCache struct {
+	mux     sync.Mutex
+	size    int
+	used    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cachedAttachment is an entry of the attachment cache
+type cachedAttachment struct {
+	id         string
+	digest     string
+	attachment *couchdb.Attachment
+}
+
+// newAttachmentCache returns an attachment cache of the given size in bytes
+func newAttachmentCache(size int) *attachmentCache {
+	return &attachmentCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns a copy of the cached attachment of the document if it has the given digest
+func (cache *attachmentCache) get(id string, digest string) (*couchdb.Attachment, bool) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	element, ok := cache.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedAttachment)
+	if entry.digest != digest {
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	return copyAttachment(entry.attachment), true
+}
+
+// put caches a copy of the attachment of the document with its digest, replacing the attachment cached for the
+// document. An attachment larger than the cache is not cached
+func (cache *attachmentCache) put(id string, digest string, attachment *couchdb.Attachment) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if element, ok := cache.entries[id]; ok {
+		cache.remove(element)
+	}
+	if len(attachment.AttachmentBytes) > cache.size {
+		return
+	}
+	cache.entries[id] = cache.lru.PushFront(&cachedAttachment{id, digest, copyAttachment(attachment)})
+	cache.used += len(attachment.AttachmentBytes)
+	for cache.used > cache.size {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// remove removes an entry from the cache. The caller is expected to hold mux
+func (cache *attachmentCache) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*cachedAttachment)
+	delete(cache.entries, entry.id)
+	cache.used -= len(entry.attachment.AttachmentBytes)
+}
+
+// copyAttachment returns a copy of the attachment, so that the values returned to the callers do not share the
+// bytes of the cached attachments
+func copyAttachment(attachment *couchdb.Attachment) *couchdb.Attachment {
+	attachmentCopy := *attachment
+	attachmentCopy.AttachmentBytes = append([]byte(nil), attachment.AttachmentBytes...)
+	return &attachmentCopy
+}
+
+// readValueCached reads the versioned value stored in the latest revision of a document like readValue, reading the
+// document with the stubs of its attachments rather than their data. The value attachment is read only if the
+// attachment cache has no copy of it with the digest of its stub, and is then cached. Reading an attachment that is
+// not cached takes a request for the document and another for the attachment
+func (vdb *VersionedDB) readValueCached(id string) (*statedb.VersionedValue, string, error) {
+	jsonDoc, stubs, revision, err := vdb.db.ReadDocStubs(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if jsonDoc == nil {
+		return nil, "", nil
+	}
+	if expired, err := isExpired(jsonDoc); err != nil || expired {
+		return nil, "", err
+	}
+
+	var attachments []couchdb.Attachment
+	for name := range stubs {
+		// the named attachments of a JSON value are not part of the value, and are not read
+		if name != valueAttachmentName {
+			attachments = append(attachments, couchdb.Attachment{Name: name})
+			continue
+		}
+		digest := stubs[name].Digest
+		attachment, ok := vdb.attachmentCache.get(id, digest)
+		if !ok {
+			if attachment, err = vdb.db.ReadAttachment(id, name, revision); err != nil {
+				return nil, "", err
+			}
+			// the revision read was replaced and compacted in between, read the document with its attachments
+			if attachment == nil {
+				return vdb.readDocValue(id, "")
+			}
+			vdb.attachmentCache.put(id, digest, attachment)
+		} else {
+			vdb.logger.Debugf("Reusing the cached attachment of document [%s] with digest [%s]", id, digest)
+		}
+		attachments = append(attachments, *attachment)
+	}
+
+	value, ver, err := vdb.decodeDoc(id, jsonDoc, attachments)
+	if err != nil {
+		return nil, "", err
+	}
+	return &statedb.VersionedValue{Value: value, Version: ver}, revision, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// ValueCodec converts between the versioned values of the state and the CouchDB documents storing them
+type ValueCodec interface {
+	// Encode returns the JSON document, which may be nil, and the attachments storing the versioned value
+	Encode(value []byte, version *version.Height) ([]byte, []couchdb.Attachment, error)
+	// Decode returns the versioned value stored in the JSON document and attachments of the document with the given id
+	Decode(id string, jsonDoc []byte, attachments []couchdb.Attachment) ([]byte, *version.Height, error)
+}
+
+// defaultValueCodec stores JSON values as the document and other values as a valueBytes attachment.
+// JSON values of at least compressionThreshold bytes are stored gzip compressed as an attachment,
+// 0 disables compression. If checksums is set, a checksum of each value is stored in the document.
+// The version is stored in the version field of the document. A document stored without a version,
+// before the versions were stored, is decoded with version (1,1)
+type defaultValueCodec struct {
+	compressionThreshold int
+	checksums            bool
+}
+
+// Encode implements method in ValueCodec interface
+func (codec *defaultValueCodec) Encode(value []byte, ver *version.Height) ([]byte, []couchdb.Attachment, error) {
+	originalValue := value
+	contentType := "application/octet-stream"
+	isJSON := couchdb.IsJSON(string(value))
+
+	// large JSON values are compressed and, as for binary data, saved as an attachment
+	if isJSON && codec.compressionThreshold > 0 && len(value) >= codec.compressionThreshold {
+		compressedValue, err := compressValue(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Debugf("Compressed value from %d to %d bytes", len(value), len(compressedValue))
+		value = compressedValue
+		contentType = compressedContentType
+		isJSON = false
+	}
+
+	if isJSON {
+		if codec.checksums {
+			var err error
+			if value, err = addJSONChecksum(value); err != nil {
+				return nil, nil, err
+			}
+		}
+		versionedValue, err := addVersionField(value, ver)
+		return versionedValue, nil, err
+	}
+
+	// if the data is not JSON, save as binary attachment in Couch
+	attachment := couchdb.Attachment{}
+	attachment.AttachmentBytes = value
+	attachment.ContentType = contentType
+	attachment.Name = valueAttachmentName
+
+	// the checksum, if enabled, is stored in the document along with the attachment
+	var checksumDoc []byte
+	if codec.checksums {
+		checksumDoc = []byte(fmt.Sprintf(`{"%s":"%s"}`, checksumField, binaryChecksum(originalValue)))
+	}
+	versionDoc, err := addVersionField(checksumDoc, ver)
+	return versionDoc, []couchdb.Attachment{attachment}, err
+}
+
+// Decode implements method in ValueCodec interface. A value stored compressed is returned decompressed.
+// A value stored with a checksum is verified, and ErrChecksumMismatch is returned if it does not match
+func (codec *defaultValueCodec) Decode(id string, jsonDoc []byte, attachments []couchdb.Attachment) ([]byte, *version.Height, error) {
+	jsonDoc, ver, err := removeVersionField(jsonDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ver == nil {
+		ver = legacyVersion
+	}
+	if attachments == nil {
+		if jsonDoc == nil || !bytes.Contains(jsonDoc, []byte(checksumField)) {
+			return jsonDoc, ver, nil
+		}
+		value, err := verifyJSONChecksum(jsonDoc)
+		return value, ver, err
+	}
+
+	for _, attachment := range attachments {
+		if attachment.Name != valueAttachmentName {
+			continue
+		}
+		value := attachment.AttachmentBytes
+		if attachment.ContentType == compressedContentType {
+			if value, err = decompressValue(value); err != nil {
+				return nil, nil, err
+			}
+		}
+		if jsonDoc != nil && bytes.Contains(jsonDoc, []byte(checksumField)) {
+			fields := map[string]interface{}{}
+			if err := json.Unmarshal(jsonDoc, &fields); err != nil {
+				return nil, nil, err
+			}
+			if fields[checksumField] != binaryChecksum(value) {
+				return nil, nil, ErrChecksumMismatch
+			}
+		}
+		return value, ver, nil
+	}
+	return nil, nil, fmt.Errorf("Document %s has no valueBytes attachment", id)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// defaultCompactConcurrency is the number of databases compacted at a time by CompactAll if the options do not set it
+const defaultCompactConcurrency = 4
+
+// CompactOptions configures the compaction of the databases by CompactAll
+type CompactOptions struct {
+	// Concurrency is the number of databases compacted at a time, defaultCompactConcurrency if not positive
+	Concurrency int
+	// Views compacts the views of the design documents of each database too, such as the Mango indexes
+	Views bool
+}
+
+// CompactResult is the result of the compaction of a database by CompactAll. Err is the error that failed the
+// compaction, in which case the views of the database are not compacted
+type CompactResult struct {
+	DBName string
+	// the design documents whose views were compacted
+	DesignDocs []string
+	Err        error
+}
+
+// CompactAll starts the compaction of all the databases the provider manages, e.g. during a maintenance window,
+// which removes the old revisions of the documents from the database files. CouchDB compacts the databases in the
+// background, so CompactAll returns once the compactions are started. The compaction of a database that fails does
+// not stop the compaction of the others: a result is returned per database, in the order of the database names,
+// along with an error listing the databases that failed
+func (provider *VersionedDBProvider) CompactAll(opts CompactOptions) ([]*CompactResult, error) {
+	provider.mux.Lock()
+	if provider.closed {
+		provider.mux.Unlock()
+		return nil, ErrProviderClosed
+	}
+	dbNames := make([]string, 0, len(provider.databases))
+	vdbs := make(map[string]*VersionedDB, len(provider.databases))
+	for dbName, vdb := range provider.databases {
+		dbNames = append(dbNames, dbName)
+		vdbs[dbName] = vdb
+	}
+	provider.mux.Unlock()
+	sort.Strings(dbNames)
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultCompactConcurrency
+	}
+	results := make([]*CompactResult, len(dbNames))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, dbName := range dbNames {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, dbName string) {
+			defer wg.Done()
+			results[i] = vdbs[dbName].compact(opts.Views)
+			<-slots
+		}(i, dbName)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, result := range results {
+		if result.Err != nil {
+			logger.Errorf("Failed to compact database %s: %s", result.DBName, result.Err.Error())
+			failed = append(failed, result.DBName)
+		}
+	}
+	logger.Infof("Started the compaction of %d databases", len(dbNames)-len(failed))
+	if len(failed) > 0 {
+		return results, fmt.Errorf("Failed to compact %d of %d databases: %v", len(failed), len(dbNames), failed)
+	}
+	return results, nil
+}
+
+// compact starts the compaction of the database and, if views is set, of the views of its design documents
+func (vdb *VersionedDB) compact(views bool) *CompactResult {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	result := &CompactResult{DBName: vdb.dbName}
+	if _, result.Err = vdb.db.CompactDatabase(); result.Err != nil || !views {
+		return result
+	}
+	indexes, err := vdb.db.ListIndexes()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	compacted := make(map[string]bool)
+	for _, index := range indexes {
+		// the special _all_docs index has no design document
+		if index.DesignDoc == "" || compacted[index.DesignDoc] {
+			continue
+		}
+		compacted[index.DesignDoc] = true
+		if _, result.Err = vdb.db.CompactViews(index.DesignDoc); result.Err != nil {
+			return result
+		}
+		result.DesignDocs = append(result.DesignDocs, index.DesignDoc)
+	}
+	vdb.logger.Debugf("Started the compaction of the database and the views of %d design documents", len(result.DesignDocs))
+	return result
+}
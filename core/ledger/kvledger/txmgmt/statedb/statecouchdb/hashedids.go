@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// keyField is the reserved field of a document holding the escaped key of the document if its id is hashed, from
+// which the key is read back
+const keyField = "~key"
+
+// keyIDHashLength is the length of the hash ending the key part of a hashed id, in hex digits
+const keyIDHashLength = 2 * sha256.Size
+
+// hashKeyID returns the key part of the document id of an escaped key, which is the escaped key itself unless it
+// is longer than the maximum length of the encoder, in which case the id is hashed: the key part is the escaped
+// key cut at the maximum length, on a rune boundary, followed by the SHA-256 hash of the whole escaped key in hex
+func (keys keyEncoder) hashKeyID(escapedKey string) string {
+	if keys.maxKeyIDLength == 0 || len(escapedKey) <= keys.maxKeyIDLength {
+		return escapedKey
+	}
+	end := keys.maxKeyIDLength
+	for end > 0 && !utf8.RuneStart(escapedKey[end]) {
+		end--
+	}
+	hash := sha256.Sum256([]byte(escapedKey))
+	return escapedKey[:end] + hex.EncodeToString(hash[:])
+}
+
+// isHashedKeyID returns true if the key part of a document id is hashed. The key part of a hashed id is always
+// longer than the maximum length, while the key part of the other ids never is
+func (keys keyEncoder) isHashedKeyID(keyID string) bool {
+	return keys.maxKeyIDLength > 0 && len(keyID) > keys.maxKeyIDLength
+}
+
+// addKeyField returns the JSON document, an empty document if nil, with the escaped key stored in the key field
+func addKeyField(jsonDoc []byte, escapedKey string) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if jsonDoc != nil {
+		var err error
+		if fields, err = decodeJSONFields(jsonDoc); err != nil {
+			return nil, err
+		}
+	}
+	fields[keyField] = escapedKey
+	return json.Marshal(fields)
+}
+
+// splitDocID returns the namespace and the key of the document with the given id and JSON document like
+// SplitCompositeKey, except that the key of a hashed id is read from the key field of the document
+func (keys keyEncoder) splitDocID(id string, jsonDoc []byte) (string, string) {
+	namespace, _ := keys.splitCompositeKey([]byte(id))
+	key, _ := keys.docKey(nil, id, jsonDoc)
+	return namespace, key
+}
+
+// docKey returns the key of the document with the given id and JSON document, read from the key field of the
+// document if the id is hashed. If the JSON document has no key field, as the binary values that the range scans
+// return without their document, the document is read for its key field, unless db is nil
+func (keys keyEncoder) docKey(db *couchdb.CouchDatabase, id string, jsonDoc []byte) (string, error) {
+	_, key := keys.splitCompositeKey([]byte(id))
+	split := strings.SplitN(id, string(compositeKeySep), 2)
+	if len(split) < 2 || !keys.isHashedKeyID(split[1]) {
+		return key, nil
+	}
+	escapedKey, ok := readKeyField(jsonDoc)
+	if !ok && db != nil {
+		stubsDoc, _, _, err := db.ReadDocStubs(id)
+		if err != nil {
+			return "", err
+		}
+		escapedKey, ok = readKeyField(stubsDoc)
+	}
+	if !ok {
+		logger.Warningf("Document %q has a hashed id but no key field", id)
+		return key, nil
+	}
+	return keys.unescapeKey(escapedKey), nil
+}
+
+// readKeyField returns the escaped key stored in the key field of the JSON document, and false if it has none
+func readKeyField(jsonDoc []byte) (string, bool) {
+	if !bytes.Contains(jsonDoc, []byte(keyField)) {
+		return "", false
+	}
+	fields := &struct {
+		Key *string `json:"~key"`
+	}{}
+	if err := json.Unmarshal(jsonDoc, fields); err != nil || fields.Key == nil {
+		return "", false
+	}
+	return *fields.Key, true
+}
+
+// keyRangeIDs returns the document ids bounding a scan of the keys of the namespace from startKey to endKey,
+// exclusive, or to the end of the namespace if endKey is empty. If a bound key has a hashed id, whose hash does not
+// sort in the order of the keys, the scan is widened to all the ids sharing the key part of the bound before its
+// hash, and inRange tells the keys of the range apart. inRange is nil if the ids bound the range exactly
+func (keys keyEncoder) keyRangeIDs(namespace string, startKey string, endKey string) (string, string, func(key string) bool) {
+	escapedStartKey, escapedEndKey := keys.escapeKey(startKey), keys.escapeKey(endKey)
+	startKeyID, endKeyID := keys.hashKeyID(escapedStartKey), keys.hashKeyID(escapedEndKey)
+	exact := true
+	if startKeyID != escapedStartKey {
+		startKeyID = startKeyID[:len(startKeyID)-keyIDHashLength]
+		exact = false
+	}
+	if endKeyID != escapedEndKey {
+		// the greatest rune sorts after the rest of any key sharing the cut key
+		endKeyID = endKeyID[:len(endKeyID)-keyIDHashLength] + string(utf8.MaxRune)
+		exact = false
+	}
+	startID := escapeNamespace(namespace) + string(compositeKeySep) + startKeyID
+	endID := escapeNamespace(namespace) + string(compositeKeySep) + endKeyID
+	if endKey == "" {
+		endID = string(constructNamespaceEndKey(namespace))
+	}
+	if exact {
+		return startID, endID, nil
+	}
+	inRange := func(key string) bool {
+		escapedKey := keys.escapeKey(key)
+		return escapedKey >= escapedStartKey && (endKey == "" || escapedKey < escapedEndKey)
+	}
+	return startID, endID, inRange
+}
+
+// withKeyRange returns the filter of a range scan, nil if none, further restricted to the keys that inRange accepts
+func withKeyRange(filter func(key string, value []byte) bool, inRange func(key string) bool) func(key string, value []byte) bool {
+	return func(key string, value []byte) bool {
+		return inRange(key) && (filter == nil || filter(key, value))
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// namespaceIndexDesignDocPrefix is the prefix of the design documents holding the indexes of a namespace,
+// followed by the namespace
+const namespaceIndexDesignDocPrefix = "fabric_ns_"
+
+// queryIndexDesignDoc is the design document holding the indexes created by EnsureIndexesForQuery
+const queryIndexDesignDoc = "fabric_query"
+
+// namespaceIndexDesignDoc returns the name of the design document holding the indexes of the namespace
+func namespaceIndexDesignDoc(namespace string) string {
+	return namespaceIndexDesignDocPrefix + namespace
+}
+
+// CreateNamespaceIndex creates an index given its definition in the format of the CouchDB _index endpoint, scoped
+// to the namespace. The index is held by the design document of the namespace, whatever design document the
+// definition names, and a partial filter on the document ids restricts the index to the documents of the namespace.
+// The partial filter of the definition, if any, still applies. As CouchDB only uses a partial index for the queries
+// naming it, the queries of the namespace select the index with use_index
+func (vdb *VersionedDB) CreateNamespaceIndex(namespace string, indexDefinition string) (*couchdb.CreateIndexResponse, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	definition := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(indexDefinition), &definition); err != nil {
+		return nil, fmt.Errorf("Invalid index definition: %s", err.Error())
+	}
+	index, ok := definition["index"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid index definition: the index field is missing")
+	}
+
+	namespaceFilter := map[string]interface{}{"_id": map[string]interface{}{
+		"$gte": string(constructNamespaceStartKey(namespace)),
+		"$lt":  string(constructNamespaceEndKey(namespace))}}
+	if filter, ok := index["partial_filter_selector"]; ok {
+		index["partial_filter_selector"] = map[string]interface{}{"$and": []interface{}{namespaceFilter, filter}}
+	} else {
+		index["partial_filter_selector"] = namespaceFilter
+	}
+	definition["ddoc"] = namespaceIndexDesignDoc(namespace)
+
+	scopedDefinition, err := json.Marshal(definition)
+	if err != nil {
+		return nil, err
+	}
+	vdb.logger.Debugf("Creating index of namespace [%s]: %s", namespace, scopedDefinition)
+	return vdb.db.CreateIndex(string(scopedDefinition))
+}
+
+// ListNamespaceIndexes returns the indexes of the namespace created by CreateNamespaceIndex
+func (vdb *VersionedDB) ListNamespaceIndexes(namespace string) ([]couchdb.IndexInfo, error) {
+	indexes, err := vdb.db.ListIndexes()
+	if err != nil {
+		return nil, err
+	}
+	designDoc := "_design/" + namespaceIndexDesignDoc(namespace)
+	var namespaceIndexes []couchdb.IndexInfo
+	for _, index := range indexes {
+		if index.DesignDoc == designDoc {
+			namespaceIndexes = append(namespaceIndexes, index)
+		}
+	}
+	return namespaceIndexes, nil
+}
+
+// DropNamespaceIndexes drops all the indexes of the namespace. The indexes of the other namespaces are kept
+func (vdb *VersionedDB) DropNamespaceIndexes(namespace string) error {
+	indexes, err := vdb.ListNamespaceIndexes(namespace)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err := vdb.db.DeleteIndex(index.DesignDoc, index.Name); err != nil {
+			return err
+		}
+		vdb.logger.Infof("Dropped index %s of namespace [%s]", index.Name, namespace)
+	}
+	return nil
+}
+
+// EnsureIndexesForQuery creates the index that the query needs to not be run as a full scan of the database, if
+// no index of the database covers the query, e.g. to create the indexes of the queries of a chaincode before it
+// goes live. It returns the names of the indexes created, none if the query needs no index or is already covered.
+// The fields of the index are the fields of the sort, in order, followed by the fields the selector matches, in
+// lexical order. The fields of the alternatives of $or, $nor and $not are not indexed, as a single index does not
+// serve them. An index covers the query if it has the same fields, the sort fields first in the same order, and is
+// not partial, since CouchDB only uses a partial index for the queries naming it. The indexes are created in the
+// design document fabric_query
+func (vdb *VersionedDB) EnsureIndexesForQuery(query string) ([]string, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	query, err := vdb.queryCompiler.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	sortFields, selectorFields, err := queryIndexFields(query)
+	if err != nil {
+		return nil, err
+	}
+	fields := append(sortFields, selectorFields...)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	indexes, err := vdb.db.ListIndexes()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if indexCoversFields(index, sortFields, selectorFields) {
+			vdb.logger.Debugf("Index %s of design document %s covers the fields %v of query %s", index.Name, index.DesignDoc, fields, query)
+			return nil, nil
+		}
+	}
+
+	name := "by_" + strings.Join(fields, "_")
+	definition, err := json.Marshal(map[string]interface{}{
+		"index": map[string]interface{}{"fields": fields},
+		"name":  name,
+		"ddoc":  queryIndexDesignDoc,
+		"type":  "json"})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := vdb.db.CreateIndex(string(definition)); err != nil {
+		return nil, err
+	}
+	vdb.logger.Infof("Created index %s on the fields %v of query %s", name, fields, query)
+	return []string{name}, nil
+}
+
+// queryIndexFields returns the fields of the sort of the Mango query, in order, and the other fields its selector
+// matches, in lexical order
+func queryIndexFields(query string) ([]string, []string, error) {
+	mangoQuery := &struct {
+		Selector map[string]interface{} `json:"selector"`
+		Sort     []interface{}          `json:"sort"`
+	}{}
+	if err := json.Unmarshal([]byte(query), mangoQuery); err != nil {
+		return nil, nil, fmt.Errorf("Invalid query: %s", err.Error())
+	}
+
+	sortFields := []string{}
+	sorted := map[string]bool{}
+	for _, entry := range mangoQuery.Sort {
+		switch entry := entry.(type) {
+		case string:
+			sortFields = append(sortFields, entry)
+			sorted[entry] = true
+		case map[string]interface{}:
+			for field := range entry {
+				sortFields = append(sortFields, field)
+				sorted[field] = true
+			}
+		default:
+			return nil, nil, fmt.Errorf("Invalid query: invalid sort %v", entry)
+		}
+	}
+
+	matched := map[string]bool{}
+	collectSelectorFields(mangoQuery.Selector, "", matched)
+	selectorFields := []string{}
+	for field := range matched {
+		if !sorted[field] {
+			selectorFields = append(selectorFields, field)
+		}
+	}
+	sort.Strings(selectorFields)
+	return sortFields, selectorFields, nil
+}
+
+// collectSelectorFields adds the fields the selector matches to fields, the fields of nested objects being
+// prefixed with the path of the object
+func collectSelectorFields(selector map[string]interface{}, path string, fields map[string]bool) {
+	for key, condition := range selector {
+		switch {
+		case key == "$and":
+			if conditions, ok := condition.([]interface{}); ok {
+				for _, condition := range conditions {
+					if subSelector, ok := condition.(map[string]interface{}); ok {
+						collectSelectorFields(subSelector, path, fields)
+					}
+				}
+			}
+		case strings.HasPrefix(key, "$"):
+			// an operator on the field of the path, or an alternative ($or, $nor, $not) that is not indexed
+			if path != "" && key != "$or" && key != "$nor" && key != "$not" {
+				fields[path] = true
+			}
+		default:
+			field := key
+			if path != "" {
+				field = path + "." + key
+			}
+			if subSelector, ok := condition.(map[string]interface{}); ok {
+				collectSelectorFields(subSelector, field, fields)
+			} else {
+				fields[field] = true
+			}
+		}
+	}
+}
+
+// indexCoversFields returns true if the index is a json index, which is not partial, on the sort fields in
+// order followed by the selector fields in any order
+func indexCoversFields(index couchdb.IndexInfo, sortFields []string, selectorFields []string) bool {
+	if index.Type != "json" {
+		return false
+	}
+	definition := &struct {
+		Fields                []interface{}   `json:"fields"`
+		PartialFilterSelector json.RawMessage `json:"partial_filter_selector"`
+	}{}
+	if err := json.Unmarshal(index.Definition, definition); err != nil || len(definition.PartialFilterSelector) > 0 {
+		return false
+	}
+	indexFields := []string{}
+	for _, entry := range definition.Fields {
+		switch entry := entry.(type) {
+		case string:
+			indexFields = append(indexFields, entry)
+		case map[string]interface{}:
+			for field := range entry {
+				indexFields = append(indexFields, field)
+			}
+		}
+	}
+	if len(indexFields) != len(sortFields)+len(selectorFields) {
+		return false
+	}
+	for i, field := range sortFields {
+		if indexFields[i] != field {
+			return false
+		}
+	}
+	remaining := append([]string{}, indexFields[len(sortFields):]...)
+	sort.Strings(remaining)
+	for i, field := range selectorFields {
+		if remaining[i] != field {
+			return false
+		}
+	}
+	return true
+}
+
+// IndexBuildStatus is the build state of the indexes of a design document, as reported by IndexBuildStatus
+type IndexBuildStatus struct {
+	DesignDoc string
+	// Building is set while CouchDB updates the indexes
+	Building bool
+	// Ready is set once the indexes are built up to the latest update of the database, so that the queries using
+	// them are not held while the indexes catch up
+	Ready bool
+	// IndexedSeq and DatabaseSeq are the update sequences the indexes are built up to and the database is at
+	IndexedSeq  string
+	DatabaseSeq string
+}
+
+// IndexBuildStatus reports whether the indexes of the design document are fully built. CouchDB builds an index in
+// the background once created, and the queries using the index are slow until it is built, so operators can wait
+// for the indexes to be ready before directing traffic to the peer. As the indexes are updated as the database is,
+// the indexes of a database being written may briefly not be ready again
+func (vdb *VersionedDB) IndexBuildStatus(designDoc string) (*IndexBuildStatus, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	info, err := vdb.db.ReadDesignDocInfo(designDoc)
+	if err != nil {
+		return nil, err
+	}
+	dbInfo, _, err := vdb.db.GetDatabaseInfo()
+	if err != nil {
+		return nil, err
+	}
+	status := &IndexBuildStatus{DesignDoc: designDoc, Building: info.UpdaterRunning,
+		IndexedSeq: info.UpdateSeq, DatabaseSeq: dbInfo.UpdateSeq}
+	status.Ready = !status.Building && updateSeqNumber(status.IndexedSeq) >= updateSeqNumber(status.DatabaseSeq)
+	vdb.logger.Debugf("Index build status of design document %s: %+v", designDoc, status)
+	return status, nil
+}
+
+// updateSeqNumber returns the number an update sequence starts with, which counts the updates of the database
+// whether the sequence is a number, as in CouchDB 1.x, or an opaque string, as from CouchDB 2.0. 0 is returned
+// for a sequence that does not start with a number
+func updateSeqNumber(seq string) int64 {
+	end := strings.IndexFunc(seq, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(seq)
+	}
+	number, err := strconv.ParseInt(seq[:end], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return number
+}
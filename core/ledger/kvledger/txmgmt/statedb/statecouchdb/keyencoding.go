@@ -0,0 +1,130 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+)
+
+// keyEncodingDocID is the id of the internal document recording the encoding of the document ids of the keys
+const keyEncodingDocID = "statedb_key_encoding"
+
+// keyEncodingVersion is the version of the encoding of the document ids that ConstructCompositeKey implements. It is
+// to be increased by any change of the encoding that the document ids already stored would not be read back with
+const keyEncodingVersion = 1
+
+// The key encoding schemes. With the escaped scheme, the keys that are not valid UTF-8 are escaped in hex or base64,
+// whatever the invalid UTF-8 key policy as both are read back. With the ordered scheme, the keys are stored in the
+// ordered encoding
+const (
+	escapedKeyScheme = "escaped"
+	orderedKeyScheme = "ordered"
+)
+
+// KeyEncoding is the encoding of the document ids of the keys of a database. MaxKeyIDLength is the length beyond
+// which the keys are stored under a hashed id, 0 if none is
+type KeyEncoding struct {
+	Version        int    `json:"Version"`
+	Scheme         string `json:"Scheme"`
+	MaxKeyIDLength int    `json:"MaxKeyIDLength,omitempty"`
+}
+
+func (encoding KeyEncoding) String() string {
+	if encoding.MaxKeyIDLength > 0 {
+		return fmt.Sprintf("%d/%s/hashed>%d", encoding.Version, encoding.Scheme, encoding.MaxKeyIDLength)
+	}
+	return fmt.Sprintf("%d/%s", encoding.Version, encoding.Scheme)
+}
+
+// ErrKeyEncodingMismatch is returned when a database is opened whose keys were written with a key encoding other
+// than the configured one, which the document ids of its keys would not be read back with
+type ErrKeyEncodingMismatch struct {
+	DBName  string
+	Stored  KeyEncoding
+	Current KeyEncoding
+}
+
+func (e *ErrKeyEncodingMismatch) Error() string {
+	return fmt.Sprintf("Database %s was written with key encoding %s, which is incompatible with the configured key encoding %s",
+		e.DBName, e.Stored, e.Current)
+}
+
+// keyEncoder encodes the keys into the document ids of a database as configured when the database is opened. The
+// configuration is read once rather than for every key, so that the keys are escaped and unescaped alike for as long
+// as the database is open, whatever the configuration changes in between
+type keyEncoder struct {
+	// the keys are stored in the ordered encoding, see encodeOrderedKey
+	ordered bool
+	// the keys that are not valid UTF-8 are escaped in base64 rather than in hex, or rejected by the updates if
+	// rejectInvalidUTF8 is set. The keys in the ordered encoding are never rejected
+	base64            bool
+	rejectInvalidUTF8 bool
+	// the key part of the document ids longer than maxKeyIDLength is hashed, see hashKeyID. The ids are never
+	// hashed if 0
+	maxKeyIDLength int
+}
+
+// newKeyEncoder returns the key encoder of the configured key encoding
+func newKeyEncoder() keyEncoder {
+	ordered := ledgerconfig.IsCouchDBOrderedKeysEnabled()
+	policy := ledgerconfig.GetCouchDBInvalidUTF8KeyPolicy()
+	return keyEncoder{ordered: ordered, base64: policy == "base64", rejectInvalidUTF8: policy == "reject" && !ordered,
+		maxKeyIDLength: ledgerconfig.GetCouchDBMaxKeyIDLength()}
+}
+
+// keyEncoding returns the key encoding the keys are written with by the encoder
+func (keys keyEncoder) keyEncoding() KeyEncoding {
+	if keys.ordered {
+		return KeyEncoding{Version: keyEncodingVersion, Scheme: orderedKeyScheme, MaxKeyIDLength: keys.maxKeyIDLength}
+	}
+	return KeyEncoding{Version: keyEncodingVersion, Scheme: escapedKeyScheme, MaxKeyIDLength: keys.maxKeyIDLength}
+}
+
+// checkKeyEncoding checks that the keys of the database were written with the key encoding of its encoder, as recorded
+// in the key encoding document, and returns ErrKeyEncodingMismatch otherwise. The key encoding is recorded if the
+// database has no record of it, i.e. when the database is created, but also for a database written before the key
+// encoding was recorded, whose keys are assumed to be written with the configured key encoding
+func (vdb *VersionedDB) checkKeyEncoding() error {
+	current := vdb.keys.keyEncoding()
+	encodingJSON, _, err := vdb.db.ReadDoc(keyEncodingDocID)
+	if err != nil {
+		return err
+	}
+	if encodingJSON == nil {
+		if encodingJSON, err = json.Marshal(current); err != nil {
+			return err
+		}
+		if _, err = vdb.db.SaveDoc(keyEncodingDocID, "", encodingJSON, nil); err != nil {
+			vdb.logger.Errorf("Failed to record the key encoding: %s", err.Error())
+			return err
+		}
+		vdb.logger.Debugf("Recorded key encoding %s", current)
+		return nil
+	}
+
+	stored := KeyEncoding{}
+	if err := json.Unmarshal(encodingJSON, &stored); err != nil {
+		return fmt.Errorf("Invalid key encoding record: %s", err.Error())
+	}
+	if stored != current {
+		return &ErrKeyEncodingMismatch{DBName: vdb.dbName, Stored: stored, Current: current}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// mergeAttempts is the number of times a merge is applied before giving up, when the document is written by
+// another writer in between the read of the current value and the write of the merged value
+const mergeAttempts = 3
+
+// mergePatch applies a JSON merge patch, as defined by RFC 7396, to the decoded JSON value target and returns the
+// result: the fields of an object patch are merged into the target object recursively, a field set to null is
+// removed, and a patch that is not an object replaces the target
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchFields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetFields, ok := target.(map[string]interface{})
+	if !ok {
+		targetFields = map[string]interface{}{}
+	}
+	for name, field := range patchFields {
+		if field == nil {
+			delete(targetFields, name)
+			continue
+		}
+		targetFields[name] = mergePatch(targetFields[name], field)
+	}
+	return targetFields
+}
+
+// mergeJSON returns the JSON value with the JSON merge patch applied, the patch applied to an empty object if
+// value is nil. The _id and _rev fields of the value read from its document are not part of the merged value
+func mergeJSON(value []byte, patch []byte) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if value != nil {
+		var err error
+		if fields, err = decodeJSONFields(value); err != nil {
+			return nil, err
+		}
+		delete(fields, "_id")
+		delete(fields, "_rev")
+	}
+	patchFields, err := decodeJSONFields(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(fields, patchFields))
+}
+
+// resolveMerge reads the current value of the key and applies the merge patch of the batch to it. It returns a
+// batch holding the merged value of the key, to be written as by Put, along with the revision of the document
+// the merge applies to. The merged value is checked against the schema of the namespace. The attachments, vector
+// clock and expiry stored with the current value are not kept
+func (vdb *VersionedDB) resolveMerge(ck statedb.CompositeKey, batch *statedb.UpdateBatch) (*statedb.UpdateBatch, string, error) {
+	patch := batch.KVs[ck]
+	if !couchdb.IsJSON(string(patch.Value)) {
+		return nil, "", fmt.Errorf("Invalid merge patch for ns=%s, key=%s: the patch is not a JSON object", ck.Namespace, ck.Key)
+	}
+	id := vdb.keys.compositeKeyID(ck.Namespace, ck.Key)
+	current, rev, err := vdb.readValue(id, "")
+	if err != nil {
+		return nil, "", err
+	}
+	var currentValue []byte
+	if current != nil {
+		if !couchdb.IsJSON(string(current.Value)) {
+			return nil, "", fmt.Errorf("Cannot merge into ns=%s, key=%s: the current value is not JSON", ck.Namespace, ck.Key)
+		}
+		currentValue = current.Value
+	} else {
+		// an expired value is read as absent, but its document is still to be replaced at its revision
+		revs, err := vdb.db.ReadDocRevisions([]string{id})
+		if err != nil {
+			return nil, "", err
+		}
+		rev = revs[id]
+	}
+
+	merged, err := mergeJSON(currentValue, patch.Value)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := vdb.validateSchema(ck, merged); err != nil {
+		return nil, "", err
+	}
+	mergedBatch := statedb.NewUpdateBatch()
+	mergedBatch.Put(ck.Namespace, ck.Key, merged, patch.Version)
+	return mergedBatch, rev, nil
+}
+
+// saveMerge writes the document storing the value of the key merged with the merge patch of the batch. The merged
+// value is saved at the revision it was merged from, so that a write of the document in between is not lost: the
+// merge is applied again to the value written, or, if the key is in revs, ErrStale is returned as the key is no
+// longer at the revision expected
+func (vdb *VersionedDB) saveMerge(ck statedb.CompositeKey, batch *statedb.UpdateBatch, revs map[statedb.CompositeKey]string) error {
+	id := vdb.keys.compositeKeyID(ck.Namespace, ck.Key)
+	expectedRev, expected := revs[ck]
+	for attempt := 1; ; attempt++ {
+		mergedBatch, rev, err := vdb.resolveMerge(ck, batch)
+		if err != nil {
+			return err
+		}
+		if expected && rev != expectedRev {
+			return ErrStale
+		}
+		jsonDoc, attachments, skip, err := vdb.encodeValueDoc(ck, mergedBatch)
+		if err != nil || skip {
+			return err
+		}
+		_, err = vdb.db.SaveDoc(id, rev, jsonDoc, attachments)
+		if err == nil {
+			return nil
+		}
+		if expected || attempt >= mergeAttempts {
+			vdb.logger.Errorf("Error during Commit() for ns=%s, key=%s: %s\n", ck.Namespace, ck.Key, err.Error())
+			return vdb.checkStale(ck, revs, err)
+		}
+		vdb.logger.Debugf("Retrying the merge of ns=%s, key=%s after a failed write: %s", ck.Namespace, ck.Key, err.Error())
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// ErrMigrationMismatch is returned by MigrateDB if the new database does not hold the same revisions of the same
+// documents as the old one once they are copied, in which case the old database is not dropped
+var ErrMigrationMismatch = errors.New("The migrated database does not match the source database")
+
+// migratePageSize is the number of documents copied, and verified, per request by MigrateDB
+const migratePageSize = 1000
+
+// MigrateDB copies the state database oldName to the database newName, which is created if it does not exist, e.g.
+// to rename the database of a ledger after the channel naming rules changed. All the documents are copied in bulk
+// with their revisions and attachments, including the savepoint and the design documents of the indexes. Once
+// copied, the new database is verified to hold exactly the same revisions of the same documents as the old one, and
+// only then is the old database dropped, if dropSource is set.
+// A migration that was interrupted is resumed by calling MigrateDB again, the documents already copied at their
+// revision being skipped. ErrDBInUse is returned if a handle to either database is open, as the commits during the
+// migration would be missed
+func (provider *VersionedDBProvider) MigrateDB(oldName string, newName string, dropSource bool) error {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+	oldName = strings.ToLower(oldName)
+	newName = strings.ToLower(newName)
+	if provider.closed {
+		return ErrProviderClosed
+	}
+	if oldName == newName {
+		return fmt.Errorf("Cannot migrate database %s to itself", oldName)
+	}
+	for _, dbName := range []string{oldName, newName} {
+		if vdb := provider.databases[dbName]; vdb != nil && vdb.getOpenCount() > 0 {
+			return ErrDBInUse
+		}
+	}
+	// the savepoint of a handle that is not open may still be pending
+	if vdb := provider.databases[oldName]; vdb != nil {
+		if err := vdb.Flush(); err != nil {
+			return err
+		}
+	}
+
+	dbNames, err := provider.couchInstance.GetAllDatabases()
+	if err != nil {
+		return err
+	}
+	if !containsString(dbNames, oldName) {
+		return fmt.Errorf("Database %s does not exist", oldName)
+	}
+	source, err := couchdb.CreateCouchDatabase(*provider.couchInstance, oldName)
+	if err != nil {
+		return err
+	}
+	target, err := couchdb.CreateCouchDatabaseWithOptions(*provider.couchInstance, newName, databaseOptions())
+	if err != nil {
+		return err
+	}
+	// the cached handles would not reflect the copied documents
+	delete(provider.databases, newName)
+
+	copied, err := copyDocuments(source, target)
+	if err != nil {
+		logger.Errorf("Migration of database %s to %s failed after %d documents: %s", oldName, newName, copied, err.Error())
+		return err
+	}
+	verified, err := verifyDocuments(source, target)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Migrated database %s to %s, %d documents copied and %d verified", oldName, newName, copied, verified)
+
+	if !dropSource {
+		return nil
+	}
+	if vdb := provider.databases[oldName]; vdb != nil {
+		vdb.stopWatchdog()
+		vdb.stopSweeper()
+	}
+	if _, err := source.DropDatabase(); err != nil {
+		logger.Errorf("Error dropping database %s: %s", oldName, err.Error())
+		return err
+	}
+	delete(provider.databases, oldName)
+	return nil
+}
+
+// copyDocuments copies the documents of the source database that the target does not have at the same revision, in
+// pages of ids. It returns the number of documents copied
+func copyDocuments(source *couchdb.CouchDatabase, target *couchdb.CouchDatabase) (int, error) {
+	copied := 0
+	startKey := ""
+	for {
+		sourceRevs, targetRevs, endKey, err := readRevisionPage(source, target, startKey)
+		if err != nil {
+			return copied, err
+		}
+		copiedRevs := make(map[string]string, len(targetRevs))
+		for _, rev := range targetRevs {
+			copiedRevs[rev.ID] = rev.Rev
+		}
+		missing := []couchdb.DocRevRequest{}
+		for _, rev := range sourceRevs {
+			if copiedRevs[rev.ID] != rev.Rev {
+				missing = append(missing, rev)
+			}
+		}
+		if len(missing) > 0 {
+			docs, err := source.BulkGet(missing)
+			if err != nil {
+				return copied, err
+			}
+			for _, doc := range docs {
+				if doc.Error != "" {
+					return copied, fmt.Errorf("Error reading revision %s of document %s: %s %s", doc.Rev, doc.ID, doc.Error, doc.Reason)
+				}
+			}
+			if err := target.BulkSaveRevisions(docs); err != nil {
+				return copied, err
+			}
+			copied += len(docs)
+		}
+		if endKey == "" {
+			return copied, nil
+		}
+		startKey = endKey
+	}
+}
+
+// verifyDocuments verifies that the target database holds the same revisions of the same documents as the source
+// database, in pages of ids. It returns the number of documents verified, or ErrMigrationMismatch
+func verifyDocuments(source *couchdb.CouchDatabase, target *couchdb.CouchDatabase) (int, error) {
+	verified := 0
+	startKey := ""
+	for {
+		sourceRevs, targetRevs, endKey, err := readRevisionPage(source, target, startKey)
+		if err != nil {
+			return verified, err
+		}
+		if len(sourceRevs) != len(targetRevs) {
+			logger.Errorf("Migrated database has %d documents after %s, the source database %d", len(targetRevs), startKey, len(sourceRevs))
+			return verified, ErrMigrationMismatch
+		}
+		for i := range sourceRevs {
+			if sourceRevs[i] != targetRevs[i] {
+				logger.Errorf("Migrated database has revision %s of document %s, the source database revision %s of document %s",
+					targetRevs[i].Rev, targetRevs[i].ID, sourceRevs[i].Rev, sourceRevs[i].ID)
+				return verified, ErrMigrationMismatch
+			}
+		}
+		verified += len(sourceRevs)
+		if endKey == "" {
+			return verified, nil
+		}
+		startKey = endKey
+	}
+}
+
+// readRevisionPage reads the revisions of a page of the documents of the source database starting at startKey, and
+// the revisions of the documents of the target database in the same range of ids. The range ends at the returned
+// end key, which is "" if the page is the last one, in which case the range of the target has no end
+func readRevisionPage(source *couchdb.CouchDatabase, target *couchdb.CouchDatabase, startKey string) ([]couchdb.DocRevRequest,
+	[]couchdb.DocRevRequest, string, error) {
+	sourceRevs, _, err := source.ReadDocRevisionRange(startKey, "", migratePageSize)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	endKey := ""
+	if len(sourceRevs) == migratePageSize {
+		endKey = sourceRevs[len(sourceRevs)-1].ID + "\x00"
+	}
+	targetRevs, _, err := target.ReadDocRevisionRange(startKey, endKey, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return sourceRevs, targetRevs, endKey, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
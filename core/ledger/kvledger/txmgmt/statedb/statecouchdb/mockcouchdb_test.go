@@ -0,0 +1,497 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/testutil"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// mockCouchDB is a minimal in-memory stand-in for a single CouchDB database, serving only
+// the JSON document requests the VersionedDB needs. It records the requests it receives so
+// that tests can assert on the traffic without a running CouchDB
+type mockCouchDB struct {
+	mux      sync.Mutex
+	docs     map[string][]byte
+	revs     map[string]int
+	requests []string
+	queries  []string
+
+	// if set, document writes are held until the channel is closed
+	holdWrites chan struct{}
+	heldWrites int
+
+	// if set, the database does not exist until it is created. The creates and the query of
+	// the create request are recorded
+	dbMissing   bool
+	creates     int
+	createQuery string
+
+	// the databases listed by _all_dbs
+	allDBs []string
+
+	// if set, requests must authenticate with these "username:password" credentials
+	credentials string
+
+	// the latency added to each request
+	delay time.Duration
+
+	// the version reported by the root endpoint, 1.6.1 if not set
+	serverVersion string
+
+	// the ids of the documents whose reads or writes fail with an internal server error
+	failReads  map[string]bool
+	failWrites map[string]bool
+
+	// the number of range reads that fail with an internal server error before they succeed
+	failRangeReads int
+
+	// if set, the document writes are rejected with a conflict unless at the current revision of the document,
+	// and the hook of a document id, if any, is called once before the next write of the document, e.g. to
+	// write the document concurrently
+	checkRevs    bool
+	beforeWrites map[string]func()
+
+	// if set, the document writes succeed with an empty revision
+	emptyRevs bool
+
+	// the revisions of the deleted documents, listed as deleted by the changes feed, and the bodies of the
+	// purge requests. If purgeNotImplemented is set, the purges fail as on CouchDB 2.0 to 2.2
+	tombstones          map[string]string
+	purges              []string
+	purgeNotImplemented bool
+
+	// the design documents listed by _index, and the databases whose compaction fails with an internal server error
+	designDocs      []string
+	failCompactions map[string]bool
+
+	// the update sequence of the database, the number of requests received if not set, and the view index
+	// info served by the _info endpoint of the design documents, by design document name
+	updateSeq      int
+	designDocInfos map[string]string
+
+	// the data of the attachments served by the attachment reads, keyed by document id and attachment name
+	// separated by a slash
+	attachments map[string][]byte
+}
+
+func newMockCouchDB() (*mockCouchDB, *httptest.Server) {
+	mock := &mockCouchDB{docs: make(map[string][]byte), revs: make(map[string]int)}
+	return mock, httptest.NewServer(mock)
+}
+
+func (mock *mockCouchDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.mux.Lock()
+	delay := mock.delay
+	mock.mux.Unlock()
+	time.Sleep(delay)
+
+	mock.mux.Lock()
+	holdWrites := mock.holdWrites
+	if holdWrites != nil && r.Method == http.MethodPut {
+		mock.heldWrites++
+	}
+	mock.mux.Unlock()
+	if holdWrites != nil && r.Method == http.MethodPut {
+		<-holdWrites
+	}
+
+	mock.mux.Lock()
+	defer mock.mux.Unlock()
+	mock.requests = append(mock.requests, r.Method+" "+r.URL.Path)
+	mock.queries = append(mock.queries, r.URL.RawQuery)
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	w.Header().Set("Content-Type", "application/json")
+	if username, password, _ := r.BasicAuth(); mock.credentials != "" && username+":"+password != mock.credentials {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"unauthorized","reason":"Name or password is incorrect."}`)
+		return
+	}
+	switch {
+	case path[0] == "":
+		serverVersion := mock.serverVersion
+		if serverVersion == "" {
+			serverVersion = "1.6.1"
+		}
+		fmt.Fprintf(w, `{"couchdb":"Welcome","version":"%s"}`, serverVersion)
+	case path[0] == "_all_dbs":
+		json.NewEncoder(w).Encode(mock.allDBs)
+	case path[0] == "fabric_locks":
+		mock.serveLock(w, r)
+	case len(path) == 1 && r.Method == http.MethodPut:
+		mock.dbMissing = false
+		mock.creates++
+		mock.createQuery = r.URL.RawQuery
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"ok":true}`)
+	case mock.dbMissing:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":"not_found","reason":"Database does not exist."}`)
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		mock.dbMissing = true
+		mock.docs = make(map[string][]byte)
+		mock.revs = make(map[string]int)
+		fmt.Fprint(w, `{"ok":true}`)
+	case len(path) == 1:
+		updateSeq := mock.updateSeq
+		if updateSeq == 0 {
+			updateSeq = len(mock.requests)
+		}
+		fmt.Fprintf(w, `{"db_name":"%s","update_seq":"%d-mock"}`, path[0], updateSeq)
+	case path[1] == "_ensure_full_commit":
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"ok":true}`)
+	case path[1] == "_all_docs" && mock.failRangeReads > 0:
+		mock.failRangeReads--
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal_server_error","reason":"range read failed"}`)
+	case path[1] == "_all_docs":
+		mock.serveAllDocs(w, r)
+	case strings.HasPrefix(path[1], "_compact") && mock.failCompactions[path[0]]:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal_server_error","reason":"compaction failed"}`)
+	case strings.HasPrefix(path[1], "_compact"):
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"ok":true}`)
+	case path[1] == "_index" && r.Method == http.MethodGet:
+		indexes := []map[string]interface{}{{"ddoc": nil, "name": "_all_docs", "type": "special", "def": map[string]interface{}{}}}
+		for _, designDoc := range mock.designDocs {
+			indexes = append(indexes, map[string]interface{}{"ddoc": designDoc, "name": "by_owner", "type": "json", "def": map[string]interface{}{}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total_rows": len(indexes), "indexes": indexes})
+	case strings.HasPrefix(path[1], "_design/") && strings.HasSuffix(path[1], "/_info"):
+		designDoc := strings.TrimSuffix(strings.TrimPrefix(path[1], "_design/"), "/_info")
+		info, ok := mock.designDocInfos[designDoc]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not_found","reason":"missing"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"name":"%s","view_index":%s}`, designDoc, info)
+	case path[1] == "_bulk_get":
+		mock.serveBulkGet(w, r)
+	case path[1] == "_bulk_docs":
+		mock.serveBulkDocs(w, r)
+	case path[1] == "_changes":
+		mock.serveChanges(w, r)
+	case path[1] == "_purge":
+		mock.servePurge(w, r)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && mock.failReads[path[1]]:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal_server_error","reason":"read failed"}`)
+	case r.Method == http.MethodHead:
+		if _, ok := mock.docs[path[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Etag", fmt.Sprintf(`"%d-mock"`, mock.revs[path[1]]))
+	case r.Method == http.MethodGet && mock.attachments[path[1]] != nil:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(mock.attachments[path[1]])
+	case r.Method == http.MethodGet:
+		doc, ok := mock.docs[path[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not_found","reason":"missing"}`)
+			return
+		}
+		w.Header().Set("Etag", fmt.Sprintf(`"%d-mock"`, mock.revs[path[1]]))
+		w.Write(doc)
+	case r.Method == http.MethodPut && mock.failWrites[path[1]]:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal_server_error","reason":"write failed"}`)
+	case r.Method == http.MethodPut:
+		if hook := mock.beforeWrites[path[1]]; hook != nil {
+			delete(mock.beforeWrites, path[1])
+			hook()
+		}
+		if _, ok := mock.docs[path[1]]; mock.checkRevs &&
+			(ok && r.Header.Get("If-Match") != fmt.Sprintf("%d-mock", mock.revs[path[1]]) || !ok && r.Header.Get("If-Match") != "") {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":"conflict","reason":"Document update conflict."}`)
+			return
+		}
+		doc, _ := ioutil.ReadAll(r.Body)
+		mock.docs[path[1]] = doc
+		mock.revs[path[1]]++
+		w.Header().Set("Etag", fmt.Sprintf(`"%d-mock"`, mock.revs[path[1]]))
+		if mock.emptyRevs {
+			w.Header().Set("Etag", `""`)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"ok":true,"id":"%s"}`, path[1])
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveLock serves the requests on the database of the create lock, which is always free
+func (mock *mockCouchDB) serveLock(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		w.Header().Set("Etag", `"1-mock"`)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"ok":true}`)
+	default:
+		fmt.Fprint(w, `{"ok":true}`)
+	}
+}
+
+// serveAllDocs serves the ids, and the documents if include_docs is set, of the range given by startkey and endkey,
+// up to limit ids if set, or the revisions of the keys posted
+func (mock *mockCouchDB) serveAllDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		request := &struct {
+			Keys []string `json:"keys"`
+		}{}
+		json.NewDecoder(r.Body).Decode(request)
+		rows := []map[string]interface{}{}
+		for _, id := range request.Keys {
+			if _, ok := mock.docs[id]; !ok {
+				rows = append(rows, map[string]interface{}{"key": id, "error": "not_found"})
+				continue
+			}
+			rows = append(rows, map[string]interface{}{"id": id, "key": id, "value": map[string]string{"rev": fmt.Sprintf("%d-mock", mock.revs[id])}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total_rows": len(mock.docs), "rows": rows})
+		return
+	}
+
+	var startKey, endKey string
+	query := r.URL.Query()
+	json.Unmarshal([]byte(query.Get("startkey")), &startKey)
+	json.Unmarshal([]byte(query.Get("endkey")), &endKey)
+
+	ids := []string{}
+	for id := range mock.docs {
+		if id >= startKey && (endKey == "" || id < endKey) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(ids) {
+		ids = ids[:limit]
+	}
+
+	rows := []map[string]interface{}{}
+	for _, id := range ids {
+		row := map[string]interface{}{"id": id, "key": id, "value": map[string]string{"rev": fmt.Sprintf("%d-mock", mock.revs[id])}}
+		if query.Get("include_docs") == "true" {
+			doc := map[string]interface{}{}
+			json.Unmarshal(mock.docs[id], &doc)
+			doc["_id"] = id
+			doc["_rev"] = fmt.Sprintf("%d-mock", mock.revs[id])
+			row["doc"] = doc
+		}
+		rows = append(rows, row)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"total_rows": len(mock.docs), "offset": 0, "rows": rows})
+}
+
+// serveBulkGet serves the latest revision of the requested documents, as CouchDB 2.x does
+func (mock *mockCouchDB) serveBulkGet(w http.ResponseWriter, r *http.Request) {
+	request := &struct {
+		Docs []struct {
+			ID string `json:"id"`
+		} `json:"docs"`
+	}{}
+	json.NewDecoder(r.Body).Decode(request)
+
+	results := []map[string]interface{}{}
+	for _, requested := range request.Docs {
+		result := map[string]interface{}{"id": requested.ID}
+		if docJSON, ok := mock.docs[requested.ID]; ok {
+			doc := map[string]interface{}{}
+			json.Unmarshal(docJSON, &doc)
+			doc["_id"] = requested.ID
+			doc["_rev"] = fmt.Sprintf("%d-mock", mock.revs[requested.ID])
+			result["docs"] = []map[string]interface{}{{"ok": doc}}
+		} else {
+			result["docs"] = []map[string]interface{}{{"error": map[string]string{
+				"id": requested.ID, "rev": "undefined", "error": "not_found", "reason": "missing"}}}
+		}
+		results = append(results, result)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// serveBulkDocs writes the posted documents as new revisions, the documents without their _id and _rev fields, and
+// removes the documents posted as deleted. A document whose revision is not the current one fails with a conflict,
+// and those in failWrites with an error
+func (mock *mockCouchDB) serveBulkDocs(w http.ResponseWriter, r *http.Request) {
+	request := &struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}{}
+	json.NewDecoder(r.Body).Decode(request)
+
+	results := []map[string]interface{}{}
+	for _, doc := range request.Docs {
+		id, _ := doc["_id"].(string)
+		rev, _ := doc["_rev"].(string)
+		currentRev := ""
+		if _, ok := mock.docs[id]; ok {
+			currentRev = fmt.Sprintf("%d-mock", mock.revs[id])
+		}
+		switch {
+		case mock.failWrites[id]:
+			results = append(results, map[string]interface{}{"id": id, "error": "internal_server_error", "reason": "write failed"})
+		case rev != currentRev:
+			results = append(results, map[string]interface{}{"id": id, "error": "conflict", "reason": "Document update conflict."})
+		case doc["_deleted"] == true:
+			delete(mock.docs, id)
+			mock.revs[id]++
+			results = append(results, map[string]interface{}{"ok": true, "id": id, "rev": fmt.Sprintf("%d-mock", mock.revs[id])})
+		default:
+			delete(doc, "_id")
+			delete(doc, "_rev")
+			mock.docs[id], _ = json.Marshal(doc)
+			mock.revs[id]++
+			results = append(results, map[string]interface{}{"ok": true, "id": id, "rev": fmt.Sprintf("%d-mock", mock.revs[id])})
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(results)
+}
+
+// serveChanges serves the changes feed, a change per document and deleted document in the order of their ids,
+// starting after the number of changes given by since, up to limit changes if set
+func (mock *mockCouchDB) serveChanges(w http.ResponseWriter, r *http.Request) {
+	ids := []string{}
+	for id := range mock.docs {
+		ids = append(ids, id)
+	}
+	for id := range mock.tombstones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	query := r.URL.Query()
+	since, _ := strconv.Atoi(query.Get("since"))
+	ids = ids[since:]
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(ids) {
+		ids = ids[:limit]
+	}
+
+	results := []map[string]interface{}{}
+	for _, id := range ids {
+		rev := fmt.Sprintf("%d-mock", mock.revs[id])
+		result := map[string]interface{}{"id": id}
+		if tombstoneRev, ok := mock.tombstones[id]; ok {
+			rev = tombstoneRev
+			result["deleted"] = true
+		}
+		result["changes"] = []map[string]string{{"rev": rev}}
+		results = append(results, result)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results, "last_seq": strconv.Itoa(since + len(ids))})
+}
+
+// servePurge records the purge request and removes the purged deleted documents
+func (mock *mockCouchDB) servePurge(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	mock.purges = append(mock.purges, string(body))
+	if mock.purgeNotImplemented {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, `{"error":"not_implemented","reason":"this feature is not yet implemented"}`)
+		return
+	}
+	revs := map[string][]string{}
+	json.Unmarshal(body, &revs)
+	for id, purgedRevs := range revs {
+		if len(purgedRevs) == 1 && mock.tombstones[id] == purgedRevs[0] {
+			delete(mock.tombstones, id)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"purge_seq": nil, "purged": revs})
+}
+
+// getHeldWrites returns the number of document writes that were held
+func (mock *mockCouchDB) getHeldWrites() int {
+	mock.mux.Lock()
+	defer mock.mux.Unlock()
+	return mock.heldWrites
+}
+
+// getDoc returns the stored document with the given id
+func (mock *mockCouchDB) getDoc(id string) []byte {
+	mock.mux.Lock()
+	defer mock.mux.Unlock()
+	return mock.docs[id]
+}
+
+// countRequests returns the number of requests received with the given method whose path ends with suffix
+func (mock *mockCouchDB) countRequests(method string, suffix string) int {
+	mock.mux.Lock()
+	defer mock.mux.Unlock()
+	count := 0
+	for _, request := range mock.requests {
+		if strings.HasPrefix(request, method+" ") && strings.HasSuffix(request, suffix) {
+			count++
+		}
+	}
+	return count
+}
+
+// requestQueries returns the queries of the requests received with the given method whose path ends with suffix
+func (mock *mockCouchDB) requestQueries(method string, suffix string) []url.Values {
+	mock.mux.Lock()
+	defer mock.mux.Unlock()
+	queries := []url.Values{}
+	for i, request := range mock.requests {
+		if strings.HasPrefix(request, method+" ") && strings.HasSuffix(request, suffix) {
+			query, _ := url.ParseQuery(mock.queries[i])
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// newMockProvider constructs a VersionedDBProvider backed by the given mock server
+func newMockProvider(t testing.TB, server *httptest.Server) *VersionedDBProvider {
+	couchInstance, err := couchdb.CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, "")
+	provider, err := NewVersionedDBProviderWithInstance(couchInstance)
+	testutil.AssertNoError(t, err, "")
+	return provider
+}
+
+// newMockVersionedDB constructs a VersionedDB backed by the given mock server
+func newMockVersionedDB(t testing.TB, server *httptest.Server, dbName string) *VersionedDB {
+	couchInstance, err := couchdb.CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, "")
+	vdb, err := newVersionedDB(couchInstance, dbName)
+	testutil.AssertNoError(t, err, "")
+	return vdb
+}
+
+// compositeKeyID returns the document id of the key with the configured key encoding
+func compositeKeyID(ns string, key string) string {
+	return newKeyEncoder().compositeKeyID(ns, key)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// NonQueryableRecord is a key matched by a query whose value is stored as an attachment of its document, i.e. a
+// binary value or a compressed JSON value. The selector of a query only sees the JSON part of such a document,
+// which holds the internal fields but not the value, so the key is not returned as a query result
+type NonQueryableRecord struct {
+	Namespace string
+	Key       string
+	Version   *version.Height
+}
+
+// NonQueryableReporter is implemented by the iterators returned by ExecuteQuery. NonQueryableRecords returns the
+// keys the query matched that were skipped as their value is stored as an attachment, up to the current result
+type NonQueryableReporter interface {
+	NonQueryableRecords() []*NonQueryableRecord
+}
+
+// newNonQueryableRecord returns the record of a query result whose value is stored as an attachment, or nil if
+// the value of the result is its JSON document, or is not a document
+func newNonQueryableRecord(keys keyEncoder, result couchdb.QueryResult) (*NonQueryableRecord, error) {
+	doc := &struct {
+		Attachments map[string]json.RawMessage `json:"_attachments"`
+	}{}
+	if err := json.Unmarshal(result.Value, doc); err != nil {
+		if _, isTypeError := err.(*json.UnmarshalTypeError); isTypeError {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, ok := doc.Attachments[valueAttachmentName]; !ok {
+		return nil, nil
+	}
+	jsonDoc, err := removeField(result.Value, "_attachments")
+	if err != nil {
+		return nil, err
+	}
+	_, ver, err := decodeStoredValue(jsonDoc)
+	if err != nil {
+		return nil, err
+	}
+	namespace, key := keys.splitDocID(result.ID, jsonDoc)
+	return &NonQueryableRecord{Namespace: namespace, Key: key, Version: ver}, nil
+}
+
+// CountNonQueryableKeys returns the number of keys of the namespace whose value is stored as an attachment, which
+// rich queries cannot match on their value: the binary values, and the JSON values stored compressed. Only the
+// attachment stubs of the documents are read, not the values
+func (vdb *VersionedDB) CountNonQueryableKeys(namespace string) (int, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return 0, err
+	}
+	startKey := string(constructNamespaceStartKey(namespace))
+	endKey := string(constructNamespaceEndKey(namespace))
+
+	count := 0
+	for {
+		docs, err := vdb.db.ReadAttachmentStubRange(startKey, endKey, vdb.resultsPageSize)
+		if err != nil {
+			vdb.logger.Debugf("Error calling ReadAttachmentStubRange(): %s\n", err.Error())
+			return 0, err
+		}
+		for _, doc := range docs {
+			if _, ok := doc.ContentTypes[valueAttachmentName]; ok {
+				count++
+			}
+		}
+		if len(docs) < vdb.resultsPageSize {
+			break
+		}
+		// the next page starts right after the last document of this page
+		startKey = docs[len(docs)-1].ID + "\x00"
+	}
+	vdb.logger.Debugf("Namespace %s has %d non-queryable keys", namespace, count)
+	return count, nil
+}
@@ -0,0 +1,289 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// Unlimited is the limit of the range scans and the queries returning all their results, any limit of 0 or less
+// being unlimited. The results of an unlimited range scan or query are read from CouchDB in pages as they are
+// iterated, so that they are never all held in memory
+const Unlimited = 0
+
+// defaultResultsPageSize is the number of results read per request by the unlimited range scans and queries
+const defaultResultsPageSize = 1000
+
+// pagedScanner iterates over the results of an unlimited range scan or query, reading the next page of results
+// once the results of the current page are yielded
+type pagedScanner struct {
+	readPage func() ([]couchdb.QueryResult, error)
+	newPage  func(results []couchdb.QueryResult) statedb.ResultsIterator
+	pageSize int
+	partial  bool
+
+	page     statedb.ResultsIterator
+	lastPage bool
+	done     bool
+	err      error
+	warning  string
+
+	// the non-queryable records matched by the pages before the current one
+	nonQueryable []*NonQueryableRecord
+}
+
+// newPagedScanner returns a scanner over the pages returned by readPage, which must return the next page of up
+// to pageSize results on each call, each page being iterated by the iterator returned by newPage. The first
+// page is read upfront, so that a failure to start the scan is returned. In partial mode, the failure to read a
+// page ends the iteration once the results read before it are yielded, see PartialScanner
+func newPagedScanner(readPage func() ([]couchdb.QueryResult, error), newPage func([]couchdb.QueryResult) statedb.ResultsIterator,
+	pageSize int, partial bool) (*pagedScanner, error) {
+	scanner := &pagedScanner{readPage: readPage, newPage: newPage, pageSize: pageSize, partial: partial}
+	if err := scanner.nextPage(); err != nil {
+		return nil, err
+	}
+	return scanner, nil
+}
+
+// nextPage reads the next page of results. In partial mode, the results a page returns along with a failure are
+// kept, and the page is the last one
+func (scanner *pagedScanner) nextPage() error {
+	results, err := scanner.readPage()
+	if err != nil && (!scanner.partial || results == nil) {
+		return err
+	}
+	if reporter, ok := scanner.page.(NonQueryableReporter); ok {
+		scanner.nonQueryable = append(scanner.nonQueryable, reporter.NonQueryableRecords()...)
+	}
+	scanner.page = scanner.newPage(results)
+	scanner.lastPage = err != nil || len(results) < scanner.pageSize
+	scanner.err = err
+	return nil
+}
+
+func (scanner *pagedScanner) Next() (statedb.QueryResult, error) {
+	for {
+		result, err := scanner.page.Next()
+		if err != nil || result != nil {
+			return result, err
+		}
+		if scanner.lastPage {
+			scanner.done = true
+			return nil, nil
+		}
+		if err := scanner.nextPage(); err != nil {
+			if !scanner.partial {
+				return nil, err
+			}
+			scanner.err = err
+			scanner.lastPage = true
+		}
+	}
+}
+
+// Err implements method in PartialScanner interface
+func (scanner *pagedScanner) Err() error {
+	if !scanner.done {
+		return nil
+	}
+	return scanner.err
+}
+
+// Warning implements method in QueryWarner interface, returning the warning of the first page of a query
+func (scanner *pagedScanner) Warning() string {
+	return scanner.warning
+}
+
+// NonQueryableRecords implements method in NonQueryableReporter interface, returning the non-queryable records of
+// all the pages read so far
+func (scanner *pagedScanner) NonQueryableRecords() []*NonQueryableRecord {
+	records := scanner.nonQueryable
+	if reporter, ok := scanner.page.(NonQueryableReporter); ok {
+		records = append(append([]*NonQueryableRecord{}, records...), reporter.NonQueryableRecords()...)
+	}
+	return records
+}
+
+func (scanner *pagedScanner) Close() {
+	scanner.page.Close()
+}
+
+// idPager reads the document ids of a range in pages of up to pageSize ids. Each page starts right after the last
+// id of the previous page rather than skipping the ids before it, so that a page is read as fast wherever it is in
+// the range
+type idPager struct {
+	db       *couchdb.CouchDatabase
+	startID  string
+	endID    string
+	pageSize int
+	lastPage bool
+}
+
+// newNamespaceIDPager returns a pager over the document ids of the keys of the namespace
+func (vdb *VersionedDB) newNamespaceIDPager(namespace string) *idPager {
+	return &idPager{db: vdb.db, startID: string(constructNamespaceStartKey(namespace)),
+		endID: string(constructNamespaceEndKey(namespace)), pageSize: vdb.resultsPageSize}
+}
+
+// next returns the next page of ids, empty once all the ids of the range are read
+func (pager *idPager) next() ([]string, error) {
+	if pager.lastPage {
+		return nil, nil
+	}
+	page, err := pager.db.ReadDocIDRange(pager.startID, pager.endID, pager.pageSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	pager.lastPage = len(page) < pager.pageSize
+	if len(page) > 0 {
+		pager.startID = page[len(page)-1] + "\x00"
+	}
+	return page, nil
+}
+
+// newPagedRangeScanner returns a scanner over all the keys of a range, read in pages. Each page starts right
+// after the document id of the last key of the previous page, so that the pages neither overlap nor miss keys
+func (vdb *VersionedDB) newPagedRangeScanner(namespace string, startID string, endID string, partial bool,
+	filter func(key string, value []byte) bool) (statedb.ResultsIterator, error) {
+	readPage := func() ([]couchdb.QueryResult, error) {
+		queryResult, err := vdb.db.ReadDocRangePartial(startID, endID, vdb.resultsPageSize, 0)
+		if queryResult == nil {
+			return nil, err
+		}
+		if len(*queryResult) > 0 {
+			startID = (*queryResult)[len(*queryResult)-1].ID + "\x00"
+		}
+		return *queryResult, err
+	}
+	newPage := func(results []couchdb.QueryResult) statedb.ResultsIterator {
+		scanner := newKVScanner(vdb.db, vdb.keys, namespace, results)
+		scanner.filter = filter
+		return scanner
+	}
+	scanner, err := newPagedScanner(readPage, newPage, vdb.resultsPageSize, partial)
+	if err != nil {
+		vdb.logger.Debugf("Error calling ReadDocRange(): %s\n", err.Error())
+		return nil, err
+	}
+	return scanner, nil
+}
+
+// newPagedQueryScanner returns a scanner over all the results of a query, read in pages. The pages are selected
+// with the skip of the query, so the documents matching the query that are written or deleted during the
+// iteration may shift the pages, and a result may be missed or returned twice. The pages start at the skip set
+// in the body of the query, if any, and end once the limit set in the body of the query, if any, is reached. The
+// results are yielded as *ParsedQueryRecord if parsed is true
+func (vdb *VersionedDB) newPagedQueryScanner(query string, parsed bool) (statedb.ResultsIterator, error) {
+	remaining, skip, err := getQueryPage(query)
+	if err != nil {
+		return nil, err
+	}
+	limited := remaining > 0
+	firstPage := true
+	var warning string
+	readPage := func() ([]couchdb.QueryResult, error) {
+		pageSize := vdb.resultsPageSize
+		if limited {
+			if remaining == 0 {
+				return []couchdb.QueryResult{}, nil
+			}
+			if remaining < pageSize {
+				pageSize = remaining
+			}
+		}
+		pageQuery, err := setQueryPage(query, pageSize, skip)
+		if err != nil {
+			return nil, err
+		}
+		queryResult, pageWarning, err := vdb.db.QueryDocumentsWithWarning(pageQuery, pageSize, skip)
+		if err != nil {
+			return nil, err
+		}
+		if firstPage {
+			warning = pageWarning
+			firstPage = false
+		}
+		skip += len(*queryResult)
+		remaining -= len(*queryResult)
+		return *queryResult, nil
+	}
+	newPage := func(results []couchdb.QueryResult) statedb.ResultsIterator {
+		scanner := newQueryScanner(vdb.keys, results)
+		scanner.parsed = parsed
+		return scanner
+	}
+	scanner, err := newPagedScanner(readPage, newPage, vdb.resultsPageSize, false)
+	if err != nil {
+		vdb.logger.Debugf("Error calling QueryDocuments(): %s\n", err.Error())
+		return nil, err
+	}
+	if warning != "" {
+		vdb.logger.Warningf("Query %s returned warning: %s", query, warning)
+	}
+	scanner.warning = warning
+	return scanner, nil
+}
+
+// getQueryPage returns the limit and the skip set in the body of the query, 0 if not set
+func getQueryPage(query string) (int, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(query)))
+	decoder.UseNumber()
+	queryMap := make(map[string]interface{})
+	if err := decoder.Decode(&queryMap); err != nil {
+		return 0, 0, err
+	}
+	page := make([]int, 2)
+	for i, field := range []string{"limit", "skip"} {
+		value, ok := queryMap[field]
+		if !ok {
+			continue
+		}
+		number, ok := value.(json.Number)
+		if !ok {
+			return 0, 0, fmt.Errorf("Invalid %s %v in query, the %s must be a number", field, value, field)
+		}
+		n, err := number.Int64()
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("Invalid %s %v in query, the %s must be a non-negative integer", field, value, field)
+		}
+		page[i] = int(n)
+	}
+	return page[0], page[1], nil
+}
+
+// setQueryPage returns the query with the limit and the skip of a page of its results set in its body, where
+// CouchDB reads them
+func setQueryPage(query string, limit int, skip int) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(query)))
+	decoder.UseNumber()
+	queryMap := make(map[string]interface{})
+	if err := decoder.Decode(&queryMap); err != nil {
+		return "", err
+	}
+	queryMap["limit"] = limit
+	queryMap["skip"] = skip
+	pageQuery, err := json.Marshal(queryMap)
+	if err != nil {
+		return "", err
+	}
+	return string(pageQuery), nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+)
+
+// progressChunkSize is the number of keys written between two progress reports of ApplyUpdatesWithProgress
+const progressChunkSize = 100
+
+// ApplyUpdatesWithProgress applies the batch like ApplyUpdates, and reports the progress of the writes of a large
+// batch, e.g. during a state rebuild: the keys are written in chunks, and progress is called with the number of
+// keys written and the number of keys of the batch once each chunk is written. The done counts are increasing, the
+// last one being the total once all the keys are written. progress is called from its own goroutine, never with
+// the locks of the database held, so it may call the database. The counts reached while it runs are coalesced,
+// and it is called with the latest of them. All the calls to progress complete before ApplyUpdatesWithProgress
+// returns. The batch is applied synchronously, after any batch queued in async commit mode
+func (vdb *VersionedDB) ApplyUpdatesWithProgress(batch *statedb.UpdateBatch, height *version.Height,
+	progress func(done, total int)) error {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := vdb.validateKeys(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkReadOnlyNamespaces(batch); err != nil {
+		return err
+	}
+	if err := vdb.validateSchemas(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkQuotas(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkPaused(); err != nil {
+		return err
+	}
+	if err := vdb.WaitForCommits(); err != nil {
+		return err
+	}
+	reporter := newProgressReporter(len(batch.KVs), progress)
+	defer reporter.close()
+	return vdb.applyUpdates(batch, height, "", nil, reporter.report)
+}
+
+// progressReporter calls a progress callback from its own goroutine with the counts reported, the counts not
+// yet delivered being replaced by the later ones, so that reporting never blocks on the callback
+type progressReporter struct {
+	updates chan int
+	done    chan struct{}
+}
+
+// newProgressReporter starts the goroutine calling progress with the counts reported, out of total
+func newProgressReporter(total int, progress func(done, total int)) *progressReporter {
+	reporter := &progressReporter{updates: make(chan int, 1), done: make(chan struct{})}
+	go func() {
+		defer close(reporter.done)
+		for done := range reporter.updates {
+			progress(done, total)
+		}
+	}()
+	return reporter
+}
+
+// report reports a count, replacing the count not yet delivered, if any
+func (reporter *progressReporter) report(done int) {
+	for {
+		select {
+		case reporter.updates <- done:
+			return
+		case <-reporter.updates:
+		}
+	}
+}
+
+// close waits until the counts reported are delivered
+func (reporter *progressReporter) close() {
+	close(reporter.updates)
+	<-reporter.done
+}
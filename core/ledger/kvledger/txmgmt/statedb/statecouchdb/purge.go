@@ -0,0 +1,72 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// ErrPurgeUnsafe is returned by PurgeDeleted if the state databases are configured as replicated, since the purges
+// are not replicated and the replication could bring the purged documents back
+var ErrPurgeUnsafe = errors.New("Purging the deleted documents of a replicated database is unsafe")
+
+// purgePageSize is the number of changes read, and at most the number of documents purged, per request
+const purgePageSize = 1000
+
+// PurgeDeleted purges the deleted documents of the database, whose tombstones CouchDB otherwise keeps forever,
+// to reclaim their space and speed up the scans. Only the documents that the changes feed reports as deleted are
+// purged, and only their deleted revision. It returns the number of documents purged.
+// A purge is irreversible, so it is refused with ErrPurgeUnsafe if the databases are configured as replicated.
+// couchdb.ErrPurgeNotSupported is returned if the server does not support purging, as CouchDB 2.0 to 2.2
+func (vdb *VersionedDB) PurgeDeleted() (int, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if ledgerconfig.IsCouchDBReplicated() {
+		return 0, ErrPurgeUnsafe
+	}
+	purged := 0
+	since := ""
+	for {
+		changes, err := vdb.db.ReadChanges(couchdb.ChangesOptions{Since: since, Limit: purgePageSize})
+		if err != nil {
+			return purged, err
+		}
+		tombstones := make(map[string][]string)
+		for _, change := range changes.Results {
+			if change.Deleted {
+				tombstones[change.ID] = []string{change.Rev}
+			}
+		}
+		if len(tombstones) > 0 {
+			purgedRevs, err := vdb.db.PurgeDocuments(tombstones)
+			if err != nil {
+				return purged, err
+			}
+			purged += len(purgedRevs)
+		}
+		if len(changes.Results) < purgePageSize {
+			break
+		}
+		since = changes.LastSeq
+	}
+	vdb.logger.Infof("Purged %d deleted documents", purged)
+	return purged, nil
+}
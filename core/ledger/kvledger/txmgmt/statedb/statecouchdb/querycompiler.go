@@ -0,0 +1,32 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+// QueryCompiler compiles the queries run by ExecuteQuery into Mango, the JSON query language of CouchDB, so that
+// the queries can be written in another query language
+type QueryCompiler interface {
+	// Compile returns the Mango query for the user query
+	Compile(userQuery string) (string, error)
+}
+
+// mangoQueryCompiler is the default query compiler, for queries written in Mango, which it returns as is
+type mangoQueryCompiler struct{}
+
+// Compile implements method in QueryCompiler interface
+func (compiler mangoQueryCompiler) Compile(userQuery string) (string, error) {
+	return userQuery, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+)
+
+// NamespaceQuota limits the state stored in a namespace. A limit of 0 is not enforced
+type NamespaceQuota struct {
+	MaxBytes     int64
+	MaxDocuments int64
+}
+
+// ErrQuotaExceeded is returned by ApplyUpdates if the updates would grow a namespace beyond its quota
+type ErrQuotaExceeded struct {
+	Namespace string
+	Quota     NamespaceQuota
+	Bytes     int64
+	Documents int64
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("Updates would grow namespace [%s] to %d bytes in %d documents, exceeding its quota of %d bytes in %d documents",
+		e.Namespace, e.Bytes, e.Documents, e.Quota.MaxBytes, e.Quota.MaxDocuments)
+}
+
+// namespaceUsage tracks the size of each key of a namespace, and their total
+type namespaceUsage struct {
+	sizes map[string]int64
+	bytes int64
+}
+
+// SetNamespaceQuota sets the quota of the namespace, which applies to the updates applied from then on.
+// Setting a zero quota removes the quota of the namespace
+func (vdb *VersionedDB) SetNamespaceQuota(namespace string, quota NamespaceQuota) {
+	vdb.quotaMux.Lock()
+	defer vdb.quotaMux.Unlock()
+	if quota == (NamespaceQuota{}) {
+		delete(vdb.quotas, namespace)
+		return
+	}
+	vdb.quotas[namespace] = quota
+}
+
+// GetNamespaceQuota returns the quota of the namespace, and false if the namespace has no quota
+func (vdb *VersionedDB) GetNamespaceQuota(namespace string) (NamespaceQuota, bool) {
+	vdb.quotaMux.Lock()
+	defer vdb.quotaMux.Unlock()
+	quota, ok := vdb.quotas[namespace]
+	return quota, ok
+}
+
+// GetNamespaceUsage returns the number of bytes and documents that count against the quota of the namespace.
+// The bytes are the sizes of the values as written, or as read from CouchDB for the values written before
+// the usage of the namespace was first needed
+func (vdb *VersionedDB) GetNamespaceUsage(namespace string) (int64, int64, error) {
+	vdb.quotaMux.Lock()
+	defer vdb.quotaMux.Unlock()
+	usage, err := vdb.loadNamespaceUsage(namespace)
+	if err != nil {
+		return 0, 0, err
+	}
+	return usage.bytes, int64(len(usage.sizes)), nil
+}
+
+// loadNamespaceUsage returns the usage of the namespace, reading the namespace the first time it is needed.
+// The caller must hold quotaMux
+func (vdb *VersionedDB) loadNamespaceUsage(namespace string) (*namespaceUsage, error) {
+	if usage, ok := vdb.usage[namespace]; ok {
+		return usage, nil
+	}
+	stream, err := vdb.db.StreamDocRange(string(constructNamespaceStartKey(namespace)),
+		string(constructNamespaceEndKey(namespace)), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	usage := &namespaceUsage{sizes: make(map[string]int64)}
+	for {
+		result, err := stream.Next()
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			break
+		}
+		key, err := vdb.keys.docKey(vdb.db, result.ID, result.Value)
+		if err != nil {
+			return nil, err
+		}
+		usage.sizes[key] = int64(len(result.Value))
+		usage.bytes += int64(len(result.Value))
+	}
+	vdb.logger.Debugf("Namespace %s holds %d bytes in %d documents", namespace, usage.bytes, len(usage.sizes))
+	vdb.usage[namespace] = usage
+	return usage, nil
+}
+
+// checkQuotas returns ErrQuotaExceeded if the batch would grow a namespace beyond its quota. Otherwise the
+// usage of the namespaces is updated to account for the batch, as the batch is about to be applied
+func (vdb *VersionedDB) checkQuotas(batch *statedb.UpdateBatch) error {
+	vdb.quotaMux.Lock()
+	defer vdb.quotaMux.Unlock()
+	if len(vdb.quotas) == 0 {
+		return nil
+	}
+
+	// the new size of each updated key, -1 for a deleted key
+	updates := make(map[string]map[string]int64)
+	for ck, vv := range batch.KVs {
+		if _, ok := vdb.quotas[ck.Namespace]; !ok {
+			continue
+		}
+		if updates[ck.Namespace] == nil {
+			updates[ck.Namespace] = make(map[string]int64)
+		}
+		size := int64(-1)
+		if vv.Value != nil {
+			size = int64(len(vv.Value))
+		}
+		updates[ck.Namespace][ck.Key] = size
+	}
+
+	newBytes := make(map[string]int64)
+	for namespace, sizes := range updates {
+		usage, err := vdb.loadNamespaceUsage(namespace)
+		if err != nil {
+			return err
+		}
+		bytes, documents := usage.bytes, int64(len(usage.sizes))
+		for key, size := range sizes {
+			oldSize, exists := usage.sizes[key]
+			if exists {
+				bytes -= oldSize
+				documents--
+			}
+			if size >= 0 {
+				bytes += size
+				documents++
+			}
+		}
+		quota := vdb.quotas[namespace]
+		if (quota.MaxBytes > 0 && bytes > quota.MaxBytes) || (quota.MaxDocuments > 0 && documents > quota.MaxDocuments) {
+			vdb.logger.Warningf("Updates would exceed the quota of namespace %s", namespace)
+			return &ErrQuotaExceeded{Namespace: namespace, Quota: quota, Bytes: bytes, Documents: documents}
+		}
+		newBytes[namespace] = bytes
+	}
+
+	for namespace, sizes := range updates {
+		usage := vdb.usage[namespace]
+		for key, size := range sizes {
+			if size < 0 {
+				delete(usage.sizes, key)
+			} else {
+				usage.sizes[key] = size
+			}
+		}
+		usage.bytes = newBytes[namespace]
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// idRange is a query reduced to a range of document ids, from startID to endID exclusive, and to the values the
+// fields of the documents of the range must be equal to, by field path. The end of the range is open if endID is
+// empty
+type idRange struct {
+	startID string
+	endID   string
+	equals  map[string]interface{}
+}
+
+// reduceQueryToRange returns the range of document ids that the query reduces to, or nil if it does not. A query
+// reduces to a range if it has no other member than its selector, and the selector restricts _id, to a value or to
+// a range with $eq, $gt, $gte, $lt and $lte, and every other field to a value, given as is or with $eq. The value
+// of a field is a string, a number, a boolean or null, and the fields of nested objects are named with a dot
+// separating the fields, as in Mango
+func reduceQueryToRange(query string) *idRange {
+	mango := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(query), &mango); err != nil || len(mango) != 1 || mango["selector"] == nil {
+		return nil
+	}
+	selector := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(mango["selector"]))
+	decoder.UseNumber()
+	if err := decoder.Decode(&selector); err != nil {
+		return nil
+	}
+	idCondition, ok := selector["_id"]
+	if !ok {
+		return nil
+	}
+	reduced := &idRange{equals: make(map[string]interface{})}
+	if !reduced.restrictID(idCondition) {
+		return nil
+	}
+	for field, condition := range selector {
+		if field == "_id" {
+			continue
+		}
+		if strings.HasPrefix(field, "$") {
+			return nil
+		}
+		if operators, ok := condition.(map[string]interface{}); ok {
+			value, ok := operators["$eq"]
+			if !ok || len(operators) != 1 {
+				return nil
+			}
+			condition = value
+		}
+		if !isScalar(condition) {
+			return nil
+		}
+		reduced.equals[field] = condition
+	}
+	return reduced
+}
+
+// restrictID sets the range of the ids to the condition on _id, and returns false if the condition does not
+// reduce to a range
+func (reduced *idRange) restrictID(condition interface{}) bool {
+	if id, ok := condition.(string); ok {
+		condition = map[string]interface{}{"$eq": id}
+	}
+	operators, ok := condition.(map[string]interface{})
+	if !ok || len(operators) == 0 {
+		return false
+	}
+	for operator, operand := range operators {
+		id, ok := operand.(string)
+		if !ok {
+			return false
+		}
+		// the ids following an id are the ids it prefixes, which a 0x00 byte follows, and the greater ids
+		switch operator {
+		case "$eq":
+			reduced.raiseStart(id)
+			reduced.lowerEnd(id + "\x00")
+		case "$gt":
+			reduced.raiseStart(id + "\x00")
+		case "$gte":
+			reduced.raiseStart(id)
+		case "$lt":
+			reduced.lowerEnd(id)
+		case "$lte":
+			reduced.lowerEnd(id + "\x00")
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (reduced *idRange) raiseStart(startID string) {
+	if startID > reduced.startID {
+		reduced.startID = startID
+	}
+}
+
+func (reduced *idRange) lowerEnd(endID string) {
+	if reduced.endID == "" || endID < reduced.endID {
+		reduced.endID = endID
+	}
+}
+
+// isScalar returns true if a value decoded from JSON is a string, a number, a boolean or null
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, json.Number, bool, nil:
+		return true
+	}
+	return false
+}
+
+// matches returns true if the fields of the JSON document have the values of the range. The document of a value
+// stored as an attachment holds the internal fields only, so it matches only a range without field values
+func (reduced *idRange) matches(jsonDoc []byte) bool {
+	fields, err := decodeJSONFields(jsonDoc)
+	if err != nil {
+		return false
+	}
+	for field, expected := range reduced.equals {
+		var value interface{} = fields
+		for _, name := range strings.Split(field, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if value, ok = object[name]; !ok {
+				return false
+			}
+		}
+		if !scalarEquals(value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// scalarEquals returns true if the value decoded from JSON equals the expected scalar, the numbers being compared
+// by value as in Mango
+func scalarEquals(value interface{}, expected interface{}) bool {
+	expectedNumber, ok := expected.(json.Number)
+	if !ok {
+		return value == expected
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return false
+	}
+	if number == expectedNumber {
+		return true
+	}
+	x, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(string(expectedNumber), 64)
+	return err == nil && x == y
+}
+
+// executeRangeQuery runs a query reduced to a range of ids as a scan of the range, in pages, whose documents are
+// filtered by the values of their fields, up to limit results, or all of them if limit is not positive. The
+// results are held in memory. The internal documents are not returned. The documents storing their value as an
+// attachment are read with the stubs of their attachments, not the attachments, and are matched on their JSON
+// part as Mango matches them, so that the iterator reports those matched as NonQueryableRecord
+func (vdb *VersionedDB) executeRangeQuery(idRange *idRange, limit int, parsed bool) (statedb.ResultsIterator, error) {
+	var results []couchdb.QueryResult
+	startID := idRange.startID
+	for {
+		page, err := vdb.db.ReadDocStubRange(startID, idRange.endID, vdb.resultsPageSize)
+		if err != nil {
+			vdb.logger.Debugf("Error calling ReadDocStubRange(): %s\n", err.Error())
+			return nil, err
+		}
+		for _, result := range page {
+			if isInternalDocID(result.ID) || !idRange.matches(result.Value) {
+				continue
+			}
+			results = append(results, result)
+			if limit > 0 && len(results) >= limit {
+				break
+			}
+		}
+		if len(page) < vdb.resultsPageSize || limit > 0 && len(results) >= limit {
+			break
+		}
+		startID = page[len(page)-1].ID + "\x00"
+	}
+	scanner := newQueryScanner(vdb.keys, results)
+	scanner.parsed = parsed
+	return scanner, nil
+}
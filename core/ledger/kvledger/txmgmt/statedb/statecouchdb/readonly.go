@@ -0,0 +1,72 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+)
+
+// ErrNamespaceReadOnly is returned by ApplyUpdates if the batch updates a namespace set read-only
+type ErrNamespaceReadOnly struct {
+	Namespace string
+	Key       string
+}
+
+func (e *ErrNamespaceReadOnly) Error() string {
+	return fmt.Sprintf("Key [%s] of namespace [%s] cannot be updated, the namespace is read-only", e.Key, e.Namespace)
+}
+
+// SetNamespaceReadOnly sets the namespace read-only: the batches applied from then on that update any key of the
+// namespace are rejected with ErrNamespaceReadOnly, as a whole, before any of their updates is written, so that
+// the updates of the other namespaces of the batch are not committed either. The namespace remains readable
+func (vdb *VersionedDB) SetNamespaceReadOnly(namespace string) {
+	vdb.readOnlyMux.Lock()
+	defer vdb.readOnlyMux.Unlock()
+	vdb.readOnlyNamespaces[namespace] = true
+}
+
+// SetNamespaceWritable sets the namespace writable again after SetNamespaceReadOnly
+func (vdb *VersionedDB) SetNamespaceWritable(namespace string) {
+	vdb.readOnlyMux.Lock()
+	defer vdb.readOnlyMux.Unlock()
+	delete(vdb.readOnlyNamespaces, namespace)
+}
+
+// IsNamespaceReadOnly returns true if the namespace is set read-only
+func (vdb *VersionedDB) IsNamespaceReadOnly(namespace string) bool {
+	vdb.readOnlyMux.RLock()
+	defer vdb.readOnlyMux.RUnlock()
+	return vdb.readOnlyNamespaces[namespace]
+}
+
+// checkReadOnlyNamespaces returns ErrNamespaceReadOnly for the first key of the batch in a read-only namespace
+func (vdb *VersionedDB) checkReadOnlyNamespaces(batch *statedb.UpdateBatch) error {
+	vdb.readOnlyMux.RLock()
+	defer vdb.readOnlyMux.RUnlock()
+	if len(vdb.readOnlyNamespaces) == 0 {
+		return nil
+	}
+	for _, ck := range sortedCompositeKeys(batch) {
+		if vdb.readOnlyNamespaces[ck.Namespace] {
+			vdb.logger.Warningf("Rejecting the update of key [%s] of read-only namespace [%s]", ck.Key, ck.Namespace)
+			return &ErrNamespaceReadOnly{Namespace: ck.Namespace, Key: ck.Key}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// ReadSet accumulates the keys read by a transaction and resolves the keys not fetched yet in a single bulk read,
+// rather than a read per key. The keys are added without being fetched, and are all fetched at once by Flush, or
+// by the first Get of a key not fetched yet. A ReadSet is not safe for concurrent use
+type ReadSet struct {
+	vdb     *VersionedDB
+	pending []statedb.CompositeKey
+	added   map[statedb.CompositeKey]bool
+	values  map[statedb.CompositeKey]*statedb.VersionedValue
+}
+
+// NewReadSet returns an empty read set of the database
+func (vdb *VersionedDB) NewReadSet() *ReadSet {
+	return &ReadSet{vdb: vdb,
+		added:  make(map[statedb.CompositeKey]bool),
+		values: make(map[statedb.CompositeKey]*statedb.VersionedValue)}
+}
+
+// Add adds a key to the read set, to be fetched by the next Flush. A key already added is not added again
+func (rs *ReadSet) Add(namespace string, key string) {
+	compositeKey := statedb.CompositeKey{Namespace: namespace, Key: key}
+	if rs.added[compositeKey] {
+		return
+	}
+	rs.added[compositeKey] = true
+	rs.pending = append(rs.pending, compositeKey)
+}
+
+// Get returns the value of a key of the read set, adding the key if it was not added. If the key was not fetched
+// yet, all the keys not fetched yet are fetched first. nil is returned if the key does not exist
+func (rs *ReadSet) Get(namespace string, key string) (*statedb.VersionedValue, error) {
+	rs.Add(namespace, key)
+	compositeKey := statedb.CompositeKey{Namespace: namespace, Key: key}
+	if value, ok := rs.values[compositeKey]; ok {
+		return value, nil
+	}
+	if err := rs.Flush(); err != nil {
+		return nil, err
+	}
+	return rs.values[compositeKey], nil
+}
+
+// Flush fetches the keys of the read set not fetched yet, in a single bulk read. CouchDB 1.x has no bulk read,
+// so the keys are then fetched one by one. The keys are fetched again by the next Flush if the read fails
+func (rs *ReadSet) Flush() error {
+	if len(rs.pending) == 0 {
+		return nil
+	}
+	rs.vdb.beginOperation()
+	defer rs.vdb.endOperation()
+
+	for _, compositeKey := range rs.pending {
+		if err := checkNamespace(compositeKey.Namespace); err != nil {
+			return err
+		}
+	}
+	clustered, err := rs.vdb.db.IsClustered()
+	if err != nil {
+		return err
+	}
+	if !clustered {
+		for _, compositeKey := range rs.pending {
+			value, _, err := rs.vdb.readValue(rs.vdb.keys.compositeKeyID(compositeKey.Namespace, compositeKey.Key), "")
+			if err != nil {
+				return err
+			}
+			rs.values[compositeKey] = value
+		}
+		rs.pending = nil
+		return nil
+	}
+
+	docRequests := make([]couchdb.DocRevRequest, len(rs.pending))
+	for i, compositeKey := range rs.pending {
+		docRequests[i] = couchdb.DocRevRequest{ID: rs.vdb.keys.compositeKeyID(compositeKey.Namespace, compositeKey.Key)}
+	}
+	docResults, err := rs.vdb.db.BulkGet(docRequests)
+	if err != nil {
+		return err
+	}
+	values := make([]*statedb.VersionedValue, len(docResults))
+	for i, docResult := range docResults {
+		if values[i], err = rs.vdb.decodeBulkGetResult(docResult); err != nil {
+			return err
+		}
+	}
+	rs.vdb.logger.Debugf("Fetched %d keys of a read set in a single bulk read", len(rs.pending))
+	for i, compositeKey := range rs.pending {
+		rs.values[compositeKey] = values[i]
+	}
+	rs.pending = nil
+	return nil
+}
+
+// Values returns the values of the keys of the read set fetched so far, keyed by key. The value of a key that does
+// not exist is nil
+func (rs *ReadSet) Values() map[statedb.CompositeKey]*statedb.VersionedValue {
+	values := make(map[statedb.CompositeKey]*statedb.VersionedValue, len(rs.values))
+	for compositeKey, value := range rs.values {
+		values[compositeKey] = value
+	}
+	return values
+}
+
+// decodeBulkGetResult decodes the latest revision of a document read by BulkGet, nil if the document does not
+// exist, is deleted or stores an expired value
+func (vdb *VersionedDB) decodeBulkGetResult(docResult couchdb.DocRevResult) (*statedb.VersionedValue, error) {
+	switch {
+	case docResult.Error == "not_found":
+		return nil, nil
+	case docResult.Error != "":
+		return nil, fmt.Errorf("Error reading document %s: %s %s", docResult.ID, docResult.Error, docResult.Reason)
+	}
+	deleted := &struct {
+		Deleted bool `json:"_deleted"`
+	}{}
+	if err := json.Unmarshal(docResult.JSONDoc, deleted); err == nil && deleted.Deleted {
+		return nil, nil
+	}
+	if expired, err := isExpired(docResult.JSONDoc); err != nil || expired {
+		return nil, err
+	}
+	var attachments []couchdb.Attachment
+	if len(docResult.Attachments) > 0 {
+		attachments = docResult.Attachments
+	}
+	value, ver, err := vdb.decodeDoc(docResult.ID, docResult.JSONDoc, attachments)
+	if err != nil {
+		return nil, err
+	}
+	return &statedb.VersionedValue{Value: value, Version: ver}, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// reconcilePageSize is the number of changes read per request when reconciling the savepoint
+const reconcilePageSize = 1000
+
+// ReconcileSavepoint checks that the recorded savepoint does not lag the data committed, as it may after an unclean
+// shutdown that interrupted a commit after its data was written but before its savepoint was recorded, or while the
+// savepoint was deferred. If the savepoint lags, it is advanced and the correction is logged. The reconciled
+// savepoint is returned.
+//
+// The reconciliation is best-effort: the heights committed are read from the versions of the documents written
+// since the update sequence of the savepoint, as listed by the changes feed. The batches are applied in order, so
+// the blocks below the greatest block written are known to be fully committed, but the greatest block written may
+// be partially written. The savepoint is therefore advanced to the greatest height written below that block only,
+// and the greatest block is left to be replayed, which rewrites the same values. The heights of the documents that
+// were overwritten or deleted since are not known, so the savepoint may still lag once reconciled
+func (vdb *VersionedDB) ReconcileSavepoint() (*version.Height, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := vdb.WaitForCommits(); err != nil {
+		return nil, err
+	}
+	vdb.writeMux.Lock()
+	defer vdb.writeMux.Unlock()
+	vdb.savepointMux.Lock()
+	defer vdb.savepointMux.Unlock()
+	if vdb.pendingSavepoint != nil {
+		if err := vdb.recordPendingSavepoint(); err != nil {
+			return nil, err
+		}
+	}
+
+	savepointDoc, err := vdb.readSavepoint()
+	if err != nil {
+		return nil, err
+	}
+	savepoint := savepointDoc.height()
+	committed, updateSeq, err := vdb.committedHeight(savepointDoc.UpdateSeq)
+	if err != nil {
+		return nil, err
+	}
+	if committed == nil || committed.Compare(savepoint) <= 0 {
+		vdb.logger.Debugf("Savepoint at height %v is up to date with the data committed up to update sequence %s",
+			savepoint, updateSeq)
+		return savepoint, nil
+	}
+
+	vdb.logger.Warningf("Savepoint at height %v lags the data committed up to update sequence %s, advancing it to height %v",
+		savepoint, updateSeq, committed)
+	if err := vdb.recordSavepoint(committed, "", nil); err != nil {
+		vdb.logger.Errorf("Failed to advance the savepoint to height %v: %s", committed, err.Error())
+		return nil, err
+	}
+	if vdb.appliedHeight != nil && committed.Compare(vdb.appliedHeight) > 0 {
+		vdb.appliedHeight = committed
+	}
+	return committed, nil
+}
+
+// committedHeight returns the greatest height written by the documents changed since the update sequence below
+// the greatest block they were written at, along with the update sequence the changes were read up to. The
+// height is nil if none was written below the greatest block
+func (vdb *VersionedDB) committedHeight(since string) (*version.Height, string, error) {
+	var heights []*version.Height
+	for {
+		changes, err := vdb.db.ReadChanges(couchdb.ChangesOptions{Since: since, Limit: reconcilePageSize})
+		if err != nil {
+			return nil, "", err
+		}
+		var requests []couchdb.DocRevRequest
+		for _, change := range changes.Results {
+			if !change.Deleted && !isInternalDocID(change.ID) {
+				requests = append(requests, couchdb.DocRevRequest{ID: change.ID, Rev: change.Rev})
+			}
+		}
+		if len(requests) > 0 {
+			docs, err := vdb.db.BulkGet(requests)
+			if err != nil {
+				return nil, "", err
+			}
+			for _, doc := range docs {
+				if doc.Error != "" || doc.JSONDoc == nil {
+					continue
+				}
+				if _, ver, err := removeVersionField(doc.JSONDoc); err == nil && ver != nil {
+					heights = append(heights, ver)
+				}
+			}
+		}
+		since = changes.LastSeq
+		if len(changes.Results) < reconcilePageSize {
+			break
+		}
+	}
+
+	var greatest, committed *version.Height
+	for _, height := range heights {
+		if greatest == nil || height.BlockNum > greatest.BlockNum {
+			greatest = height
+		}
+	}
+	for _, height := range heights {
+		if height.BlockNum < greatest.BlockNum && (committed == nil || height.Compare(committed) > 0) {
+			committed = height
+		}
+	}
+	return committed, since, nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// HeightedBatch is a batch of updates along with the height it is applied at, as replayed by ReplayBatches
+type HeightedBatch struct {
+	Batch  *statedb.UpdateBatch
+	Height *version.Height
+}
+
+// ErrReplayFailed is returned by ReplayBatches for the first batch that failed to be applied. The batches
+// before it are applied and the savepoint is at the height of the last of them. As for a batch that ApplyUpdates
+// fails to apply, the failed batch may be partially written, and is to be replayed again. None of the batches
+// after it are applied
+type ErrReplayFailed struct {
+	Index  int
+	Height *version.Height
+	Err    error
+}
+
+func (e *ErrReplayFailed) Error() string {
+	return fmt.Sprintf("Failed to replay batch %d at height %v: %s", e.Index, e.Height, e.Err.Error())
+}
+
+// ReplayBatches applies the batches in order, as ApplyUpdates would apply them one after the other, for the
+// reconstruction of the state database from the blocks. It is optimized for throughput: the documents of each
+// batch are written in a single bulk write, on top of the revisions written by the batches before it, and the
+// savepoint is recorded once, at the height of the last batch, rather than after each batch. The heights of the
+// batches must be increasing, and the batches below the recorded savepoint are skipped. The replay stops at the
+// first batch that fails to be applied, and returns ErrReplayFailed for it
+func (vdb *VersionedDB) ReplayBatches(batches []HeightedBatch) error {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := vdb.checkPaused(); err != nil {
+		return err
+	}
+	if err := vdb.WaitForCommits(); err != nil {
+		return err
+	}
+	vdb.writeMux.Lock()
+	defer vdb.writeMux.Unlock()
+
+	// the current revisions of the documents, by id, read or written during the replay. A document known not to
+	// exist has an empty revision
+	revs := make(map[string]string)
+	var replayErr error
+	var lastHeight *version.Height
+	var lastBatch *statedb.UpdateBatch
+	wrote := false
+	for i, heighted := range batches {
+		if i > 0 && heighted.Height.Compare(batches[i-1].Height) <= 0 {
+			replayErr = &ErrReplayFailed{i, heighted.Height,
+				fmt.Errorf("height is not above the height %v of the batch before it", batches[i-1].Height)}
+			break
+		}
+		replayed, err := vdb.isReplayed(heighted.Height)
+		if err != nil {
+			replayErr = &ErrReplayFailed{i, heighted.Height, err}
+			break
+		}
+		if replayed {
+			vdb.logger.Debugf("Batch at height %v is below the recorded savepoint at height %v, skipping", heighted.Height, vdb.recoveredHeight)
+			continue
+		}
+		if err := vdb.replayBatch(heighted.Batch, revs); err != nil {
+			vdb.logger.Errorf("Failed to replay batch at height %v: %s", heighted.Height, err.Error())
+			replayErr = &ErrReplayFailed{i, heighted.Height, err}
+			break
+		}
+		lastHeight = heighted.Height
+		lastBatch = heighted.Batch
+		wrote = wrote || len(heighted.Batch.KVs) > 0
+	}
+	if lastHeight == nil {
+		return replayErr
+	}
+	stateHash, err := vdb.hashState(lastBatch)
+	if err != nil {
+		return err
+	}
+
+	// the savepoint of the batches replayed, written once for all of them
+	vdb.savepointMux.Lock()
+	defer vdb.savepointMux.Unlock()
+	vdb.pendingWrites = vdb.pendingWrites || wrote
+	if vdb.appliedHeight == nil || lastHeight.Compare(vdb.appliedHeight) > 0 {
+		vdb.appliedHeight = lastHeight
+		vdb.pendingSavepoint = lastHeight
+		vdb.pendingToken = ""
+		vdb.pendingStateHash = stateHash
+	}
+	if vdb.pendingSavepoint == nil {
+		return replayErr
+	}
+	if err := vdb.recordPendingSavepoint(); err != nil {
+		if replayErr != nil {
+			vdb.logger.Errorf("Failed to record the savepoint of the batches replayed: %s", err.Error())
+			return replayErr
+		}
+		return err
+	}
+	vdb.logger.Debugf("Replayed %d batches up to height %v", len(batches), lastHeight)
+	return replayErr
+}
+
+// replayBatch writes the documents of the batch in a single bulk write. The revisions of the documents not
+// already in revs are read first, in a single request, and revs is updated with the revisions written. The deletes
+// are written as deleted revisions, and the deletes of the keys that have no document are not written
+func (vdb *VersionedDB) replayBatch(batch *statedb.UpdateBatch, revs map[string]string) error {
+	if err := vdb.validateKeys(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkReadOnlyNamespaces(batch); err != nil {
+		return err
+	}
+	if err := vdb.validateSchemas(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkQuotas(batch); err != nil {
+		return err
+	}
+
+	var docs []couchdb.DocRevResult
+	var unknownIDs []string
+	for _, ck := range sortedCompositeKeys(batch) {
+		id := vdb.keys.compositeKeyID(ck.Namespace, ck.Key)
+		valueBatch := batch
+		// the merge patches are merged with the values written by the batches before them, which are already saved
+		if batch.Merges[ck] {
+			mergedBatch, rev, err := vdb.resolveMerge(ck, batch)
+			if err != nil {
+				return err
+			}
+			valueBatch = mergedBatch
+			revs[id] = rev
+		}
+		// a delete is written once the revision of the document is known, and not at all if it has no document
+		if valueBatch.KVs[ck].Value == nil {
+			if _, ok := revs[id]; !ok {
+				unknownIDs = append(unknownIDs, id)
+			}
+			docs = append(docs, couchdb.DocRevResult{ID: id})
+			continue
+		}
+		jsonDoc, attachments, skip, err := vdb.encodeValueDoc(ck, valueBatch)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		if _, ok := revs[id]; !ok {
+			unknownIDs = append(unknownIDs, id)
+		}
+		docs = append(docs, couchdb.DocRevResult{ID: id, JSONDoc: jsonDoc, Attachments: attachments})
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	attempted := false
+	return vdb.retryIfDatabaseMissing(func() error {
+		// a missing database is recreated empty, so the revisions known before the retry are gone
+		if attempted {
+			for id := range revs {
+				revs[id] = ""
+			}
+		}
+		attempted = true
+		if len(unknownIDs) > 0 {
+			currentRevs, err := vdb.db.ReadDocRevisions(unknownIDs)
+			if err != nil {
+				return err
+			}
+			for _, id := range unknownIDs {
+				revs[id] = currentRevs[id]
+			}
+		}
+		var writes []couchdb.DocRevResult
+		deletes := make(map[string]bool)
+		for _, doc := range docs {
+			doc.Rev = revs[doc.ID]
+			if doc.JSONDoc == nil {
+				if doc.Rev == "" {
+					continue
+				}
+				doc.JSONDoc = []byte(`{"_deleted":true}`)
+				deletes[doc.ID] = true
+			}
+			writes = append(writes, doc)
+		}
+		if len(writes) == 0 {
+			return nil
+		}
+		savedRevs, err := vdb.db.BulkSaveDocs(writes)
+		if err != nil {
+			return err
+		}
+		for i, doc := range writes {
+			revs[doc.ID] = savedRevs[i]
+			// a deleted document is written again as a new document
+			if deletes[doc.ID] {
+				revs[doc.ID] = ""
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,131 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/core/ledger/util/db"
+)
+
+// getSavepointMirrorPath returns the path of the local LevelDB the savepoints of the state databases are mirrored to
+func getSavepointMirrorPath() string {
+	return filepath.Join(ledgerconfig.GetRootPath(), "couchdbSavepointMirror")
+}
+
+// savepointMirror is a local LevelDB holding a copy of the savepoint of each state database, keyed by database
+// name, along with the revision of the savepoint document the copy was taken from. The revision of the savepoint
+// document changes whenever the savepoint does, so a copy at the current revision is the savepoint recorded in
+// CouchDB, which is read without reading the savepoint document. CouchDB remains authoritative: a copy at another
+// revision is discarded for the savepoint read from CouchDB
+type savepointMirror struct {
+	db *db.DB
+}
+
+// mirroredSavepoint is the copy of a savepoint held by the savepoint mirror
+type mirroredSavepoint struct {
+	couchSavepointData
+	Rev string `json:"Rev"`
+}
+
+// newSavepointMirror opens the savepoint mirror at the given path, creating it if missing
+func newSavepointMirror(dbPath string) *savepointMirror {
+	mirrorDB := db.CreateDB(&db.Conf{DBPath: dbPath})
+	mirrorDB.Open()
+	logger.Debugf("Opened savepoint mirror dbPath=%s", dbPath)
+	return &savepointMirror{mirrorDB}
+}
+
+// get returns the copy of the savepoint of the named database, nil if there is none
+func (mirror *savepointMirror) get(dbName string) (*mirroredSavepoint, error) {
+	mirroredJSON, err := mirror.db.Get([]byte(dbName))
+	if err != nil || mirroredJSON == nil {
+		return nil, err
+	}
+	mirrored := &mirroredSavepoint{}
+	if err := json.Unmarshal(mirroredJSON, mirrored); err != nil {
+		return nil, err
+	}
+	mirrored.recorded = true
+	return mirrored, nil
+}
+
+// put records the copy of the savepoint of the named database, read or written at the given revision of the
+// savepoint document
+func (mirror *savepointMirror) put(dbName string, savepointDoc *couchSavepointData, rev string) error {
+	mirroredJSON, err := json.Marshal(&mirroredSavepoint{*savepointDoc, rev})
+	if err != nil {
+		return err
+	}
+	return mirror.db.Put([]byte(dbName), mirroredJSON, true)
+}
+
+// delete removes the copy of the savepoint of the named database
+func (mirror *savepointMirror) delete(dbName string) error {
+	return mirror.db.Delete([]byte(dbName), true)
+}
+
+func (mirror *savepointMirror) close() {
+	mirror.db.Close()
+}
+
+// readMirroredSavepoint returns the copy of the savepoint held by the savepoint mirror if it is at the revision
+// of the savepoint document in CouchDB, which is read without the document. false is returned if the savepoint
+// is to be read from CouchDB: the mirror has no copy, the copy is at another revision, or the revision cannot
+// be read
+func (vdb *VersionedDB) readMirroredSavepoint() (*couchSavepointData, bool) {
+	mirrored, err := vdb.savepointMirror.get(vdb.dbName)
+	if err != nil {
+		vdb.logger.Warningf("Failed to read the mirrored savepoint: %s", err.Error())
+		return nil, false
+	}
+	if mirrored == nil {
+		return nil, false
+	}
+	rev, err := vdb.db.ReadDocRev(savepointDocID, vdb.savepointReadQuorum)
+	if err != nil {
+		vdb.logger.Warningf("Failed to read the revision of the savepoint: %s", err.Error())
+		return nil, false
+	}
+	if rev != mirrored.Rev {
+		vdb.logger.Warningf("Mirrored savepoint at height %v of revision [%s] disagrees with the savepoint of revision [%s], "+
+			"reading the savepoint from CouchDB", mirrored.height(), mirrored.Rev, rev)
+		return nil, false
+	}
+	vdb.logger.Debugf("Read the mirrored savepoint at height %v", mirrored.height())
+	return &mirrored.couchSavepointData, true
+}
+
+// mirrorSavepoint records the savepoint read from or written to CouchDB at the given revision in the savepoint
+// mirror. The mirror is a cache of CouchDB, so a failure is logged and the copy is discarded
+func (vdb *VersionedDB) mirrorSavepoint(savepointDoc *couchSavepointData, rev string) {
+	var err error
+	if savepointDoc.recorded || rev != "" {
+		err = vdb.savepointMirror.put(vdb.dbName, savepointDoc, rev)
+	} else {
+		err = vdb.savepointMirror.delete(vdb.dbName)
+	}
+	if err == nil {
+		return
+	}
+	vdb.logger.Warningf("Failed to mirror the savepoint at height %v: %s", savepointDoc.height(), err.Error())
+	if err := vdb.savepointMirror.delete(vdb.dbName); err != nil {
+		vdb.logger.Errorf("Failed to discard the mirrored savepoint: %s", err.Error())
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+)
+
+// defaultScanPageSize is the number of keys read per request by ScanNamespace if the options do not set it
+const defaultScanPageSize = 1000
+
+// defaultScanRetryInterval is the wait before the first retry of a page by ScanNamespace if the options do not set it
+const defaultScanRetryInterval = 100 * time.Millisecond
+
+// ScanOptions configures a scan of a namespace by ScanNamespace
+type ScanOptions struct {
+	// PageSize is the number of keys read per request, defaultScanPageSize if not positive
+	PageSize int
+	// MaxRetries is the number of times the read of a page is retried before the scan fails
+	MaxRetries int
+	// RetryInterval is the wait before the first retry of a page, doubled for each following retry of the page,
+	// defaultScanRetryInterval if not positive
+	RetryInterval time.Duration
+	// Resume resumes the scan after ResumeAfter, the last key checkpointed by an interrupted scan
+	Resume      bool
+	ResumeAfter string
+	// Checkpoint, if set, is called with the last key of each page once fn returned for all the keys of the page.
+	// An error of Checkpoint stops the scan
+	Checkpoint func(key string) error
+}
+
+// ScanNamespace calls fn for each key of the namespace, in the order of the range scans, and stops at the first
+// error of fn, which is returned. The keys are read in pages, and the read of a page that fails, e.g. because
+// CouchDB is temporarily unavailable, is retried with backoff. As a page is read completely before fn is called
+// for its keys, fn is called once per key even when reads are retried. Progress is reported to the Checkpoint
+// of the options after each page, from which an interrupted scan can be resumed
+func (vdb *VersionedDB) ScanNamespace(namespace string, opts ScanOptions, fn func(statedb.VersionedKV) error) error {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return err
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultScanPageSize
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultScanRetryInterval
+	}
+
+	// the pages are read by document id, the next page starting right after the id of the last key read
+	startID := string(constructNamespaceStartKey(namespace))
+	if opts.Resume {
+		startID = vdb.keys.compositeKeyID(namespace, opts.ResumeAfter) + "\x00"
+	}
+	endID := string(constructNamespaceEndKey(namespace))
+	scanned := 0
+	for {
+		kvs, lastID, err := vdb.readScanPage(namespace, startID, endID, opts)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if err := fn(*kv); err != nil {
+				return err
+			}
+		}
+		scanned += len(kvs)
+		if len(kvs) > 0 && opts.Checkpoint != nil {
+			if err := opts.Checkpoint(kvs[len(kvs)-1].Key); err != nil {
+				return err
+			}
+		}
+		if len(kvs) < opts.PageSize {
+			vdb.logger.Debugf("Scanned %d keys of namespace [%s]", scanned, namespace)
+			return nil
+		}
+		startID = lastID + "\x00"
+	}
+}
+
+// readScanPage reads the keys of a page of a namespace scan, starting at the given document id, along with the
+// id of the last document read. A failed read is retried as configured by the options
+func (vdb *VersionedDB) readScanPage(namespace string, startID string, endID string, opts ScanOptions) ([]*statedb.VersionedKV, string, error) {
+	retryInterval := opts.RetryInterval
+	for retries := 0; ; retries++ {
+		kvs, lastID, err := vdb.readScanPageOnce(namespace, startID, endID, opts.PageSize)
+		if err == nil {
+			return kvs, lastID, nil
+		}
+		if retries >= opts.MaxRetries {
+			vdb.logger.Errorf("Scan of namespace [%s] failed after %d retries: %s", namespace, retries, err.Error())
+			return nil, "", err
+		}
+		vdb.logger.Warningf("Scan of namespace [%s] failed to read a page, retrying in %s: %s", namespace, retryInterval, err.Error())
+		time.Sleep(retryInterval)
+		retryInterval *= 2
+	}
+}
+
+func (vdb *VersionedDB) readScanPageOnce(namespace string, startID string, endID string, pageSize int) ([]*statedb.VersionedKV, string, error) {
+	queryResult, err := vdb.db.ReadDocRange(startID, endID, pageSize, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(*queryResult) == 0 {
+		return nil, "", nil
+	}
+	scanner := newKVScanner(vdb.db, vdb.keys, namespace, *queryResult)
+	kvs := make([]*statedb.VersionedKV, 0, len(*queryResult))
+	for {
+		result, err := scanner.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if result == nil {
+			return kvs, (*queryResult)[len(*queryResult)-1].ID, nil
+		}
+		kvs = append(kvs, result.(*statedb.VersionedKV))
+	}
+}
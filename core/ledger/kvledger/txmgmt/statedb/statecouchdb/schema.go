@@ -0,0 +1,220 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+// ErrSchemaViolation is returned by ApplyUpdates if a value does not conform to the JSON schema
+// registered for its namespace
+type ErrSchemaViolation struct {
+	Namespace string
+	Key       string
+	Reason    string
+}
+
+func (e *ErrSchemaViolation) Error() string {
+	return fmt.Sprintf("Value of key [%s] in namespace [%s] violates the namespace schema: %s", e.Key, e.Namespace, e.Reason)
+}
+
+// jsonSchema validates JSON values against a JSON Schema. The validation keywords supported are type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems, minimum, maximum, minLength,
+// maxLength and pattern. Other keywords are ignored
+type jsonSchema struct {
+	schema   map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// newJSONSchema parses the schema and compiles the patterns it contains
+func newJSONSchema(schemaBytes []byte) (*jsonSchema, error) {
+	schema := make(map[string]interface{})
+	if err := json.Unmarshal(schemaBytes, &schema); err != nil {
+		return nil, fmt.Errorf("Invalid JSON schema: %s", err.Error())
+	}
+	s := &jsonSchema{schema: schema, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.compilePatterns(schema); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonSchema) compilePatterns(schema map[string]interface{}) error {
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid pattern [%s] in JSON schema: %s", pattern, err.Error())
+		}
+		s.patterns[pattern] = re
+	}
+	subSchemas := []interface{}{schema["items"], schema["additionalProperties"]}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for _, property := range properties {
+			subSchemas = append(subSchemas, property)
+		}
+	}
+	for _, subSchema := range subSchemas {
+		if subSchema, ok := subSchema.(map[string]interface{}); ok {
+			if err := s.compilePatterns(subSchema); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns a message describing the first violation of the schema by the JSON value, or "" if the value conforms
+func (s *jsonSchema) validate(value []byte) string {
+	var decoded interface{}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return "value is not JSON"
+	}
+	return s.validateValue(s.schema, decoded, "$")
+}
+
+func (s *jsonSchema) validateValue(schema map[string]interface{}, value interface{}, path string) string {
+	if types, ok := schema["type"]; ok && !matchesType(types, value) {
+		return fmt.Sprintf("%s is not of type %v", path, types)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprintf("%#v", allowed) == fmt.Sprintf("%#v", value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("%s is not one of %v", path, enum)
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(schema, value, path)
+	case []interface{}:
+		if msg := checkBound(schema, "minItems", "maxItems", float64(len(value)), path+" item count"); msg != "" {
+			return msg
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				if msg := s.validateValue(items, item, fmt.Sprintf("%s[%d]", path, i)); msg != "" {
+					return msg
+				}
+			}
+		}
+	case string:
+		if msg := checkBound(schema, "minLength", "maxLength", float64(utf8.RuneCountInString(value)), path+" length"); msg != "" {
+			return msg
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !s.patterns[pattern].MatchString(value) {
+			return fmt.Sprintf("%s does not match pattern %s", path, pattern)
+		}
+	case float64:
+		return checkBound(schema, "minimum", "maximum", value, path)
+	}
+	return ""
+}
+
+func (s *jsonSchema) validateObject(schema map[string]interface{}, value map[string]interface{}, path string) string {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					return fmt.Sprintf("%s is missing required property %s", path, name)
+				}
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	// properties are validated in order, so that the violation reported is deterministic
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertyPath := path + "." + name
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			if msg := s.validateValue(property, value[name], propertyPath); msg != "" {
+				return msg
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Sprintf("%s is not an allowed property", propertyPath)
+			}
+		case map[string]interface{}:
+			if msg := s.validateValue(additional, value[name], propertyPath); msg != "" {
+				return msg
+			}
+		}
+	}
+	return ""
+}
+
+// matchesType returns true if the value is of the type, or one of the types, given by the type keyword
+func matchesType(types interface{}, value interface{}) bool {
+	typeNames, ok := types.([]interface{})
+	if !ok {
+		typeNames = []interface{}{types}
+	}
+	for _, typeName := range typeNames {
+		switch typeName {
+		case "object":
+			_, ok = value.(map[string]interface{})
+		case "array":
+			_, ok = value.([]interface{})
+		case "string":
+			_, ok = value.(string)
+		case "boolean":
+			_, ok = value.(bool)
+		case "null":
+			ok = value == nil
+		case "number":
+			_, ok = value.(float64)
+		case "integer":
+			var number float64
+			number, ok = value.(float64)
+			ok = ok && number == math.Trunc(number)
+		default:
+			ok = false
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBound returns a message if the number is below the minKeyword or above the maxKeyword bound of the schema
+func checkBound(schema map[string]interface{}, minKeyword string, maxKeyword string, number float64, what string) string {
+	if min, ok := schema[minKeyword].(float64); ok && number < min {
+		return fmt.Sprintf("%s %v is less than %s %v", what, number, minKeyword, min)
+	}
+	if max, ok := schema[maxKeyword].(float64); ok && number > max {
+		return fmt.Sprintf("%s %v is greater than %s %v", what, number, maxKeyword, max)
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// namespaceSizeSampleSize is the least number of documents whose sizes EstimateNamespaceSize reads, the sample
+// holding up to twice as many documents
+const namespaceSizeSampleSize = 100
+
+// EstimateNamespaceSize returns an estimate of the number of bytes the documents of the namespace hold, for
+// capacity planning, as CouchDB reports the sizes of whole databases only. The ids of the documents of the namespace
+// are listed in pages, and a sample of the documents evenly spaced in the key range is read; the estimate is the
+// average size of these documents, their JSON along with their attachments, times the number of documents.
+// The estimate is exact for a namespace of no more documents than the sample, and otherwise its accuracy depends on
+// how much the sizes of the documents vary across the key range. It does not account for what CouchDB stores beyond
+// the latest revisions of the documents, i.e. the revision history, the b-tree nodes and the space not yet
+// compacted, so the namespace usually takes more space on disk than estimated
+func (vdb *VersionedDB) EstimateNamespaceSize(namespace string) (int64, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return 0, err
+	}
+
+	// every stride-th id is sampled, and once the sample holds twice the sample size, every other id of the sample
+	// is dropped and the stride doubled, so that the sample stays evenly spaced without holding all the ids
+	pager := vdb.newNamespaceIDPager(namespace)
+	var sample []string
+	count, stride := 0, 1
+	for {
+		page, err := pager.next()
+		if err != nil {
+			vdb.logger.Debugf("Error calling ReadDocIDRange(): %s\n", err.Error())
+			return 0, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, id := range page {
+			if count%stride == 0 {
+				sample = append(sample, id)
+			}
+			count++
+			if len(sample) == 2*namespaceSizeSampleSize {
+				for i := 0; i < namespaceSizeSampleSize; i++ {
+					sample[i] = sample[2*i]
+				}
+				sample = sample[:namespaceSizeSampleSize]
+				stride *= 2
+			}
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	requests := make([]couchdb.DocRevRequest, len(sample))
+	for i, id := range sample {
+		requests[i] = couchdb.DocRevRequest{ID: id}
+	}
+	results, err := vdb.db.BulkGet(requests)
+	if err != nil {
+		return 0, err
+	}
+	var sampledBytes, sampled int64
+	for _, result := range results {
+		// a document deleted since its id was listed is left out of the sample
+		if result.Error != "" {
+			continue
+		}
+		sampledBytes += int64(len(result.JSONDoc))
+		for _, attachment := range result.Attachments {
+			sampledBytes += int64(len(attachment.AttachmentBytes))
+		}
+		sampled++
+	}
+	if sampled == 0 {
+		return 0, nil
+	}
+	estimate := sampledBytes * int64(count) / sampled
+	vdb.logger.Debugf("Namespace %s holds an estimated %d bytes in %d documents, from a sample of %d documents",
+		namespace, estimate, count, sampled)
+	return estimate, nil
+}
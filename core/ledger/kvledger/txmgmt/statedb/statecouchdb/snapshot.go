@@ -0,0 +1,137 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// ErrSnapshotExpired is returned by the iterator of a snapshot range scan if a revision of the snapshot is no
+// longer available, because the database was compacted since the snapshot was taken
+var ErrSnapshotExpired = errors.New("The snapshot expired, a revision it reads was removed by compaction")
+
+// SnapshotIterator iterates over the keys of a range as they were at the update sequence the snapshot was taken
+// at, whatever is committed during the iteration
+type SnapshotIterator struct {
+	vdb       *VersionedDB
+	namespace string
+	updateSeq string
+	revs      []couchdb.DocRevRequest
+	page      []couchdb.DocRevResult
+	cursor    int
+	// inRange tells the keys of the range apart from the other keys sharing the key part of a hashed bound
+	inRange func(key string) bool
+}
+
+// GetStateRangeScanIteratorAtSnapshot returns an iterator over the keys of the range, like GetStateRangeScanIterator,
+// that yields the values of all the keys as they were when the scan started, so that the scan reflects a single
+// consistent view of the state, e.g. to compute a deterministic hash of the state. The ids and the revisions of
+// all the documents of the range are read upfront in a single request, which pins the update sequence of the
+// database, and the documents are then read in pages at these revisions. The query limit does not apply.
+//
+// CouchDB has no snapshot isolation, so the snapshot relies on the revisions it pins and has these limitations:
+//  - the revisions replaced after the snapshot was taken are only kept until the database is compacted, after
+//    which the iterator fails with ErrSnapshotExpired
+//  - the ids and the revisions of the whole range are held in memory for the duration of the scan
+//  - in a cluster, the shards of the database are read at their own sequence, so the snapshot is only consistent
+//    if no commit completes while the revisions are listed
+func (vdb *VersionedDB) GetStateRangeScanIteratorAtSnapshot(namespace string, startKey string, endKey string) (*SnapshotIterator, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	startID, endID, inRange := vdb.keys.keyRangeIDs(namespace, startKey, endKey)
+	revs, updateSeq, err := vdb.db.ReadDocRevisionRange(startID, endID, 0)
+	if err != nil {
+		vdb.logger.Debugf("Error calling ReadDocRevisionRange(): %s\n", err.Error())
+		return nil, err
+	}
+	vdb.logger.Debugf("Snapshot of %d keys of namespace [%s] taken at update sequence %s", len(revs), namespace, updateSeq)
+	return &SnapshotIterator{vdb: vdb, namespace: namespace, updateSeq: updateSeq, revs: revs, inRange: inRange}, nil
+}
+
+// UpdateSeq returns the update sequence of the database that the snapshot was taken at
+func (itr *SnapshotIterator) UpdateSeq() string {
+	return itr.updateSeq
+}
+
+// Next implements method in ResultsIterator interface
+func (itr *SnapshotIterator) Next() (statedb.QueryResult, error) {
+	for {
+		result, key, err := itr.next()
+		if err != nil || result == nil {
+			return nil, err
+		}
+		if itr.inRange != nil && !itr.inRange(key) {
+			continue
+		}
+		var attachments []couchdb.Attachment
+		if len(result.Attachments) > 0 {
+			attachments = result.Attachments
+		}
+		value, ver, err := itr.vdb.decodeDoc(result.ID, result.JSONDoc, attachments)
+		if err != nil {
+			return nil, err
+		}
+		return &statedb.VersionedKV{
+			CompositeKey:   statedb.CompositeKey{Namespace: itr.namespace, Key: key},
+			VersionedValue: statedb.VersionedValue{Value: value, Version: ver}}, nil
+	}
+}
+
+// next returns the next document of the snapshot read at its revision, along with its key
+func (itr *SnapshotIterator) next() (*couchdb.DocRevResult, string, error) {
+	if itr.cursor >= len(itr.page) {
+		if len(itr.revs) == 0 {
+			return nil, "", nil
+		}
+		pageSize := itr.vdb.resultsPageSize
+		if pageSize > len(itr.revs) {
+			pageSize = len(itr.revs)
+		}
+		page, err := itr.vdb.db.BulkGet(itr.revs[:pageSize])
+		if err != nil {
+			return nil, "", err
+		}
+		itr.revs = itr.revs[pageSize:]
+		itr.page = page
+		itr.cursor = 0
+	}
+
+	result := &itr.page[itr.cursor]
+	itr.cursor++
+	switch {
+	case result.Error == "not_found":
+		return nil, "", ErrSnapshotExpired
+	case result.Error != "":
+		return nil, "", fmt.Errorf("Error reading revision %s of document %s: %s %s", result.Rev, result.ID, result.Error, result.Reason)
+	}
+	_, key := itr.vdb.keys.splitDocID(result.ID, result.JSONDoc)
+	return result, key, nil
+}
+
+// Close implements method in ResultsIterator interface
+func (itr *SnapshotIterator) Close() {
+	itr.revs = nil
+	itr.page = nil
+}
@@ -18,17 +18,27 @@ package statecouchdb
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
 	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
 	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
 	logging "github.com/op/go-logging"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 var logger = logging.MustGetLogger("statecouchdb")
@@ -37,24 +47,124 @@ var compositeKeySep = []byte{0x00}
 var lastKeyIndicator = byte(0x01)
 var savePointKey = []byte{0x00}
 
+// stateDBNamePattern matches the names of state databases, which are named after the ledger ids. Other databases,
+// such as the CouchDB system databases whose names start with an underscore, do not match
+var stateDBNamePattern = regexp.MustCompile(`^[a-z][a-z0-9.-]*$`)
+
+// closeTimeout is the maximum time Close waits for in-flight operations to finish
+var closeTimeout = 30 * time.Second
+
+// compressedContentType marks a valueBytes attachment holding a gzip compressed JSON value
+const compressedContentType = "application/gzip"
+
+// checksumField is the document field holding the checksum of the value
+const checksumField = "~checksum"
+
+// valueAttachmentName is the name of the attachment storing a value that is not stored as JSON. The other
+// attachments of a document are the named attachments stored with the value
+const valueAttachmentName = "valueBytes"
+
+// namespaceField is the reserved field of a JSON document holding the namespace of its value,
+// if the namespace field is enabled
+const namespaceField = "~namespace"
+
+// namespaceIndexDefinition indexes the namespace field, for the queries selecting the values of a namespace
+const namespaceIndexDefinition = `{"index":{"fields":["` + namespaceField + `"]},"name":"by_namespace","ddoc":"fabric_namespace","type":"json"}`
+
+// ErrDBInUse is returned by DeleteDB if handles to the database are still open
+var ErrDBInUse = errors.New("Database has open handles")
+
+// ErrChecksumMismatch is returned by GetState if a value does not match the checksum stored with it
+var ErrChecksumMismatch = errors.New("Value does not match its checksum")
+
+// ErrStale is returned by ApplyUpdatesWithExpectedTokens if a key changed since it was read for update
+var ErrStale = errors.New("State changed since it was read for update")
+
+// ErrInvalidUTF8Key is returned by ApplyUpdates if a key is not valid UTF-8 and the invalid UTF-8 key policy
+// is to reject such keys
+type ErrInvalidUTF8Key struct {
+	Namespace string
+	Key       string
+}
+
+func (e *ErrInvalidUTF8Key) Error() string {
+	return fmt.Sprintf("Key %q in namespace [%s] is not valid UTF-8", e.Key, e.Namespace)
+}
+
+// ErrReservedNamespace is returned by the reads and updates of a namespace starting with an underscore, whose
+// document ids would be reserved by CouchDB, if the reserved namespace policy is to reject such namespaces
+type ErrReservedNamespace struct {
+	Namespace string
+}
+
+func (e *ErrReservedNamespace) Error() string {
+	return fmt.Sprintf("Namespace [%s] starts with an underscore, which is reserved by CouchDB", e.Namespace)
+}
+
+// ErrEmptyNamespace is returned by the reads, scans and updates of the empty namespace. The document ids of its
+// keys would start with the separator, and the keys would not be told apart from the internal documents, such as
+// the savepoint, that SplitCompositeKey returns as keys of the empty namespace
+var ErrEmptyNamespace = errors.New("Namespace is empty")
+
+// ErrPaused is returned by the commits to a paused VersionedDB, if such commits are rejected rather than
+// waiting until the VersionedDB is resumed
+var ErrPaused = errors.New("Commits are paused")
+
+// ErrProviderClosed is returned for the databases requested from a VersionedDBProvider once it is closed
+var ErrProviderClosed = errors.New("VersionedDBProvider is closed")
+
+// ErrRevisionNotFound is returned by GetStateByRevision if the revision does not exist or was removed by compaction
+var ErrRevisionNotFound = errors.New("Revision not found")
+
 // VersionedDBProvider implements interface VersionedDBProvider
 type VersionedDBProvider struct {
 	couchInstance *couchdb.CouchInstance
 	databases     map[string]*VersionedDB
 	mux           sync.Mutex
-	openCounts    uint64
+	closed        bool
+
+	// the local mirror of the savepoints of the databases, if enabled
+	savepointMirror *savepointMirror
 }
 
 // NewVersionedDBProvider instantiates VersionedDBProvider
 func NewVersionedDBProvider() (*VersionedDBProvider, error) {
 	logger.Debugf("constructing CouchDB VersionedDBProvider")
 	couchDBDef := ledgerconfig.GetCouchDBDefinition()
-	couchInstance, err := couchdb.CreateCouchInstance(couchDBDef.URL, couchDBDef.Username, couchDBDef.Password)
+	couchInstance, err := couchdb.CreateCouchInstanceWithLimits(couchDBDef.URL, couchDBDef.Username, couchDBDef.Password,
+		couchdb.ConnectionLimits{MaxIdleConns: couchDBDef.MaxIdleConns, MaxConnsPerHost: couchDBDef.MaxConnsPerHost})
 	if err != nil {
 		return nil, err
 	}
+	return NewVersionedDBProviderWithInstance(couchInstance)
+}
+
+// NewVersionedDBProviderWithInstance instantiates VersionedDBProvider with the given CouchInstance, which may
+// be shared with other providers. Closing the provider closes the instance, for the other providers too
+func NewVersionedDBProviderWithInstance(couchInstance *couchdb.CouchInstance) (*VersionedDBProvider, error) {
+	if couchInstance == nil {
+		return nil, errors.New("CouchInstance is required")
+	}
+	// the version determines whether commits are fenced with _ensure_full_commit, it is detected again on
+	// first use if the server is not reachable yet
+	if serverVersion, err := couchInstance.ServerVersion(); err != nil {
+		logger.Warningf("Failed to detect the CouchDB version: %s", err.Error())
+	} else {
+		logger.Infof("Connected to CouchDB version %s", serverVersion)
+	}
+	// the limits tune the size of the bulk reads, which are otherwise split once rejected as too large
+	if limits, err := couchInstance.GetServerLimits(); err != nil {
+		logger.Warningf("Failed to read the CouchDB server limits: %s", err.Error())
+	} else {
+		logger.Infof("CouchDB server limits: max_document_size=%d, max_http_request_size=%d", limits.MaxDocumentSize,
+			limits.MaxHTTPRequestSize)
+	}
 
-	return &VersionedDBProvider{couchInstance, make(map[string]*VersionedDB), sync.Mutex{}, 0}, nil
+	provider := &VersionedDBProvider{couchInstance: couchInstance, databases: make(map[string]*VersionedDB)}
+	if ledgerconfig.IsCouchDBSavepointMirrorEnabled() {
+		provider.savepointMirror = newSavepointMirror(getSavepointMirrorPath())
+	}
+	return provider, nil
 }
 
 // GetDBHandle gets the handle to a named database
@@ -68,6 +178,9 @@ func (provider *VersionedDBProvider) GetDBHandle(dbName string) (statedb.Version
 	// For now, we'll just lowercase the name within the couch versioned db.
 	dbName = strings.ToLower(dbName)
 
+	if provider.closed {
+		return nil, ErrProviderClosed
+	}
 	vdb := provider.databases[dbName]
 	if vdb == nil {
 		var err error
@@ -75,242 +188,2104 @@ func (provider *VersionedDBProvider) GetDBHandle(dbName string) (statedb.Version
 		if err != nil {
 			return nil, err
 		}
+		if err = vdb.checkKeyEncoding(); err != nil {
+			return nil, err
+		}
+		if err := vdb.loadTTLUse(); err != nil {
+			return nil, err
+		}
+		vdb.savepointMirror = provider.savepointMirror
+		vdb.backfillVersions()
+		provider.databases[dbName] = vdb
+	}
+	return vdb, nil
+}
+
+// GetReadOnlyDBHandle gets a read-only handle to a named database
+func (provider *VersionedDBProvider) GetReadOnlyDBHandle(dbName string) (statedb.VersionedDB, error) {
+	db, err := provider.GetDBHandle(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return statedb.NewReadOnlyVersionedDB(db), nil
+}
+
+// GetSavepoints reads the savepoints of the named databases concurrently and returns them keyed by db name.
+// A database without a recorded savepoint maps to height 0, as does a database that does not exist, which
+// is not created
+func (provider *VersionedDBProvider) GetSavepoints(dbNames []string) (map[string]*version.Height, error) {
+	heights := make([]*version.Height, len(dbNames))
+	errs := make([]error, len(dbNames))
+	var wg sync.WaitGroup
+	for i, dbName := range dbNames {
+		wg.Add(1)
+		go func(i int, dbName string) {
+			defer wg.Done()
+			heights[i], errs[i] = provider.getSavepoint(dbName)
+		}(i, dbName)
+	}
+	wg.Wait()
+
+	savepoints := make(map[string]*version.Height)
+	for i, dbName := range dbNames {
+		if errs[i] != nil {
+			logger.Errorf("Failed to read savepoint for db %s: %s", dbName, errs[i].Error())
+			return nil, errs[i]
+		}
+		savepoints[dbName] = heights[i]
+	}
+	return savepoints, nil
+}
+
+// getSavepoint reads the savepoint of the named database through its handle. A database without a handle is
+// checked for existence first, so that only the handles of existing databases are opened
+func (provider *VersionedDBProvider) getSavepoint(dbName string) (*version.Height, error) {
+	provider.mux.Lock()
+	closed := provider.closed
+	vdb := provider.databases[strings.ToLower(dbName)]
+	provider.mux.Unlock()
+	if closed {
+		return nil, ErrProviderClosed
+	}
+	if vdb == nil {
+		db := couchdb.NewCouchDatabase(*provider.couchInstance, strings.ToLower(dbName))
+		if _, _, err := db.GetDatabaseInfo(); err != nil {
+			if _, ok := err.(*couchdb.ErrDatabaseNotFound); ok {
+				return version.NewHeight(0, 0), nil
+			}
+			return nil, err
+		}
+	}
+	handle, err := provider.GetDBHandle(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return handle.GetLatestSavePoint()
+}
+
+// OpenDBs gets and opens the handles to the named databases and reads their savepoints, like GetDBHandle,
+// Open and GetLatestSavePoint do for each database, but for all the databases concurrently. This speeds up the
+// bootstrap of a peer with many channels. The heights and the handles are returned keyed by db name, a database
+// without a recorded savepoint maps to height 0. On error, the handles opened are closed
+func (provider *VersionedDBProvider) OpenDBs(dbNames []string) (map[string]*version.Height, map[string]statedb.VersionedDB, error) {
+	vdbs := make([]*VersionedDB, len(dbNames))
+	heights := make([]*version.Height, len(dbNames))
+	errs := make([]error, len(dbNames))
+	var wg sync.WaitGroup
+	for i, dbName := range dbNames {
+		wg.Add(1)
+		go func(i int, dbName string) {
+			defer wg.Done()
+			vdb, err := provider.getOrCreateDB(dbName)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			vdb.Open()
+			vdbs[i] = vdb
+			heights[i], errs[i] = vdb.GetLatestSavePoint()
+		}(i, dbName)
+	}
+	wg.Wait()
+
+	for i, dbName := range dbNames {
+		if errs[i] != nil {
+			logger.Errorf("Failed to open db %s: %s", dbName, errs[i].Error())
+			for _, vdb := range vdbs {
+				if vdb != nil {
+					vdb.Close()
+				}
+			}
+			return nil, nil, errs[i]
+		}
+	}
+	savepoints := make(map[string]*version.Height)
+	handles := make(map[string]statedb.VersionedDB)
+	for i, dbName := range dbNames {
+		savepoints[dbName] = heights[i]
+		handles[dbName] = vdbs[i]
+	}
+	return savepoints, handles, nil
+}
+
+// getOrCreateDB returns the VersionedDB of the named database like GetDBHandle, without holding the provider
+// lock while the database is created. If the database is created concurrently, the VersionedDB registered
+// first is returned
+func (provider *VersionedDBProvider) getOrCreateDB(dbName string) (*VersionedDB, error) {
+	dbName = strings.ToLower(dbName)
+	provider.mux.Lock()
+	closed := provider.closed
+	vdb := provider.databases[dbName]
+	provider.mux.Unlock()
+	if closed {
+		return nil, ErrProviderClosed
+	}
+	if vdb != nil {
+		return vdb, nil
+	}
+
+	newVDB, err := newVersionedDB(provider.couchInstance, dbName)
+	if err != nil {
+		return nil, err
+	}
+	if err := newVDB.checkKeyEncoding(); err != nil {
+		return nil, err
+	}
+	if err := newVDB.loadTTLUse(); err != nil {
+		return nil, err
+	}
+	newVDB.savepointMirror = provider.savepointMirror
+	newVDB.backfillVersions()
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+	if provider.closed {
+		return nil, ErrProviderClosed
+	}
+	if vdb = provider.databases[dbName]; vdb == nil {
+		vdb = newVDB
 		provider.databases[dbName] = vdb
 	}
 	return vdb, nil
 }
 
-// Close closes the underlying db instance
+// OpenCount returns the number of handles to the named database that are open and not yet closed
+func (provider *VersionedDBProvider) OpenCount(dbName string) uint64 {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+	vdb := provider.databases[strings.ToLower(dbName)]
+	if vdb == nil {
+		return 0
+	}
+	return vdb.getOpenCount()
+}
+
+// SetLogLevel sets the level of the logs of the named database, e.g. of the state database of one channel,
+// see VersionedDB.SetLogLevel
+func (provider *VersionedDBProvider) SetLogLevel(dbName string, level string) error {
+	db, err := provider.GetDBHandle(dbName)
+	if err != nil {
+		return err
+	}
+	return db.(*VersionedDB).SetLogLevel(level)
+}
+
+// DeleteDB drops the named database. ErrDBInUse is returned if any handle to the database is still open.
+// Deleting a database that does not exist is a no-op, so that an interrupted delete can be retried
+func (provider *VersionedDBProvider) DeleteDB(dbName string) error {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+	dbName = strings.ToLower(dbName)
+	if provider.closed {
+		return ErrProviderClosed
+	}
+	db := couchdb.NewCouchDatabase(*provider.couchInstance, dbName)
+	if vdb := provider.databases[dbName]; vdb != nil {
+		if vdb.getOpenCount() > 0 {
+			return ErrDBInUse
+		}
+		vdb.stopWatchdog()
+		vdb.stopSweeper()
+		db = vdb.db
+	}
+	if _, err := db.DropDatabase(); err != nil {
+		if _, ok := err.(*couchdb.ErrDatabaseNotFound); !ok {
+			logger.Errorf("Error dropping database %s: %s", dbName, err.Error())
+			return err
+		}
+		logger.Debugf("Database %s does not exist, nothing to drop", dbName)
+	}
+	if provider.savepointMirror != nil {
+		if err := provider.savepointMirror.delete(dbName); err != nil {
+			logger.Errorf("Failed to discard the mirrored savepoint of database %s: %s", dbName, err.Error())
+		}
+	}
+	delete(provider.databases, dbName)
+	return nil
+}
+
+// GetAllDatabases returns the names of all the state databases in the CouchDB instance, including the
+// databases created by other peers sharing the instance
+func (provider *VersionedDBProvider) GetAllDatabases() ([]string, error) {
+	dbNames, err := provider.couchInstance.GetAllDatabases()
+	if err != nil {
+		return nil, err
+	}
+	stateDBNames := []string{}
+	for _, dbName := range dbNames {
+		if stateDBNamePattern.MatchString(dbName) {
+			stateDBNames = append(stateDBNames, dbName)
+		}
+	}
+	return stateDBNames, nil
+}
+
+// GetServerLimits returns the limits that the CouchDB server imposes on the size of the documents and of the
+// requests, which operators can use to tune the batch sizes. The limits are 0 if they are unknown, e.g. because
+// the configuration of the server is not accessible with the credentials of the peer
+func (provider *VersionedDBProvider) GetServerLimits() (*couchdb.ServerLimits, error) {
+	return provider.couchInstance.GetServerLimits()
+}
+
+// RefreshCredentials updates the credentials used to authenticate to CouchDB, e.g. after they were rotated.
+// The open database handles are kept, and authenticate their subsequent requests with the new credentials
+func (provider *VersionedDBProvider) RefreshCredentials(username, password string) {
+	logger.Infof("Refreshing CouchDB credentials")
+	provider.couchInstance.UpdateCredentials(username, password)
+}
+
+// Close closes the underlying db instance. The savepoints still pending are recorded and the background
+// goroutines of the databases are stopped, then the idle connections to CouchDB are closed. The databases are
+// released: requesting a database from the provider fails with ErrProviderClosed, and the requests of the
+// handles still held fail with couchdb.ErrInstanceClosed
 func (provider *VersionedDBProvider) Close() {
-	// No close needed on Couch
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+	if provider.closed {
+		return
+	}
+	for dbName, vdb := range provider.databases {
+		vdb.stopWatchdog()
+		vdb.stopSweeper()
+		if err := vdb.Flush(); err != nil {
+			logger.Errorf("Failed to record pending savepoint for db %s: %s", dbName, err.Error())
+		}
+	}
+	provider.databases = make(map[string]*VersionedDB)
+	provider.closed = true
+	if provider.savepointMirror != nil {
+		provider.savepointMirror.close()
+	}
+	provider.couchInstance.Close()
 }
 
 // VersionedDB implements VersionedDB interface
 type VersionedDB struct {
-	db     *couchdb.CouchDatabase
-	dbName string
+	db        *couchdb.CouchDatabase
+	dbName    string
+	logger    *dbLogger
+	mux       sync.Mutex
+	openCount uint64
+
+	// the savepoint is recorded every savepointBlockInterval blocks, or once savepointTimeInterval
+	// has passed since it was last recorded. In between, the height is kept as pendingSavepoint
+	savepointMux           sync.Mutex
+	savepointBlockInterval int
+	savepointTimeInterval  time.Duration
+	pendingSavepoint       *version.Height
+	pendingToken           string
+	pendingStateHash       []byte
+	pendingWrites          bool
+	blocksSinceSavepoint   int
+	lastSavepointTime      time.Time
+
+	// the codec converting between the values and the documents storing them
+	codec ValueCodec
+
+	// the compiler of the queries into Mango
+	queryCompiler QueryCompiler
+
+	// the hasher of the batches applied, whose hash is recorded with the savepoint, nil if not enabled
+	stateHasher StateHasher
+
+	// writeMux serializes the writes of the batches, the reads are not serialized. appliedHeight is the
+	// greatest height of the batches applied, which the savepoint does not move back from, and recoveredHeight
+	// the height of the savepoint recorded before the first batch applied, below which the batches are skipped
+	writeMux        sync.Mutex
+	appliedHeight   *version.Height
+	recoveredHeight *version.Height
+
+	// the number of documents of a batch written concurrently
+	writeConcurrency int
+
+	// while paused, writeMux is held so that the commits wait, unless they are rejected with ErrPaused
+	pauseMux          sync.Mutex
+	paused            bool
+	rejectWhilePaused bool
+
+	// if set, the namespace of each JSON value is stored in the namespaceField of its document
+	namespaceField bool
+
+	// how the values that are not JSON are written, "store", "warn" or "skip", and the count of their
+	// writes warned about
+	nonJSONWritePolicy string
+	nonJSONWrites      metrics.Counter
+
+	// if set, a database found missing by a read or an update is recreated before the operation is retried
+	recreateMissingDB bool
+
+	// the number of results of the range scans and the queries, unlimited if 0 or less, and the number of
+	// results read per request by the unlimited ones
+	queryLimit      int
+	resultsPageSize int
+
+	// the duration at or above which the operations are logged as slow, the slow-query log is disabled if 0
+	slowQueryThreshold time.Duration
+
+	// the number of replicas (r) the savepoint is read from, the default of the server if 0
+	savepointReadQuorum int
+
+	// the local mirror of the savepoint, shared by the databases of the provider, nil if not enabled
+	savepointMirror *savepointMirror
+
+	// the cache of the value attachments read, nil if not enabled
+	attachmentCache *attachmentCache
+
+	// if set, GetStateMultipleKeys reads the keys in a single bulk read, see ReadSet
+	bulkReads bool
+
+	// if set, the queries reducible to a range of document ids are run as range scans, see reduceQueryToRange
+	queryRangeFallback bool
+
+	// in async commit mode (asyncCommitQueueSize > 0) ApplyUpdates only queues the batch. A background
+	// worker applies the queued batches in order, and stops applying batches after the first failure
+	commitQueueMux       sync.Mutex
+	commitQueueCond      *sync.Cond
+	commitQueue          []*queuedBatch
+	asyncCommitQueueSize int
+	commitWorkerRunning  bool
+	pendingCommits       sync.WaitGroup
+	commitErr            error
+
+	// in-flight reads and updates, which Close waits for
+	inFlightMux  sync.Mutex
+	inFlightCond *sync.Cond
+	inFlight     int
+
+	// the JSON schemas that the values of a namespace must conform to, keyed by namespace
+	schemaMux sync.RWMutex
+	schemas   map[string]*jsonSchema
+
+	// the namespaces whose updates are rejected, see SetNamespaceReadOnly
+	readOnlyMux        sync.RWMutex
+	readOnlyNamespaces map[string]bool
+
+	// the quotas of the namespaces, and the usage of the namespaces with a quota
+	quotaMux sync.Mutex
+	quotas   map[string]NamespaceQuota
+	usage    map[string]*namespaceUsage
+
+	// the height watchdog of the database, if started
+	watchdogMux sync.Mutex
+	watchdog    *heightWatchdog
+
+	// the encoder of the keys into document ids, as configured when the database is opened
+	keys keyEncoder
+
+	// the expiry sweeper of the database, if started
+	sweeperMux sync.Mutex
+	sweeper    *expirySweeper
+
+	// set once values are written with a TTL in the database, as recorded in the TTL document, see recordTTLUse
+	ttlMux  sync.Mutex
+	ttlUsed bool
+}
+
+// queuedBatch is a batch waiting in the async commit queue
+type queuedBatch struct {
+	batch  *statedb.UpdateBatch
+	height *version.Height
+	token  string
 }
 
 // newVersionedDB constructs an instance of VersionedDB
 func newVersionedDB(couchInstance *couchdb.CouchInstance, dbName string) (*VersionedDB, error) {
 	// CreateCouchDatabase creates a CouchDB database object, as well as the underlying database if it does not exist
-	db, err := couchdb.CreateCouchDatabase(*couchInstance, dbName)
+	db, err := couchdb.CreateCouchDatabaseWithOptions(*couchInstance, dbName, databaseOptions())
 	if err != nil {
 		return nil, err
 	}
-	return &VersionedDB{db, dbName}, nil
+	codec := &defaultValueCodec{compressionThreshold: ledgerconfig.GetCouchDBCompressionThreshold(),
+		checksums: ledgerconfig.IsCouchDBChecksumEnabled()}
+	vdb := &VersionedDB{db: db, dbName: dbName, logger: newDBLogger(dbName),
+		savepointBlockInterval: ledgerconfig.GetCouchDBSavepointBlockInterval(),
+		savepointTimeInterval:  ledgerconfig.GetCouchDBSavepointTimeInterval(),
+		lastSavepointTime:      time.Now(),
+		codec:                  codec,
+		queryCompiler:          mangoQueryCompiler{},
+		namespaceField:         ledgerconfig.IsCouchDBNamespaceFieldEnabled(),
+		nonJSONWritePolicy:     ledgerconfig.GetCouchDBNonJSONWritePolicy(),
+		nonJSONWrites:          metrics.GetOrRegisterCounter(fmt.Sprintf("statedb.%s.nonjson.writes", dbName), metrics.DefaultRegistry),
+		writeConcurrency:       ledgerconfig.GetCouchDBWriteConcurrency(),
+		rejectWhilePaused:      ledgerconfig.IsCouchDBRejectCommitsWhilePausedEnabled(),
+		asyncCommitQueueSize:   ledgerconfig.GetCouchDBAsyncCommitQueueSize(),
+		recreateMissingDB:      ledgerconfig.IsCouchDBRecreateMissingDatabasesEnabled(),
+		queryLimit:             ledgerconfig.GetCouchDBQueryLimit(),
+		resultsPageSize:        defaultResultsPageSize,
+		slowQueryThreshold:     ledgerconfig.GetCouchDBSlowQueryThreshold(),
+		savepointReadQuorum:    savepointReadQuorum(),
+		bulkReads:              ledgerconfig.IsCouchDBBulkReadsEnabled(),
+		queryRangeFallback:     ledgerconfig.IsCouchDBQueryRangeFallbackEnabled(),
+		keys:                   newKeyEncoder(),
+		schemas:                make(map[string]*jsonSchema),
+		readOnlyNamespaces:     make(map[string]bool),
+		quotas:                 make(map[string]NamespaceQuota),
+		usage:                  make(map[string]*namespaceUsage)}
+	vdb.commitQueueCond = sync.NewCond(&vdb.commitQueueMux)
+	vdb.inFlightCond = sync.NewCond(&vdb.inFlightMux)
+	if attachmentCacheSize := ledgerconfig.GetCouchDBAttachmentCacheSize(); attachmentCacheSize > 0 {
+		vdb.attachmentCache = newAttachmentCache(attachmentCacheSize)
+	}
+	if vdb.namespaceField {
+		if _, err := db.CreateIndex(namespaceIndexDefinition); err != nil {
+			return nil, err
+		}
+	}
+	return vdb, nil
+}
+
+// databaseOptions returns the cluster options the state databases are created with
+func databaseOptions() couchdb.DatabaseOptions {
+	return couchdb.DatabaseOptions{
+		Shards:   ledgerconfig.GetCouchDBShards(),
+		Replicas: ledgerconfig.GetCouchDBReplicas()}
+}
+
+// savepointReadQuorum returns the number of replicas the savepoint is read from, a majority of the replicas of
+// the state databases if the quorum savepoint reads are enabled, 0 otherwise
+func savepointReadQuorum() int {
+	if !ledgerconfig.IsCouchDBQuorumSavepointReadsEnabled() {
+		return 0
+	}
+	replicas := ledgerconfig.GetCouchDBReplicas()
+	if replicas <= 0 {
+		replicas = defaultClusterReplicas
+	}
+	return replicas/2 + 1
+}
+
+// retryIfDatabaseMissing runs op and, if op fails with couchdb.ErrDatabaseNotFound because the database was deleted
+// from under the handle and missing databases are recreated, recreates the database empty and runs op once more
+func (vdb *VersionedDB) retryIfDatabaseMissing(op func() error) error {
+	err := op()
+	if _, ok := err.(*couchdb.ErrDatabaseNotFound); !ok || !vdb.recreateMissingDB {
+		return err
+	}
+	vdb.logger.Warningf("Database does not exist, recreating it. The indexes of the database must be recreated")
+	if _, err := vdb.db.CreateDatabaseIfNotExistWithOptions(databaseOptions()); err != nil {
+		return err
+	}
+	if vdb.namespaceField {
+		if _, err := vdb.db.CreateIndex(namespaceIndexDefinition); err != nil {
+			return err
+		}
+	}
+	return op()
 }
 
 // Open implements method in VersionedDB interface
+// A shared couch instance is used, so Open only counts the handle as outstanding
 func (vdb *VersionedDB) Open() error {
-	// no need to open db since a shared couch instance is used
+	vdb.mux.Lock()
+	defer vdb.mux.Unlock()
+	vdb.openCount++
 	return nil
 }
 
 // Close implements method in VersionedDB interface
+// A shared couch instance is used, so Close only releases a handle counted by Open after waiting
+// for in-flight operations, up to closeTimeout, and recording any savepoint that is still pending
 func (vdb *VersionedDB) Close() {
-	// no need to close db since a shared couch instance is used
+	if !vdb.waitForOperations(closeTimeout) {
+		vdb.logger.Warningf("Timed out waiting for in-flight operations on close")
+	}
+	if err := vdb.Flush(); err != nil {
+		vdb.logger.Errorf("Failed to record pending savepoint on close: %s", err.Error())
+	}
+	vdb.mux.Lock()
+	defer vdb.mux.Unlock()
+	if vdb.openCount > 0 {
+		vdb.openCount--
+	}
+}
+
+func (vdb *VersionedDB) getOpenCount() uint64 {
+	vdb.mux.Lock()
+	defer vdb.mux.Unlock()
+	return vdb.openCount
+}
+
+// beginOperation counts an in-flight operation, to be ended by endOperation
+func (vdb *VersionedDB) beginOperation() {
+	vdb.inFlightMux.Lock()
+	defer vdb.inFlightMux.Unlock()
+	vdb.inFlight++
+}
+
+func (vdb *VersionedDB) endOperation() {
+	vdb.inFlightMux.Lock()
+	defer vdb.inFlightMux.Unlock()
+	vdb.inFlight--
+	if vdb.inFlight == 0 {
+		vdb.inFlightCond.Broadcast()
+	}
+}
+
+// logIfSlow logs the operation at WARN if it took at least the slow-query threshold since start. The subject
+// describes what the operation read or wrote, e.g. the namespace and the key
+func (vdb *VersionedDB) logIfSlow(start time.Time, operation string, subject string) {
+	if elapsed := time.Since(start); elapsed >= vdb.slowQueryThreshold {
+		vdb.logger.Warningf("Slow operation %s took %s: %s", operation, elapsed, subject)
+	}
+}
+
+// waitForOperations waits until no operation is in flight. It returns false if the timeout expired first
+func (vdb *VersionedDB) waitForOperations(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		vdb.inFlightMux.Lock()
+		for vdb.inFlight > 0 {
+			vdb.inFlightCond.Wait()
+		}
+		vdb.inFlightMux.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 // GetState implements method in VersionedDB interface
 func (vdb *VersionedDB) GetState(namespace string, key string) (*statedb.VersionedValue, error) {
-	logger.Debugf("GetState(). ns=%s, key=%s", namespace, key)
+	vdb.beginOperation()
+	defer vdb.endOperation()
 
-	compositeKey := constructCompositeKey(namespace, key)
+	if vdb.logger.IsEnabledFor(logging.DEBUG) {
+		vdb.logger.Debugf("GetState(). ns=%s, key=%s", namespace, key)
+	}
+	if vdb.slowQueryThreshold > 0 {
+		defer vdb.logIfSlow(time.Now(), "GetState", fmt.Sprintf("namespace [%s] key [%s]", namespace, key))
+	}
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	id := vdb.keys.compositeKeyID(namespace, key)
 
-	docBytes, _, err := vdb.db.ReadDoc(string(compositeKey))
+	var vv *statedb.VersionedValue
+	err := vdb.retryIfDatabaseMissing(func() error {
+		var err error
+		vv, _, err = vdb.readValue(id, "")
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	if docBytes == nil {
+	if vv == nil {
 		return nil, nil
 	}
 
 	// trace the first 200 bytes of value only, in case it is huge
-	if docBytes != nil && logger.IsEnabledFor(logging.DEBUG) {
-		if len(docBytes) < 200 {
-			logger.Debugf("getCommittedValueAndVersion() Read docBytes %s", docBytes)
+	if vdb.logger.IsEnabledFor(logging.DEBUG) {
+		if len(vv.Value) < 200 {
+			vdb.logger.Debugf("GetState() ns=%s, key=%s, read docBytes %s", namespace, key, vv.Value)
 		} else {
-			logger.Debugf("getCommittedValueAndVersion() Read docBytes %s...", docBytes[0:200])
+			vdb.logger.Debugf("GetState() ns=%s, key=%s, read docBytes %s...", namespace, key, vv.Value[0:200])
 		}
 	}
 
-	ver := version.NewHeight(1, 1) //TODO - version hardcoded to 1 is a temporary value for the prototype
-
-	return &statedb.VersionedValue{Value: docBytes, Version: ver}, nil
+	return vv, nil
 }
 
-// GetStateMultipleKeys implements method in VersionedDB interface
-func (vdb *VersionedDB) GetStateMultipleKeys(namespace string, keys []string) ([]*statedb.VersionedValue, error) {
+// Exists returns whether the key exists, i.e. whether GetState would return a value for it, with a HEAD request
+// for its document rather than a read of the value. A key that does not exist results in false and no error,
+// while a failure to check the key results in an error. As the response to a HEAD request has no body, a
+// database deleted from under the handle is not told from a missing key, and the keys are reported missing.
+// In a database where values are written with a TTL, the document is read instead, with the stubs of its
+// attachments rather than their data, so that a key whose value is expired does not exist
+func (vdb *VersionedDB) Exists(namespace string, key string) (bool, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
 
-	vals := make([]*statedb.VersionedValue, len(keys))
-	for i, key := range keys {
-		val, err := vdb.GetState(namespace, key)
+	vdb.logger.Debugf("Exists(). ns=%s, key=%s", namespace, key)
+
+	if err := checkNamespace(namespace); err != nil {
+		return false, err
+	}
+	if !vdb.isTTLUsed() {
+		rev, err := vdb.db.ReadDocRev(vdb.keys.compositeKeyID(namespace, key), 0)
 		if err != nil {
+			return false, err
+		}
+		return rev != "", nil
+	}
+	jsonDoc, _, _, err := vdb.db.ReadDocStubs(vdb.keys.compositeKeyID(namespace, key))
+	if err != nil {
+		return false, err
+	}
+	if jsonDoc == nil {
+		return false, nil
+	}
+	expired, err := isExpired(jsonDoc)
+	if err != nil {
+		return false, err
+	}
+	return !expired, nil
+}
+
+// ValueKind tells how a value is stored in CouchDB
+type ValueKind int
+
+const (
+	// KindJSON is the kind of a value stored as a JSON document, including a JSON value stored compressed
+	KindJSON ValueKind = iota
+	// KindBinary is the kind of a value stored as a binary attachment
+	KindBinary
+)
+
+// GetStateWithKind gets the value of a key along with the kind of the value, as stored in CouchDB.
+// The kind is undefined if the key does not exist or its value is expired, in which case the returned value is nil
+func (vdb *VersionedDB) GetStateWithKind(namespace string, key string) (*statedb.VersionedValue, ValueKind, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	vdb.logger.Debugf("GetStateWithKind(). ns=%s, key=%s", namespace, key)
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, KindJSON, err
+	}
+	id := vdb.keys.compositeKeyID(namespace, key)
+	jsonDoc, attachments, _, err := vdb.db.ReadDocAttachments(id, "")
+	if err != nil {
+		return nil, KindJSON, err
+	}
+	if jsonDoc == nil && attachments == nil {
+		return nil, KindJSON, nil
+	}
+	if expired, err := isExpired(jsonDoc); err != nil || expired {
+		return nil, KindJSON, err
+	}
+	value, ver, err := vdb.decodeDoc(id, jsonDoc, attachments)
+	if err != nil {
+		return nil, KindJSON, err
+	}
+	return &statedb.VersionedValue{Value: value, Version: ver}, valueKind(attachments), nil
+}
+
+// valueKind returns the kind of a value stored with the given attachments
+func valueKind(attachments []couchdb.Attachment) ValueKind {
+	for _, attachment := range attachments {
+		if attachment.Name == valueAttachmentName && attachment.ContentType != compressedContentType {
+			return KindBinary
+		}
+	}
+	return KindJSON
+}
+
+// GetStateByRevision gets the value of the given revision of a key, which may be an older revision
+// kept by CouchDB until the database is compacted. ErrRevisionNotFound is returned if the revision does not exist
+func (vdb *VersionedDB) GetStateByRevision(namespace string, key string, rev string) (*statedb.VersionedValue, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	vdb.logger.Debugf("GetStateByRevision(). ns=%s, key=%s, rev=%s", namespace, key, rev)
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	id := vdb.keys.compositeKeyID(namespace, key)
+
+	vv, _, err := vdb.readValue(id, rev)
+	if err != nil {
+		return nil, err
+	}
+	if vv == nil {
+		return nil, ErrRevisionNotFound
+	}
+	return vv, nil
+}
+
+// KeyRevision identifies a revision of a key, as read by GetStateByRevisions. An empty Rev identifies the latest revision
+type KeyRevision struct {
+	Namespace string
+	Key       string
+	Rev       string
+}
+
+// KeyRevisionResult is the value of a revision of a key read by GetStateByRevisions, or the error reading it.
+// Err is ErrRevisionNotFound if the revision does not exist or was removed by compaction
+type KeyRevisionResult struct {
+	KeyRevision
+	VersionedValue *statedb.VersionedValue
+	Err            error
+}
+
+// GetStateByRevisions gets the values of the given revisions of keys, like GetStateByRevision does for a single
+// revision, in a single call to CouchDB. The results are returned in the order of the requests. The failure to read
+// a revision is reported in its result, with the revision read in Rev. The revision of an expired value is not found
+func (vdb *VersionedDB) GetStateByRevisions(requests []KeyRevision) ([]*KeyRevisionResult, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	docRequests := make([]couchdb.DocRevRequest, len(requests))
+	for i, request := range requests {
+		if err := checkNamespace(request.Namespace); err != nil {
 			return nil, err
 		}
-		vals[i] = val
+		docRequests[i] = couchdb.DocRevRequest{ID: vdb.keys.compositeKeyID(request.Namespace, request.Key), Rev: request.Rev}
 	}
-	return vals, nil
+	docResults, err := vdb.db.BulkGet(docRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*KeyRevisionResult, len(requests))
+	for i, docResult := range docResults {
+		result := &KeyRevisionResult{KeyRevision: requests[i]}
+		result.Rev = docResult.Rev
+		expired, err := isExpired(docResult.JSONDoc)
+		switch {
+		case docResult.Error == "not_found":
+			result.Err = ErrRevisionNotFound
+		case docResult.Error != "":
+			result.Err = fmt.Errorf("Error reading revision %s of key %s: %s %s", requests[i].Rev, requests[i].Key, docResult.Error, docResult.Reason)
+		case err != nil:
+			result.Err = err
+		case expired:
+			// an expired value is absent, as for GetStateByRevision
+			result.Err = ErrRevisionNotFound
+		default:
+			var attachments []couchdb.Attachment
+			if len(docResult.Attachments) > 0 {
+				attachments = docResult.Attachments
+			}
+			value, ver, err := vdb.decodeDoc(docResult.ID, docResult.JSONDoc, attachments)
+			if err != nil {
+				result.Err = err
+			} else {
+				result.VersionedValue = &statedb.VersionedValue{Value: value, Version: ver}
+			}
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// GetStateForUpdate gets the value of a key like GetState, along with an opaque token identifying the
+// current revision of the key, or "" if the key does not exist. Passing the token to
+// ApplyUpdatesWithExpectedTokens makes the update fail with ErrStale if the key changed meanwhile
+func (vdb *VersionedDB) GetStateForUpdate(namespace string, key string) (*statedb.VersionedValue, string, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	vdb.logger.Debugf("GetStateForUpdate(). ns=%s, key=%s", namespace, key)
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, "", err
+	}
+	id := vdb.keys.compositeKeyID(namespace, key)
 
+	vv, rev, err := vdb.readValue(id, "")
+	if err != nil {
+		return nil, "", err
+	}
+	return vv, rev, nil
+}
+
+// readValue reads the versioned value stored in the given revision of a document, or in the latest revision
+// if rev is empty, along with the revision read. nil is returned if the document does not exist, or if its
+// value is expired. With the attachment cache, the latest revision is read through the cache
+func (vdb *VersionedDB) readValue(id string, rev string) (*statedb.VersionedValue, string, error) {
+	if vdb.attachmentCache != nil && rev == "" {
+		return vdb.readValueCached(id)
+	}
+	return vdb.readDocValue(id, rev)
+}
+
+// readDocValue reads the versioned value stored in a revision of a document like readValue, reading the document
+// along with all of its attachments
+func (vdb *VersionedDB) readDocValue(id string, rev string) (*statedb.VersionedValue, string, error) {
+	jsonDoc, attachments, revision, err := vdb.db.ReadDocAttachments(id, rev)
+	if err != nil {
+		return nil, "", err
+	}
+	if jsonDoc == nil && attachments == nil {
+		return nil, "", nil
+	}
+	if expired, err := isExpired(jsonDoc); err != nil || expired {
+		return nil, "", err
+	}
+	value, ver, err := vdb.decodeDoc(id, jsonDoc, attachments)
+	if err != nil {
+		return nil, "", err
+	}
+	return &statedb.VersionedValue{Value: value, Version: ver}, revision, nil
+}
+
+// decodeDoc decodes the versioned value stored in a document with the codec, once the namespace, key, vector
+// clock and expiry fields are removed from the document. The named attachments of the document are not
+// passed to the codec
+func (vdb *VersionedDB) decodeDoc(id string, jsonDoc []byte, attachments []couchdb.Attachment) ([]byte, *version.Height, error) {
+	jsonDoc, err := removeNamespaceField(jsonDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if jsonDoc, err = removeField(jsonDoc, keyField); err != nil {
+		return nil, nil, err
+	}
+	if jsonDoc, _, err = removeVectorClockField(jsonDoc); err != nil {
+		return nil, nil, err
+	}
+	if jsonDoc, _, err = removeExpiryField(jsonDoc); err != nil {
+		return nil, nil, err
+	}
+	var valueAttachments []couchdb.Attachment
+	for _, attachment := range attachments {
+		if attachment.Name == valueAttachmentName {
+			valueAttachments = append(valueAttachments, attachment)
+		}
+	}
+	// the attachments of a JSON value are listed in its document, and are not part of the value
+	if valueAttachments == nil && len(attachments) > 0 {
+		if jsonDoc, err = removeField(jsonDoc, "_attachments"); err != nil {
+			return nil, nil, err
+		}
+	}
+	return vdb.codec.Decode(id, jsonDoc, valueAttachments)
+}
+
+// GetStateWithVectorClock gets the value of a key like GetState, along with the vector clock stored with
+// the value by UpdateBatch.PutWithVectorClock. The vector clock is nil for the values versioned by their
+// height only. Comparing the vector clocks of two values, e.g. with VectorClock.ConcurrentWith, detects
+// the values written concurrently by several writers
+func (vdb *VersionedDB) GetStateWithVectorClock(namespace string, key string) (*statedb.VersionedValue, statedb.VectorClock, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	vdb.logger.Debugf("GetStateWithVectorClock(). ns=%s, key=%s", namespace, key)
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, nil, err
+	}
+	id := vdb.keys.compositeKeyID(namespace, key)
+	jsonDoc, attachments, _, err := vdb.db.ReadDocAttachments(id, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if jsonDoc == nil && attachments == nil {
+		return nil, nil, nil
+	}
+	if expired, err := isExpired(jsonDoc); err != nil || expired {
+		return nil, nil, err
+	}
+	_, clock, err := removeVectorClockField(jsonDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, ver, err := vdb.decodeDoc(id, jsonDoc, attachments)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &statedb.VersionedValue{Value: value, Version: ver}, clock, nil
+}
+
+// GetStateAttachments gets the named attachments stored with the value of a key, by name. nil is returned
+// if the key does not exist or its value is expired
+func (vdb *VersionedDB) GetStateAttachments(namespace string, key string) (map[string][]byte, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	vdb.logger.Debugf("GetStateAttachments(). ns=%s, key=%s", namespace, key)
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	jsonDoc, attachments, _, err := vdb.db.ReadDocAttachments(vdb.keys.compositeKeyID(namespace, key), "")
+	if err != nil {
+		return nil, err
+	}
+	if jsonDoc == nil && attachments == nil {
+		return nil, nil
+	}
+	if expired, err := isExpired(jsonDoc); err != nil || expired {
+		return nil, err
+	}
+	namedAttachments := make(map[string][]byte)
+	for _, attachment := range attachments {
+		if attachment.Name != valueAttachmentName {
+			namedAttachments[attachment.Name] = attachment.AttachmentBytes
+		}
+	}
+	return namedAttachments, nil
+}
+
+// addNamedAttachments returns the attachments storing a value with the named attachments added, in order of name
+func addNamedAttachments(attachments []couchdb.Attachment, namedAttachments map[string][]byte) ([]couchdb.Attachment, error) {
+	names := make([]string, 0, len(namedAttachments))
+	for name := range namedAttachments {
+		if name == valueAttachmentName {
+			return nil, fmt.Errorf("Attachment name %s is reserved", valueAttachmentName)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attachments = append(attachments, couchdb.Attachment{Name: name, ContentType: "application/octet-stream",
+			AttachmentBytes: namedAttachments[name]})
+	}
+	return attachments, nil
+}
+
+// GetStateMultipleKeys implements method in VersionedDB interface. A key passed several times is read
+// once, and its positions share the value read. If bulk reads are enabled, the keys are read in a single bulk
+// read, see ReadSet
+func (vdb *VersionedDB) GetStateMultipleKeys(namespace string, keys []string) ([]*statedb.VersionedValue, error) {
+
+	vals := make([]*statedb.VersionedValue, len(keys))
+	if vdb.bulkReads {
+		readSet := vdb.NewReadSet()
+		for _, key := range keys {
+			readSet.Add(namespace, key)
+		}
+		if err := readSet.Flush(); err != nil {
+			return nil, err
+		}
+		values := readSet.Values()
+		for i, key := range keys {
+			vals[i] = values[statedb.CompositeKey{Namespace: namespace, Key: key}]
+		}
+		return vals, nil
+	}
+	read := make(map[string]*statedb.VersionedValue, len(keys))
+	for i, key := range keys {
+		val, ok := read[key]
+		if !ok {
+			var err error
+			if val, err = vdb.GetState(namespace, key); err != nil {
+				return nil, err
+			}
+			read[key] = val
+		}
+		vals[i] = val
+	}
+	return vals, nil
+
+}
+
+// GetStateRangeScanIterator implements method in VersionedDB interface
+// startKey is inclusive
+// endKey is exclusive
+// The number of results is limited by the configured query limit, see GetStateRangeScanIteratorWithLimit
+func (vdb *VersionedDB) GetStateRangeScanIterator(namespace string, startKey string, endKey string) (statedb.ResultsIterator, error) {
+	return vdb.getStateRangeScanIterator(namespace, startKey, endKey, vdb.queryLimit, false, nil)
+}
+
+// GetStateRangeScanIteratorWithLimit is like GetStateRangeScanIterator, but the iterator yields up to limit results,
+// or all the results of the range if the limit is Unlimited
+func (vdb *VersionedDB) GetStateRangeScanIteratorWithLimit(namespace string, startKey string, endKey string, limit int) (statedb.ResultsIterator, error) {
+	return vdb.getStateRangeScanIterator(namespace, startKey, endKey, limit, false, nil)
+}
+
+// GetStateRangeScanIteratorPartial is like GetStateRangeScanIterator, but the failure to read a document of the
+// range does not fail the scan. The iterator yields the results read before the failure, which is then reported
+// by its Err method, see PartialScanner. A failure to read the range itself still fails the scan
+func (vdb *VersionedDB) GetStateRangeScanIteratorPartial(namespace string, startKey string, endKey string) (statedb.ResultsIterator, error) {
+	return vdb.getStateRangeScanIterator(namespace, startKey, endKey, vdb.queryLimit, true, nil)
+}
+
+func (vdb *VersionedDB) getStateRangeScanIterator(namespace string, startKey string, endKey string, limit int, partial bool,
+	filter func(key string, value []byte) bool) (statedb.ResultsIterator, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+	if vdb.slowQueryThreshold > 0 {
+		defer vdb.logIfSlow(time.Now(), "GetStateRangeScanIterator",
+			fmt.Sprintf("namespace [%s] range [%s, %s)", namespace, startKey, endKey))
+	}
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	startID, endID, inRange := vdb.keys.keyRangeIDs(namespace, startKey, endKey)
+	if inRange != nil {
+		filter = withKeyRange(filter, inRange)
+	}
+	if limit <= 0 {
+		return vdb.newPagedRangeScanner(namespace, startID, endID, partial, filter)
+	}
+	queryResult, err := vdb.db.ReadDocRangePartial(startID, endID, limit, 0)
+	if err != nil && (!partial || queryResult == nil) {
+		vdb.logger.Debugf("Error calling ReadDocRange(): %s\n", err.Error())
+		return nil, err
+	}
+	scanner := newKVScanner(vdb.db, vdb.keys, namespace, *queryResult)
+	scanner.filter = filter
+	if err != nil {
+		vdb.logger.Warningf("Range scan of namespace [%s] returns %d results before failing: %s", namespace,
+			len(*queryResult), err.Error())
+		scanner.err = err
+	}
+	vdb.logger.Debugf("Exiting GetStateRangeScanIterator")
+	return scanner, nil
+
+}
+
+// PartialScanner is implemented by the iterators returned by the range scans. Err returns the failure that ended
+// a scan returning partial results, which is only reported once the results read before it are yielded, or nil
+type PartialScanner interface {
+	Err() error
+}
+
+// GetStateRangeScanIteratorWithFilter is like GetStateRangeScanIterator, but the iterator only yields the
+// results for which filter returns true. The results not passing the filter are still read from CouchDB
+func (vdb *VersionedDB) GetStateRangeScanIteratorWithFilter(namespace string, startKey string, endKey string,
+	filter func(key string, value []byte) bool) (statedb.ResultsIterator, error) {
+
+	return vdb.getStateRangeScanIterator(namespace, startKey, endKey, vdb.queryLimit, false, filter)
+
+}
+
+// GetStateRangeScanIteratorStreaming is like GetStateRangeScanIterator, but the results are decoded from the
+// CouchDB response as the iterator is advanced instead of being read in memory upfront, and the results are not
+// limited in number. The iterator holds the response open until it is closed, so Close must be called
+func (vdb *VersionedDB) GetStateRangeScanIteratorStreaming(namespace string, startKey string, endKey string) (statedb.ResultsIterator, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	startID, endID, inRange := vdb.keys.keyRangeIDs(namespace, startKey, endKey)
+	stream, err := vdb.db.StreamDocRange(startID, endID, 0, 0)
+	if err != nil {
+		vdb.logger.Debugf("Error calling StreamDocRange(): %s\n", err.Error())
+		return nil, err
+	}
+	return &kvStreamScanner{namespace, stream, vdb.db, vdb.keys, inRange}, nil
+}
+
+// GetKeys returns an iterator over all the keys of the namespace, of type *statedb.CompositeKey.
+// Only the document ids are retrieved, the values are not read. The ids are read in pages as the keys are
+// iterated, so that they are never all held in memory
+func (vdb *VersionedDB) GetKeys(namespace string) (statedb.ResultsIterator, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	scanner, err := newKeyScanner(vdb.db, vdb.keys, namespace, vdb.newNamespaceIDPager(namespace))
+	if err != nil {
+		vdb.logger.Debugf("Error calling ReadDocIDRange(): %s\n", err.Error())
+		return nil, err
+	}
+	vdb.logger.Debugf("Exiting GetKeys")
+	return scanner, nil
+
+}
+
+// ExecuteQuery implements method in VersionedDB interface
+// The number of results is limited by the configured query limit, see ExecuteQueryWithLimit
+func (vdb *VersionedDB) ExecuteQuery(query string) (statedb.ResultsIterator, error) {
+	return vdb.ExecuteQueryWithLimit(query, vdb.queryLimit)
+}
+
+// ExecuteQueryWithLimit is like ExecuteQuery, but the iterator yields up to limit results, or all the results of
+// the query if the limit is Unlimited
+func (vdb *VersionedDB) ExecuteQueryWithLimit(query string, limit int) (statedb.ResultsIterator, error) {
+	return vdb.executeQuery(query, limit, false)
+}
+
+// ExecuteParsedQuery is like ExecuteQueryWithLimit, but the results are of type *ParsedQueryRecord, whose JSON value
+// is parsed once as the results are iterated, for the callers processing the fields of many results
+func (vdb *VersionedDB) ExecuteParsedQuery(query string, limit int) (statedb.ResultsIterator, error) {
+	return vdb.executeQuery(query, limit, true)
+}
+
+// ParsedQueryRecord is a result of ExecuteParsedQuery, a query record along with the fields of its JSON value. The
+// numbers of the fields are of type json.Number, so that they keep the precision and the form they are written with
+type ParsedQueryRecord struct {
+	statedb.VersionedQueryRecord
+	Fields map[string]interface{}
+}
+
+// executeQuery runs the query, yielding up to limit results, parsed if parsed is true
+func (vdb *VersionedDB) executeQuery(query string, limit int, parsed bool) (statedb.ResultsIterator, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+	if vdb.slowQueryThreshold > 0 {
+		defer vdb.logIfSlow(time.Now(), "ExecuteQuery", fmt.Sprintf("query %s", query))
+	}
+
+	query, err := vdb.queryCompiler.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	if vdb.queryRangeFallback {
+		if idRange := reduceQueryToRange(query); idRange != nil {
+			vdb.logger.Debugf("Running query %s as a range scan of the ids from [%s] to [%s]", query, idRange.startID, idRange.endID)
+			return vdb.executeRangeQuery(idRange, limit, parsed)
+		}
+	}
+	if limit <= 0 {
+		return vdb.newPagedQueryScanner(query, parsed)
+	}
+	// the limit is set in the body of the query, where CouchDB reads it, unless the query sets a lower one
+	queryLimit, skip, err := getQueryPage(query)
+	if err != nil {
+		return nil, err
+	}
+	if queryLimit > 0 && queryLimit < limit {
+		limit = queryLimit
+	}
+	if query, err = setQueryPage(query, limit, skip); err != nil {
+		return nil, err
+	}
+	queryResult, warning, err := vdb.db.QueryDocumentsWithWarning(query, limit, skip)
+	if err != nil {
+		vdb.logger.Debugf("Error calling QueryDocuments(): %s\n", err.Error())
+		return nil, err
+	}
+	// CouchDB warns of queries that no index matches, which are run as a full scan of the database
+	if warning != "" {
+		vdb.logger.Warningf("Query %s returned warning: %s", query, warning)
+	}
+	vdb.logger.Debugf("Exiting ExecuteQuery")
+	scanner := newQueryScanner(vdb.keys, *queryResult)
+	scanner.warning = warning
+	scanner.parsed = parsed
+	return scanner, nil
+}
+
+// QueryWarner is implemented by the iterators returned by ExecuteQuery. Warning returns the warning CouchDB
+// returned with the results of the query, e.g. that no index matches the query, or "" if none
+type QueryWarner interface {
+	Warning() string
+}
+
+// ExplainQuery returns the query plan CouchDB would use for the given query, including the chosen index.
+// Tooling can use it to warn about queries that result in a full scan
+func (vdb *VersionedDB) ExplainQuery(query string) (string, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	query, err := vdb.queryCompiler.Compile(query)
+	if err != nil {
+		return "", err
+	}
+	explain, err := vdb.db.ExplainQuery(query)
+	if err != nil {
+		vdb.logger.Debugf("Error calling ExplainQuery(): %s\n", err.Error())
+		return "", err
+	}
+	return explain, nil
+}
+
+// SetLogLevel sets the level of the logs of the operations on the database, e.g. "DEBUG" to debug the state
+// database of one channel without the logs of the other channels. The level is independent of the level of the
+// statecouchdb module, which the logs of the database follow again once the level is set to ""
+func (vdb *VersionedDB) SetLogLevel(level string) error {
+	if level == "" {
+		vdb.logger.resetLevel()
+		return nil
+	}
+	logLevel, err := logging.LogLevel(level)
+	if err != nil {
+		return err
+	}
+	vdb.logger.setLevel(logLevel)
+	return nil
+}
+
+// SetQueryCompiler replaces the compiler of the queries run by ExecuteQuery and ExplainQuery, which takes Mango
+// queries by default
+func (vdb *VersionedDB) SetQueryCompiler(compiler QueryCompiler) {
+	vdb.queryCompiler = compiler
+}
+
+// SetValueCodec replaces the codec converting between the values and the documents storing them.
+// The documents written with the codec replaced are not readable with the new codec, unless it reads them
+func (vdb *VersionedDB) SetValueCodec(codec ValueCodec) {
+	vdb.codec = codec
+}
+
+// ApplyUpdates implements method in VersionedDB interface
+// In async commit mode the batch is queued and ApplyUpdates returns before the batch is written,
+// see WaitForCommits
+func (vdb *VersionedDB) ApplyUpdates(batch *statedb.UpdateBatch, height *version.Height) error {
+	return vdb.submitUpdates(batch, height, "")
+}
+
+// ApplyUpdatesWithToken applies the batch like ApplyUpdates, and records the idempotency token of the batch
+// along with the savepoint. Retrying a batch that was already applied with the same token at the same height
+// is detected and is a no-op, which makes block commit safe to retry
+func (vdb *VersionedDB) ApplyUpdatesWithToken(batch *statedb.UpdateBatch, height *version.Height, token string) error {
+	return vdb.submitUpdates(batch, height, token)
+}
+
+// ApplyWrites applies a sequence of writes like ApplyUpdates applies a batch, for the bulk paths that read the writes
+// as a raw sequence, e.g. from a log, in which a key may be written more than once. The writes of a key are coalesced,
+// the last one winning, so that a single document write is issued per key. A write with a nil value deletes the
+// document of the key
+func (vdb *VersionedDB) ApplyWrites(writes []*statedb.VersionedKV, height *version.Height) error {
+	batch := coalesceWrites(writes)
+	if coalesced := len(writes) - len(batch.KVs); coalesced > 0 {
+		vdb.logger.Debugf("Coalesced %d writes of keys written more than once at height %v", coalesced, height)
+	}
+	return vdb.ApplyUpdates(batch, height)
+}
+
+// coalesceWrites returns the batch of the writes, in which the last write of each key wins
+func coalesceWrites(writes []*statedb.VersionedKV) *statedb.UpdateBatch {
+	batch := statedb.NewUpdateBatch()
+	for _, kv := range writes {
+		if kv.Value == nil {
+			batch.Delete(kv.Namespace, kv.Key, kv.Version)
+			continue
+		}
+		batch.Put(kv.Namespace, kv.Key, kv.Value, kv.Version)
+	}
+	return batch
+}
+
+// RegisterNamespaceSchema registers the JSON schema that the values written to the namespace must conform to.
+// ApplyUpdates rejects a batch holding a value that violates the schema with ErrSchemaViolation, and writes none
+// of the batch. Registering a schema again for the namespace replaces the schema registered before
+func (vdb *VersionedDB) RegisterNamespaceSchema(namespace string, schema []byte) error {
+	s, err := newJSONSchema(schema)
+	if err != nil {
+		return err
+	}
+	vdb.schemaMux.Lock()
+	defer vdb.schemaMux.Unlock()
+	vdb.schemas[namespace] = s
+	return nil
+}
+
+// validateKeys returns ErrEmptyNamespace for the first key of the batch in the empty namespace, and
+// ErrReservedNamespace or ErrInvalidUTF8Key for the first key of the batch in a reserved namespace or that is
+// not valid UTF-8, if such namespaces or keys are rejected rather than escaped
+func (vdb *VersionedDB) validateKeys(batch *statedb.UpdateBatch) error {
+	for _, ck := range sortedCompositeKeys(batch) {
+		if err := checkNamespace(ck.Namespace); err != nil {
+			return err
+		}
+		if vdb.keys.rejectInvalidUTF8 && !utf8.ValidString(ck.Key) {
+			return &ErrInvalidUTF8Key{Namespace: ck.Namespace, Key: ck.Key}
+		}
+	}
+	return nil
+}
+
+// checkNamespace returns ErrEmptyNamespace if the namespace is empty, and ErrReservedNamespace if the namespace
+// starts with an underscore and such namespaces are rejected rather than escaped
+func checkNamespace(ns string) error {
+	if ns == "" {
+		return ErrEmptyNamespace
+	}
+	if strings.HasPrefix(ns, "_") && ledgerconfig.GetCouchDBReservedNamespacePolicy() == "reject" {
+		return &ErrReservedNamespace{Namespace: ns}
+	}
+	return nil
+}
+
+// validateSchemas checks the values in the batch against the schemas registered for their namespaces.
+// Deletes are not checked, nor are the merge patches, whose merged values are checked as they are merged
+func (vdb *VersionedDB) validateSchemas(batch *statedb.UpdateBatch) error {
+	for ck, vv := range batch.KVs {
+		if vv.Value == nil || batch.Merges[ck] {
+			continue
+		}
+		if err := vdb.validateSchema(ck, vv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSchema checks the value of the key against the schema registered for its namespace, if any
+func (vdb *VersionedDB) validateSchema(ck statedb.CompositeKey, value []byte) error {
+	vdb.schemaMux.RLock()
+	defer vdb.schemaMux.RUnlock()
+	schema := vdb.schemas[ck.Namespace]
+	if schema == nil {
+		return nil
+	}
+	if msg := schema.validate(value); msg != "" {
+		vdb.logger.Debugf("Value of key ns=%s, key=%s violates the namespace schema: %s", ck.Namespace, ck.Key, msg)
+		return &ErrSchemaViolation{Namespace: ck.Namespace, Key: ck.Key, Reason: msg}
+	}
+	return nil
+}
+
+// submitUpdates applies the batch, or queues it for the commit worker in async commit mode.
+// Queuing blocks while the queue is full, and fails once a queued batch has failed to apply
+func (vdb *VersionedDB) submitUpdates(batch *statedb.UpdateBatch, height *version.Height, token string) error {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+	if err := vdb.validateKeys(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkReadOnlyNamespaces(batch); err != nil {
+		return err
+	}
+	if err := vdb.validateSchemas(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkQuotas(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkPaused(); err != nil {
+		return err
+	}
+	if vdb.asyncCommitQueueSize <= 0 {
+		return vdb.applyBatch(batch, height, token)
+	}
+
+	vdb.commitQueueMux.Lock()
+	defer vdb.commitQueueMux.Unlock()
+	for len(vdb.commitQueue) >= vdb.asyncCommitQueueSize && vdb.commitErr == nil {
+		vdb.commitQueueCond.Wait()
+	}
+	if vdb.commitErr != nil {
+		return vdb.commitErr
+	}
+	vdb.commitQueue = append(vdb.commitQueue, &queuedBatch{batch, height, token})
+	vdb.pendingCommits.Add(1)
+	if !vdb.commitWorkerRunning {
+		vdb.commitWorkerRunning = true
+		go vdb.commitWorker()
+	}
+	return nil
+}
+
+// commitWorker applies the queued batches in order and exits once the queue is empty
+func (vdb *VersionedDB) commitWorker() {
+	for {
+		vdb.commitQueueMux.Lock()
+		if len(vdb.commitQueue) == 0 {
+			vdb.commitWorkerRunning = false
+			vdb.commitQueueMux.Unlock()
+			return
+		}
+		queued := vdb.commitQueue[0]
+		failed := vdb.commitErr != nil
+		vdb.commitQueueMux.Unlock()
+
+		// a batch must not be applied after a failed one, as the state would skip the failed batch
+		var err error
+		if !failed {
+			if err = vdb.applyBatch(queued.batch, queued.height, queued.token); err != nil {
+				vdb.logger.Errorf("Async commit of batch at height %v failed: %s", queued.height, err.Error())
+			}
+		}
+
+		vdb.commitQueueMux.Lock()
+		vdb.commitQueue = vdb.commitQueue[1:]
+		if err != nil {
+			vdb.commitErr = err
+		}
+		vdb.commitQueueCond.Broadcast()
+		vdb.commitQueueMux.Unlock()
+		vdb.pendingCommits.Done()
+	}
+}
+
+// Pause quiesces the commits to the database, e.g. for the time of a backup, and returns once the commit in
+// flight, if any, is written. While paused, the commits wait until Resume is called, or fail with ErrPaused if
+// so configured. In async commit mode, the queued batches are not written while paused. The reads continue.
+// Pausing a paused database has no effect
+func (vdb *VersionedDB) Pause() {
+	vdb.pauseMux.Lock()
+	defer vdb.pauseMux.Unlock()
+	if vdb.paused {
+		return
+	}
+	vdb.writeMux.Lock()
+	vdb.paused = true
+	vdb.logger.Infof("Commits paused")
+}
+
+// Resume resumes the commits paused by Pause. Resuming a database that is not paused has no effect
+func (vdb *VersionedDB) Resume() {
+	vdb.pauseMux.Lock()
+	defer vdb.pauseMux.Unlock()
+	if !vdb.paused {
+		return
+	}
+	vdb.paused = false
+	vdb.writeMux.Unlock()
+	vdb.logger.Infof("Commits resumed")
+}
+
+// checkPaused returns ErrPaused if the database is paused and the commits are rejected while paused
+func (vdb *VersionedDB) checkPaused() error {
+	if !vdb.rejectWhilePaused {
+		return nil
+	}
+	vdb.pauseMux.Lock()
+	defer vdb.pauseMux.Unlock()
+	if vdb.paused {
+		return ErrPaused
+	}
+	return nil
+}
+
+// WaitForCommits waits until all batches queued in async commit mode have been written, and returns
+// the error of the first batch that failed to apply, if any. The savepoint of the written batches is
+// durable only once recorded, see Flush
+func (vdb *VersionedDB) WaitForCommits() error {
+	vdb.pendingCommits.Wait()
+	vdb.commitQueueMux.Lock()
+	defer vdb.commitQueueMux.Unlock()
+	return vdb.commitErr
+}
+
+// ApplyUpdatesWithExpectedTokens applies the batch like ApplyUpdates, provided that each key in tokens is still
+// at the revision identified by its token, as returned by GetStateForUpdate. Otherwise nothing is applied and
+// ErrStale is returned. The batch is applied synchronously, after any batch queued in async commit mode.
+// A key expected not to exist, with token "", is only checked before the batch is applied, a concurrent
+// creation of the key while the batch is applied is not detected
+func (vdb *VersionedDB) ApplyUpdatesWithExpectedTokens(batch *statedb.UpdateBatch, height *version.Height,
+	tokens map[statedb.CompositeKey]string) error {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	if err := vdb.validateKeys(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkReadOnlyNamespaces(batch); err != nil {
+		return err
+	}
+	if err := vdb.validateSchemas(batch); err != nil {
+		return err
+	}
+	if err := vdb.checkPaused(); err != nil {
+		return err
+	}
+	if err := vdb.WaitForCommits(); err != nil {
+		return err
+	}
+	for ck, token := range tokens {
+		_, rev, err := vdb.db.ReadDoc(vdb.keys.compositeKeyID(ck.Namespace, ck.Key))
+		if err != nil {
+			return err
+		}
+		if rev != token {
+			vdb.logger.Debugf("Key ns=%s, key=%s changed since it was read for update", ck.Namespace, ck.Key)
+			return ErrStale
+		}
+	}
+	if err := vdb.checkQuotas(batch); err != nil {
+		return err
+	}
+	return vdb.applyUpdates(batch, height, "", tokens, nil)
+}
+
+// applyBatch writes the batch, unless it is already applied with the given token
+func (vdb *VersionedDB) applyBatch(batch *statedb.UpdateBatch, height *version.Height, token string) error {
+	applied, err := vdb.isBatchApplied(height, token)
+	if err != nil {
+		return err
+	}
+	if applied {
+		vdb.logger.Infof("Batch with token %s at height %v is already applied, skipping", token, height)
+		return nil
+	}
+	return vdb.applyUpdates(batch, height, token, nil, nil)
+}
+
+// isBatchApplied returns true if the last applied batch, recorded or pending, has the given height and token
+func (vdb *VersionedDB) isBatchApplied(height *version.Height, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	vdb.savepointMux.Lock()
+	defer vdb.savepointMux.Unlock()
+	if vdb.pendingSavepoint != nil {
+		return vdb.pendingToken == token && version.AreSame(vdb.pendingSavepoint, height), nil
+	}
+	savepointDoc, err := vdb.readSavepoint()
+	if err != nil {
+		return false, err
+	}
+	return savepointDoc.Token == token && version.AreSame(savepointDoc.height(), height), nil
+}
+
+// applyUpdates writes the batch. The keys in revs are saved with a check that they are still at the given revision.
+// Unless the documents are written concurrently, the keys are written in order of namespace then key, so that the
+// changes feed lists the writes of a batch in a deterministic order. Concurrent calls are serialized, and the
+// savepoint is never moved back to a lower height. A batch below the savepoint recorded before the first batch
+// applied through the handle, e.g. a block replayed during recovery, is already applied and is skipped.
+// If progress is not nil, the keys are written in chunks, and progress is called with the number of keys written
+// once each chunk is written. When the writes are retried after the database is recreated, the chunks written
+// before are not reported again, so the counts reported are increasing
+func (vdb *VersionedDB) applyUpdates(batch *statedb.UpdateBatch, height *version.Height, token string,
+	revs map[statedb.CompositeKey]string, progress func(done int)) error {
+	vdb.writeMux.Lock()
+	defer vdb.writeMux.Unlock()
+	if vdb.slowQueryThreshold > 0 {
+		defer vdb.logIfSlow(time.Now(), "ApplyUpdates", fmt.Sprintf("%d keys at height %v", len(batch.KVs), height))
+	}
+
+	replayed, err := vdb.isReplayed(height)
+	if err != nil {
+		return err
+	}
+	if replayed {
+		vdb.logger.Infof("Batch at height %v is below the recorded savepoint at height %v, skipping", height, vdb.recoveredHeight)
+		return nil
+	}
+
+	keys := sortedCompositeKeys(batch)
+	chunkSize := len(keys)
+	if progress != nil {
+		chunkSize = progressChunkSize
+	}
+	reported := 0
+	err = vdb.retryIfDatabaseMissing(func() error {
+		for start := 0; start < len(keys); start += chunkSize {
+			end := start + chunkSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if err := vdb.saveValues(keys[start:end], batch, revs); err != nil {
+				return err
+			}
+			if progress != nil && end > reported {
+				reported = end
+				progress(end)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stateHash, err := vdb.hashState(batch)
+	if err != nil {
+		return err
+	}
+
+	vdb.savepointMux.Lock()
+	defer vdb.savepointMux.Unlock()
+	vdb.pendingWrites = vdb.pendingWrites || len(batch.KVs) > 0
+	if vdb.appliedHeight != nil && height.Compare(vdb.appliedHeight) < 0 {
+		vdb.logger.Warningf("Batch at height %v applied after height %v, the savepoint is left at the greater height",
+			height, vdb.appliedHeight)
+		return nil
+	}
+	vdb.appliedHeight = height
+	vdb.pendingSavepoint = height
+	vdb.pendingToken = token
+	vdb.pendingStateHash = stateHash
+	vdb.blocksSinceSavepoint++
+	if vdb.blocksSinceSavepoint < vdb.savepointBlockInterval &&
+		(vdb.savepointTimeInterval <= 0 || time.Since(vdb.lastSavepointTime) < vdb.savepointTimeInterval) {
+		vdb.logger.Debugf("Deferring savepoint at height %v", height)
+		return nil
+	}
+
+	// Record a savepoint at a given height
+	return vdb.recordPendingSavepoint()
+}
+
+// isReplayed returns true if the height is below the savepoint recorded before the first batch applied through
+// the handle, which is read when the first batch is applied. The batches applied through the handle may complete
+// out of order, so a batch below the height of another one applied through the handle is not a replay
+func (vdb *VersionedDB) isReplayed(height *version.Height) (bool, error) {
+	if vdb.appliedHeight == nil {
+		var savepointDoc *couchSavepointData
+		err := vdb.retryIfDatabaseMissing(func() error {
+			var err error
+			savepointDoc, err = vdb.readSavepoint()
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		if savepointDoc.recorded {
+			vdb.recoveredHeight = savepointDoc.height()
+			vdb.appliedHeight = vdb.recoveredHeight
+		}
+	}
+	return vdb.recoveredHeight != nil && height.Compare(vdb.recoveredHeight) < 0, nil
+}
+
+// compositeKeys sorts composite keys by namespace then key
+type compositeKeys []statedb.CompositeKey
+
+func (keys compositeKeys) Len() int      { return len(keys) }
+func (keys compositeKeys) Swap(i, j int) { keys[i], keys[j] = keys[j], keys[i] }
+func (keys compositeKeys) Less(i, j int) bool {
+	if keys[i].Namespace != keys[j].Namespace {
+		return keys[i].Namespace < keys[j].Namespace
+	}
+	return keys[i].Key < keys[j].Key
+}
+
+// saveValues writes the values of the keys, concurrently if so configured
+func (vdb *VersionedDB) saveValues(keys []statedb.CompositeKey, batch *statedb.UpdateBatch,
+	revs map[statedb.CompositeKey]string) error {
+	if vdb.writeConcurrency > 1 {
+		return vdb.saveValuesConcurrently(keys, batch, revs)
+	}
+	for _, ck := range keys {
+		if err := vdb.saveValue(ck, batch, revs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveValuesConcurrently writes the values of the keys with up to writeConcurrency writes in flight. The keys of a
+// batch are distinct, so the concurrent writes never conflict with each other. All the writes are waited for, and
+// the error of the first key in order whose write failed is returned
+func (vdb *VersionedDB) saveValuesConcurrently(keys []statedb.CompositeKey, batch *statedb.UpdateBatch,
+	revs map[statedb.CompositeKey]string) error {
+	errs := make([]error, len(keys))
+	slots := make(chan struct{}, vdb.writeConcurrency)
+	var wg sync.WaitGroup
+	for i, ck := range keys {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, ck statedb.CompositeKey) {
+			defer wg.Done()
+			errs[i] = vdb.saveValue(ck, batch, revs)
+			<-slots
+		}(i, ck)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveValue writes the document storing the value of the key in the batch
+func (vdb *VersionedDB) saveValue(ck statedb.CompositeKey, batch *statedb.UpdateBatch, revs map[statedb.CompositeKey]string) error {
+	if batch.Merges[ck] {
+		return vdb.saveMerge(ck, batch, revs)
+	}
+	vv := batch.KVs[ck]
+	id := vdb.keys.compositeKeyID(ck.Namespace, ck.Key)
+
+	// trace the first 200 characters of versioned value only, in case it is huge
+	if vdb.logger.IsEnabledFor(logging.DEBUG) {
+		versionedValueDump := fmt.Sprintf("%#v", vv)
+		if len(versionedValueDump) > 200 {
+			versionedValueDump = versionedValueDump[0:200] + "..."
+		}
+		vdb.logger.Debugf("Applying ns=%s, key=%s, versionedValue=%s", ck.Namespace, ck.Key, versionedValueDump)
+	}
+
+	if vv.Value == nil {
+		return vdb.deleteValue(ck, revs)
+	}
+
+	jsonDoc, attachments, skip, err := vdb.encodeValueDoc(ck, batch)
+	if err != nil || skip {
+		return err
+	}
+
+	// SaveDoc using couchdb client, the binary data, if any, is persisted as attachments
+	rev, err := vdb.db.SaveDoc(id, revs[ck], jsonDoc, attachments)
+	if err != nil {
+		vdb.logger.Errorf("Error during Commit() for ns=%s, key=%s: %s\n", ck.Namespace, ck.Key, err.Error())
+		return vdb.checkStale(ck, revs, err)
+	}
+	vdb.logger.Debugf("Saved document revision number: %s\n", rev)
+	return nil
+}
+
+// deleteValue deletes the document of the key, at the revision in revs if the key is saved with a check of its
+// revision, and at its current revision otherwise. Deleting a key that has no document is a no-op
+func (vdb *VersionedDB) deleteValue(ck statedb.CompositeKey, revs map[statedb.CompositeKey]string) error {
+	id := vdb.keys.compositeKeyID(ck.Namespace, ck.Key)
+	rev, expected := revs[ck]
+	if !expected || rev == "" {
+		currentRev, err := vdb.db.ReadDocRev(id, 0)
+		if err != nil {
+			return err
+		}
+		if expected && currentRev != "" {
+			vdb.logger.Debugf("Key ns=%s, key=%s was written since it was read for delete", ck.Namespace, ck.Key)
+			return ErrStale
+		}
+		rev = currentRev
+	}
+	if rev == "" {
+		vdb.logger.Debugf("No document to delete for ns=%s, key=%s", ck.Namespace, ck.Key)
+		return nil
+	}
+
+	deleted, err := vdb.db.BulkDeleteDocs([]couchdb.DocRevRequest{{ID: id, Rev: rev}})
+	if err != nil {
+		vdb.logger.Errorf("Error during Commit() for ns=%s, key=%s: %s\n", ck.Namespace, ck.Key, err.Error())
+		return err
+	}
+	if len(deleted) == 0 {
+		return vdb.checkStale(ck, revs, &couchdb.ErrDocumentConflict{Reason: fmt.Sprintf("document %s changed before it was deleted", id)})
+	}
+	vdb.logger.Debugf("Deleted document of ns=%s, key=%s at revision %s", ck.Namespace, ck.Key, rev)
+	return nil
+}
+
+// encodeValueDoc returns the JSON document and attachments storing the value of the key in the batch, along with
+// the fields and attachments added to the value. skip is true if the value is not to be written, as configured for
+// the values that are not JSON
+func (vdb *VersionedDB) encodeValueDoc(ck statedb.CompositeKey, batch *statedb.UpdateBatch) ([]byte, []couchdb.Attachment, bool, error) {
+	vv := batch.KVs[ck]
+
+	// the values that are not JSON are stored as attachments, which rich queries cannot match
+	if vv.Value != nil && vdb.nonJSONWritePolicy != "store" && !couchdb.IsJSON(string(vv.Value)) {
+		vdb.nonJSONWrites.Inc(1)
+		if vdb.nonJSONWritePolicy == "skip" {
+			vdb.logger.Warningf("Skipping the write of non-JSON value for ns=%s, key=%s", ck.Namespace, ck.Key)
+			return nil, nil, true, nil
+		}
+		vdb.logger.Warningf("Storing non-JSON value for ns=%s, key=%s as an attachment", ck.Namespace, ck.Key)
+	}
+
+	jsonDoc, attachments, err := vdb.codec.Encode(vv.Value, vv.Version)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if vdb.namespaceField && jsonDoc != nil && attachments == nil {
+		if jsonDoc, err = addNamespaceField(jsonDoc, ck.Namespace); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if vv.Value != nil {
+		if attachments, err = addNamedAttachments(attachments, batch.Attachments[ck]); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if clock := batch.VectorClocks[ck]; len(clock) > 0 && vv.Value != nil {
+		if jsonDoc, err = addVectorClockField(jsonDoc, clock); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if expiry, ok := batch.Expiries[ck]; ok && vv.Value != nil {
+		if err = vdb.recordTTLUse(); err != nil {
+			return nil, nil, false, err
+		}
+		if jsonDoc, err = addExpiryField(jsonDoc, expiry); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if escapedKey := vdb.keys.escapeKey(ck.Key); vdb.keys.hashKeyID(escapedKey) != escapedKey {
+		if jsonDoc, err = addKeyField(jsonDoc, escapedKey); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	return jsonDoc, attachments, false, nil
+}
+
+// sortedCompositeKeys returns the keys of the batch sorted by namespace then key
+func sortedCompositeKeys(batch *statedb.UpdateBatch) []statedb.CompositeKey {
+	keys := make(compositeKeys, 0, len(batch.KVs))
+	for ck := range batch.KVs {
+		keys = append(keys, ck)
+	}
+	sort.Sort(keys)
+	return keys
+}
+
+// checkStale returns ErrStale if saving a key expected at a revision failed because the key is at another
+// revision, and the error of the save otherwise
+func (vdb *VersionedDB) checkStale(ck statedb.CompositeKey, revs map[statedb.CompositeKey]string, saveErr error) error {
+	expectedRev, ok := revs[ck]
+	if !ok {
+		return saveErr
+	}
+	_, rev, err := vdb.db.ReadDoc(vdb.keys.compositeKeyID(ck.Namespace, ck.Key))
+	if err == nil && rev != expectedRev {
+		return ErrStale
+	}
+	return saveErr
+}
+
+// compressValue gzip compresses a value
+func compressValue(value []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	gw := gzip.NewWriter(&buffer)
+	if _, err := gw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// binaryChecksum returns the checksum of a value stored as an attachment
+func binaryChecksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// jsonChecksum returns the checksum of the fields of a JSON value. The checksum covers the
+// canonical serialization of the fields, as CouchDB does not preserve the formatting of a document
+func jsonChecksum(fields map[string]interface{}) (string, error) {
+	canonicalJSON, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return binaryChecksum(canonicalJSON), nil
+}
+
+// decodeJSONFields decodes the fields of a JSON value, preserving numbers as written
+func decodeJSONFields(value []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	fields := map[string]interface{}{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// addJSONChecksum returns the JSON value with the checksum of its fields added
+func addJSONChecksum(value []byte) ([]byte, error) {
+	fields, err := decodeJSONFields(value)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := jsonChecksum(fields)
+	if err != nil {
+		return nil, err
+	}
+	fields[checksumField] = checksum
+	return json.Marshal(fields)
 }
 
-// GetStateRangeScanIterator implements method in VersionedDB interface
-// startKey is inclusive
-// endKey is exclusive
-func (vdb *VersionedDB) GetStateRangeScanIterator(namespace string, startKey string, endKey string) (statedb.ResultsIterator, error) {
+// verifyJSONChecksum verifies the checksum stored in a JSON document against the fields of the
+// value, and returns the document without the checksum
+func verifyJSONChecksum(jsonDoc []byte) ([]byte, error) {
+	fields, err := decodeJSONFields(jsonDoc)
+	if err != nil {
+		return nil, err
+	}
+	storedChecksum, ok := fields[checksumField]
+	if !ok {
+		return jsonDoc, nil
+	}
+	delete(fields, checksumField)
 
-	compositeStartKey := constructCompositeKey(namespace, startKey)
-	compositeEndKey := constructCompositeKey(namespace, endKey)
-	if endKey == "" {
-		compositeEndKey[len(compositeEndKey)-1] = lastKeyIndicator
+	// the _id and _rev fields are added by CouchDB and are not covered by the checksum
+	valueFields := map[string]interface{}{}
+	for name, field := range fields {
+		if name != "_id" && name != "_rev" {
+			valueFields[name] = field
+		}
 	}
-	queryResult, err := vdb.db.ReadDocRange(string(compositeStartKey), string(compositeEndKey), 1000, 0)
+	checksum, err := jsonChecksum(valueFields)
 	if err != nil {
-		logger.Debugf("Error calling ReadDocRange(): %s\n", err.Error())
 		return nil, err
 	}
-	logger.Debugf("Exiting GetStateRangeScanIterator")
-	return newKVScanner(namespace, *queryResult), nil
-
+	if storedChecksum != checksum {
+		return nil, ErrChecksumMismatch
+	}
+	return json.Marshal(fields)
 }
 
-// ExecuteQuery implements method in VersionedDB interface
-func (vdb *VersionedDB) ExecuteQuery(query string) (statedb.ResultsIterator, error) {
-
-	//TODO - limit is currently set at 1000,  eventually this will need to be changed
-	//to reflect a config option and potentially return an exception if the threshold is exceeded
-	// skip (paging) is not utilized by fabric
-	queryResult, err := vdb.db.QueryDocuments(query, 1000, 0)
+// addNamespaceField returns the JSON document with the namespace stored in the namespace field
+func addNamespaceField(jsonDoc []byte, namespace string) ([]byte, error) {
+	fields, err := decodeJSONFields(jsonDoc)
 	if err != nil {
-		logger.Debugf("Error calling QueryDocuments(): %s\n", err.Error())
 		return nil, err
 	}
-	logger.Debugf("Exiting ExecuteQuery")
-	return newQueryScanner(*queryResult), nil
+	fields[namespaceField] = namespace
+	return json.Marshal(fields)
 }
 
-// ApplyUpdates implements method in VersionedDB interface
-func (vdb *VersionedDB) ApplyUpdates(batch *statedb.UpdateBatch, height *version.Height) error {
-
-	for ck, vv := range batch.KVs {
-		compositeKey := constructCompositeKey(ck.Namespace, ck.Key)
-
-		// trace the first 200 characters of versioned value only, in case it is huge
-		if logger.IsEnabledFor(logging.DEBUG) {
-			versionedValueDump := fmt.Sprintf("%#v", vv)
-			if len(versionedValueDump) > 200 {
-				versionedValueDump = versionedValueDump[0:200] + "..."
-			}
-			logger.Debugf("Applying key=%#v, versionedValue=%s", ck, versionedValueDump)
-		}
-
-		// TODO add delete logic for couch using this approach from stateleveldb - convert nils to deletes
-		/*		if vv.Value == nil {
-					levelBatch.Delete(compositeKey)
-				} else {
-					levelBatch.Put(compositeKey, encodeValue(vv.Value, vv.Version))
-				}
-		*/
-
-		if couchdb.IsJSON(string(vv.Value)) {
-
-			// SaveDoc using couchdb client and use JSON format
-			rev, err := vdb.db.SaveDoc(string(compositeKey), "", vv.Value, nil)
-			if err != nil {
-				logger.Errorf("Error during Commit(): %s\n", err.Error())
-				return err
-			}
-			if rev != "" {
-				logger.Debugf("Saved document revision number: %s\n", rev)
-			}
-
-		} else { // if the data is not JSON, save as binary attachment in Couch
+// removeNamespaceField returns the JSON document without the namespace field, if the document has one
+func removeNamespaceField(jsonDoc []byte) ([]byte, error) {
+	return removeField(jsonDoc, namespaceField)
+}
 
-			//Create an attachment structure and load the bytes
-			attachment := &couchdb.Attachment{}
-			attachment.AttachmentBytes = vv.Value
-			attachment.ContentType = "application/octet-stream"
-			attachment.Name = "valueBytes"
+// removeField returns the JSON document without the given field, if the document has it
+func removeField(jsonDoc []byte, field string) ([]byte, error) {
+	if !bytes.Contains(jsonDoc, []byte(field)) {
+		return jsonDoc, nil
+	}
+	fields, err := decodeJSONFields(jsonDoc)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fields[field]; !ok {
+		return jsonDoc, nil
+	}
+	delete(fields, field)
+	return json.Marshal(fields)
+}
 
-			attachments := []couchdb.Attachment{}
-			attachments = append(attachments, *attachment)
+// decompressValue restores a value compressed by compressValue
+func decompressValue(compressedValue []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(compressedValue))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
 
-			// SaveDoc using couchdb client and use attachment to persist the binary data
-			rev, err := vdb.db.SaveDoc(string(compositeKey), "", nil, attachments)
-			if err != nil {
-				logger.Errorf("Error during Commit(): %s\n", err.Error())
-				return err
-			}
-			if rev != "" {
-				logger.Debugf("Saved document revision number: %s\n", rev)
-			}
+// Flush records the savepoint of the last applied batch if it has not been recorded yet.
+// In async commit mode the queued batches are written first
+func (vdb *VersionedDB) Flush() error {
+	if err := vdb.WaitForCommits(); err != nil {
+		return err
+	}
+	vdb.savepointMux.Lock()
+	defer vdb.savepointMux.Unlock()
+	if vdb.pendingSavepoint == nil {
+		return nil
+	}
+	return vdb.recordPendingSavepoint()
+}
 
+// recordPendingSavepoint records the pending savepoint. The caller is expected to hold savepointMux
+func (vdb *VersionedDB) recordPendingSavepoint() error {
+	// ensure full commit to flush all data writes to disk before the savepoint is recorded.
+	// Batches without writes (e.g. blocks of read-only transactions) have nothing to flush
+	if vdb.pendingWrites {
+		if err := vdb.ensureFullCommit(); err != nil {
+			return err
 		}
 	}
 
-	// Record a savepoint at a given height
-	err := vdb.recordSavepoint(height)
+	err := vdb.recordSavepoint(vdb.pendingSavepoint, vdb.pendingToken, vdb.pendingStateHash)
 	if err != nil {
-		logger.Errorf("Error during recordSavepoint: %s\n", err.Error())
+		vdb.logger.Errorf("Error during recordSavepoint: %s\n", err.Error())
 		return err
 	}
 
+	vdb.pendingSavepoint = nil
+	vdb.pendingToken = ""
+	vdb.pendingStateHash = nil
+	vdb.pendingWrites = false
+	vdb.blocksSinceSavepoint = 0
+	vdb.lastSavepointTime = time.Now()
 	return nil
 }
 
 // Savepoint docid (key) for couchdb
 const savepointDocID = "statedb_savepoint"
 
+// defaultClusterReplicas is the number of replicas (n) of the databases of a CouchDB cluster by default
+const defaultClusterReplicas = 3
+
 // Savepoint data for couchdb
 type couchSavepointData struct {
 	BlockNum  uint64 `json:"BlockNum"`
 	TxNum     uint64 `json:"TxNum"`
 	UpdateSeq string `json:"UpdateSeq"`
+	Token     string `json:"Token,omitempty"`
+	StateHash []byte `json:"StateHash,omitempty"`
+
+	// recorded is false if no savepoint is recorded
+	recorded bool
+}
+
+func (savepointDoc *couchSavepointData) height() *version.Height {
+	return &version.Height{BlockNum: savepointDoc.BlockNum, TxNum: savepointDoc.TxNum}
 }
 
 // recordSavepoint Record a savepoint in statedb.
 // Couch parallelizes writes in cluster or sharded setup and ordering is not guaranteed.
-// Hence we need to fence the savepoint with sync. So ensure_full_commit is called before AND after writing savepoint document
+// Hence we need to fence the savepoint with sync. So ensure_full_commit is called before AND after writing savepoint document.
+// The fence before the savepoint is issued by ApplyUpdates, and only when the batch wrote any data
 // TODO: Optimization - merge 2nd ensure_full_commit with savepoint by using X-Couch-Full-Commit header
-func (vdb *VersionedDB) recordSavepoint(height *version.Height) error {
+func (vdb *VersionedDB) recordSavepoint(height *version.Height, token string, stateHash []byte) error {
 	var err error
 	var savepointDoc couchSavepointData
-	// ensure full commit to flush all changes until now to disk
-	dbResponse, err := vdb.db.EnsureFullCommit()
-	if err != nil || dbResponse.Ok != true {
-		logger.Errorf("Failed to perform full commit\n")
-		return errors.New("Failed to perform full commit")
-	}
 
 	// construct savepoint document
 	// UpdateSeq would be useful if we want to get all db changes since a logical savepoint
 	dbInfo, _, err := vdb.db.GetDatabaseInfo()
 	if err != nil {
-		logger.Errorf("Failed to get DB info %s\n", err.Error())
+		vdb.logger.Errorf("Failed to get DB info %s\n", err.Error())
 		return err
 	}
 	savepointDoc.BlockNum = height.BlockNum
 	savepointDoc.TxNum = height.TxNum
 	savepointDoc.UpdateSeq = dbInfo.UpdateSeq
+	savepointDoc.Token = token
+	savepointDoc.StateHash = stateHash
 
 	savepointDocJSON, err := json.Marshal(savepointDoc)
 	if err != nil {
-		logger.Errorf("Failed to create savepoint data %s\n", err.Error())
+		vdb.logger.Errorf("Failed to create savepoint data %s\n", err.Error())
 		return err
 	}
 
-	// SaveDoc using couchdb client and use JSON format
-	_, err = vdb.db.SaveDoc(savepointDocID, "", savepointDocJSON, nil)
+	rev, saved, err := vdb.saveSavepoint(&savepointDoc, savepointDocJSON)
 	if err != nil {
-		logger.Errorf("Failed to save the savepoint to DB %s\n", err.Error())
+		vdb.logger.Errorf("Failed to save the savepoint to DB %s\n", err.Error())
 		return err
 	}
+	if !saved {
+		return nil
+	}
 
 	// ensure full commit to flush savepoint to disk
-	dbResponse, err = vdb.db.EnsureFullCommit()
+	if err := vdb.ensureFullCommit(); err != nil {
+		return err
+	}
+	if vdb.savepointMirror != nil {
+		savepointDoc.recorded = true
+		vdb.mirrorSavepoint(&savepointDoc, rev)
+	}
+	return nil
+}
+
+// savepointSaveAttempts is the number of times the savepoint is saved before giving up, when the savepoint
+// document is updated concurrently by another writer
+const savepointSaveAttempts = 3
+
+// saveSavepoint saves the savepoint document at its current revision, which SaveDoc reads, so that a savepoint
+// written concurrently by another writer is not blindly overwritten. On a conflict, the savepoint document is read
+// again: the savepoint is saved on top of it at the revision read, unless the savepoint written concurrently is at
+// a greater height, which is then left in place and saved is false
+func (vdb *VersionedDB) saveSavepoint(savepointDoc *couchSavepointData, savepointDocJSON []byte) (string, bool, error) {
+	rev := ""
+	for attempt := 1; ; attempt++ {
+		savedRev, err := vdb.db.SaveDoc(savepointDocID, rev, savepointDocJSON, nil)
+		if err == nil {
+			return savedRev, true, nil
+		}
+		if _, ok := err.(*couchdb.ErrDocumentConflict); !ok || attempt >= savepointSaveAttempts {
+			return "", false, err
+		}
+		vdb.logger.Debugf("Savepoint document was updated concurrently, retrying the savepoint at height %v", savepointDoc.height())
+
+		storedJSON, storedRev, err := vdb.db.ReadDoc(savepointDocID)
+		if err != nil {
+			return "", false, err
+		}
+		if storedJSON != nil {
+			stored := &couchSavepointData{}
+			if err := json.Unmarshal(storedJSON, stored); err != nil {
+				return "", false, err
+			}
+			if stored.height().Compare(savepointDoc.height()) > 0 {
+				vdb.logger.Warningf("Savepoint at height %v was written concurrently, keeping it over the savepoint at height %v",
+					stored.height(), savepointDoc.height())
+				return storedRev, false, nil
+			}
+		}
+		rev = storedRev
+	}
+}
+
+// ensureFullCommit flushes all changes until now to disk. It is skipped for CouchDB 2.x and later clusters,
+// which ignore _ensure_full_commit and acknowledge the writes once they are written to a quorum of replicas
+func (vdb *VersionedDB) ensureFullCommit() error {
+	clustered, err := vdb.db.IsClustered()
+	if err != nil {
+		vdb.logger.Debugf("Failed to detect the CouchDB version, issuing full commit: %s", err.Error())
+	}
+	if clustered {
+		return nil
+	}
+	dbResponse, err := vdb.db.EnsureFullCommit()
 	if err != nil || dbResponse.Ok != true {
-		logger.Errorf("Failed to perform full commit\n")
+		vdb.logger.Errorf("Failed to perform full commit\n")
 		return errors.New("Failed to perform full commit")
 	}
 	return nil
@@ -318,102 +2293,552 @@ func (vdb *VersionedDB) recordSavepoint(height *version.Height) error {
 
 // GetLatestSavePoint implements method in VersionedDB interface
 func (vdb *VersionedDB) GetLatestSavePoint() (*version.Height, error) {
+	savepointDoc, err := vdb.readSavepoint()
+	if err != nil {
+		return &version.Height{BlockNum: 0, TxNum: 0}, err
+	}
+	return savepointDoc.height(), nil
+}
+
+// GetLatestSavePointWithSeq is like GetLatestSavePoint, but also returns the update sequence of the database
+// stored with the savepoint, which the changes feed can be read since. The update sequence is "" if no
+// savepoint is recorded
+func (vdb *VersionedDB) GetLatestSavePointWithSeq() (*version.Height, string, error) {
+	savepointDoc, err := vdb.readSavepoint()
+	if err != nil {
+		return &version.Height{BlockNum: 0, TxNum: 0}, "", err
+	}
+	return savepointDoc.height(), savepointDoc.UpdateSeq, nil
+}
+
+// readSavepoint reads the recorded savepoint document. If no savepoint is recorded, the savepoint at height 0 is returned.
+// With the savepoint mirror, the mirrored savepoint is returned if it is at the revision of the savepoint document,
+// otherwise the savepoint document is read and mirrored
+func (vdb *VersionedDB) readSavepoint() (*couchSavepointData, error) {
+
+	if vdb.savepointMirror != nil {
+		if savepointDoc, ok := vdb.readMirroredSavepoint(); ok {
+			return savepointDoc, nil
+		}
+	}
 
 	var err error
-	savepointJSON, _, err := vdb.db.ReadDoc(savepointDocID)
+	var savepointJSON []byte
+	var rev string
+	if vdb.savepointReadQuorum > 0 {
+		savepointJSON, rev, err = vdb.db.ReadDocWithQuorum(savepointDocID, vdb.savepointReadQuorum)
+	} else {
+		savepointJSON, rev, err = vdb.db.ReadDoc(savepointDocID)
+	}
 	if err != nil {
-		logger.Errorf("Failed to read savepoint data %s\n", err.Error())
-		return &version.Height{BlockNum: 0, TxNum: 0}, err
+		vdb.logger.Errorf("Failed to read savepoint data %s\n", err.Error())
+		return nil, err
 	}
 
+	savepointDoc := &couchSavepointData{}
+
 	// ReadDoc() not found (404) will result in nil response, in these cases return height 0
 	if savepointJSON == nil {
-		return &version.Height{BlockNum: 0, TxNum: 0}, nil
+		if vdb.savepointMirror != nil {
+			vdb.mirrorSavepoint(savepointDoc, "")
+		}
+		return savepointDoc, nil
 	}
 
-	savepointDoc := &couchSavepointData{}
 	err = json.Unmarshal(savepointJSON, &savepointDoc)
 	if err != nil {
-		logger.Errorf("Failed to unmarshal savepoint data %s\n", err.Error())
-		return &version.Height{BlockNum: 0, TxNum: 0}, err
+		vdb.logger.Errorf("Failed to unmarshal savepoint data %s\n", err.Error())
+		return nil, err
+	}
+	savepointDoc.recorded = true
+	if vdb.savepointMirror != nil {
+		vdb.mirrorSavepoint(savepointDoc, rev)
 	}
 
-	return &version.Height{BlockNum: savepointDoc.BlockNum, TxNum: savepointDoc.TxNum}, nil
+	return savepointDoc, nil
+}
+
+// ConstructCompositeKey returns the id of the document storing the key of the namespace, which is the
+// namespace and the key separated by a 0x00 byte. It is exported for tools reading or writing the state
+// documents directly. A key that is not valid UTF-8, or that starts with the escaped key marker, is escaped
+// as configured by the invalid UTF-8 key policy, in hex unless the policy is base64. As the ids always contain
+// the separator, they never collide with the ids of the internal documents, such as the savepoint. A key longer
+// than the configured maxKeyIDLength is stored under a hashed id, which holds its first bytes followed by a hash
+// of the whole key, and the key itself is stored in the ~key field of its document.
+//
+// CouchDB collates the document ids in byte order in _all_docs, which range scans read. As no escaped namespace
+// contains the separator or the indicator, the ids of a namespace sort together, before the namespace end key,
+// and the ids of the keys that are valid UTF-8 and not escaped sort in the byte order of the keys. With ordered
+// keys, all the keys are encoded in an order-preserving form, so that all of them sort in byte order
+func ConstructCompositeKey(ns string, key string) []byte {
+	return newKeyEncoder().constructCompositeKey(ns, key)
 }
 
-func constructCompositeKey(ns string, key string) []byte {
-	compositeKey := []byte(ns)
+// constructCompositeKey returns the document id of the key like ConstructCompositeKey, with the key encoding of
+// the encoder
+func (keys keyEncoder) constructCompositeKey(ns string, key string) []byte {
+	escapedNs, escapedKey := escapeNamespace(ns), keys.hashKeyID(keys.escapeKey(key))
+	compositeKey := make([]byte, 0, len(escapedNs)+len(compositeKeySep)+len(escapedKey))
+	compositeKey = append(compositeKey, escapedNs...)
 	compositeKey = append(compositeKey, compositeKeySep...)
-	compositeKey = append(compositeKey, []byte(key)...)
-	return compositeKey
+	return append(compositeKey, escapedKey...)
+}
+
+// compositeKeyID returns the composite key of ConstructCompositeKey as a document id, with a single allocation
+// rather than converting the composite key to a string
+func (keys keyEncoder) compositeKeyID(ns string, key string) string {
+	return escapeNamespace(ns) + string(compositeKeySep) + keys.hashKeyID(keys.escapeKey(key))
+}
+
+// escapedKeyMarker starts the escaped keys, followed by the name of the encoding and the encoded key.
+// The valid UTF-8 keys starting with the marker are escaped too, so that all keys round-trip
+const escapedKeyMarker = "\x7f"
+
+// escapeKey returns the key escaped if it is not valid UTF-8 or starts with the escaped key marker,
+// otherwise the key is returned as is. With ordered keys, the key is returned in the ordered encoding
+func (keys keyEncoder) escapeKey(key string) string {
+	if isPlainKey(key) {
+		return key
+	}
+	if keys.ordered {
+		return encodeOrderedKey(key)
+	}
+	if utf8.ValidString(key) && !strings.HasPrefix(key, escapedKeyMarker) {
+		return key
+	}
+	if keys.base64 {
+		return escapedKeyMarker + "base64:" + base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return escapedKeyMarker + "hex:" + hex.EncodeToString([]byte(key))
+}
+
+// isPlainKey returns true if all the bytes of the key are below the escaped key marker. Such a key is stored as is
+// whatever the key encoding
+func isPlainKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] >= escapedKeyMarker[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// orderedKeyRuneOffset is the code point encoding the first byte that the ordered encoding does not keep as is
+const orderedKeyRuneOffset = 0x80
+
+// encodeOrderedKey returns the key in the ordered encoding, which keeps the bytes below the escaped key marker
+// and encodes each byte from the marker as a code point from orderedKeyRuneOffset, in UTF-8. The encoding is
+// valid UTF-8 whatever the key, and preserves the byte order of the keys since the code points increase with
+// the bytes they encode and all of them sort after the bytes kept
+func encodeOrderedKey(key string) string {
+	encodedKey := bytes.NewBuffer(make([]byte, 0, len(key)))
+	for i := 0; i < len(key); i++ {
+		if key[i] < escapedKeyMarker[0] {
+			encodedKey.WriteByte(key[i])
+		} else {
+			encodedKey.WriteRune(rune(key[i]-escapedKeyMarker[0]) + orderedKeyRuneOffset)
+		}
+	}
+	return encodedKey.String()
+}
+
+// decodeOrderedKey returns the key encoded by encodeOrderedKey
+func decodeOrderedKey(encodedKey string) string {
+	key := make([]byte, 0, len(encodedKey))
+	for _, r := range encodedKey {
+		if r < orderedKeyRuneOffset {
+			key = append(key, byte(r))
+		} else {
+			key = append(key, byte(r-orderedKeyRuneOffset)+escapedKeyMarker[0])
+		}
+	}
+	return string(key)
+}
+
+// escapeNamespace returns the namespace prefixed with the escaped key marker if it starts with an underscore,
+// since CouchDB reserves such document ids, or with the marker itself, so that all namespaces round-trip.
+// The separator and indicator bytes are escaped as the indicator followed by 0x01 and 0x02 respectively,
+// which preserves the order of the namespaces and keeps the composite keys of a namespace within its range
+func escapeNamespace(ns string) string {
+	if strings.ContainsAny(ns, "\x00\x01") {
+		ns = strings.NewReplacer("\x00", "\x01\x01", "\x01", "\x01\x02").Replace(ns)
+	}
+	if strings.HasPrefix(ns, "_") || strings.HasPrefix(ns, escapedKeyMarker) {
+		return escapedKeyMarker + ns
+	}
+	return ns
+}
+
+// unescapeNamespace returns the namespace escaped by escapeNamespace
+func unescapeNamespace(ns string) string {
+	ns = strings.TrimPrefix(ns, escapedKeyMarker)
+	if strings.Contains(ns, "\x01") {
+		ns = strings.NewReplacer("\x01\x01", "\x00", "\x01\x02", "\x01").Replace(ns)
+	}
+	return ns
+}
+
+// unescapeKey returns the key escaped by escapeKey, whatever the policy it was escaped with
+func (keys keyEncoder) unescapeKey(key string) string {
+	if isPlainKey(key) {
+		return key
+	}
+	if keys.ordered {
+		return decodeOrderedKey(key)
+	}
+	if !strings.HasPrefix(key, escapedKeyMarker) {
+		return key
+	}
+	encodedKey := strings.TrimPrefix(key, escapedKeyMarker)
+	var decodedKey []byte
+	var err error
+	switch {
+	case strings.HasPrefix(encodedKey, "hex:"):
+		decodedKey, err = hex.DecodeString(strings.TrimPrefix(encodedKey, "hex:"))
+	case strings.HasPrefix(encodedKey, "base64:"):
+		decodedKey, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(encodedKey, "base64:"))
+	default:
+		return key
+	}
+	if err != nil {
+		logger.Warningf("Failed to unescape key %q: %s", key, err.Error())
+		return key
+	}
+	return string(decodedKey)
+}
+
+// constructNamespaceStartKey returns the start key of a scan over all the keys of a namespace, which is the composite
+// key of the empty key whatever the key encoding
+func constructNamespaceStartKey(ns string) []byte {
+	return append([]byte(escapeNamespace(ns)), compositeKeySep...)
+}
+
+// constructNamespaceEndKey returns the exclusive end key of a scan over all the keys of a namespace.
+// The indicator is appended to the namespace, in place of the separator, so the boundary sorts right
+// after all the composite keys of the namespace whatever the bytes of the namespace are
+func constructNamespaceEndKey(ns string) []byte {
+	endKey := []byte(escapeNamespace(ns))
+	endKey = append(endKey, lastKeyIndicator)
+	return endKey
+}
+
+// SplitCompositeKey returns the namespace and the key of a document id constructed by ConstructCompositeKey.
+// The namespace ends at the first 0x00 byte, the key may contain further 0x00 bytes, and an escaped key is
+// returned unescaped. An id without a separator, such as the savepoint document id, is returned as a key
+// of the empty namespace, which application state never uses. A hashed id does not hold the whole key, which
+// is to be read from the ~key field of its document
+func SplitCompositeKey(compositeKey []byte) (string, string) {
+	return newKeyEncoder().splitCompositeKey(compositeKey)
 }
 
-func splitCompositeKey(compositeKey []byte) (string, string) {
+// splitCompositeKey returns the namespace and the key of a document id like SplitCompositeKey, with the key
+// encoding of the encoder
+func (keys keyEncoder) splitCompositeKey(compositeKey []byte) (string, string) {
 	split := bytes.SplitN(compositeKey, compositeKeySep, 2)
-	return string(split[0]), string(split[1])
+	if len(split) < 2 {
+		return "", string(split[0])
+	}
+	return unescapeNamespace(string(split[0])), keys.unescapeKey(string(split[1]))
+}
+
+// isInternalDocID returns true for documents that are not application state, such as the savepoint.
+// All application state is stored under a composite key, which always contains the separator
+func isInternalDocID(id string) bool {
+	return !bytes.Contains([]byte(id), compositeKeySep)
 }
 
 type kvScanner struct {
 	cursor    int
 	namespace string
 	results   []couchdb.QueryResult
+	filter    func(key string, value []byte) bool
+	err       error
+	// db is read for the keys of the binary values stored under a hashed id
+	db   *couchdb.CouchDatabase
+	keys keyEncoder
 }
 
-func newKVScanner(namespace string, queryResults []couchdb.QueryResult) *kvScanner {
-	return &kvScanner{-1, namespace, queryResults}
+func newKVScanner(db *couchdb.CouchDatabase, keys keyEncoder, namespace string, queryResults []couchdb.QueryResult) *kvScanner {
+	return &kvScanner{-1, namespace, queryResults, nil, nil, db, keys}
 }
 
 func (scanner *kvScanner) Next() (statedb.QueryResult, error) {
 
 	scanner.cursor++
 
+	// skip the results not passing the filter, if any
+	for scanner.filter != nil && scanner.cursor < len(scanner.results) {
+		key, err := scanner.keys.docKey(scanner.db, scanner.results[scanner.cursor].ID, scanner.results[scanner.cursor].Value)
+		if err != nil {
+			return nil, err
+		}
+		if scanner.filter(key, scanner.results[scanner.cursor].Value) {
+			break
+		}
+		scanner.cursor++
+	}
+
 	if scanner.cursor >= len(scanner.results) {
 		return nil, nil
 	}
 
 	selectedKV := scanner.results[scanner.cursor]
 
-	_, key := splitCompositeKey([]byte(selectedKV.ID))
+	key, err := scanner.keys.docKey(scanner.db, selectedKV.ID, selectedKV.Value)
+	if err != nil {
+		return nil, err
+	}
+	value, ver, err := decodeStoredValue(selectedKV.Value)
+	if err != nil {
+		return nil, err
+	}
 
-	//TODO - change hardcoded version (1,1) when version header is available in CouchDB
 	return &statedb.VersionedKV{
 		CompositeKey:   statedb.CompositeKey{Namespace: scanner.namespace, Key: key},
-		VersionedValue: statedb.VersionedValue{Value: selectedKV.Value, Version: version.NewHeight(1, 1)}}, nil
+		VersionedValue: statedb.VersionedValue{Value: value, Version: ver}}, nil
+}
+
+// Err implements method in PartialScanner interface
+func (scanner *kvScanner) Err() error {
+	if scanner.cursor < len(scanner.results) {
+		return nil
+	}
+	return scanner.err
 }
 
 func (scanner *kvScanner) Close() {
 	scanner = nil
 }
 
+// kvStreamScanner iterates over the results of a couchdb.RangeQueryStream, skipping the keys that inRange, if
+// set, tells are outside of the range scanned
+type kvStreamScanner struct {
+	namespace string
+	stream    *couchdb.RangeQueryStream
+	db        *couchdb.CouchDatabase
+	keys      keyEncoder
+	inRange   func(key string) bool
+}
+
+func (scanner *kvStreamScanner) Next() (statedb.QueryResult, error) {
+	var result *couchdb.QueryResult
+	var key string
+	for {
+		var err error
+		result, err = scanner.stream.Next()
+		if err != nil || result == nil {
+			return nil, err
+		}
+		if key, err = scanner.keys.docKey(scanner.db, result.ID, result.Value); err != nil {
+			return nil, err
+		}
+		if scanner.inRange == nil || scanner.inRange(key) {
+			break
+		}
+	}
+	value, ver, err := decodeStoredValue(result.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statedb.VersionedKV{
+		CompositeKey:   statedb.CompositeKey{Namespace: scanner.namespace, Key: key},
+		VersionedValue: statedb.VersionedValue{Value: value, Version: ver}}, nil
+}
+
+func (scanner *kvStreamScanner) Close() {
+	scanner.stream.Close()
+}
+
+type keyScanner struct {
+	cursor    int
+	namespace string
+	ids       []string
+	pager     *idPager
+	// db is read for the keys stored under a hashed id
+	db   *couchdb.CouchDatabase
+	keys keyEncoder
+}
+
+// newKeyScanner returns a scanner over the keys of the ids read by the pager. The first page is read upfront, so
+// that a failure to start the scan is returned
+func newKeyScanner(db *couchdb.CouchDatabase, keys keyEncoder, namespace string, pager *idPager) (*keyScanner, error) {
+	ids, err := pager.next()
+	if err != nil {
+		return nil, err
+	}
+	return &keyScanner{-1, namespace, ids, pager, db, keys}, nil
+}
+
+func (scanner *keyScanner) Next() (statedb.QueryResult, error) {
+
+	scanner.cursor++
+
+	for scanner.cursor >= len(scanner.ids) {
+		ids, err := scanner.pager.next()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		scanner.ids = ids
+		scanner.cursor = 0
+	}
+
+	key, err := scanner.keys.docKey(scanner.db, scanner.ids[scanner.cursor], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statedb.CompositeKey{Namespace: scanner.namespace, Key: key}, nil
+}
+
+func (scanner *keyScanner) Close() {
+	scanner = nil
+}
+
 type queryScanner struct {
-	cursor  int
-	results []couchdb.QueryResult
+	cursor       int
+	results      []couchdb.QueryResult
+	warning      string
+	nonQueryable []*NonQueryableRecord
+	// parsed tells whether the results are yielded as *ParsedQueryRecord
+	parsed bool
+	keys   keyEncoder
 }
 
-func newQueryScanner(queryResults []couchdb.QueryResult) *queryScanner {
-	return &queryScanner{-1, queryResults}
+func newQueryScanner(keys keyEncoder, queryResults []couchdb.QueryResult) *queryScanner {
+	return &queryScanner{-1, queryResults, "", nil, false, keys}
 }
 
 func (scanner *queryScanner) Next() (statedb.QueryResult, error) {
 
 	scanner.cursor++
 
+	// skip internal docs such as the savepoint, a broad selector may match them, and the docs storing their
+	// value as an attachment, whose record would be the attachment stub rather than the value. The results
+	// without an id, whose _id the fields of the query project away, cannot be told apart from the internal
+	// docs, and are returned with an empty namespace and key
+	for ; scanner.cursor < len(scanner.results); scanner.cursor++ {
+		result := scanner.results[scanner.cursor]
+		if result.ID != "" && isInternalDocID(result.ID) {
+			continue
+		}
+		record, err := newNonQueryableRecord(scanner.keys, result)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			break
+		}
+		scanner.nonQueryable = append(scanner.nonQueryable, record)
+	}
+
 	if scanner.cursor >= len(scanner.results) {
 		return nil, nil
 	}
 
 	selectedResultRecord := scanner.results[scanner.cursor]
 
-	namespace, key := splitCompositeKey([]byte(selectedResultRecord.ID))
+	namespace, key := scanner.keys.splitDocID(selectedResultRecord.ID, selectedResultRecord.Value)
+	record, ver, err := decodeStoredValue(selectedResultRecord.Value)
+	if err != nil {
+		return nil, err
+	}
 
-	//TODO - change hardcoded version (1,1) when version support is available in CouchDB
-	return &statedb.VersionedQueryRecord{
+	queryRecord := statedb.VersionedQueryRecord{
 		Namespace: namespace,
 		Key:       key,
-		Version:   version.NewHeight(1, 1),
-		Record:    selectedResultRecord.Value}, nil
+		Version:   ver,
+		Record:    record}
+	if !scanner.parsed {
+		return &queryRecord, nil
+	}
+	fields, err := decodeJSONFields(record)
+	if err != nil {
+		return nil, err
+	}
+	return &ParsedQueryRecord{VersionedQueryRecord: queryRecord, Fields: fields}, nil
+}
+
+// Warning implements method in QueryWarner interface
+func (scanner *queryScanner) Warning() string {
+	return scanner.warning
+}
+
+// NonQueryableRecords implements method in NonQueryableReporter interface
+func (scanner *queryScanner) NonQueryableRecords() []*NonQueryableRecord {
+	return scanner.nonQueryable
 }
 
 func (scanner *queryScanner) Close() {
 	scanner = nil
 }
+
+// dbLogger tags the messages of the package logger with the name of the database they relate to,
+// so that logs of multiple channels can be told apart. Once a level is set for the database, the
+// messages are logged through a logger of a module of the database, at that level
+type dbLogger struct {
+	dbName string
+	mux    sync.RWMutex
+	logger *logging.Logger
+}
+
+func newDBLogger(dbName string) *dbLogger {
+	return &dbLogger{dbName: dbName, logger: newModuleLogger("statecouchdb")}
+}
+
+func newModuleLogger(module string) *logging.Logger {
+	l := logging.MustGetLogger(module)
+	// skip the dbLogger frame when reporting the caller
+	l.ExtraCalldepth = 1
+	return l
+}
+
+// setLevel sets the level of the logs of the database, independently of the level of the package logger
+func (l *dbLogger) setLevel(level logging.Level) {
+	module := "statecouchdb/" + l.dbName
+	logging.SetLevel(level, module)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.logger = newModuleLogger(module)
+}
+
+// resetLevel makes the logs of the database follow the level of the package logger again
+func (l *dbLogger) resetLevel() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.logger = newModuleLogger("statecouchdb")
+}
+
+func (l *dbLogger) get() *logging.Logger {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	return l.logger
+}
+
+func (l *dbLogger) IsEnabledFor(level logging.Level) bool {
+	return l.get().IsEnabledFor(level)
+}
+
+func (l *dbLogger) Debugf(format string, args ...interface{}) {
+	logger := l.get()
+	// spare prepending the database name to the arguments when the message is not logged
+	if !logger.IsEnabledFor(logging.DEBUG) {
+		return
+	}
+	logger.Debugf("[%s] "+format, append([]interface{}{l.dbName}, args...)...)
+}
+
+func (l *dbLogger) Infof(format string, args ...interface{}) {
+	l.get().Infof("[%s] "+format, append([]interface{}{l.dbName}, args...)...)
+}
+
+func (l *dbLogger) Warningf(format string, args ...interface{}) {
+	l.get().Warningf("[%s] "+format, append([]interface{}{l.dbName}, args...)...)
+}
+
+func (l *dbLogger) Errorf(format string, args ...interface{}) {
+	l.get().Errorf("[%s] "+format, append([]interface{}{l.dbName}, args...)...)
+}
@@ -17,12 +17,32 @@ limitations under the License.
 package statecouchdb
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb/commontests"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb/stateleveldb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
 	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
 	"github.com/hyperledger/fabric/core/ledger/testutil"
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+	logging "github.com/op/go-logging"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/spf13/viper"
 )
 
@@ -75,6 +95,70 @@ func TestIterator(t *testing.T) {
 	}
 }
 
+func TestGetStateMultipleKeysDuplicates(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		commontests.TestGetStateMultipleKeysDuplicates(t, env.DBProvider)
+
+	}
+
+	// each distinct key is read once
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	reads := mock.countRequests("GET", "ns1\x00key1")
+	vals, err := db.GetStateMultipleKeys("ns1", []string{"key1", "key2", "key1", "key2"})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, len(vals), 4)
+	testutil.AssertSame(t, vals[0], vals[2])
+	testutil.AssertNil(t, vals[1])
+	testutil.AssertNil(t, vals[3])
+	testutil.AssertEquals(t, mock.countRequests("GET", "ns1\x00key1"), reads+1)
+	testutil.AssertEquals(t, mock.countRequests("GET", "ns1\x00key2"), 1)
+}
+
+func TestNewVersionedDBProviderWithInstance(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	couchInstance, err := couchdb.CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, "")
+
+	// providers constructed with the same instance share it
+	provider1, err := NewVersionedDBProviderWithInstance(couchInstance)
+	testutil.AssertNoError(t, err, "")
+	provider2, err := NewVersionedDBProviderWithInstance(couchInstance)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertSame(t, provider1.couchInstance, provider2.couchInstance)
+
+	db, err := provider1.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00key1"))
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+
+	_, err = NewVersionedDBProviderWithInstance(nil)
+	testutil.AssertError(t, err, "Expected an error without an instance")
+}
+
+func TestReadOnlyHandle(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		commontests.TestReadOnlyHandle(t, env.DBProvider)
+
+	}
+}
+
 /* TODO re-visit after adding version wrapper in couchdb
 func TestEncodeDecodeValueAndVersion(t *testing.T) {
 	testValueAndVersionEncodeing(t, []byte("value1"), version.NewHeight(1, 2))
@@ -98,14 +182,557 @@ func TestCompositeKey(t *testing.T) {
 	}
 }
 
+func TestSplitCompositeKeyWithoutSeparator(t *testing.T) {
+	ns, key := SplitCompositeKey([]byte(savepointDocID))
+	testutil.AssertEquals(t, ns, "")
+	testutil.AssertEquals(t, key, savepointDocID)
+	testutil.AssertEquals(t, isInternalDocID(savepointDocID), true)
+	testutil.AssertEquals(t, isInternalDocID(string(ConstructCompositeKey("ns", "key"))), false)
+}
+
+func TestCompositeKeyEncoding(t *testing.T) {
+	// the document ids are the namespace and the key separated by a single 0x00 byte
+	testutil.AssertEquals(t, ConstructCompositeKey("ns1", "key1"), []byte("ns1\x00key1"))
+	testutil.AssertEquals(t, ConstructCompositeKey("ns1", ""), []byte("ns1\x00"))
+	testutil.AssertEquals(t, ConstructCompositeKey("", "key1"), []byte("\x00key1"))
+	testutil.AssertEquals(t, ConstructCompositeKey("ns1", "key1"), append(append([]byte("ns1"), compositeKeySep...), "key1"...))
+
+	// the namespace ends at the first separator, a key may contain the separator
+	ns, key := SplitCompositeKey([]byte("ns1\x00key\x001"))
+	testutil.AssertEquals(t, ns, "ns1")
+	testutil.AssertEquals(t, key, "key\x001")
+	ns, key = SplitCompositeKey(ConstructCompositeKey("ns1", "key\x001"))
+	testutil.AssertEquals(t, ns, "ns1")
+	testutil.AssertEquals(t, key, "key\x001")
+
+	// the keys written by ApplyUpdates are stored under the exported encoding
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00key1"))
+}
+
+func TestInvalidUTF8KeyPolicy(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "reject")
+	invalidKey := "key\xff\xfe1"
+	markedKey := escapedKeyMarker + "hex:6b6579"
+
+	// under the reject policy, the updates writing an invalid key fail and nothing is written
+	viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "reject")
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", invalidKey, []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	err := db.ApplyUpdates(batch, version.NewHeight(1, 2))
+	testutil.AssertEquals(t, err, &ErrInvalidUTF8Key{Namespace: "ns1", Key: invalidKey})
+	testutil.AssertNil(t, mock.getDoc("ns1\x00key1"))
+
+	// under the escape policies, the keys are stored as valid UTF-8 and round-trip
+	for _, policy := range []string{"hex", "base64"} {
+		viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", policy)
+		for _, key := range []string{invalidKey, markedKey, "key1"} {
+			testCompositeKey(t, "ns1", key)
+			testutil.AssertEquals(t, utf8.Valid(ConstructCompositeKey("ns1", key)), true)
+		}
+	}
+	viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "hex")
+	testutil.AssertEquals(t, ConstructCompositeKey("ns1", invalidKey), []byte("ns1\x00"+escapedKeyMarker+"hex:6b6579fffe31"))
+
+	// the policy is resolved when the database is opened
+	db = newMockVersionedDB(t, server, "testdb")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", invalidKey, []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+	vv, err := db.GetState("ns1", invalidKey)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+	itr, err := db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	queryResult, err := itr.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, queryResult.(*statedb.VersionedKV).Key, invalidKey)
+}
+
+func TestCompositeKeyOrdering(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+	// the keys in byte order, with keys containing or starting with the separator and the indicator
+	validKeys := []string{"", "\x00", "\x00\x01", "\x01", "\x01a", "a", "a\x00", "a\x00b", "a\x01", "a\x02", "b",
+		"~", "\u00e9", "\uffff", "\U0010ffff"}
+	allKeys := []string{"", "\x00", "\x01", "\x01\xff", "a", "a\x00", "a\x01", "a\x7f", "a\x80", "a\xff", "~", "\x7f",
+		"\x7f\x00", "\xc3(", "\u00e9", "\xc3\xff", "\uffff", "\xff", "\xff\x00", "\xff\xff"}
+	// adversarial namespaces, whose keys must sort within the range of their namespace only
+	namespaces := []string{"ns", "ns\x00", "ns\x00key", "ns\x01", "ns\x01\x02", "_ns", "\x7fns"}
+
+	checkOrdering := func(keys []string) {
+		for _, ns := range namespaces {
+			startKey := string(ConstructCompositeKey(ns, ""))
+			endKey := string(constructNamespaceEndKey(ns))
+			var ids []string
+			for _, key := range keys {
+				testCompositeKey(t, ns, key)
+				id := string(ConstructCompositeKey(ns, key))
+				testutil.AssertEquals(t, utf8.ValidString(id), true)
+				testutil.AssertEquals(t, id >= startKey && id < endKey, true)
+				ids = append(ids, id)
+				// the ids of the other namespaces are outside the range of the namespace
+				for _, otherNs := range namespaces {
+					otherID := string(ConstructCompositeKey(otherNs, key))
+					testutil.AssertEquals(t, otherID >= startKey && otherID < endKey, otherNs == ns)
+				}
+			}
+			testutil.AssertEquals(t, sort.StringsAreSorted(ids), true)
+		}
+	}
+
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+	testutil.AssertEquals(t, sort.StringsAreSorted(validKeys), true)
+	checkOrdering(validKeys)
+	// the keys below the escaped key marker are stored as is
+	testutil.AssertEquals(t, ConstructCompositeKey("ns", "key\x01"), []byte("ns\x00key\x01"))
+
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", true)
+	testutil.AssertEquals(t, sort.StringsAreSorted(allKeys), true)
+	checkOrdering(allKeys)
+	testutil.AssertEquals(t, ConstructCompositeKey("ns", "key\x01"), []byte("ns\x00key\x01"))
+	testutil.AssertEquals(t, ConstructCompositeKey("ns", "key\xff"), []byte("ns\x00key\u0100"))
+
+	// the range scans return the keys in byte order, including the keys that are not valid UTF-8
+	checkScans := func(db statedb.VersionedDB) {
+		batch := statedb.NewUpdateBatch()
+		for i := len(allKeys) - 1; i >= 0; i-- {
+			batch.Put("ns", allKeys[i], []byte(`{"asset_name":"marble"}`), version.NewHeight(1, uint64(i)))
+			batch.Put("ns\x00", allKeys[i], []byte(`{"asset_name":"marble"}`), version.NewHeight(1, uint64(i)))
+		}
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, uint64(len(allKeys)))), "")
+		for _, scan := range []struct {
+			startKey, endKey string
+			keys             []string
+		}{
+			{"", "", allKeys},
+			{"\x01", "a\xff", allKeys[2:9]},
+			{"\x7f", "", allKeys[11:]},
+		} {
+			itr, err := db.GetStateRangeScanIterator("ns", scan.startKey, scan.endKey)
+			testutil.AssertNoError(t, err, "")
+			var keys []string
+			for {
+				queryResult, err := itr.Next()
+				testutil.AssertNoError(t, err, "")
+				if queryResult == nil {
+					break
+				}
+				keys = append(keys, queryResult.(*statedb.VersionedKV).Key)
+			}
+			itr.Close()
+			testutil.AssertEquals(t, keys, scan.keys)
+		}
+	}
+
+	_, server := newMockCouchDB()
+	defer server.Close()
+	checkScans(newMockVersionedDB(t, server, "testdb"))
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		checkScans(db)
+
+	}
+}
+
+func TestRangeScanPartialResults(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	batch.Put("ns1", "key4", []byte(`{"asset_name":"marble4"}`), version.NewHeight(1, 3))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+	// the binary documents are read one by one during the scan, and the read of key3 fails
+	mock.mux.Lock()
+	mock.docs["ns1\x00key3"] = []byte(`{"_attachments":{"valueBytes":{"stub":true}}}`)
+	mock.failReads = map[string]bool{"ns1\x00key3": true}
+	mock.mux.Unlock()
+
+	_, err := db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertError(t, err, "Expected the range scan to fail")
+
+	itr, err := db.GetStateRangeScanIteratorPartial("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+	var keys []string
+	for {
+		testutil.AssertNoError(t, itr.(PartialScanner).Err(), "")
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		if queryResult == nil {
+			break
+		}
+		keys = append(keys, queryResult.(*statedb.VersionedKV).Key)
+	}
+	testutil.AssertEquals(t, keys, []string{"key1", "key2"})
+	testutil.AssertError(t, itr.(PartialScanner).Err(), "Expected the failure to be reported once the results are yielded")
+
+	// a complete scan reports no failure
+	mock.mux.Lock()
+	mock.failReads = nil
+	delete(mock.docs, "ns1\x00key3")
+	mock.mux.Unlock()
+	itr, err = db.GetStateRangeScanIteratorPartial("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	count := 0
+	for queryResult, _ := itr.Next(); queryResult != nil; queryResult, _ = itr.Next() {
+		count++
+	}
+	testutil.AssertEquals(t, count, 3)
+	testutil.AssertNoError(t, itr.(PartialScanner).Err(), "")
+}
+
+func TestScanNamespace(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	var expectedKeys []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		batch.Put("ns1", key, []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i+1)))
+		expectedKeys = append(expectedKeys, key)
+	}
+	batch.Put("ns2", "key00", []byte(`{"asset_name":"marble"}`), version.NewHeight(1, 26))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 26)), "")
+
+	// the reads of the second and the third pages fail transiently
+	rangeReads := mock.countRequests("GET", "/_all_docs")
+	var keys, checkpoints []string
+	opts := ScanOptions{
+		PageSize:      10,
+		MaxRetries:    2,
+		RetryInterval: time.Millisecond,
+		Checkpoint: func(key string) error {
+			checkpoints = append(checkpoints, key)
+			mock.mux.Lock()
+			mock.failRangeReads = 2
+			mock.mux.Unlock()
+			return nil
+		},
+	}
+	err := db.ScanNamespace("ns1", opts, func(kv statedb.VersionedKV) error {
+		keys = append(keys, kv.Key)
+		return nil
+	})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, keys, expectedKeys)
+	testutil.AssertEquals(t, checkpoints, []string{"key09", "key19", "key24"})
+	testutil.AssertEquals(t, mock.countRequests("GET", "/_all_docs")-rangeReads, 7)
+
+	// a scan resumed from a checkpoint reads the remaining keys
+	mock.mux.Lock()
+	mock.failRangeReads = 0
+	mock.mux.Unlock()
+	keys = nil
+	err = db.ScanNamespace("ns1", ScanOptions{PageSize: 10, Resume: true, ResumeAfter: "key19"}, func(kv statedb.VersionedKV) error {
+		keys = append(keys, kv.Key)
+		return nil
+	})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, keys, expectedKeys[20:])
+
+	// the scan fails once the retries are exhausted
+	mock.mux.Lock()
+	mock.failRangeReads = 3
+	mock.mux.Unlock()
+	err = db.ScanNamespace("ns1", ScanOptions{MaxRetries: 2, RetryInterval: time.Millisecond}, func(kv statedb.VersionedKV) error {
+		return nil
+	})
+	testutil.AssertError(t, err, "Expected the scan to fail once the retries are exhausted")
+
+	// the scan stops at the first error of fn
+	mock.mux.Lock()
+	mock.failRangeReads = 0
+	mock.mux.Unlock()
+	keys = nil
+	fnErr := errors.New("fn failed")
+	err = db.ScanNamespace("ns1", ScanOptions{PageSize: 10}, func(kv statedb.VersionedKV) error {
+		keys = append(keys, kv.Key)
+		if kv.Key == "key12" {
+			return fnErr
+		}
+		return nil
+	})
+	testutil.AssertSame(t, err, fnErr)
+	testutil.AssertEquals(t, keys, expectedKeys[:13])
+}
+
+func TestUnlimitedRangeScan(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.queryLimit", 1000)
+	viper.Set("ledger.state.couchDBConfig.queryLimit", 20)
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.resultsPageSize = 10
+
+	batch := statedb.NewUpdateBatch()
+	var expectedKeys []string
+	for i := 0; i < 35; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		batch.Put("ns1", key, []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i+1)))
+		expectedKeys = append(expectedKeys, key)
+	}
+	batch.Put("ns2", "key00", []byte(`{"asset_name":"marble"}`), version.NewHeight(1, 36))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 36)), "")
+	scanKeys := func(itr statedb.ResultsIterator) []string {
+		defer itr.Close()
+		var keys []string
+		for {
+			queryResult, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			if queryResult == nil {
+				return keys
+			}
+			keys = append(keys, queryResult.(*statedb.VersionedKV).Key)
+		}
+	}
+
+	// the configured limit applies by default
+	itr, err := db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, scanKeys(itr), expectedKeys[:20])
+
+	// an unlimited scan reads the pages as they are iterated, and returns all the keys once each
+	rangeReads := mock.countRequests("GET", "/_all_docs")
+	itr, err = db.GetStateRangeScanIteratorWithLimit("ns1", "", "", Unlimited)
+	testutil.AssertNoError(t, err, "")
+	_, err = itr.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, mock.countRequests("GET", "/_all_docs")-rangeReads, 1)
+	testutil.AssertEquals(t, scanKeys(itr), expectedKeys[1:])
+	testutil.AssertEquals(t, mock.countRequests("GET", "/_all_docs")-rangeReads, 4)
+
+	itr, err = db.GetStateRangeScanIteratorWithLimit("ns1", "key05", "key25", -1)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, scanKeys(itr), expectedKeys[5:25])
+
+	// a limit of 0 configured makes the scans unlimited by default, the filtered ones included
+	viper.Set("ledger.state.couchDBConfig.queryLimit", 0)
+	db = newMockVersionedDB(t, server, "testdb")
+	db.resultsPageSize = 10
+	itr, err = db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, scanKeys(itr), expectedKeys)
+	itr, err = db.GetStateRangeScanIteratorWithFilter("ns1", "", "", func(key string, value []byte) bool {
+		return strings.HasSuffix(key, "5")
+	})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, scanKeys(itr), []string{"key05", "key15", "key25"})
+
+	// a failed page read fails the scan, or ends a partial scan once the keys read before are returned
+	itr, err = db.GetStateRangeScanIteratorPartial("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	for i := 0; i < 10; i++ {
+		_, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+	}
+	mock.mux.Lock()
+	mock.failRangeReads = 1
+	mock.mux.Unlock()
+	queryResult, err := itr.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, queryResult)
+	testutil.AssertError(t, itr.(PartialScanner).Err(), "Expected the failed page read to be reported")
+
+	itr, err = db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	for i := 0; i < 10; i++ {
+		_, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+	}
+	mock.mux.Lock()
+	mock.failRangeReads = 1
+	mock.mux.Unlock()
+	_, err = itr.Next()
+	testutil.AssertError(t, err, "Expected the failed page read to fail the scan")
+}
+
+func TestUnlimitedQuery(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+		vdb.resultsPageSize = 10
+
+		batch := statedb.NewUpdateBatch()
+		for i := 0; i < 35; i++ {
+			batch.Put("ns1", fmt.Sprintf("key%02d", i), []byte(`{"asset_name":"marble","owner":"tom"}`), version.NewHeight(1, uint64(i+1)))
+		}
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 35)), "")
+		countResults := func(itr statedb.ResultsIterator) int {
+			defer itr.Close()
+			keys := make(map[string]bool)
+			for {
+				queryResult, err := itr.Next()
+				testutil.AssertNoError(t, err, "")
+				if queryResult == nil {
+					return len(keys)
+				}
+				key := queryResult.(*statedb.VersionedQueryRecord).Key
+				testutil.AssertEquals(t, keys[key], false)
+				keys[key] = true
+			}
+		}
+
+		itr, err := vdb.ExecuteQueryWithLimit(`{"selector":{"owner":"tom"}}`, 20)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, countResults(itr), 20)
+
+		// an unlimited query returns all the results, across pages
+		itr, err = vdb.ExecuteQueryWithLimit(`{"selector":{"owner":"tom"}}`, Unlimited)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, countResults(itr), 35)
+
+	}
+}
+
 func testCompositeKey(t *testing.T, ns string, key string) {
-	compositeKey := constructCompositeKey(ns, key)
+	compositeKey := ConstructCompositeKey(ns, key)
 	t.Logf("compositeKey=%#v", compositeKey)
-	ns1, key1 := splitCompositeKey(compositeKey)
+	ns1, key1 := SplitCompositeKey(compositeKey)
 	testutil.AssertEquals(t, ns1, ns)
 	testutil.AssertEquals(t, key1, key)
 }
 
+func TestGetLatestSavePointWithSeq(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	sp, updateSeq, err := db.GetLatestSavePointWithSeq()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(0, 0))
+	testutil.AssertEquals(t, updateSeq, "")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	// the update sequence is the one recorded in the savepoint document
+	savepointDoc := &couchSavepointData{}
+	testutil.AssertNoError(t, json.Unmarshal(mock.getDoc(savepointDocID), savepointDoc), "")
+	testutil.AssertNotEquals(t, savepointDoc.UpdateSeq, "")
+	sp, updateSeq, err = db.GetLatestSavePointWithSeq()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+	testutil.AssertEquals(t, updateSeq, savepointDoc.UpdateSeq)
+}
+
+func TestInternalDocIDsGuarded(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.reservedNamespaces", "reject")
+
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNotNil(t, mock.getDoc(savepointDocID))
+
+	// the savepoint cannot be read or overwritten as application state of the empty namespace
+	_, err := db.GetState("", savepointDocID)
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	batch = statedb.NewUpdateBatch()
+	batch.Put("", savepointDocID, []byte(`{"BlockNum":99,"TxNum":0}`), version.NewHeight(2, 1))
+	batch.Put("", versionBackfillDocID, []byte(`{"updated":0}`), version.NewHeight(2, 1))
+	testutil.AssertEquals(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), ErrEmptyNamespace)
+	savepoint, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, savepoint, version.NewHeight(1, 1))
+	var vv *statedb.VersionedValue
+
+	// the namespaces whose document ids would be reserved by CouchDB are rejected
+	viper.Set("ledger.state.couchDBConfig.reservedNamespaces", "reject")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("_design", "fabric_namespace", []byte(`{"asset_name":"marble2"}`), version.NewHeight(3, 1))
+	err = db.ApplyUpdates(batch, version.NewHeight(3, 1))
+	testutil.AssertEquals(t, err, &ErrReservedNamespace{Namespace: "_design"})
+	_, err = db.GetState("_local", "key1")
+	testutil.AssertEquals(t, err, &ErrReservedNamespace{Namespace: "_local"})
+	_, err = db.GetStateRangeScanIterator("_local", "", "")
+	testutil.AssertEquals(t, err, &ErrReservedNamespace{Namespace: "_local"})
+
+	// or stored under escaped document ids
+	viper.Set("ledger.state.couchDBConfig.reservedNamespaces", "escape")
+	for _, ns := range []string{"_design", escapedKeyMarker + "ns1", "ns1"} {
+		testCompositeKey(t, ns, "key1")
+	}
+	testutil.AssertEquals(t, ConstructCompositeKey("_design", "key1"), []byte(escapedKeyMarker+"_design\x00key1"))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(3, 1)), "")
+	testutil.AssertNotNil(t, mock.getDoc(escapedKeyMarker+"_design\x00fabric_namespace"))
+	vv, err = db.GetState("_design", "fabric_namespace")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+}
+
+func TestEmptyNamespaceRejected(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// the empty namespace is rejected by the updates, without writing any key of the batch
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	testutil.AssertEquals(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), ErrEmptyNamespace)
+	testutil.AssertNil(t, mock.getDoc("ns1\x00key1"))
+	testutil.AssertNil(t, mock.getDoc("\x00key1"))
+
+	// by the reads
+	_, err := db.GetState("", "key1")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, err = db.GetStateMultipleKeys("", []string{"key1", "key2"})
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, _, err = db.GetStateWithKind("", "key1")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, _, err = db.GetStateForUpdate("", "key1")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, err = db.GetStateByRevision("", "key1", "1-mock")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, err = db.GetStateByRevisions([]KeyRevision{{Namespace: "ns1", Key: "key1"}, {Namespace: "", Key: "key1"}})
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, err = db.NewReadSet().Get("", "key1")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+
+	// and by the scans, which would otherwise cover the internal documents
+	_, err = db.GetStateRangeScanIterator("", "", "")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, err = db.GetStateRangeScanIteratorStreaming("", "", "")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	_, err = db.GetKeys("")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+	testutil.AssertEquals(t, mock.countRequests("GET", "/_all_docs"), 0)
+
+	// the internal documents are the only ids split into the empty namespace
+	ns, key := SplitCompositeKey([]byte(savepointDocID))
+	testutil.AssertEquals(t, ns, "")
+	testutil.AssertEquals(t, key, savepointDocID)
+	testutil.AssertEquals(t, isInternalDocID(savepointDocID), true)
+	testutil.AssertEquals(t, isInternalDocID(compositeKeyID("ns1", savepointDocID)), false)
+}
+
 // The following tests are unique to couchdb, they are not used in leveldb
 
 //  query test
@@ -118,3 +745,3956 @@ func TestQuery(t *testing.T) {
 
 	}
 }
+
+func TestGetSavepoints(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		provider := env.DBProvider.(*VersionedDBProvider)
+
+		db1, err := provider.GetDBHandle("testdb1")
+		testutil.AssertNoError(t, err, "")
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(1, 1))
+		db1.ApplyUpdates(batch, version.NewHeight(1, 1))
+
+		db2, err := provider.GetDBHandle("testdb2")
+		testutil.AssertNoError(t, err, "")
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(3, 2))
+		db2.ApplyUpdates(batch, version.NewHeight(3, 2))
+
+		// testdb has no savepoint recorded and should map to height 0
+		savepoints, err := provider.GetSavepoints([]string{"testdb", "testdb1", "testdb2"})
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(savepoints), 3)
+		testutil.AssertEquals(t, savepoints["testdb"], version.NewHeight(0, 0))
+		testutil.AssertEquals(t, savepoints["testdb1"], version.NewHeight(1, 1))
+		testutil.AssertEquals(t, savepoints["testdb2"], version.NewHeight(3, 2))
+
+	}
+}
+
+func TestOpenCloseCounting(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		provider := env.DBProvider.(*VersionedDBProvider)
+
+		db, err := provider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, provider.OpenCount("testdb"), uint64(0))
+
+		db.Open()
+		db.Open()
+		testutil.AssertEquals(t, provider.OpenCount("testdb"), uint64(2))
+
+		db.Close()
+		testutil.AssertEquals(t, provider.OpenCount("testdb"), uint64(1))
+
+		db.Close()
+		db.Close()
+		testutil.AssertEquals(t, provider.OpenCount("testdb"), uint64(0))
+
+	}
+}
+
+func TestDeleteDBWhileOpen(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		provider := env.DBProvider.(*VersionedDBProvider)
+
+		db, err := provider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte("value1"), version.NewHeight(1, 1))
+		db.ApplyUpdates(batch, version.NewHeight(1, 1))
+
+		db.Open()
+		err = provider.DeleteDB("testdb")
+		testutil.AssertEquals(t, err, ErrDBInUse)
+
+		db.Close()
+		err = provider.DeleteDB("testdb")
+		testutil.AssertNoError(t, err, "")
+
+		// a new handle starts out with an empty database
+		db, err = provider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		sp, err := db.GetLatestSavePoint()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, sp, version.NewHeight(0, 0))
+
+	}
+}
+
+func TestQueryExcludesSavepoint(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"jerry"}`), version.NewHeight(1, 1))
+		db.ApplyUpdates(batch, version.NewHeight(1, 1))
+
+		// the selector matches the savepoint doc as well as the application doc
+		itr, err := db.ExecuteQuery(`{"selector":{"$or":[{"owner":"jerry"},{"BlockNum":{"$gte":0}}]}}`)
+		testutil.AssertNoError(t, err, "")
+
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNotNil(t, queryResult)
+		versionedQueryRecord := queryResult.(*statedb.VersionedQueryRecord)
+		testutil.AssertEquals(t, versionedQueryRecord.Namespace, "ns1")
+		testutil.AssertEquals(t, versionedQueryRecord.Key, "key1")
+
+		queryResult, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, queryResult)
+
+	}
+}
+
+func TestParsedQuery(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+		vdb.resultsPageSize = 2
+
+		batch := statedb.NewUpdateBatch()
+		for i := 0; i < 3; i++ {
+			batch.Put("ns1", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(
+				`{"owner":"tom","count":900719925474099%d,"price":2.5,"size":{"width":%d},"tags":["a",true,null]}`, i, i)),
+				version.NewHeight(1, uint64(i+1)))
+		}
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the parsed records match the raw records, for both the limited and the unlimited queries
+		for _, limit := range []int{10, Unlimited} {
+			itr, err := vdb.ExecuteParsedQuery(`{"selector":{"owner":"tom"}}`, limit)
+			testutil.AssertNoError(t, err, "")
+			for i := 0; i < 3; i++ {
+				queryResult, err := itr.Next()
+				testutil.AssertNoError(t, err, "")
+				record := queryResult.(*ParsedQueryRecord)
+				testutil.AssertEquals(t, record.Key, fmt.Sprintf("key%d", i))
+				testutil.AssertEquals(t, record.Version, version.NewHeight(1, uint64(i+1)))
+				fields, err := decodeJSONFields(record.Record)
+				testutil.AssertNoError(t, err, "")
+				testutil.AssertEquals(t, record.Fields, fields)
+
+				// the numbers keep their precision and their form
+				testutil.AssertEquals(t, record.Fields["count"], json.Number(fmt.Sprintf("900719925474099%d", i)))
+				testutil.AssertEquals(t, record.Fields["price"], json.Number("2.5"))
+				testutil.AssertEquals(t, record.Fields["size"], map[string]interface{}{"width": json.Number(fmt.Sprintf("%d", i))})
+				testutil.AssertEquals(t, record.Fields["tags"], []interface{}{"a", true, nil})
+			}
+			queryResult, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			testutil.AssertNil(t, queryResult)
+			itr.Close()
+		}
+
+		// the records are raw by default
+		itr, err := vdb.ExecuteQuery(`{"selector":{"owner":"tom"}}`)
+		testutil.AssertNoError(t, err, "")
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		_, ok := queryResult.(*statedb.VersionedQueryRecord)
+		testutil.AssertEquals(t, ok, true)
+
+	}
+}
+
+func TestLoggerTaggedWithDBName(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+
+		buf := &bytes.Buffer{}
+		logging.SetBackend(logging.NewLogBackend(buf, "", 0))
+		logging.SetLevel(logging.DEBUG, "statecouchdb")
+		defer logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags))
+
+		db.GetState("ns1", "key1")
+
+		output := buf.String()
+		testutil.AssertEquals(t, strings.Contains(output, "[testdb] GetState(). ns=ns1, key=key1"), true)
+
+	}
+}
+
+func TestNonJSONWrites(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		defer viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "store")
+		viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "warn")
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		nonJSONWrites := metrics.GetOrRegisterCounter("statedb.testdb.nonjson.writes", metrics.DefaultRegistry)
+		writes := nonJSONWrites.Count()
+
+		buf := &bytes.Buffer{}
+		logging.SetBackend(logging.NewLogBackend(buf, "", 0))
+		defer logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags))
+
+		// in warn mode, the non-JSON writes are logged and counted, and still stored
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte("binary value"), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+		testutil.AssertEquals(t, strings.Contains(buf.String(), "Storing non-JSON value for ns=ns1, key=key1"), true)
+		testutil.AssertEquals(t, strings.Contains(buf.String(), "non-JSON value for ns=ns1, key=key2"), false)
+		testutil.AssertEquals(t, nonJSONWrites.Count(), writes+1)
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+
+		// in skip mode, the non-JSON writes are logged and counted, but not stored
+		env.DBProvider.Close()
+		viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "skip")
+		env.DBProvider, err = NewVersionedDBProvider()
+		testutil.AssertNoError(t, err, "")
+		db, err = env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key3", []byte("binary value"), version.NewHeight(2, 1))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+		testutil.AssertEquals(t, strings.Contains(buf.String(), "Skipping the write of non-JSON value for ns=ns1, key=key3"), true)
+		testutil.AssertEquals(t, nonJSONWrites.Count(), writes+2)
+		vv, err = db.GetState("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+
+	}
+}
+
+func TestApplyUpdatesEmptyBatch(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	err := db.ApplyUpdates(statedb.NewUpdateBatch(), version.NewHeight(2, 3))
+	testutil.AssertNoError(t, err, "")
+
+	// only the fence after the savepoint is issued, there are no data writes to flush
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_ensure_full_commit"), 1)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 1)
+
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(2, 3))
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(3, 1))
+	err = db.ApplyUpdates(batch, version.NewHeight(3, 1))
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_ensure_full_commit"), 3)
+}
+
+func TestFullCommitByServerVersion(t *testing.T) {
+	for _, serverVersion := range []string{"1.6.1", "2.1.0"} {
+		mock, server := newMockCouchDB()
+		mock.serverVersion = serverVersion
+		db := newMockVersionedDB(t, server, "testdb")
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+		sp, err := db.GetLatestSavePoint()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+
+		// 1.x is fenced before and after the savepoint, a 2.x cluster relies on quorum writes
+		expectedFences := 2
+		if serverVersion == "2.1.0" {
+			expectedFences = 0
+		}
+		testutil.AssertEquals(t, mock.countRequests("POST", "/_ensure_full_commit"), expectedFences)
+		// the version is read once
+		testutil.AssertEquals(t, mock.countRequests("GET", "/"), 1)
+		server.Close()
+	}
+}
+
+func TestSavepointBlockInterval(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.savepointBlockInterval = 3
+
+	for blockNum := uint64(1); blockNum <= 2; blockNum++ {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(blockNum, 1))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(blockNum, 1)), "")
+	}
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 0)
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(0, 0))
+
+	// the savepoint is recorded on the 3rd commit
+	testutil.AssertNoError(t, db.ApplyUpdates(statedb.NewUpdateBatch(), version.NewHeight(3, 1)), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 1)
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(3, 1))
+
+	// an explicit flush records the pending savepoint
+	testutil.AssertNoError(t, db.ApplyUpdates(statedb.NewUpdateBatch(), version.NewHeight(4, 1)), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 1)
+	testutil.AssertNoError(t, db.Flush(), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 2)
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(4, 1))
+
+	// nothing is pending, a second flush is a no-op
+	testutil.AssertNoError(t, db.Flush(), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 2)
+
+	// shutdown records the pending savepoint
+	testutil.AssertNoError(t, db.ApplyUpdates(statedb.NewUpdateBatch(), version.NewHeight(5, 1)), "")
+	db.Close()
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 3)
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(5, 1))
+}
+
+func TestGetStateByRevision(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"owner":"tom"}`), version.NewHeight(1, 1))
+		db.ApplyUpdates(batch, version.NewHeight(1, 1))
+		_, rev1, err := vdb.db.ReadDoc(string(ConstructCompositeKey("ns1", "key1")))
+		testutil.AssertNoError(t, err, "")
+
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"owner":"jerry"}`), version.NewHeight(2, 1))
+		db.ApplyUpdates(batch, version.NewHeight(2, 1))
+
+		vv, err := vdb.GetStateByRevision("ns1", "key1", rev1)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "tom"), true)
+
+		vv, err = vdb.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "jerry"), true)
+
+		_, err = vdb.GetStateByRevision("ns1", "key1", "1-0123456789abcdef")
+		testutil.AssertEquals(t, err, ErrRevisionNotFound)
+
+	}
+}
+
+func TestGetStateByRevisions(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"owner":"tom"}`), version.NewHeight(1, 1))
+		batch.Put("ns2", "key2", []byte("binary value"), version.NewHeight(1, 1))
+		db.ApplyUpdates(batch, version.NewHeight(1, 1))
+		_, token1, err := vdb.GetStateForUpdate("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"owner":"jerry"}`), version.NewHeight(2, 1))
+		db.ApplyUpdates(batch, version.NewHeight(2, 1))
+		_, token2, err := vdb.GetStateForUpdate("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+
+		results, err := vdb.GetStateByRevisions([]KeyRevision{{"ns1", "key1", token1}, {"ns1", "key1", token2},
+			{"ns2", "key2", ""}, {"ns1", "key1", "1-0123456789abcdef"}, {"ns1", "key3", ""}})
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(results), 5)
+		testutil.AssertEquals(t, results[0].KeyRevision, KeyRevision{"ns1", "key1", token1})
+		testutil.AssertEquals(t, strings.Contains(string(results[0].VersionedValue.Value), "tom"), true)
+		testutil.AssertEquals(t, results[1].KeyRevision, KeyRevision{"ns1", "key1", token2})
+		testutil.AssertEquals(t, strings.Contains(string(results[1].VersionedValue.Value), "jerry"), true)
+		testutil.AssertNoError(t, results[2].Err, "")
+		testutil.AssertEquals(t, results[2].VersionedValue.Value, []byte("binary value"))
+
+		// a pruned revision and a missing key fail individually
+		testutil.AssertEquals(t, results[3].Err, ErrRevisionNotFound)
+		testutil.AssertNil(t, results[3].VersionedValue)
+		testutil.AssertEquals(t, results[4].Key, "key3")
+		testutil.AssertEquals(t, results[4].Err, ErrRevisionNotFound)
+
+	}
+}
+
+func TestApplyUpdatesWithToken(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	testutil.AssertNoError(t, db.ApplyUpdatesWithToken(batch, version.NewHeight(1, 2), "block1"), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key1"), 1)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 1)
+
+	// retrying the same batch is a no-op
+	testutil.AssertNoError(t, db.ApplyUpdatesWithToken(batch, version.NewHeight(1, 2), "block1"), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key1"), 1)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 1)
+
+	// the retry is detected from the recorded savepoint as well, e.g. after a restart
+	db = newMockVersionedDB(t, server, "testdb")
+	testutil.AssertNoError(t, db.ApplyUpdatesWithToken(batch, version.NewHeight(1, 2), "block1"), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key1"), 1)
+
+	// a different token at the same height is applied
+	testutil.AssertNoError(t, db.ApplyUpdatesWithToken(batch, version.NewHeight(1, 2), "block1-retry"), "")
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key1"), 2)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 2)
+}
+
+func TestCompressLargeJSONValues(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		defer viper.Set("ledger.state.couchDBConfig.compressionThreshold", 0)
+		viper.Set("ledger.state.couchDBConfig.compressionThreshold", 100)
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		largeValue := []byte(`{"asset_name":"marble2","notes":"` + strings.Repeat("blue marble ", 50) + `"}`)
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", largeValue, version.NewHeight(1, 2))
+		db.ApplyUpdates(batch, version.NewHeight(1, 2))
+
+		// only the large value is stored compressed
+		_, attachments, _, err := vdb.db.ReadDocAttachments(string(ConstructCompositeKey("ns1", "key1")), "")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, attachments)
+		_, attachments, _, err = vdb.db.ReadDocAttachments(string(ConstructCompositeKey("ns1", "key2")), "")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(attachments), 1)
+		testutil.AssertEquals(t, attachments[0].ContentType, compressedContentType)
+		testutil.AssertEquals(t, len(attachments[0].AttachmentBytes) < len(largeValue), true)
+
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+
+		// the compressed value is returned byte-identical to the value written
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, largeValue)
+
+	}
+}
+
+func TestAsyncCommit(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.asyncCommitQueueSize = 10
+
+	mock.holdWrites = make(chan struct{})
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(2, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+
+	// the savepoint lags while the queued batches are not written
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(0, 0))
+
+	mock.mux.Lock()
+	close(mock.holdWrites)
+	mock.mux.Unlock()
+	testutil.AssertNoError(t, db.WaitForCommits(), "")
+
+	// the batches were applied in order
+	testutil.AssertEquals(t, strings.Contains(string(mock.getDoc("ns1\x00key1")), "marble2"), true)
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(2, 1))
+}
+
+func TestGetKeys(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	batch.Put("ns2", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(1, 3))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+	docReads := mock.countRequests("GET", "key1") + mock.countRequests("GET", "key2")
+
+	itr, err := db.GetKeys("ns1")
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+	keys := []statedb.CompositeKey{}
+	for {
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		if queryResult == nil {
+			break
+		}
+		keys = append(keys, *queryResult.(*statedb.CompositeKey))
+	}
+	testutil.AssertEquals(t, keys, []statedb.CompositeKey{{Namespace: "ns1", Key: "key1"}, {Namespace: "ns1", Key: "key2"}})
+
+	// only the ids were retrieved, no document was read
+	testutil.AssertEquals(t, mock.countRequests("GET", "/_all_docs"), 1)
+	testutil.AssertEquals(t, mock.countRequests("GET", "key1")+mock.countRequests("GET", "key2"), docReads)
+}
+
+func TestGetKeysPaged(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.resultsPageSize = 2
+
+	batch := statedb.NewUpdateBatch()
+	for i := 1; i <= 5; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i)))
+	}
+	batch.Put("ns2", "key1", []byte(`{"asset_name":"marble6"}`), version.NewHeight(1, 6))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 6)), "")
+
+	// only the first page is read until the keys are iterated
+	itr, err := db.GetKeys("ns1")
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+	testutil.AssertEquals(t, mock.countRequests("GET", "/_all_docs"), 1)
+	keys := []string{}
+	for {
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		if queryResult == nil {
+			break
+		}
+		keys = append(keys, queryResult.(*statedb.CompositeKey).Key)
+	}
+	testutil.AssertEquals(t, keys, []string{"key1", "key2", "key3", "key4", "key5"})
+
+	// each page starts after the last id of the page before it, no id is skipped by CouchDB
+	queries := mock.requestQueries("GET", "/_all_docs")
+	testutil.AssertEquals(t, len(queries), 3)
+	for _, query := range queries {
+		testutil.AssertEquals(t, query.Get("skip") == "" || query.Get("skip") == "0", true)
+	}
+	var startKey string
+	testutil.AssertNoError(t, json.Unmarshal([]byte(queries[1].Get("startkey")), &startKey), "")
+	testutil.AssertEquals(t, startKey, compositeKeyID("ns1", "key2")+"\x00")
+}
+
+func TestCreateDBWithShardsAndReplicas(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.shards", 0)
+	defer viper.Set("ledger.state.couchDBConfig.replicas", 0)
+	viper.Set("ledger.state.couchDBConfig.shards", 16)
+	viper.Set("ledger.state.couchDBConfig.replicas", 3)
+
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.dbMissing = true
+	newMockVersionedDB(t, server, "testdb")
+	testutil.AssertEquals(t, mock.creates, 1)
+	testutil.AssertEquals(t, mock.createQuery, "n=3&q=16")
+}
+
+func TestMissingDatabase(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	// the database is deleted from under the handle
+	deleteDB := func() {
+		mock.mux.Lock()
+		defer mock.mux.Unlock()
+		mock.dbMissing = true
+		mock.docs = make(map[string][]byte)
+	}
+	deleteDB()
+
+	// by default, the reads and the updates fail with a typed error
+	_, err := db.GetState("ns1", "key1")
+	testutil.AssertEquals(t, err, &couchdb.ErrDatabaseNotFound{DBName: "testdb"})
+	err = db.ApplyUpdates(batch, version.NewHeight(1, 2))
+	testutil.AssertEquals(t, err, &couchdb.ErrDatabaseNotFound{DBName: "testdb"})
+	testutil.AssertEquals(t, mock.creates, 0)
+
+	// if configured, the database is recreated, empty, and the operation is retried
+	defer viper.Set("ledger.state.couchDBConfig.recreateMissingDatabases", false)
+	viper.Set("ledger.state.couchDBConfig.recreateMissingDatabases", true)
+	mock.dbMissing = false
+	db = newMockVersionedDB(t, server, "testdb")
+	deleteDB()
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	testutil.AssertEquals(t, mock.creates, 1)
+
+	deleteDB()
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+	testutil.AssertEquals(t, mock.creates, 2)
+	vv, err = db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte(`{"asset_name":"marble1"}`))
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		viper.Set("ledger.state.couchDBConfig.recreateMissingDatabases", false)
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testmissingdb")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+		_, err = db.(*VersionedDB).db.DropDatabase()
+		testutil.AssertNoError(t, err, "")
+
+		_, err = db.GetState("ns1", "key1")
+		testutil.AssertEquals(t, err, &couchdb.ErrDatabaseNotFound{DBName: "testmissingdb"})
+
+		db.(*VersionedDB).recreateMissingDB = true
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(1, 2))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+	mock.mux.Lock()
+	mock.tombstones = map[string]string{"ns1\x00key2": "2-deleted", "ns1\x00key4": "3-deleted"}
+	mock.mux.Unlock()
+
+	// the purge is refused if the databases are replicated
+	defer viper.Set("ledger.state.couchDBConfig.replicated", false)
+	viper.Set("ledger.state.couchDBConfig.replicated", true)
+	_, err := db.PurgeDeleted()
+	testutil.AssertSame(t, err, ErrPurgeUnsafe)
+	viper.Set("ledger.state.couchDBConfig.replicated", false)
+	testutil.AssertEquals(t, len(mock.purges), 0)
+
+	// only the deleted revisions of the deleted documents are purged
+	purged, err := db.PurgeDeleted()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, purged, 2)
+	testutil.AssertEquals(t, len(mock.purges), 1)
+	var purgeRequest map[string][]string
+	testutil.AssertNoError(t, json.Unmarshal([]byte(mock.purges[0]), &purgeRequest), "")
+	testutil.AssertEquals(t, purgeRequest, map[string][]string{"ns1\x00key2": {"2-deleted"}, "ns1\x00key4": {"3-deleted"}})
+	testutil.AssertEquals(t, len(mock.tombstones), 0)
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNotNil(t, vv)
+
+	// without deleted documents, nothing is purged
+	purged, err = db.PurgeDeleted()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, purged, 0)
+	testutil.AssertEquals(t, len(mock.purges), 1)
+
+	// a server not supporting purge is reported
+	mock.mux.Lock()
+	mock.tombstones = map[string]string{"ns1\x00key2": "4-deleted"}
+	mock.purgeNotImplemented = true
+	mock.mux.Unlock()
+	_, err = db.PurgeDeleted()
+	testutil.AssertSame(t, err, couchdb.ErrPurgeNotSupported)
+}
+
+func TestPerDBLogLevel(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+	db1, err := provider.GetDBHandle("testdb1")
+	testutil.AssertNoError(t, err, "")
+	db2, err := provider.GetDBHandle("testdb2")
+	testutil.AssertNoError(t, err, "")
+
+	buf := &bytes.Buffer{}
+	logging.SetBackend(logging.NewLogBackend(buf, "", 0))
+	defer logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags))
+	logging.SetLevel(logging.INFO, "statecouchdb")
+
+	// debug is enabled for the operations on testdb1 only
+	testutil.AssertError(t, provider.SetLogLevel("testdb1", "NOISY"), "Expected an invalid level to be rejected")
+	testutil.AssertNoError(t, provider.SetLogLevel("testdb1", "DEBUG"), "")
+	db1.GetState("ns1", "key1")
+	db2.GetState("ns1", "key1")
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "[testdb1] GetState(). ns=ns1, key=key1"), true)
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "[testdb2]"), false)
+
+	// once reset, the logs of testdb1 follow the level of the module again
+	buf.Reset()
+	testutil.AssertNoError(t, provider.SetLogLevel("testdb1", ""), "")
+	db1.GetState("ns1", "key1")
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "[testdb1]"), false)
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	buf := &bytes.Buffer{}
+	logging.SetBackend(logging.NewLogBackend(buf, "", 0))
+	defer logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags))
+	logging.SetLevel(logging.INFO, "statecouchdb")
+
+	mock.mux.Lock()
+	mock.delay = 20 * time.Millisecond
+	mock.mux.Unlock()
+
+	// the slow-query log is disabled by default
+	db.GetState("ns1", "key1")
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "Slow operation"), false)
+
+	// the operations taking at least the threshold are logged with what they read or wrote
+	db.slowQueryThreshold = 10 * time.Millisecond
+	db.GetState("ns1", "key1")
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "[testdb] Slow operation GetState took"), true)
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "namespace [ns1] key [key1]"), true)
+	itr, err := db.GetStateRangeScanIterator("ns1", "key1", "key3")
+	testutil.AssertNoError(t, err, "")
+	itr.Close()
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "Slow operation GetStateRangeScanIterator took"), true)
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "namespace [ns1] range [key1, key3)"), true)
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "Slow operation ApplyUpdates took"), true)
+
+	// the operations faster than the threshold are not logged
+	buf.Reset()
+	db.slowQueryThreshold = time.Minute
+	db.GetState("ns1", "key1")
+	testutil.AssertEquals(t, strings.Contains(buf.String(), "Slow operation"), false)
+}
+
+func TestQuorumSavepointReads(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+
+	// the savepoint is read with the server default by default
+	db := newMockVersionedDB(t, server, "testdb")
+	_, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	queries := mock.requestQueries("GET", "/"+savepointDocID)
+	testutil.AssertEquals(t, len(queries), 1)
+	testutil.AssertEquals(t, queries[0].Get("r"), "")
+
+	// a majority of the cluster default replicas
+	defer viper.Set("ledger.state.couchDBConfig.quorumSavepointReads", false)
+	viper.Set("ledger.state.couchDBConfig.quorumSavepointReads", true)
+	db = newMockVersionedDB(t, server, "testdb")
+	_, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	queries = mock.requestQueries("GET", "/"+savepointDocID)
+	testutil.AssertEquals(t, len(queries), 2)
+	testutil.AssertEquals(t, queries[1].Get("r"), "2")
+
+	// a majority of the configured replicas
+	defer viper.Set("ledger.state.couchDBConfig.replicas", 0)
+	viper.Set("ledger.state.couchDBConfig.replicas", 5)
+	db = newMockVersionedDB(t, server, "testdb")
+	_, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	queries = mock.requestQueries("GET", "/"+savepointDocID)
+	testutil.AssertEquals(t, queries[2].Get("r"), "3")
+
+	// the state is read with the server default
+	db.GetState("ns1", "key1")
+	queries = mock.requestQueries("GET", "/ns1\x00key1")
+	testutil.AssertEquals(t, len(queries), 1)
+	testutil.AssertEquals(t, queries[0].Get("r"), "")
+}
+
+func TestSavepointMirror(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	defer viper.Set("peer.fileSystemPath", viper.GetString("peer.fileSystemPath"))
+	viper.Set("peer.fileSystemPath", "/tmp/fabric/ledgertests/statecouchdb")
+	defer os.RemoveAll("/tmp/fabric/ledgertests/statecouchdb")
+	defer viper.Set("ledger.state.couchDBConfig.savepointMirror", false)
+	viper.Set("ledger.state.couchDBConfig.savepointMirror", true)
+	provider := newMockProvider(t, server)
+	defer provider.Close()
+	handle, err := provider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	db := handle.(*VersionedDB)
+
+	// the savepoint is mirrored on commit
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNoError(t, db.Flush(), "")
+	mirrored, err := provider.savepointMirror.get("testdb")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, mirrored.height(), version.NewHeight(1, 1))
+	testutil.AssertEquals(t, mirrored.Rev, "1-mock")
+
+	// the mirrored savepoint is read once its revision is checked, without reading the savepoint document
+	reads := mock.countRequests("GET", "/"+savepointDocID)
+	height, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, height, version.NewHeight(1, 1))
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+savepointDocID), reads)
+	testutil.AssertEquals(t, mock.countRequests("HEAD", "/"+savepointDocID), 1)
+
+	// CouchDB is authoritative when the savepoint document was updated elsewhere, and the mirror follows it
+	mock.mux.Lock()
+	mock.docs[savepointDocID] = []byte(`{"BlockNum":5,"TxNum":2,"UpdateSeq":"9-mock"}`)
+	mock.revs[savepointDocID]++
+	mock.mux.Unlock()
+	height, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, height, version.NewHeight(5, 2))
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+savepointDocID), reads+1)
+	mirrored, err = provider.savepointMirror.get("testdb")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, mirrored.height(), version.NewHeight(5, 2))
+	testutil.AssertEquals(t, mirrored.Rev, "2-mock")
+	height, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, height, version.NewHeight(5, 2))
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+savepointDocID), reads+1)
+}
+
+func TestAttachmentCache(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.attachmentCache = newAttachmentCache(1024)
+
+	id := compositeKeyID("ns1", "key1")
+	stubDoc := `{"_id":"ns1\u0000key1","_attachments":{"valueBytes":{"content_type":"application/octet-stream","digest":"%s","length":%d,"stub":true}}}`
+	mock.mux.Lock()
+	mock.docs[id] = []byte(fmt.Sprintf(stubDoc, "md5-1", 12))
+	mock.revs[id] = 1
+	mock.attachments = map[string][]byte{id + "/valueBytes": []byte("binary value")}
+	mock.mux.Unlock()
+
+	// the second read reuses the cached attachment, as its digest is unchanged
+	for i := 0; i < 2; i++ {
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+		// the value returned does not share the bytes of the cached attachment
+		vv.Value[0] = 'B'
+	}
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+id), 2)
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+id+"/valueBytes"), 1)
+
+	// an attachment with another digest is read again
+	mock.mux.Lock()
+	mock.docs[id] = []byte(fmt.Sprintf(stubDoc, "md5-2", 13))
+	mock.revs[id]++
+	mock.attachments[id+"/valueBytes"] = []byte("binary value2")
+	mock.mux.Unlock()
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte("binary value2"))
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+id+"/valueBytes"), 2)
+	queries := mock.requestQueries("GET", "/"+id+"/valueBytes")
+	testutil.AssertEquals(t, queries[1].Get("rev"), "2-mock")
+
+	// the least recently used attachments are evicted once the cache is full
+	cache := newAttachmentCache(10)
+	cache.put("doc1", "md5-1", &couchdb.Attachment{Name: valueAttachmentName, AttachmentBytes: make([]byte, 4)})
+	cache.put("doc2", "md5-2", &couchdb.Attachment{Name: valueAttachmentName, AttachmentBytes: make([]byte, 4)})
+	_, ok := cache.get("doc1", "md5-1")
+	testutil.AssertEquals(t, ok, true)
+	cache.put("doc3", "md5-3", &couchdb.Attachment{Name: valueAttachmentName, AttachmentBytes: make([]byte, 4)})
+	_, ok = cache.get("doc2", "md5-2")
+	testutil.AssertEquals(t, ok, false)
+	_, ok = cache.get("doc1", "md5-1")
+	testutil.AssertEquals(t, ok, true)
+	cache.put("doc4", "md5-4", &couchdb.Attachment{Name: valueAttachmentName, AttachmentBytes: make([]byte, 11)})
+	_, ok = cache.get("doc4", "md5-4")
+	testutil.AssertEquals(t, ok, false)
+}
+
+func TestKeyEncodingCheck(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+
+	// the key encoding is recorded when the database is first opened
+	provider := newMockProvider(t, server)
+	_, err := provider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	provider.Close()
+	mock.mux.Lock()
+	stored := KeyEncoding{}
+	testutil.AssertNoError(t, json.Unmarshal(mock.docs[keyEncodingDocID], &stored), "")
+	mock.mux.Unlock()
+	testutil.AssertEquals(t, stored, KeyEncoding{Version: keyEncodingVersion, Scheme: escapedKeyScheme})
+
+	// a database written with the ordered keys cannot be opened with the escaped keys
+	defer viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", true)
+	provider = newMockProvider(t, server)
+	_, err = provider.GetDBHandle("testdb")
+	testutil.AssertEquals(t, err, &ErrKeyEncodingMismatch{DBName: "testdb",
+		Stored:  KeyEncoding{Version: keyEncodingVersion, Scheme: escapedKeyScheme},
+		Current: KeyEncoding{Version: keyEncodingVersion, Scheme: orderedKeyScheme}})
+	testutil.AssertEquals(t, err.Error(), "Database testdb was written with key encoding 1/escaped, which is incompatible with the configured key encoding 1/ordered")
+	provider.Close()
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+
+	// nor can a database written with another version of the key encoding
+	mock.mux.Lock()
+	mock.docs[keyEncodingDocID] = []byte(`{"Version":2,"Scheme":"escaped"}`)
+	mock.mux.Unlock()
+	provider = newMockProvider(t, server)
+	defer provider.Close()
+	_, _, err = provider.OpenDBs([]string{"testdb"})
+	_, ok := err.(*ErrKeyEncodingMismatch)
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, strings.Contains(err.Error(), "key encoding 2/escaped"), true)
+}
+
+func TestReadSetBulkFetch(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.serverVersion = "2.1.1"
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	for i := 0; i < 20; i += 2 {
+		batch.Put("ns1", fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i+1)))
+	}
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 20)), "")
+
+	// the 20 keys of the read set are fetched in a single bulk read
+	reads := mock.countRequests("GET", "key00")
+	readSet := db.NewReadSet()
+	for i := 0; i < 20; i++ {
+		readSet.Add("ns1", fmt.Sprintf("key%02d", i))
+	}
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_get"), 0)
+	testutil.AssertNoError(t, readSet.Flush(), "")
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_get"), 1)
+	testutil.AssertEquals(t, mock.countRequests("GET", "key00"), reads)
+	values := readSet.Values()
+	testutil.AssertEquals(t, len(values), 20)
+	testutil.AssertEquals(t, values[statedb.CompositeKey{Namespace: "ns1", Key: "key01"}] == nil, true)
+	vv := values[statedb.CompositeKey{Namespace: "ns1", Key: "key02"}]
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), `"asset_name":"marble2"`), true)
+	testutil.AssertEquals(t, vv.Version, version.NewHeight(1, 3))
+
+	// the keys fetched are not fetched again, the first Get of a key not fetched yet fetches it
+	vv, err := readSet.Get("ns1", "key04")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), `"asset_name":"marble4"`), true)
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_get"), 1)
+	readSet.Add("ns1", "key20")
+	vv, err = readSet.Get("ns1", "key21")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv == nil, true)
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_get"), 2)
+	_, fetched := readSet.Values()[statedb.CompositeKey{Namespace: "ns1", Key: "key20"}]
+	testutil.AssertEquals(t, fetched, true)
+
+	// in bulk read mode GetStateMultipleKeys reads the keys in a single bulk read
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("key%02d", i))
+	}
+	db.bulkReads = true
+	vals, err := db.GetStateMultipleKeys("ns1", keys)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_get"), 3)
+	testutil.AssertEquals(t, mock.countRequests("GET", "key00"), reads)
+	testutil.AssertEquals(t, len(vals), 20)
+	testutil.AssertEquals(t, strings.Contains(string(vals[0].Value), `"asset_name":"marble0"`), true)
+	testutil.AssertEquals(t, vals[1] == nil, true)
+}
+
+func TestCompactAll(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+	defer provider.Close()
+
+	dbNames := []string{"testdb1", "testdb2", "testdb3"}
+	for _, dbName := range dbNames {
+		_, err := provider.GetDBHandle(dbName)
+		testutil.AssertNoError(t, err, "")
+	}
+
+	// the compaction is started on each database, with the views of each design document once
+	mock.mux.Lock()
+	mock.designDocs = []string{"_design/fabric_ns_ns1", "_design/fabric_ns_ns1", "_design/fabric_query"}
+	mock.mux.Unlock()
+	results, err := provider.CompactAll(CompactOptions{Concurrency: 2, Views: true})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, len(results), 3)
+	for i, dbName := range dbNames {
+		testutil.AssertEquals(t, mock.countRequests("POST", "/"+dbName+"/_compact"), 1)
+		testutil.AssertEquals(t, mock.countRequests("POST", "/"+dbName+"/_compact/fabric_ns_ns1"), 1)
+		testutil.AssertEquals(t, mock.countRequests("POST", "/"+dbName+"/_compact/fabric_query"), 1)
+		testutil.AssertEquals(t, results[i].DBName, dbName)
+		testutil.AssertEquals(t, results[i].DesignDocs, []string{"_design/fabric_ns_ns1", "_design/fabric_query"})
+		testutil.AssertNoError(t, results[i].Err, "")
+	}
+
+	// the failure to compact a database does not stop the compaction of the others, and is reported
+	mock.mux.Lock()
+	mock.failCompactions = map[string]bool{"testdb2": true}
+	mock.mux.Unlock()
+	results, err = provider.CompactAll(CompactOptions{})
+	testutil.AssertError(t, err, "Expected an error for the database whose compaction failed")
+	testutil.AssertEquals(t, strings.Contains(err.Error(), "[testdb2]"), true)
+	testutil.AssertNoError(t, results[0].Err, "")
+	testutil.AssertError(t, results[1].Err, "Expected an error for the database whose compaction failed")
+	testutil.AssertNoError(t, results[2].Err, "")
+	testutil.AssertEquals(t, len(results[0].DesignDocs), 0)
+	for _, dbName := range dbNames {
+		testutil.AssertEquals(t, mock.countRequests("POST", "/"+dbName+"/_compact"), 2)
+	}
+
+	provider.Close()
+	_, err = provider.CompactAll(CompactOptions{})
+	testutil.AssertEquals(t, err, ErrProviderClosed)
+}
+
+func TestIndexBuildStatus(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// the index is building while the updater runs, and is not ready until it catches up with the database
+	mock.mux.Lock()
+	mock.updateSeq = 120
+	mock.designDocInfos = map[string]string{"fabric_query": `{"updater_running":true,"update_seq":40}`}
+	mock.mux.Unlock()
+	status, err := db.IndexBuildStatus("_design/fabric_query")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, status, &IndexBuildStatus{DesignDoc: "_design/fabric_query", Building: true,
+		IndexedSeq: "40", DatabaseSeq: "120-mock"})
+
+	mock.mux.Lock()
+	mock.designDocInfos["fabric_query"] = `{"updater_running":false,"update_seq":100}`
+	mock.mux.Unlock()
+	status, err = db.IndexBuildStatus("fabric_query")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, status.Building, false)
+	testutil.AssertEquals(t, status.Ready, false)
+
+	mock.mux.Lock()
+	mock.designDocInfos["fabric_query"] = `{"updater_running":false,"update_seq":"120-g1AAAAFTeJzLYWBg4MhgTmHgz8tPSTV0MDQy1zMAQsMcoARTIkMeC8N_IMjKYE5"}`
+	mock.mux.Unlock()
+	status, err = db.IndexBuildStatus("_design/fabric_query")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, status.Building, false)
+	testutil.AssertEquals(t, status.Ready, true)
+	testutil.AssertEquals(t, mock.countRequests("GET", "/testdb/_design/fabric_query/_info"), 3)
+
+	// a missing design document fails
+	_, err = db.IndexBuildStatus("_design/missing")
+	testutil.AssertError(t, err, "Expected an error for a missing design document")
+}
+
+func TestCloseWaitsForInFlightCommits(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.Open()
+
+	mock.holdWrites = make(chan struct{})
+	var commits sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		commits.Add(1)
+		go func(blockNum uint64) {
+			defer commits.Done()
+			batch := statedb.NewUpdateBatch()
+			for j := uint64(1); j <= 3; j++ {
+				batch.Put("ns1", fmt.Sprintf("block%d-key%d", blockNum, j), []byte(`{"asset_name":"marble"}`), version.NewHeight(blockNum, j))
+			}
+			testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(blockNum, 3)), "")
+		}(uint64(i))
+	}
+	// the batches are applied one at a time, the first one is held while the others wait
+	for mock.getHeldWrites() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		db.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Close returned while commits were in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mock.mux.Lock()
+	close(mock.holdWrites)
+	mock.mux.Unlock()
+	<-closed
+	commits.Wait()
+
+	// every batch was applied completely
+	for i := 1; i <= 3; i++ {
+		for j := 1; j <= 3; j++ {
+			testutil.AssertNotNil(t, mock.getDoc(fmt.Sprintf("ns1\x00block%d-key%d", i, j)))
+		}
+	}
+}
+
+func TestValueChecksums(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		defer viper.Set("ledger.state.couchDBConfig.checksums", false)
+		viper.Set("ledger.state.couchDBConfig.checksums", true)
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		binaryValue := []byte{0x00, 0x01, 0x02, 0xff}
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","size":12345678901234567890}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", binaryValue, version.NewHeight(1, 2))
+		db.ApplyUpdates(batch, version.NewHeight(1, 2))
+
+		// the values round-trip, without the checksum
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), `"size":12345678901234567890`), true)
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), checksumField), false)
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, binaryValue)
+
+		// tampering with the stored JSON value is detected
+		compositeKey := string(ConstructCompositeKey("ns1", "key1"))
+		storedDoc, _, err := vdb.db.ReadDoc(compositeKey)
+		testutil.AssertNoError(t, err, "")
+		_, err = vdb.db.SaveDoc(compositeKey, "", bytes.Replace(storedDoc, []byte("marble1"), []byte("marble2"), 1), nil)
+		testutil.AssertNoError(t, err, "")
+		_, err = db.GetState("ns1", "key1")
+		testutil.AssertEquals(t, err, ErrChecksumMismatch)
+
+		// as is tampering with a stored binary value
+		compositeKey = string(ConstructCompositeKey("ns1", "key2"))
+		checksumDoc := []byte(fmt.Sprintf(`{"%s":"%s"}`, checksumField, binaryChecksum(binaryValue)))
+		_, err = vdb.db.SaveDoc(compositeKey, "", checksumDoc, []couchdb.Attachment{{Name: "valueBytes",
+			ContentType: "application/octet-stream", AttachmentBytes: []byte{0x00, 0x01, 0x02, 0xfe}}})
+		testutil.AssertNoError(t, err, "")
+		_, err = db.GetState("ns1", "key2")
+		testutil.AssertEquals(t, err, ErrChecksumMismatch)
+
+	}
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.credentials = "admin:secret1"
+
+	couchInstance, err := couchdb.CreateCouchInstance(server.Listener.Addr().String(), "admin", "secret1")
+	testutil.AssertNoError(t, err, "")
+	provider := &VersionedDBProvider{couchInstance: couchInstance, databases: make(map[string]*VersionedDB)}
+	db, err := provider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	// the credentials are rotated on the server
+	mock.mux.Lock()
+	mock.credentials = "admin:secret2"
+	mock.mux.Unlock()
+	_, err = db.GetState("ns1", "key1")
+	testutil.AssertError(t, err, "Expected an error with the rotated credentials")
+
+	// the open handle authenticates with the refreshed credentials
+	provider.RefreshCredentials("admin", "secret2")
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+}
+
+func TestRangeScanWithFilter(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","color":"blue"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2","color":"red"}`), version.NewHeight(1, 2))
+	batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3","color":"blue"}`), version.NewHeight(1, 3))
+	batch.Put("ns1", "key4", []byte(`{"asset_name":"marble4","color":"red"}`), version.NewHeight(1, 4))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 4)), "")
+
+	itr, err := db.GetStateRangeScanIteratorWithFilter("ns1", "key1", "key4", func(key string, value []byte) bool {
+		return strings.Contains(string(value), "blue")
+	})
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+
+	keys := []string{}
+	for {
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		if queryResult == nil {
+			break
+		}
+		keys = append(keys, queryResult.(*statedb.VersionedKV).Key)
+	}
+	testutil.AssertEquals(t, keys, []string{"key1", "key3"})
+}
+
+func TestRangeScanMultiByteNamespace(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	namespaces := []string{"ns", "nsé", "ns日本", "ns日本語"}
+	batch := statedb.NewUpdateBatch()
+	for _, ns := range namespaces {
+		for _, key := range []string{"a", "key1", "ÿ", "日本"} {
+			batch.Put(ns, key, []byte(`{"asset_name":"marble"}`), version.NewHeight(1, 1))
+		}
+	}
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	// an open ended scan returns all the keys of the namespace, and only those
+	for _, ns := range namespaces {
+		itr, err := db.GetStateRangeScanIterator(ns, "", "")
+		testutil.AssertNoError(t, err, "")
+		keys := []string{}
+		for {
+			queryResult, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			if queryResult == nil {
+				break
+			}
+			testutil.AssertEquals(t, queryResult.(*statedb.VersionedKV).Namespace, ns)
+			keys = append(keys, queryResult.(*statedb.VersionedKV).Key)
+		}
+		itr.Close()
+		testutil.AssertEquals(t, keys, []string{"a", "key1", "ÿ", "日本"})
+	}
+}
+
+func TestGetAllDatabases(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.allDBs = []string{"_global_changes", "_replicator", "_users", "fabric_locks", "mychannel", "testchain.v1-2"}
+
+	couchInstance, err := couchdb.CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, "")
+	provider := &VersionedDBProvider{couchInstance: couchInstance, databases: make(map[string]*VersionedDB)}
+	dbNames, err := provider.GetAllDatabases()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, dbNames, []string{"mychannel", "testchain.v1-2"})
+}
+
+func TestApplyUpdatesWithExpectedTokens(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"tom"}`), version.NewHeight(1, 1))
+		db.ApplyUpdates(batch, version.NewHeight(1, 1))
+
+		// read-modify-write of an unchanged key succeeds, as does the creation of an absent key
+		_, token, err := vdb.GetStateForUpdate("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		vv, absentToken, err := vdb.GetStateForUpdate("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"jerry"}`), version.NewHeight(2, 1))
+		batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2","owner":"jerry"}`), version.NewHeight(2, 1))
+		tokens := map[statedb.CompositeKey]string{{Namespace: "ns1", Key: "key1"}: token, {Namespace: "ns1", Key: "key2"}: absentToken}
+		testutil.AssertNoError(t, vdb.ApplyUpdatesWithExpectedTokens(batch, version.NewHeight(2, 1), tokens), "")
+		vv, err = db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "jerry"), true)
+
+		// the key changes after it is read for update, the update fails and nothing is applied
+		_, token, err = vdb.GetStateForUpdate("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"bob"}`), version.NewHeight(3, 1))
+		db.ApplyUpdates(batch, version.NewHeight(3, 1))
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"alice"}`), version.NewHeight(4, 1))
+		batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3","owner":"alice"}`), version.NewHeight(4, 1))
+		tokens = map[statedb.CompositeKey]string{{Namespace: "ns1", Key: "key1"}: token}
+		testutil.AssertEquals(t, vdb.ApplyUpdatesWithExpectedTokens(batch, version.NewHeight(4, 1), tokens), ErrStale)
+		vv, err = db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "bob"), true)
+		vv, err = db.GetState("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+
+	}
+}
+
+func TestNamespaceSchema(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	schema := []byte(`{"type":"object","required":["asset_name","size"],
+		"properties":{"asset_name":{"type":"string","pattern":"^marble"},"size":{"type":"integer","minimum":1}}}`)
+	testutil.AssertNoError(t, db.RegisterNamespaceSchema("ns1", schema), "")
+	testutil.AssertError(t, db.RegisterNamespaceSchema("ns1", []byte(`{"type":`)), "Invalid schema should be rejected")
+
+	// a conforming value is written, as is any value of a namespace without a schema
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","size":3}`), version.NewHeight(1, 1))
+	batch.Put("ns2", "key1", []byte(`{"size":"large"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNotNil(t, vv)
+
+	// a violating value fails the whole batch, naming the key
+	writes := mock.countRequests("PUT", "")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2","size":2}`), version.NewHeight(2, 1))
+	batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3","size":0}`), version.NewHeight(2, 1))
+	err = db.ApplyUpdates(batch, version.NewHeight(2, 1))
+	violation, ok := err.(*ErrSchemaViolation)
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, violation.Key, "key3")
+	testutil.AssertEquals(t, violation.Reason, "$.size 0 is less than minimum 1")
+	testutil.AssertEquals(t, mock.countRequests("PUT", ""), writes)
+
+	for _, value := range []string{`{"asset_name":"marble2"}`, `{"asset_name":"box","size":1}`,
+		`{"asset_name":"marble2","size":1.5}`, `["marble2"]`, `not json`} {
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key2", []byte(value), version.NewHeight(2, 1))
+		_, ok = db.ApplyUpdates(batch, version.NewHeight(2, 1)).(*ErrSchemaViolation)
+		testutil.AssertEquals(t, ok, true)
+	}
+
+	// deletes are not validated
+	batch = statedb.NewUpdateBatch()
+	batch.Delete("ns1", "key1", version.NewHeight(2, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+}
+
+func TestRangeScanStreaming(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	for i := 1; i <= 5; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, 1))
+	}
+	batch.Put("ns2", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	itr, err := db.GetStateRangeScanIteratorStreaming("ns1", "key2", "")
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+	for i := 2; i <= 5; i++ {
+		result, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		vkv := result.(*statedb.VersionedKV)
+		testutil.AssertEquals(t, vkv.Key, fmt.Sprintf("key%d", i))
+		testutil.AssertEquals(t, strings.Contains(string(vkv.Value), fmt.Sprintf("marble%d", i)), true)
+	}
+	result, err := itr.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, result)
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	value := []byte(`{"asset_name":"marble"}`)
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", value, version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	_, ok := db.GetNamespaceQuota("ns1")
+	testutil.AssertEquals(t, ok, false)
+	db.SetNamespaceQuota("ns1", NamespaceQuota{MaxDocuments: 3})
+	quota, ok := db.GetNamespaceQuota("ns1")
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, quota, NamespaceQuota{MaxDocuments: 3})
+
+	// the usage of the existing documents is read from CouchDB, writes up to the quota succeed
+	_, documents, err := db.GetNamespaceUsage("ns1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, documents, int64(1))
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", value, version.NewHeight(2, 1))
+	batch.Put("ns1", "key2", value, version.NewHeight(2, 1))
+	batch.Put("ns1", "key3", value, version.NewHeight(2, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+
+	// a write past the quota fails, while other namespaces are unaffected
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key4", value, version.NewHeight(3, 1))
+	err = db.ApplyUpdates(batch, version.NewHeight(3, 1))
+	exceeded, ok := err.(*ErrQuotaExceeded)
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, exceeded.Namespace, "ns1")
+	testutil.AssertEquals(t, exceeded.Documents, int64(4))
+	vv, err := db.GetState("ns1", "key4")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	batch = statedb.NewUpdateBatch()
+	for i := 0; i < 5; i++ {
+		batch.Put("ns2", fmt.Sprintf("key%d", i), value, version.NewHeight(3, 1))
+	}
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(3, 1)), "")
+
+	// the quota is changed at runtime, a byte quota is enforced on the size of the values
+	bytes, documents, err := db.GetNamespaceUsage("ns1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, documents, int64(3))
+	db.SetNamespaceQuota("ns1", NamespaceQuota{MaxBytes: bytes + 10})
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key4", []byte("0123456789"), version.NewHeight(4, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(4, 1)), "")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key5", []byte("0"), version.NewHeight(5, 1))
+	_, ok = db.ApplyUpdates(batch, version.NewHeight(5, 1)).(*ErrQuotaExceeded)
+	testutil.AssertEquals(t, ok, true)
+
+	// removing the quota lifts the limit
+	db.SetNamespaceQuota("ns1", NamespaceQuota{})
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(5, 1)), "")
+}
+
+func TestOpenDBs(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+
+	dbNames := make([]string, 20)
+	for i := range dbNames {
+		dbNames[i] = fmt.Sprintf("testdb%d", i)
+	}
+	mock.delay = 10 * time.Millisecond
+
+	// serial bootstrap, as done by opening the channels one at a time
+	start := time.Now()
+	for _, dbName := range dbNames {
+		db, err := provider.GetDBHandle(dbName)
+		testutil.AssertNoError(t, err, "")
+		db.Open()
+		_, err = db.GetLatestSavePoint()
+		testutil.AssertNoError(t, err, "")
+		db.Close()
+	}
+	serial := time.Since(start)
+
+	provider = newMockProvider(t, server)
+	start = time.Now()
+	savepoints, handles, err := provider.OpenDBs(dbNames)
+	parallel := time.Since(start)
+	testutil.AssertNoError(t, err, "")
+	t.Logf("serial bootstrap took %s, parallel bootstrap took %s", serial, parallel)
+	testutil.AssertEquals(t, parallel < serial/2, true)
+
+	testutil.AssertEquals(t, len(savepoints), len(dbNames))
+	testutil.AssertEquals(t, len(handles), len(dbNames))
+	for _, dbName := range dbNames {
+		testutil.AssertEquals(t, savepoints[dbName], version.NewHeight(0, 0))
+		db, err := provider.GetDBHandle(dbName)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertSame(t, handles[dbName], db)
+		testutil.AssertEquals(t, provider.OpenCount(dbName), uint64(1))
+	}
+}
+
+func BenchmarkBootstrapSerial(b *testing.B) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.delay = time.Millisecond
+	for i := 0; i < b.N; i++ {
+		provider := newMockProvider(b, server)
+		for j := 0; j < 50; j++ {
+			db, _ := provider.GetDBHandle(fmt.Sprintf("testdb%d", j))
+			db.Open()
+			db.GetLatestSavePoint()
+		}
+	}
+}
+
+func BenchmarkBootstrapParallel(b *testing.B) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.delay = time.Millisecond
+	dbNames := make([]string, 50)
+	for j := range dbNames {
+		dbNames[j] = fmt.Sprintf("testdb%d", j)
+	}
+	for i := 0; i < b.N; i++ {
+		provider := newMockProvider(b, server)
+		provider.OpenDBs(dbNames)
+	}
+}
+
+// versionedJSONCodec stores the value along with its version in a JSON document
+type versionedJSONCodec struct{}
+
+type versionedJSONDoc struct {
+	Value    []byte `json:"value"`
+	BlockNum uint64 `json:"blockNum"`
+	TxNum    uint64 `json:"txNum"`
+}
+
+func (codec versionedJSONCodec) Encode(value []byte, ver *version.Height) ([]byte, []couchdb.Attachment, error) {
+	jsonDoc, err := json.Marshal(&versionedJSONDoc{value, ver.BlockNum, ver.TxNum})
+	return jsonDoc, nil, err
+}
+
+func (codec versionedJSONCodec) Decode(id string, jsonDoc []byte, attachments []couchdb.Attachment) ([]byte, *version.Height, error) {
+	doc := &versionedJSONDoc{}
+	if err := json.Unmarshal(jsonDoc, doc); err != nil {
+		return nil, nil, err
+	}
+	return doc.Value, version.NewHeight(doc.BlockNum, doc.TxNum), nil
+}
+
+func TestValueCodec(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.SetValueCodec(versionedJSONCodec{})
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte("binary value"), version.NewHeight(3, 7))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(3, 8))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(3, 8)), "")
+
+	// the values are stored as encoded by the codec, and round-trip along with their versions
+	testutil.AssertEquals(t, strings.Contains(string(mock.getDoc(string(ConstructCompositeKey("ns1", "key1")))), `"blockNum":3`), true)
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv, &statedb.VersionedValue{Value: []byte("binary value"), Version: version.NewHeight(3, 7)})
+	vv, err = db.GetState("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv, &statedb.VersionedValue{Value: []byte(`{"asset_name":"marble2"}`), Version: version.NewHeight(3, 8)})
+	vv, err = db.GetState("ns1", "key3")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+}
+
+func TestHeightWatchdog(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+
+	var mux sync.Mutex
+	checks := 0
+	expectedHeight := func() (uint64, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		checks++
+		return 5, nil
+	}
+	getChecks := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return checks
+	}
+	testutil.AssertNoError(t, provider.StartHeightWatchdog("watchdogdb", expectedHeight, 10*time.Millisecond, 2), "")
+	testutil.AssertError(t, provider.StartHeightWatchdog("watchdogdb", expectedHeight, 10*time.Millisecond, 2),
+		"Starting a second watchdog should fail")
+
+	// no savepoint is recorded, the state database lags the expected height
+	divergences := metrics.GetOrRegisterCounter("statedb.watchdogdb.height.divergences", metrics.DefaultRegistry)
+	lag := metrics.GetOrRegisterGauge("statedb.watchdogdb.height.lag", metrics.DefaultRegistry)
+	for start := time.Now(); divergences.Count() == 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.AssertEquals(t, divergences.Count() > 0, true)
+	testutil.AssertEquals(t, lag.Value(), int64(5))
+
+	// the state database catches up with block 4, to within the threshold
+	db, _ := provider.GetDBHandle("watchdogdb")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(4, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(4, 1)), "")
+	testutil.AssertNoError(t, db.(*VersionedDB).Flush(), "")
+	for start := time.Now(); lag.Value() != 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.AssertEquals(t, lag.Value(), int64(0))
+
+	// the watchdog stops on close
+	provider.Close()
+	checksOnClose := getChecks()
+	time.Sleep(50 * time.Millisecond)
+	testutil.AssertEquals(t, getChecks(), checksOnClose)
+}
+
+func TestProviderClose(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	goroutines := runtime.NumGoroutine()
+	provider := newMockProvider(t, server)
+
+	db, err := provider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNoError(t, provider.StartHeightWatchdog("testdb", func() (uint64, error) { return 1, nil },
+		10*time.Millisecond, 2), "")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	provider.Close()
+	provider.Close()
+
+	// the operations after close fail cleanly
+	_, err = provider.GetDBHandle("testdb")
+	testutil.AssertEquals(t, err, ErrProviderClosed)
+	_, _, err = provider.OpenDBs([]string{"testdb"})
+	testutil.AssertEquals(t, err, ErrProviderClosed)
+	testutil.AssertEquals(t, provider.DeleteDB("testdb"), ErrProviderClosed)
+	_, err = db.GetState("ns1", "key1")
+	testutil.AssertEquals(t, err, couchdb.ErrInstanceClosed)
+	testutil.AssertEquals(t, provider.OpenCount("testdb"), uint64(0))
+
+	// the goroutines of the watchdog and of the idle connections are stopped
+	for start := time.Now(); runtime.NumGoroutine() > goroutines && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.AssertEquals(t, runtime.NumGoroutine() <= goroutines, true)
+}
+
+func TestApplyUpdatesInSortedOrder(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	for _, ck := range []statedb.CompositeKey{{Namespace: "ns2", Key: "key1"}, {Namespace: "ns1", Key: "key3"},
+		{Namespace: "ns10", Key: "key0"}, {Namespace: "ns1", Key: "key1"}, {Namespace: "ns2", Key: "key0"}, {Namespace: "ns1", Key: "key2"}} {
+		batch.Put(ck.Namespace, ck.Key, []byte(`{"asset_name":"marble"}`), version.NewHeight(1, 1))
+	}
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	writes := []string{}
+	for _, request := range mock.requests {
+		if strings.HasPrefix(request, "PUT /testdb/ns") {
+			writes = append(writes, strings.TrimPrefix(request, "PUT /testdb/"))
+		}
+	}
+	testutil.AssertEquals(t, writes, []string{"ns1\x00key1", "ns1\x00key2", "ns1\x00key3", "ns10\x00key0", "ns2\x00key0", "ns2\x00key1"})
+}
+
+func TestGetStateWithKind(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		defer viper.Set("ledger.state.couchDBConfig.compressionThreshold", 0)
+		viper.Set("ledger.state.couchDBConfig.compressionThreshold", 100)
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		largeValue := []byte(`{"asset_name":"marble3","notes":"` + strings.Repeat("blue marble ", 50) + `"}`)
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2))
+		batch.Put("ns1", "key3", largeValue, version.NewHeight(1, 3))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		vv, kind, err := vdb.GetStateWithKind("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, kind, KindJSON)
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+
+		// the binary value is returned as written, rather than the attachment-backed document
+		vv, kind, err = vdb.GetStateWithKind("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, kind, KindBinary)
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+
+		// a JSON value stored compressed as an attachment is still JSON
+		vv, kind, err = vdb.GetStateWithKind("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, kind, KindJSON)
+		testutil.AssertEquals(t, vv.Value, largeValue)
+
+		vv, _, err = vdb.GetStateWithKind("ns1", "key4")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+
+	}
+}
+
+func TestExists(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+
+	// the key is checked with a HEAD request, without reading its value
+	reads := mock.countRequests("GET", "/"+compositeKeyID("ns1", "key1"))
+	exists, err := db.Exists("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, exists, true)
+	testutil.AssertEquals(t, mock.countRequests("HEAD", "/"+compositeKeyID("ns1", "key1")), 1)
+	testutil.AssertEquals(t, mock.countRequests("GET", "/"+compositeKeyID("ns1", "key1")), reads)
+
+	// a missing key is not an error
+	exists, err = db.Exists("ns1", "key3")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, exists, false)
+
+	// a failure to check the key is an error rather than a missing key
+	mock.mux.Lock()
+	mock.failReads = map[string]bool{compositeKeyID("ns1", "key2"): true}
+	mock.mux.Unlock()
+	exists, err = db.Exists("ns1", "key2")
+	testutil.AssertError(t, err, "Expected an error when the key cannot be checked")
+	testutil.AssertEquals(t, exists, false)
+
+	_, err = db.Exists("", "key1")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+}
+
+func TestGetStateAttachments(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		attachments := map[string][]byte{"thumbnail": []byte("thumbnail bytes"), "signature": []byte("signature bytes")}
+		batch := statedb.NewUpdateBatch()
+		batch.PutWithAttachments("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1), attachments)
+		batch.PutWithAttachments("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2), attachments)
+		batch.Put("ns1", "key3", []byte("binary value"), version.NewHeight(1, 3))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the values are read as stored without the named attachments
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		value := map[string]interface{}{}
+		testutil.AssertNoError(t, json.Unmarshal(vv.Value, &value), "")
+		testutil.AssertEquals(t, value["asset_name"], "marble1")
+		testutil.AssertNil(t, value["_attachments"])
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+
+		for _, key := range []string{"key1", "key2"} {
+			namedAttachments, err := vdb.GetStateAttachments("ns1", key)
+			testutil.AssertNoError(t, err, "")
+			testutil.AssertEquals(t, namedAttachments, attachments)
+		}
+		namedAttachments, err := vdb.GetStateAttachments("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(namedAttachments), 0)
+		namedAttachments, err = vdb.GetStateAttachments("ns1", "key4")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, namedAttachments)
+
+		// the name of the attachment storing the value is reserved
+		batch = statedb.NewUpdateBatch()
+		batch.PutWithAttachments("ns1", "key5", []byte("binary value"), version.NewHeight(2, 1),
+			map[string][]byte{"valueBytes": []byte("other bytes")})
+		testutil.AssertError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+
+	}
+}
+
+func TestGetStateWithVectorClock(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		clock := statedb.VectorClock{"peer1": 1}
+		batch := statedb.NewUpdateBatch()
+		batch.PutWithVectorClock("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1), clock)
+		batch.PutWithVectorClock("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2), clock)
+		batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(1, 3))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the vector clocks round-trip, and are not part of the values
+		vv, readClock, err := vdb.GetStateWithVectorClock("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, readClock, clock)
+		testutil.AssertEquals(t, vv.Version, version.NewHeight(1, 1))
+		value := map[string]interface{}{}
+		testutil.AssertNoError(t, json.Unmarshal(vv.Value, &value), "")
+		testutil.AssertEquals(t, value["asset_name"], "marble1")
+		testutil.AssertNil(t, value[vectorClockField])
+		vv, err = db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		value = map[string]interface{}{}
+		testutil.AssertNoError(t, json.Unmarshal(vv.Value, &value), "")
+		testutil.AssertNil(t, value[vectorClockField])
+		vv, readClock, err = vdb.GetStateWithVectorClock("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, readClock, clock)
+		testutil.AssertEquals(t, vv, &statedb.VersionedValue{Value: []byte("binary value"), Version: version.NewHeight(1, 2)})
+
+		// the values versioned by their height only have no vector clock
+		vv, readClock, err = vdb.GetStateWithVectorClock("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNotNil(t, vv)
+		testutil.AssertNil(t, readClock)
+		vv, readClock, err = vdb.GetStateWithVectorClock("ns1", "key4")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+		testutil.AssertNil(t, readClock)
+
+		// two writers update the value read at the same clock: the update committed last is concurrent with
+		// the value it overwrites, whereas an update made after reading the latest value descends from it
+		_, baseClock, err := vdb.GetStateWithVectorClock("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		batch = statedb.NewUpdateBatch()
+		batch.PutWithVectorClock("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"peer2"}`), version.NewHeight(2, 1),
+			baseClock.Increment("peer2"))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+		_, committedClock, err := vdb.GetStateWithVectorClock("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, committedClock, statedb.VectorClock{"peer1": 1, "peer2": 1})
+		concurrentClock := baseClock.Increment("peer3")
+		testutil.AssertEquals(t, concurrentClock.ConcurrentWith(committedClock), true)
+		testutil.AssertEquals(t, committedClock.Descends(baseClock), true)
+		testutil.AssertEquals(t, committedClock.Increment("peer3").ConcurrentWith(committedClock), false)
+
+	}
+}
+
+func TestDiffAgainstLevelDB(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		levelEnv := stateleveldb.NewTestVDBEnv(t)
+		defer levelEnv.Cleanup()
+		couchDB, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		levelDB, err := levelEnv.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","size":1}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2))
+		batch.Put("ns1", "key3", []byte("value3"), version.NewHeight(1, 3))
+		testutil.AssertNoError(t, levelDB.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+		testutil.AssertNoError(t, couchDB.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the migrated state matches, although CouchDB returns the JSON values as documents
+		diffs, err := statedb.DiffAgainst(levelDB, couchDB, []string{"ns1"}, func(diff *statedb.Diff) error {
+			t.Fatalf("Unexpected difference for key %s", diff.Key)
+			return nil
+		})
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, diffs, 0)
+
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","size":2}`), version.NewHeight(2, 1))
+		testutil.AssertNoError(t, couchDB.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key4", []byte("value4"), version.NewHeight(2, 1))
+		testutil.AssertNoError(t, levelDB.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+
+		kinds := map[string]statedb.DiffKind{}
+		diffs, err = statedb.DiffAgainst(levelDB, couchDB, []string{"ns1"}, func(diff *statedb.Diff) error {
+			kinds[diff.Key] = diff.Kind
+			return nil
+		})
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, diffs, 2)
+		testutil.AssertEquals(t, kinds, map[string]statedb.DiffKind{"key1": statedb.DiffValue, "key4": statedb.DiffMissing})
+
+	}
+}
+
+func TestNamespaceIndexes(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		// the same index definition creates a distinct index in each namespace
+		indexDefinition := `{"index":{"fields":["owner"]},"name":"by_owner","ddoc":"shared","type":"json"}`
+		for _, ns := range []string{"ns1", "ns2"} {
+			indexResp, err := vdb.CreateNamespaceIndex(ns, indexDefinition)
+			testutil.AssertNoError(t, err, "")
+			testutil.AssertEquals(t, indexResp.Result, "created")
+			testutil.AssertEquals(t, indexResp.ID, "_design/fabric_ns_"+ns)
+		}
+
+		// each index only covers the documents of its namespace
+		for _, ns := range []string{"ns1", "ns2"} {
+			indexes, err := vdb.ListNamespaceIndexes(ns)
+			testutil.AssertNoError(t, err, "")
+			testutil.AssertEquals(t, len(indexes), 1)
+			testutil.AssertEquals(t, indexes[0].Name, "by_owner")
+			definition := struct {
+				PartialFilterSelector map[string]map[string]string `json:"partial_filter_selector"`
+			}{}
+			testutil.AssertNoError(t, json.Unmarshal(indexes[0].Definition, &definition), "")
+			testutil.AssertEquals(t, definition.PartialFilterSelector["_id"],
+				map[string]string{"$gte": ns + "\x00", "$lt": ns + "\x01"})
+		}
+
+		// dropping the indexes of a namespace keeps those of the other namespaces
+		testutil.AssertNoError(t, vdb.DropNamespaceIndexes("ns1"), "")
+		indexes, err := vdb.ListNamespaceIndexes("ns1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(indexes), 0)
+		indexes, err = vdb.ListNamespaceIndexes("ns2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(indexes), 1)
+
+		_, err = vdb.CreateNamespaceIndex("ns1", `{"name":"by_owner"}`)
+		testutil.AssertError(t, err, "Expected an error for a definition without an index")
+
+	}
+}
+
+func TestEnsureIndexesForQuery(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		// a composite index on the sort field followed by the selector field is created
+		query := `{"selector":{"owner":"tom","size":{"$gt":10}},"sort":[{"size":"desc"}]}`
+		created, err := vdb.EnsureIndexesForQuery(query)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, created, []string{"by_size_owner"})
+		indexes, err := vdb.db.ListIndexes()
+		testutil.AssertNoError(t, err, "")
+		found := false
+		for _, index := range indexes {
+			if index.DesignDoc == "_design/fabric_query" && index.Name == "by_size_owner" {
+				found = true
+				testutil.AssertEquals(t, indexCoversFields(index, []string{"size"}, []string{"owner"}), true)
+			}
+		}
+		testutil.AssertEquals(t, found, true)
+
+		// the index covers the query, and the same fields matched in a $and
+		created, err = vdb.EnsureIndexesForQuery(query)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(created), 0)
+		created, err = vdb.EnsureIndexesForQuery(`{"selector":{"$and":[{"owner":"tom"},{"size":{"$lt":5}}]},"sort":["size"]}`)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(created), 0)
+
+		// the fields of nested objects are indexed by their path, the alternatives of $or are not indexed
+		created, err = vdb.EnsureIndexesForQuery(`{"selector":{"color":{"shade":"dark"},"$or":[{"owner":"bob"},{"size":1}]}}`)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, created, []string{"by_color.shade"})
+
+		// a query that matches no field needs no index
+		created, err = vdb.EnsureIndexesForQuery(`{"selector":{"$or":[{"owner":"bob"},{"size":1}]}}`)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, len(created), 0)
+
+		_, err = vdb.EnsureIndexesForQuery(`{"selector":`)
+		testutil.AssertError(t, err, "Expected an error for an invalid query")
+
+	}
+}
+
+func TestNamespaceField(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		defer viper.Set("ledger.state.couchDBConfig.namespaceField", false)
+		viper.Set("ledger.state.couchDBConfig.namespaceField", true)
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"tom"}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2))
+		batch.Put("ns2", "key1", []byte(`{"asset_name":"marble2","owner":"tom"}`), version.NewHeight(1, 3))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the namespace is stored in the JSON documents
+		storedDoc, _, err := vdb.db.ReadDoc(string(ConstructCompositeKey("ns1", "key1")))
+		testutil.AssertNoError(t, err, "")
+		storedFields := map[string]interface{}{}
+		testutil.AssertNoError(t, json.Unmarshal(storedDoc, &storedFields), "")
+		testutil.AssertEquals(t, storedFields[namespaceField], "ns1")
+
+		// the values read back do not have the namespace field
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), namespaceField), false)
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+
+		// a selector on the namespace field only matches the values of the namespace, using the index
+		itr, err := db.ExecuteQuery(`{"selector":{"~namespace":"ns2","owner":"tom"}}`)
+		testutil.AssertNoError(t, err, "")
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		record := queryResult.(*statedb.VersionedQueryRecord)
+		testutil.AssertEquals(t, record.Namespace, "ns2")
+		testutil.AssertEquals(t, strings.Contains(string(record.Record), "marble2"), true)
+		testutil.AssertEquals(t, strings.Contains(string(record.Record), namespaceField), false)
+		queryResult, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, queryResult)
+		plan, err := vdb.ExplainQuery(`{"selector":{"~namespace":"ns2"}}`)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(plan, "by_namespace"), true)
+
+		// range scans do not return the namespace field either
+		itr, err = db.GetStateRangeScanIterator("ns1", "", "")
+		testutil.AssertNoError(t, err, "")
+		queryResult, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(queryResult.(*statedb.VersionedKV).Value), namespaceField), false)
+
+	}
+}
+
+func TestVersionBackfill(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+
+		// seed documents stored without a version, and the savepoint, before the database is first opened
+		couchDB, err := couchdb.CreateCouchDatabase(*env.DBProvider.(*VersionedDBProvider).couchInstance, "testdb")
+		testutil.AssertNoError(t, err, "")
+		_, err = couchDB.SaveDoc(string(ConstructCompositeKey("ns1", "key1")), "", []byte(`{"asset_name":"marble1"}`), nil)
+		testutil.AssertNoError(t, err, "")
+		attachment := couchdb.Attachment{Name: "valueBytes", ContentType: "application/octet-stream", AttachmentBytes: []byte("binary value")}
+		_, err = couchDB.SaveDoc(string(ConstructCompositeKey("ns1", "key2")), "", nil, []couchdb.Attachment{attachment})
+		testutil.AssertNoError(t, err, "")
+		_, err = couchDB.SaveDoc(savepointDocID, "", []byte(`{"BlockNum":5,"TxNum":2,"UpdateSeq":""}`), nil)
+		testutil.AssertNoError(t, err, "")
+
+		// the documents gain the savepoint height as version when the database is opened
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Version, version.NewHeight(5, 2))
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), versionField), false)
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv, &statedb.VersionedValue{Value: []byte("binary value"), Version: version.NewHeight(5, 2)})
+
+		// the backfill is recorded, so that it is not attempted again
+		backfillDoc, _, err := couchDB.ReadDoc(versionBackfillDocID)
+		testutil.AssertNoError(t, err, "")
+		backfillFields := map[string]interface{}{}
+		testutil.AssertNoError(t, json.Unmarshal(backfillDoc, &backfillFields), "")
+		testutil.AssertEquals(t, backfillFields["updated"], float64(2))
+
+		// the values written from then on carry their own version
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(6, 1))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(6, 1)), "")
+		vv, err = db.GetState("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Version, version.NewHeight(6, 1))
+
+		// range scans return the versions of the JSON values
+		itr, err := db.GetStateRangeScanIterator("ns1", "key1", "key2")
+		testutil.AssertNoError(t, err, "")
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, queryResult.(*statedb.VersionedKV).Version, version.NewHeight(5, 2))
+		itr, err = db.GetStateRangeScanIterator("ns1", "key3", "")
+		testutil.AssertNoError(t, err, "")
+		queryResult, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, queryResult.(*statedb.VersionedKV).Version, version.NewHeight(6, 1))
+
+	}
+}
+
+func TestConcurrentApplyUpdates(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// the batches applied concurrently leave the savepoint at the greatest height, whatever their order
+	var wg sync.WaitGroup
+	for i := uint64(1); i <= 20; i++ {
+		wg.Add(1)
+		go func(blockNum uint64) {
+			defer wg.Done()
+			batch := statedb.NewUpdateBatch()
+			batch.Put("ns1", fmt.Sprintf("key%d", blockNum), []byte(`{"asset_name":"marble1"}`), version.NewHeight(blockNum, 1))
+			testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(blockNum, 1)), "")
+		}(i)
+	}
+	wg.Wait()
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(20, 1))
+
+	// a batch at a lower height does not move the savepoint back
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(5, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(5, 1)), "")
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(20, 1))
+
+	// reads are not serialized with the writes
+	mock.mux.Lock()
+	mock.holdWrites = make(chan struct{})
+	mock.mux.Unlock()
+	done := make(chan error)
+	go func() {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key21", []byte(`{"asset_name":"marble3"}`), version.NewHeight(21, 1))
+		done <- db.ApplyUpdates(batch, version.NewHeight(21, 1))
+	}()
+	for mock.getHeldWrites() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+	mock.mux.Lock()
+	close(mock.holdWrites)
+	mock.mux.Unlock()
+	testutil.AssertNoError(t, <-done, "")
+}
+
+func TestSnapshotRangeScan(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+		vdb.resultsPageSize = 2
+
+		batch := statedb.NewUpdateBatch()
+		for i := 1; i <= 5; i++ {
+			batch.Put("ns1", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i)))
+		}
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 5)), "")
+
+		itr, err := vdb.GetStateRangeScanIteratorAtSnapshot("ns1", "", "")
+		testutil.AssertNoError(t, err, "")
+		defer itr.Close()
+		testutil.AssertNotEquals(t, itr.UpdateSeq(), "")
+		result, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, result.(*statedb.VersionedKV).Key, "key1")
+
+		// the changes committed in the middle of the scan are not observed by the scan
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns1", "key4", []byte(`{"asset_name":"updated"}`), version.NewHeight(2, 1))
+		batch.Put("ns1", "key6", []byte(`{"asset_name":"marble6"}`), version.NewHeight(2, 2))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 2)), "")
+
+		for i := 2; i <= 5; i++ {
+			result, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			kv := result.(*statedb.VersionedKV)
+			testutil.AssertEquals(t, kv.Key, fmt.Sprintf("key%d", i))
+			testutil.AssertEquals(t, strings.Contains(string(kv.Value), fmt.Sprintf("marble%d", i)), true)
+			testutil.AssertEquals(t, kv.Version, version.NewHeight(1, uint64(i)))
+		}
+		result, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, result)
+
+		// a new snapshot observes the changes
+		itr, err = vdb.GetStateRangeScanIteratorAtSnapshot("ns1", "key4", "")
+		testutil.AssertNoError(t, err, "")
+		defer itr.Close()
+		result, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(result.(*statedb.VersionedKV).Value), "updated"), true)
+		result, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, result.(*statedb.VersionedKV).Key, "key5")
+		result, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, result.(*statedb.VersionedKV).Key, "key6")
+		result, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, result)
+
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		provider := env.DBProvider.(*VersionedDBProvider)
+
+		db, err := provider.GetDBHandle("testdb1")
+		testutil.AssertNoError(t, err, "")
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2))
+		batch.Put("ns2", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 3))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the databases in use are not migrated
+		db.Open()
+		testutil.AssertEquals(t, provider.MigrateDB("testdb1", "testdb2", false), ErrDBInUse)
+		db.Close()
+
+		testutil.AssertNoError(t, provider.MigrateDB("testdb1", "testdb2", false), "")
+		source, err := couchdb.CreateCouchDatabase(*provider.couchInstance, "testdb1")
+		testutil.AssertNoError(t, err, "")
+		target, err := couchdb.CreateCouchDatabase(*provider.couchInstance, "testdb2")
+		testutil.AssertNoError(t, err, "")
+		readAllDocs := func(db *couchdb.CouchDatabase) []couchdb.DocRevResult {
+			revs, _, err := db.ReadDocRevisionRange("", "", 0)
+			testutil.AssertNoError(t, err, "")
+			docs, err := db.BulkGet(revs)
+			testutil.AssertNoError(t, err, "")
+			// the fields of the documents are compared regardless of their order
+			for i := range docs {
+				fields := map[string]interface{}{}
+				testutil.AssertNoError(t, json.Unmarshal(docs[i].JSONDoc, &fields), "")
+				docs[i].JSONDoc, err = json.Marshal(fields)
+				testutil.AssertNoError(t, err, "")
+			}
+			return docs
+		}
+		// the documents of the keys and the savepoint, along with any other internal document, are copied
+		sourceDocs := readAllDocs(source)
+		testutil.AssertEquals(t, len(sourceDocs) >= 4, true)
+		testutil.AssertEquals(t, readAllDocs(target), sourceDocs)
+
+		migrated, err := provider.GetDBHandle("testdb2")
+		testutil.AssertNoError(t, err, "")
+		vv, err := migrated.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+		sp, err := migrated.GetLatestSavePoint()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, sp, version.NewHeight(1, 3))
+
+		// a document the source does not have fails the verification, and the source is not dropped
+		batch = statedb.NewUpdateBatch()
+		batch.Put("ns3", "key1", []byte(`{"asset_name":"marble3"}`), version.NewHeight(2, 1))
+		testutil.AssertNoError(t, migrated.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+		testutil.AssertEquals(t, provider.MigrateDB("testdb1", "testdb2", true), ErrMigrationMismatch)
+		dbNames, err := provider.GetAllDatabases()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, containsString(dbNames, "testdb1"), true)
+
+		// a migration is resumed by migrating again, once verified the source is dropped
+		testutil.AssertNoError(t, provider.DeleteDB("testdb2"), "")
+		target, err = couchdb.CreateCouchDatabase(*provider.couchInstance, "testdb2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNoError(t, target.BulkSaveRevisions(sourceDocs[:2]), "")
+		testutil.AssertNoError(t, provider.MigrateDB("testdb1", "testdb2", true), "")
+		testutil.AssertEquals(t, readAllDocs(target), sourceDocs)
+		dbNames, err = provider.GetAllDatabases()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, containsString(dbNames, "testdb1"), false)
+
+	}
+}
+
+func TestApplyWritesCoalescesKeys(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	write := func(key string, value string, txNum uint64) *statedb.VersionedKV {
+		return &statedb.VersionedKV{CompositeKey: statedb.CompositeKey{Namespace: "ns1", Key: key},
+			VersionedValue: statedb.VersionedValue{Value: []byte(value), Version: version.NewHeight(1, txNum)}}
+	}
+	writes := []*statedb.VersionedKV{
+		write("key1", `{"asset_name":"marble1"}`, 1),
+		write("key2", `{"asset_name":"marble2"}`, 2),
+		write("key1", `{"asset_name":"marble3"}`, 3),
+		write("key1", `{"asset_name":"marble4"}`, 4),
+	}
+	testutil.AssertNoError(t, db.ApplyWrites(writes, version.NewHeight(1, 4)), "")
+
+	// a single write is issued per key, with the last value written
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key1"), 1)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key2"), 1)
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble4"), true)
+	testutil.AssertEquals(t, vv.Version, version.NewHeight(1, 4))
+	vv, err = db.GetState("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+
+	// a key whose last write is nil is deleted, and a key deleted that has no document is not written
+	deleteKey := func(key string, txNum uint64) *statedb.VersionedKV {
+		return &statedb.VersionedKV{CompositeKey: statedb.CompositeKey{Namespace: "ns1", Key: key},
+			VersionedValue: statedb.VersionedValue{Value: nil, Version: version.NewHeight(2, txNum)}}
+	}
+	writes = []*statedb.VersionedKV{
+		write("key1", `{"asset_name":"marble5"}`, 1),
+		deleteKey("key1", 2),
+		deleteKey("key3", 3),
+	}
+	testutil.AssertNoError(t, db.ApplyWrites(writes, version.NewHeight(2, 3)), "")
+	vv, err = db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	mock.mux.Lock()
+	_, ok := mock.docs[compositeKeyID("ns1", "key1")]
+	mock.mux.Unlock()
+	testutil.AssertEquals(t, ok, false)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key1"), 1)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/ns1\x00key3"), 0)
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_docs"), 1)
+
+	// the key is written again once deleted
+	writes = []*statedb.VersionedKV{deleteKey("key2", 1), write("key1", `{"asset_name":"marble6"}`, 2)}
+	testutil.AssertNoError(t, db.ApplyWrites(writes, version.NewHeight(3, 2)), "")
+	vv, err = db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble6"), true)
+	vv, err = db.GetState("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+}
+
+func TestSkipReplayedBatches(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(5, 0))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(5, 0)), "")
+
+	// once the database is reopened, a batch below the savepoint is a replay and is skipped
+	db = newMockVersionedDB(t, server, "testdb")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(3, 0))
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(3, 0))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(3, 0)), "")
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(5, 0))
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+	vv, err = db.GetState("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+
+	// a batch at the height of the savepoint, or above it, is applied
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key2", []byte(`{"asset_name":"marble3"}`), version.NewHeight(5, 0))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(5, 0)), "")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(6, 0))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(6, 0)), "")
+	vv, err = db.GetState("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble3"), true)
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(6, 0))
+}
+
+func TestPauseResume(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+	// while paused, the commits wait and the reads continue
+	db.Pause()
+	done := make(chan error)
+	go func() {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(2, 1))
+		done <- db.ApplyUpdates(batch, version.NewHeight(2, 1))
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Expected the commit to wait while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNotNil(t, vv)
+	testutil.AssertNil(t, mock.getDoc("ns1\x00key2"))
+	db.Resume()
+	testutil.AssertNoError(t, <-done, "")
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00key2"))
+
+	// pausing waits for the commit in flight
+	mock.mux.Lock()
+	mock.holdWrites = make(chan struct{})
+	mock.mux.Unlock()
+	go func() {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(3, 1))
+		done <- db.ApplyUpdates(batch, version.NewHeight(3, 1))
+	}()
+	for mock.getHeldWrites() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	paused := make(chan struct{})
+	go func() {
+		db.Pause()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		t.Fatalf("Expected the pause to wait for the commit in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mock.mux.Lock()
+	close(mock.holdWrites)
+	mock.holdWrites = nil
+	mock.mux.Unlock()
+	<-paused
+	testutil.AssertNoError(t, <-done, "")
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00key3"))
+	db.Resume()
+
+	// the commits can be rejected while paused instead
+	db.rejectWhilePaused = true
+	db.Pause()
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key4", []byte(`{"asset_name":"marble4"}`), version.NewHeight(4, 1))
+	testutil.AssertEquals(t, db.ApplyUpdates(batch, version.NewHeight(4, 1)), ErrPaused)
+	db.Resume()
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(4, 1)), "")
+}
+
+func TestApplyUpdatesWriteConcurrency(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.writeConcurrency = 8
+
+	// the writes of a large batch are issued concurrently, up to the configured concurrency
+	mock.mux.Lock()
+	mock.holdWrites = make(chan struct{})
+	mock.mux.Unlock()
+	batch := statedb.NewUpdateBatch()
+	for i := 0; i < 500; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i)))
+	}
+	done := make(chan error)
+	go func() {
+		done <- db.ApplyUpdates(batch, version.NewHeight(1, 499))
+	}()
+	for mock.getHeldWrites() < 8 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	testutil.AssertEquals(t, mock.getHeldWrites(), 8)
+	mock.mux.Lock()
+	close(mock.holdWrites)
+	mock.holdWrites = nil
+	mock.mux.Unlock()
+	testutil.AssertNoError(t, <-done, "")
+
+	for i := 0; i < 500; i++ {
+		vv, err := db.GetState("ns1", fmt.Sprintf("key%03d", i))
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), fmt.Sprintf(`marble%d"`, i)), true)
+	}
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 499))
+
+	// a failed write fails the commit once the other writes are done, and the savepoint is not recorded
+	mock.mux.Lock()
+	mock.failWrites = map[string]bool{"ns1\x00key250": true}
+	mock.mux.Unlock()
+	batch = statedb.NewUpdateBatch()
+	for i := 0; i < 500; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%03d", i), []byte(`{"asset_name":"marble"}`), version.NewHeight(2, uint64(i)))
+	}
+	testutil.AssertError(t, db.ApplyUpdates(batch, version.NewHeight(2, 499)), "Expected the failed write to fail the commit")
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 499))
+}
+
+func benchmarkApplyUpdates(b *testing.B, writeConcurrency int) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	mock.delay = time.Millisecond
+	db := newMockVersionedDB(b, server, "testdb")
+	db.writeConcurrency = writeConcurrency
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := statedb.NewUpdateBatch()
+		for j := 0; j < 100; j++ {
+			batch.Put("ns1", fmt.Sprintf("key%d", j), []byte(`{"asset_name":"marble1"}`), version.NewHeight(uint64(i+1), uint64(j)))
+		}
+		db.ApplyUpdates(batch, version.NewHeight(uint64(i+1), 99))
+	}
+}
+
+func BenchmarkApplyUpdatesSerial(b *testing.B) {
+	benchmarkApplyUpdates(b, 1)
+}
+
+func BenchmarkApplyUpdatesConcurrent(b *testing.B) {
+	benchmarkApplyUpdates(b, 16)
+}
+
+// replayBatchesOf returns the batches of the given blocks, writing keys of the given number in each block
+func replayBatchesOf(firstBlock, blocks, keys int) []HeightedBatch {
+	batches := make([]HeightedBatch, blocks)
+	for i := range batches {
+		blockNum := uint64(firstBlock + i)
+		batch := statedb.NewUpdateBatch()
+		for j := 0; j < keys; j++ {
+			batch.Put("ns1", fmt.Sprintf("key%d", j), []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, blockNum)), version.NewHeight(blockNum, uint64(j)))
+		}
+		batches[i] = HeightedBatch{batch, version.NewHeight(blockNum, uint64(keys-1))}
+	}
+	return batches
+}
+
+func TestReplayBatches(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// the documents of each batch are written in a single bulk write, the savepoint once
+	batches := replayBatchesOf(1, 5, 3)
+	batches[2].Batch.Put("ns1", "binary", []byte("binary value"), version.NewHeight(3, 3))
+	batches[3].Batch.Delete("ns1", "key2", version.NewHeight(4, 3))
+	testutil.AssertNoError(t, db.ReplayBatches(batches), "")
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_docs"), 5)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+savepointDocID), 1)
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(5, 2))
+	vv, err := db.GetState("ns1", "key0")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte(`{"asset_name":"marble5"}`))
+	testutil.AssertEquals(t, vv.Version, version.NewHeight(5, 0))
+	// the key deleted is written again by the batch after the delete
+	vv, err = db.GetState("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte(`{"asset_name":"marble5"}`))
+
+	// the replay stops at the first failing batch, and the savepoint is at the batch before it
+	mock.mux.Lock()
+	mock.failWrites = map[string]bool{compositeKeyID("ns1", "key0"): true}
+	mock.mux.Unlock()
+	batches = replayBatchesOf(6, 5, 3)
+	for i := 0; i < 2; i++ {
+		blockNum := uint64(6 + i)
+		batches[i].Batch = statedb.NewUpdateBatch()
+		batches[i].Batch.Put("ns1", "key1", []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, blockNum)), version.NewHeight(blockNum, 1))
+	}
+	err = db.ReplayBatches(batches)
+	replayErr, ok := err.(*ErrReplayFailed)
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, replayErr.Index, 2)
+	testutil.AssertEquals(t, replayErr.Height, version.NewHeight(8, 2))
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(7, 2))
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_bulk_docs"), 8)
+
+	// the heights of the batches must be increasing
+	mock.mux.Lock()
+	mock.failWrites = nil
+	mock.mux.Unlock()
+	batches = replayBatchesOf(8, 2, 3)
+	batches[1].Height = version.NewHeight(8, 0)
+	err = db.ReplayBatches(batches)
+	replayErr, ok = err.(*ErrReplayFailed)
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, replayErr.Index, 1)
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(8, 2))
+}
+
+func TestApplyUpdatesWithProgress(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	for i := 0; i < 250; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%03d", i), []byte(`{"asset_name":"marble"}`), version.NewHeight(1, uint64(i)))
+	}
+	var dones []int
+	progress := func(done, total int) {
+		testutil.AssertEquals(t, total, 250)
+		dones = append(dones, done)
+		// the callback is not called with the locks of the database held
+		_, err := db.GetState("ns1", "key000")
+		testutil.AssertNoError(t, err, "")
+	}
+	testutil.AssertNoError(t, db.ApplyUpdatesWithProgress(batch, version.NewHeight(1, 250), progress), "")
+
+	// the done counts are increasing, and their increments sum to the total once the batch is applied
+	testutil.AssertEquals(t, len(dones) > 0, true)
+	sum := dones[0]
+	for i := 1; i < len(dones); i++ {
+		testutil.AssertEquals(t, dones[i] > dones[i-1], true)
+		sum += dones[i] - dones[i-1]
+	}
+	testutil.AssertEquals(t, sum, 250)
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 250))
+	vv, err := db.GetState("ns1", "key249")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte(`{"asset_name":"marble"}`))
+}
+
+// benchmarkReplay measures the reconstruction of a state database from 100 blocks of 20 keys each
+func benchmarkReplay(b *testing.B, replay func(db *VersionedDB, batches []HeightedBatch) error) {
+	defer logging.SetLevel(logging.GetLevel("statecouchdb"), "statecouchdb")
+	defer logging.SetLevel(logging.GetLevel("couchdb"), "couchdb")
+	logging.SetLevel(logging.INFO, "statecouchdb")
+	logging.SetLevel(logging.INFO, "couchdb")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// each replay reconstructs an empty database
+		b.StopTimer()
+		mock, server := newMockCouchDB()
+		mock.delay = 100 * time.Microsecond
+		db := newMockVersionedDB(b, server, "testdb")
+		batches := replayBatchesOf(1, 100, 20)
+		b.StartTimer()
+		err := replay(db, batches)
+		b.StopTimer()
+		server.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkReplayBatches(b *testing.B) {
+	benchmarkReplay(b, func(db *VersionedDB, batches []HeightedBatch) error {
+		return db.ReplayBatches(batches)
+	})
+}
+
+func BenchmarkReplayApplyUpdates(b *testing.B) {
+	benchmarkReplay(b, func(db *VersionedDB, batches []HeightedBatch) error {
+		for _, heighted := range batches {
+			if err := db.ApplyUpdates(heighted.Batch, heighted.Height); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkGetState(b *testing.B) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(b, server, "testdb")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	db.ApplyUpdates(batch, version.NewHeight(1, 1))
+	// the allocations are measured with debug logging off, as in production
+	defer logging.SetLevel(logging.GetLevel("statecouchdb"), "statecouchdb")
+	defer logging.SetLevel(logging.GetLevel("couchdb"), "couchdb")
+	logging.SetLevel(logging.INFO, "statecouchdb")
+	logging.SetLevel(logging.INFO, "couchdb")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.GetState("ns1", "key1")
+	}
+}
+
+func TestCompositeKeyIDAllocations(t *testing.T) {
+	// the key encoding is resolved once per database, and the id is built with a single allocation
+	keys := newKeyEncoder()
+	allocs := testing.AllocsPerRun(100, func() {
+		keys.compositeKeyID("ns1", "key1")
+	})
+	testutil.AssertEquals(t, allocs, float64(1))
+	testutil.AssertEquals(t, compositeKeyID("ns1", "key1"), string(ConstructCompositeKey("ns1", "key1")))
+	testutil.AssertEquals(t, compositeKeyID("_ns", "key\xff"), string(ConstructCompositeKey("_ns", "key\xff")))
+}
+
+func BenchmarkCompositeKeyID(b *testing.B) {
+	keys := newKeyEncoder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		keys.compositeKeyID("ns1", "key1")
+	}
+}
+
+// equalityQueryCompiler compiles queries of the form "field = value" into a Mango selector on the field
+type equalityQueryCompiler struct{}
+
+func (compiler equalityQueryCompiler) Compile(userQuery string) (string, error) {
+	parts := strings.Split(userQuery, "=")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid query %s, expected field = value", userQuery)
+	}
+	query, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]string{strings.TrimSpace(parts[0]): strings.TrimSpace(parts[1])}})
+	return string(query), err
+}
+
+func TestQueryCompiler(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// the queries are compiled before they are run, and a query that fails to compile is not run
+	db.SetQueryCompiler(equalityQueryCompiler{})
+	_, err := db.ExecuteQuery("owner")
+	testutil.AssertError(t, err, "Expected the query to fail to compile")
+	_, err = db.ExplainQuery("owner")
+	testutil.AssertError(t, err, "Expected the query to fail to compile")
+	testutil.AssertEquals(t, mock.countRequests("POST", "/_find")+mock.countRequests("POST", "/_explain"), 0)
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"tom"}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte(`{"asset_name":"marble2","owner":"jerry"}`), version.NewHeight(1, 2))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+
+		// Mango queries are run as is by default
+		itr, err := db.ExecuteQuery(`{"selector":{"owner":"jerry"}}`)
+		testutil.AssertNoError(t, err, "")
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, queryResult.(*statedb.VersionedQueryRecord).Key, "key2")
+
+		vdb.SetQueryCompiler(equalityQueryCompiler{})
+		itr, err = db.ExecuteQuery("owner = tom")
+		testutil.AssertNoError(t, err, "")
+		queryResult, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, queryResult.(*statedb.VersionedQueryRecord).Key, "key1")
+		queryResult, err = itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, queryResult)
+
+	}
+}
+
+func TestUnindexedQueryWarning(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1","owner":"tom"}`), version.NewHeight(1, 1))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+
+		// the warning of an unindexed query is returned with the results
+		itr, err := db.ExecuteQuery(`{"selector":{"owner":"tom"}}`)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(itr.(QueryWarner).Warning(), "no matching index"), true)
+		queryResult, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNotNil(t, queryResult)
+
+		// an indexed query has no warning
+		_, err = vdb.db.CreateIndex(`{"index":{"fields":["owner"]},"name":"by_owner","type":"json"}`)
+		testutil.AssertNoError(t, err, "")
+		itr, err = db.ExecuteQuery(`{"selector":{"owner":"tom"}}`)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, itr.(QueryWarner).Warning(), "")
+
+	}
+}
+
+func TestNonQueryableKeys(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2))
+		batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(1, 3))
+		batch.Put("ns1", "key4", []byte{0x00, 0x01, 0x02, 0xff}, version.NewHeight(1, 4))
+		batch.Put("ns2", "key1", []byte("binary value"), version.NewHeight(1, 5))
+		db.ApplyUpdates(batch, version.NewHeight(1, 5))
+
+		count, err := vdb.CountNonQueryableKeys("ns1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, count, 2)
+		count, err = vdb.CountNonQueryableKeys("ns3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, count, 0)
+
+		// the query matches the documents of the binary values, which are skipped and reported
+		itr, err := vdb.ExecuteQuery(`{"selector":{"_id":{"$gt":"ns1"}}}`)
+		testutil.AssertNoError(t, err, "")
+		defer itr.Close()
+		var keys []string
+		for {
+			result, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			if result == nil {
+				break
+			}
+			keys = append(keys, result.(*statedb.VersionedQueryRecord).Key)
+		}
+		testutil.AssertEquals(t, keys, []string{"key1", "key3"})
+		records := itr.(NonQueryableReporter).NonQueryableRecords()
+		testutil.AssertEquals(t, records, []*NonQueryableRecord{
+			{Namespace: "ns1", Key: "key2", Version: version.NewHeight(1, 2)},
+			{Namespace: "ns1", Key: "key4", Version: version.NewHeight(1, 4)},
+			{Namespace: "ns2", Key: "key1", Version: version.NewHeight(1, 5)}})
+
+	}
+}
+
+// aggregateRecords returns the group keys and values of the results of an aggregate query, as compact JSON
+func aggregateRecords(t *testing.T, itr statedb.ResultsIterator) map[string]string {
+	defer itr.Close()
+	records := map[string]string{}
+	for {
+		result, err := itr.Next()
+		testutil.AssertNoError(t, err, "")
+		if result == nil {
+			return records
+		}
+		record := result.(*AggregateRecord)
+		var groupKey, value bytes.Buffer
+		testutil.AssertNoError(t, json.Compact(&groupKey, record.GroupKey), "")
+		testutil.AssertNoError(t, json.Compact(&value, record.Value), "")
+		records[groupKey.String()] = value.String()
+	}
+}
+
+func TestAggregateView(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"owner":"tom","color":"blue","size":10}`), version.NewHeight(1, 1))
+		batch.Put("ns1", "key2", []byte(`{"owner":"tom","color":"red","size":5}`), version.NewHeight(1, 2))
+		batch.Put("ns1", "key3", []byte(`{"owner":"tom","color":"blue","size":7}`), version.NewHeight(1, 3))
+		batch.Put("ns1", "key4", []byte(`{"owner":"jerry","color":"blue","size":1}`), version.NewHeight(1, 4))
+		batch.Put("ns1", "key5", []byte(`{"owner":"jerry","color":"blue","size":"large"}`), version.NewHeight(1, 5))
+		batch.Put("ns1", "key6", []byte("binary value"), version.NewHeight(1, 6))
+		batch.Put("ns2", "key1", []byte(`{"owner":"tom","color":"blue","size":100}`), version.NewHeight(1, 7))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 7)), "")
+
+		testutil.AssertNoError(t, vdb.DefineAggregateView("ns1", &AggregateView{Name: "size_by_owner_color",
+			GroupFields: []string{"owner", "color"}, ValueField: "size", Function: AggregateSum}), "")
+		testutil.AssertNoError(t, vdb.DefineAggregateView("ns1", &AggregateView{Name: "count_by_owner",
+			GroupFields: []string{"owner"}, Function: AggregateCount}), "")
+
+		// the sizes of the namespace are summed by owner and color, the sizes that are not numbers are skipped
+		itr, err := vdb.ExecuteAggregateQuery("ns1", "size_by_owner_color", 2)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, aggregateRecords(t, itr), map[string]string{
+			`["jerry","blue"]`: "1", `["tom","blue"]`: "17", `["tom","red"]`: "5"})
+
+		// and rolled up by owner only, or for the whole namespace
+		itr, err = vdb.ExecuteAggregateQuery("ns1", "size_by_owner_color", 1)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, aggregateRecords(t, itr), map[string]string{`["jerry"]`: "1", `["tom"]`: "22"})
+		itr, err = vdb.ExecuteAggregateQuery("ns1", "size_by_owner_color", 0)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, aggregateRecords(t, itr), map[string]string{"null": "23"})
+
+		// the JSON values are counted, whatever their size
+		itr, err = vdb.ExecuteAggregateQuery("ns1", "count_by_owner", 1)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, aggregateRecords(t, itr), map[string]string{`["jerry"]`: "2", `["tom"]`: "3"})
+
+		// a dropped view cannot be queried, the other views of the namespace are kept
+		testutil.AssertNoError(t, vdb.DropAggregateView("ns1", "count_by_owner"), "")
+		_, err = vdb.ExecuteAggregateQuery("ns1", "count_by_owner", 1)
+		testutil.AssertError(t, err, "Expected an error querying a dropped view")
+		_, err = vdb.ExecuteAggregateQuery("ns1", "size_by_owner_color", 1)
+		testutil.AssertNoError(t, err, "")
+
+		err = vdb.DefineAggregateView("ns1", &AggregateView{Name: "sum", GroupFields: []string{"owner"}, Function: AggregateSum})
+		testutil.AssertError(t, err, "Expected an error for a sum without a value field")
+		err = vdb.DefineAggregateView("ns1", &AggregateView{Name: "max", ValueField: "size", Function: "_max"})
+		testutil.AssertError(t, err, "Expected an error for an unsupported function")
+
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+
+		batch := statedb.NewUpdateBatch()
+		batch.PutWithTTL("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1), time.Second)
+		batch.PutWithTTL("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2), time.Second)
+		batch.Put("ns1", "key3", []byte(`{"asset_name":"marble3"}`), version.NewHeight(1, 3))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 3)), "")
+
+		// the values are visible until they expire, without the expiry
+		vv, err := db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), expiryField), false)
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, vv.Value, []byte("binary value"))
+
+		// the expired values are absent before they are swept
+		time.Sleep(1200 * time.Millisecond)
+		vv, err = db.GetState("ns1", "key1")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+		vv, err = db.GetState("ns1", "key2")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, vv)
+		vv, err = db.GetState("ns1", "key3")
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble3"), true)
+
+		// the sweep deletes the expired documents only
+		swept, err := vdb.SweepExpired()
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, swept, 2)
+		itr, err := db.GetStateRangeScanIterator("ns1", "", "")
+		testutil.AssertNoError(t, err, "")
+		keys := []string{}
+		for {
+			result, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			if result == nil {
+				break
+			}
+			keys = append(keys, result.(*statedb.VersionedKV).Key)
+		}
+		itr.Close()
+		testutil.AssertEquals(t, keys, []string{"key3"})
+
+		// a value written with a TTL is eventually purged by the sweeper
+		provider := env.DBProvider.(*VersionedDBProvider)
+		testutil.AssertNoError(t, provider.StartExpirySweeper("testdb", 100*time.Millisecond), "")
+		testutil.AssertError(t, provider.StartExpirySweeper("testdb", 100*time.Millisecond),
+			"Starting a second sweeper should fail")
+		batch = statedb.NewUpdateBatch()
+		batch.PutWithTTL("ns1", "key4", []byte(`{"asset_name":"marble4"}`), version.NewHeight(2, 1), 100*time.Millisecond)
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+		id := compositeKeyID("ns1", "key4")
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+			if jsonDoc, _, _ := vdb.db.ReadDoc(id); jsonDoc == nil {
+				break
+			}
+		}
+		jsonDoc, _, err := vdb.db.ReadDoc(id)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertNil(t, jsonDoc)
+
+	}
+}
+
+func TestMergeUpdate(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	fields := map[string]interface{}{"owner": "tom", "color": "blue", "size": 10,
+		"details": map[string]interface{}{"weight": 5, "shape": "round"}}
+	for i := 0; i < 200; i++ {
+		fields[fmt.Sprintf("note%d", i)] = strings.Repeat("x", 50)
+	}
+	largeValue, _ := json.Marshal(fields)
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", largeValue, version.NewHeight(1, 1))
+	batch.Put("ns1", "key2", []byte("binary value"), version.NewHeight(1, 2))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+
+	// only the fields of the patch are updated, the field set to null is removed
+	batch = statedb.NewUpdateBatch()
+	batch.PutMerge("ns1", "key1", []byte(`{"color":"red","details":{"shape":null},"owner":null}`), version.NewHeight(2, 1))
+	batch.PutMerge("ns1", "key3", []byte(`{"owner":"jerry"}`), version.NewHeight(2, 2))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 2)), "")
+
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Version, version.NewHeight(2, 1))
+	merged := map[string]interface{}{}
+	testutil.AssertNoError(t, json.Unmarshal(vv.Value, &merged), "")
+	delete(merged, "_id")
+	delete(merged, "_rev")
+	expected := map[string]interface{}{}
+	json.Unmarshal(largeValue, &expected)
+	expected["color"] = "red"
+	delete(expected, "owner")
+	delete(expected["details"].(map[string]interface{}), "shape")
+	testutil.AssertEquals(t, merged, expected)
+
+	// a key without a value is created from the patch
+	vv, err = db.GetState("ns1", "key3")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), `"owner":"jerry"`), true)
+
+	// a merge is applied to the current value, as a new revision of its document
+	batch = statedb.NewUpdateBatch()
+	batch.PutMerge("ns1", "key3", []byte(`{"size":3}`), version.NewHeight(3, 1))
+	currentRev := mock.revs[compositeKeyID("ns1", "key3")]
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(3, 1)), "")
+	testutil.AssertEquals(t, mock.revs[compositeKeyID("ns1", "key3")], currentRev+1)
+	vv, err = db.GetState("ns1", "key3")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), `"owner":"jerry"`), true)
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), `"size":3`), true)
+
+	// a binary value cannot be merged into, nor can a patch that is not a JSON object be merged
+	batch = statedb.NewUpdateBatch()
+	batch.PutMerge("ns1", "key2", []byte(`{"color":"red"}`), version.NewHeight(4, 1))
+	testutil.AssertError(t, db.ApplyUpdates(batch, version.NewHeight(4, 1)), "Expected an error merging into a binary value")
+	batch = statedb.NewUpdateBatch()
+	batch.PutMerge("ns1", "key1", []byte(`["red"]`), version.NewHeight(4, 1))
+	testutil.AssertError(t, db.ApplyUpdates(batch, version.NewHeight(4, 1)), "Expected an error for a patch that is not an object")
+
+	// a Put replaces a merge of the same key in the batch
+	batch = statedb.NewUpdateBatch()
+	batch.PutMerge("ns1", "key1", []byte(`{"color":"green"}`), version.NewHeight(4, 1))
+	batch.Put("ns1", "key1", []byte(`{"color":"green"}`), version.NewHeight(4, 1))
+	testutil.AssertEquals(t, batch.Merges[statedb.CompositeKey{Namespace: "ns1", Key: "key1"}], false)
+}
+
+func TestQueryScannerWithoutIDs(t *testing.T) {
+	// the results of a query whose fields project away _id, along with an internal doc and a result that is
+	// not a document
+	results := []couchdb.QueryResult{
+		{ID: "", Value: []byte(`{"owner":"tom"}`)},
+		{ID: savepointDocID, Value: []byte(`{"BlockNum":1,"TxNum":1}`)},
+		{ID: "ns1\x00key1", Value: []byte(`{"owner":"jerry","~version":"1:2"}`)},
+		{ID: "", Value: []byte(`["owner"]`)},
+	}
+	scanner := newQueryScanner(newKeyEncoder(), results)
+	defer scanner.Close()
+
+	result, err := scanner.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Namespace, "")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Key, "")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Record, []byte(`{"owner":"tom"}`))
+
+	result, err = scanner.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Namespace, "ns1")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Key, "key1")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Version, version.NewHeight(1, 2))
+
+	result, err = scanner.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Key, "")
+	testutil.AssertEquals(t, result.(*statedb.VersionedQueryRecord).Record, []byte(`["owner"]`))
+
+	result, err = scanner.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, result)
+	testutil.AssertEquals(t, len(scanner.NonQueryableRecords()), 0)
+}
+
+func TestReconcileSavepoint(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.savepointBlockInterval = 10
+
+	// the savepoint of block 1 is recorded, the savepoints of blocks 2 to 4 are deferred when the peer crashes
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNoError(t, db.Flush(), "")
+	for blockNum := uint64(2); blockNum <= 4; blockNum++ {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", fmt.Sprintf("key%d", blockNum), []byte(`{"asset_name":"marble"}`), version.NewHeight(blockNum, 1))
+		batch.Put("ns2", fmt.Sprintf("key%d", blockNum), []byte(`{"asset_name":"marble"}`), version.NewHeight(blockNum, 2))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(blockNum, 2)), "")
+	}
+
+	// the savepoint is advanced to the last height of block 3, block 4 may be partially written
+	restarted := newMockVersionedDB(t, server, "testdb")
+	sp, err := restarted.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+	sp, err = restarted.ReconcileSavepoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(3, 2))
+	sp, err = restarted.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(3, 2))
+
+	// block 4 is replayed, after which the savepoint is up to date
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key4", []byte(`{"asset_name":"marble"}`), version.NewHeight(4, 1))
+	batch.Put("ns2", "key4", []byte(`{"asset_name":"marble"}`), version.NewHeight(4, 2))
+	testutil.AssertNoError(t, restarted.ApplyUpdates(batch, version.NewHeight(4, 2)), "")
+	testutil.AssertNoError(t, restarted.Flush(), "")
+	sp, err = restarted.ReconcileSavepoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(4, 2))
+}
+
+func TestHashedKeyIDs(t *testing.T) {
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 128)
+	defer viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 0)
+	_, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+	defer provider.Close()
+	vdb, err := provider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	db := vdb.(*VersionedDB)
+
+	// the long keys share a prefix longer than the maximum length, so that they only differ in their hash
+	prefix := strings.Repeat("a", 200)
+	keys := []string{prefix + "1", prefix + "2", prefix + "3", "b", "c"}
+	batch := statedb.NewUpdateBatch()
+	for i, key := range keys {
+		batch.Put("ns1", key, []byte(fmt.Sprintf(`{"asset_name":"marble%d"}`, i)), version.NewHeight(1, uint64(i+1)))
+	}
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 5)), "")
+
+	for i, key := range keys {
+		vv, err := db.GetState("ns1", key)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), fmt.Sprintf(`"asset_name":"marble%d"`, i)), true)
+		testutil.AssertEquals(t, strings.Contains(string(vv.Value), keyField), false)
+		testutil.AssertEquals(t, vv.Version, version.NewHeight(1, uint64(i+1)))
+	}
+	id := compositeKeyID("ns1", prefix+"1")
+	testutil.AssertEquals(t, len(id), len("ns1")+1+128+keyIDHashLength)
+	testutil.AssertEquals(t, id == compositeKeyID("ns1", prefix+"2"), false)
+	ns, key := SplitCompositeKey([]byte(compositeKeyID("ns1", "b")))
+	testutil.AssertEquals(t, ns, "ns1")
+	testutil.AssertEquals(t, key, "b")
+
+	scanKeys := func(itr statedb.ResultsIterator, err error) []string {
+		testutil.AssertNoError(t, err, "")
+		defer itr.Close()
+		var scanned []string
+		for {
+			result, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			if result == nil {
+				break
+			}
+			switch result := result.(type) {
+			case *statedb.VersionedKV:
+				scanned = append(scanned, result.Key)
+			case *statedb.CompositeKey:
+				scanned = append(scanned, result.Key)
+			}
+		}
+		// the keys sharing the key part of a hashed id are in the order of their hash
+		sort.Strings(scanned)
+		return scanned
+	}
+	testutil.AssertEquals(t, scanKeys(db.GetStateRangeScanIterator("ns1", "", "")), keys)
+	testutil.AssertEquals(t, scanKeys(db.GetStateRangeScanIterator("ns1", prefix+"2", prefix+"3")), []string{prefix + "2"})
+	testutil.AssertEquals(t, scanKeys(db.GetStateRangeScanIterator("ns1", "", prefix+"2")), []string{prefix + "1"})
+	testutil.AssertEquals(t, scanKeys(db.GetStateRangeScanIterator("ns1", prefix+"2", "c")), []string{prefix + "2", prefix + "3", "b"})
+	testutil.AssertEquals(t, scanKeys(db.GetStateRangeScanIteratorWithLimit("ns1", prefix+"2", "", 10)), keys[1:])
+	testutil.AssertEquals(t, scanKeys(db.GetStateRangeScanIteratorStreaming("ns1", prefix+"3", "")), keys[2:])
+	testutil.AssertEquals(t, scanKeys(db.GetKeys("ns1")), keys)
+
+	// the key encoding records the maximum length, a database opened without hashed ids is rejected
+	encodingJSON, _, err := db.db.ReadDoc(keyEncodingDocID)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(encodingJSON), `"MaxKeyIDLength":128`), true)
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 0)
+	provider = newMockProvider(t, server)
+	_, err = provider.GetDBHandle("testdb")
+	_, ok := err.(*ErrKeyEncodingMismatch)
+	testutil.AssertEquals(t, ok, true)
+}
+
+func TestStateHash(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// the same updates hash the same whatever the order they are added in, other updates hash differently
+	newBatch := func() *statedb.UpdateBatch {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		batch.Put("ns2", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+		batch.Delete("ns1", "key3", version.NewHeight(1, 3))
+		return batch
+	}
+	batch1 := newBatch()
+	batch2 := statedb.NewUpdateBatch()
+	batch2.Delete("ns1", "key3", version.NewHeight(1, 3))
+	batch2.Put("ns2", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2))
+	batch2.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	hash1, err := HashUpdateBatch(batch1)
+	testutil.AssertNoError(t, err, "")
+	hash2, err := HashUpdateBatch(batch2)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, hash1, hash2)
+	for _, update := range []func(batch *statedb.UpdateBatch){
+		func(batch *statedb.UpdateBatch) {
+			batch.Put("ns1", "key1", []byte(`{"asset_name":"marble3"}`), version.NewHeight(1, 1))
+		},
+		func(batch *statedb.UpdateBatch) {
+			batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 4))
+		},
+		func(batch *statedb.UpdateBatch) {
+			batch.PutMerge("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+		},
+		func(batch *statedb.UpdateBatch) {
+			batch.Put("ns1", "key3", []byte{}, version.NewHeight(1, 3))
+		},
+	} {
+		batch3 := newBatch()
+		update(batch3)
+		hash3, err := HashUpdateBatch(batch3)
+		testutil.AssertNoError(t, err, "")
+		testutil.AssertEquals(t, bytes.Equal(hash1, hash3), false)
+	}
+
+	// no state hash is recorded unless a hasher is set
+	testutil.AssertNoError(t, db.ApplyUpdates(batch1, version.NewHeight(1, 3)), "")
+	sp, stateHash, err := db.GetLatestSavePointWithStateHash()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 3))
+	testutil.AssertNil(t, stateHash)
+
+	db.SetStateHasher(HashUpdateBatch)
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble4"}`), version.NewHeight(2, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+	expectedHash, err := HashUpdateBatch(batch)
+	testutil.AssertNoError(t, err, "")
+	sp, stateHash, err = db.GetLatestSavePointWithStateHash()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(2, 1))
+	testutil.AssertEquals(t, stateHash, expectedHash)
+
+	// the state hash is read back by another handle
+	sp, stateHash, err = newMockVersionedDB(t, server, "testdb").GetLatestSavePointWithStateHash()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(2, 1))
+	testutil.AssertEquals(t, stateHash, expectedHash)
+}
+
+func TestRecordSavepointConflict(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	mock.mux.Lock()
+	mock.checkRevs = true
+	mock.mux.Unlock()
+
+	// writeSavepoint writes the savepoint concurrently, right before the next savepoint write of the handle
+	writeSavepoint := func(height *version.Height) {
+		mock.mux.Lock()
+		defer mock.mux.Unlock()
+		mock.beforeWrites = map[string]func(){savepointDocID: func() {
+			mock.docs[savepointDocID] = []byte(fmt.Sprintf(`{"BlockNum":%d,"TxNum":%d,"UpdateSeq":"1"}`, height.BlockNum, height.TxNum))
+			mock.revs[savepointDocID]++
+		}}
+	}
+	apply := func(height *version.Height) {
+		batch := statedb.NewUpdateBatch()
+		batch.Put("ns1", fmt.Sprintf("key%d", height.BlockNum), []byte(`{"asset_name":"marble1"}`), height)
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, height), "")
+	}
+
+	// the savepoint is saved again on top of a savepoint written concurrently at a lower height
+	apply(version.NewHeight(1, 1))
+	writeSavepoint(version.NewHeight(1, 2))
+	apply(version.NewHeight(2, 1))
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(2, 1))
+
+	// a savepoint written concurrently at a greater height is kept
+	writeSavepoint(version.NewHeight(5, 1))
+	apply(version.NewHeight(3, 1))
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(5, 1))
+
+	// a savepoint written without a concurrent writer is saved at its revision
+	mock.mux.Lock()
+	mock.docs[savepointDocID] = []byte(`{"BlockNum":3,"TxNum":1,"UpdateSeq":"1"}`)
+	mock.mux.Unlock()
+	apply(version.NewHeight(4, 1))
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(4, 1))
+}
+
+func TestQueryRangeFallback(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.queryRangeFallback = true
+
+	batch := statedb.NewUpdateBatch()
+	for i := 1; i <= 5; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"owner":"tom","size":%d,"details":{"color":"red"}}`, i%2)), version.NewHeight(1, uint64(i)))
+	}
+	batch.Put("ns2", "key1", []byte(`{"owner":"tom","size":1}`), version.NewHeight(1, 6))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 6)), "")
+
+	queryKeys := func(query string) []string {
+		itr, err := db.ExecuteQuery(query)
+		testutil.AssertNoError(t, err, "")
+		defer itr.Close()
+		var keys []string
+		for {
+			result, err := itr.Next()
+			testutil.AssertNoError(t, err, "")
+			if result == nil {
+				return keys
+			}
+			keys = append(keys, result.(*statedb.VersionedQueryRecord).Key)
+		}
+	}
+	mock.mux.Lock()
+	mock.requests = nil
+	mock.mux.Unlock()
+
+	// the equality on a key, and the range of keys of a namespace filtered by the values of fields
+	testutil.AssertEquals(t, queryKeys(`{"selector":{"_id":"ns1\u0000key2"}}`), []string{"key2"})
+	testutil.AssertEquals(t, queryKeys(`{"selector":{"_id":{"$gt":"ns1\u0000key1","$lte":"ns1\u0000key4"},"size":1.0}}`),
+		[]string{"key3"})
+	testutil.AssertEquals(t, queryKeys(`{"selector":{"_id":{"$gte":"ns1\u0000","$lt":"ns1\u0001"},"details.color":{"$eq":"red"},"size":1}}`),
+		[]string{"key1", "key3", "key5"})
+	testutil.AssertEquals(t, queryKeys(`{"selector":{"_id":{"$gte":"ns2\u0000"},"owner":"jerry"}}`), []string(nil))
+	mock.mux.Lock()
+	for _, request := range mock.requests {
+		testutil.AssertEquals(t, strings.Contains(request, "_find"), false)
+	}
+	testutil.AssertEquals(t, len(mock.requests), 4)
+	mock.mux.Unlock()
+
+	// the queries that do not reduce to a range of ids
+	for _, query := range []string{
+		`{"selector":{"owner":"tom"}}`,
+		`{"selector":{"_id":{"$gt":"ns1\u0000"}},"fields":["owner"]}`,
+		`{"selector":{"_id":{"$regex":"^ns1"}}}`,
+		`{"selector":{"_id":{"$gt":"ns1\u0000"},"size":{"$gt":0}}}`,
+		`{"selector":{"_id":{"$gt":"ns1\u0000"},"details":{"color":"red"}}}`,
+		`{"selector":{"_id":{"$gt":"ns1\u0000"},"$or":[{"size":0},{"size":1}]}}`,
+	} {
+		testutil.AssertNil(t, reduceQueryToRange(query))
+	}
+	testutil.AssertEquals(t, reduceQueryToRange(`{"selector":{"_id":{"$gte":"a","$gt":"b","$lt":"d","$lte":"c"}}}`),
+		&idRange{startID: "b\x00", endID: "c\x00", equals: map[string]interface{}{}})
+}
+
+func TestQueryRangeFallbackMatchesMango(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+
+		batch := statedb.NewUpdateBatch()
+		for i := 1; i <= 5; i++ {
+			batch.Put("ns1", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"owner":"tom","size":%d}`, i%2)), version.NewHeight(1, uint64(i)))
+		}
+		batch.Put("ns1", "key6", []byte("binary value"), version.NewHeight(1, 6))
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 6)), "")
+
+		// the records of the results, along with those of the keys matched whose value is stored as an attachment
+		queryRecords := func(query string) []string {
+			itr, err := db.ExecuteQuery(query)
+			testutil.AssertNoError(t, err, "")
+			defer itr.Close()
+			var records []string
+			for {
+				result, err := itr.Next()
+				testutil.AssertNoError(t, err, "")
+				if result == nil {
+					for _, nonQueryable := range itr.(NonQueryableReporter).NonQueryableRecords() {
+						records = append(records, fmt.Sprintf("%s %v non-queryable", nonQueryable.Key, nonQueryable.Version))
+					}
+					sort.Strings(records)
+					return records
+				}
+				record := result.(*statedb.VersionedQueryRecord)
+				records = append(records, fmt.Sprintf("%s %v %s", record.Key, record.Version, record.Record))
+			}
+		}
+		for _, query := range []string{
+			`{"selector":{"_id":"ns1\u0000key2"}}`,
+			`{"selector":{"_id":"ns1\u0000key6"}}`,
+			`{"selector":{"_id":{"$gt":"ns1\u0000key1","$lte":"ns1\u0000key6"},"size":1}}`,
+			`{"selector":{"_id":{"$gt":"ns1\u0000key3","$lte":"ns1\u0000key6"}}}`,
+			`{"selector":{"_id":{"$gte":"ns1\u0000","$lt":"ns1\u0001"},"owner":"tom"}}`,
+		} {
+			db.(*VersionedDB).queryRangeFallback = false
+			mango := queryRecords(query)
+			db.(*VersionedDB).queryRangeFallback = true
+			testutil.AssertEquals(t, queryRecords(query), mango)
+		}
+
+		// the binary value matched by its id is reported rather than dropped
+		records := queryRecords(`{"selector":{"_id":"ns1\u0000key6"}}`)
+		testutil.AssertEquals(t, len(records), 1)
+		testutil.AssertEquals(t, strings.HasSuffix(records[0], "non-queryable"), true)
+	}
+}
+
+func TestApplyUpdatesEmptyRevision(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	// a write answered with an empty revision fails the commit, as it may not be persisted
+	mock.mux.Lock()
+	mock.emptyRevs = true
+	mock.mux.Unlock()
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	err := db.ApplyUpdates(batch, version.NewHeight(1, 1))
+	testutil.AssertError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(err.Error(), "no revision returned"), true)
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(0, 0))
+
+	mock.mux.Lock()
+	mock.emptyRevs = false
+	mock.mux.Unlock()
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	sp, err = db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+}
+
+func TestNamespaceReadOnly(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	db.SetNamespaceReadOnly("ns1")
+	testutil.AssertEquals(t, db.IsNamespaceReadOnly("ns1"), true)
+	testutil.AssertEquals(t, db.IsNamespaceReadOnly("ns2"), false)
+
+	// the batch updating the read-only namespace fails as a whole, the writable namespace is not updated either
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(2, 1))
+	batch.Put("ns2", "key1", []byte(`{"asset_name":"marble3"}`), version.NewHeight(2, 2))
+	err := db.ApplyUpdates(batch, version.NewHeight(2, 2))
+	testutil.AssertEquals(t, err, &ErrNamespaceReadOnly{Namespace: "ns1", Key: "key1"})
+	batch = statedb.NewUpdateBatch()
+	batch.Delete("ns1", "key1", version.NewHeight(2, 1))
+	_, ok := db.ApplyUpdatesWithProgress(batch, version.NewHeight(2, 1), nil).(*ErrNamespaceReadOnly)
+	testutil.AssertEquals(t, ok, true)
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+	vv, err = db.GetState("ns2", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	sp, err := db.GetLatestSavePoint()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, sp, version.NewHeight(1, 1))
+
+	// the other namespaces commit normally, and the namespace is writable again once reset
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns2", "key1", []byte(`{"asset_name":"marble3"}`), version.NewHeight(2, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(2, 1)), "")
+	db.SetNamespaceWritable("ns1")
+	batch = statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble2"}`), version.NewHeight(3, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(3, 1)), "")
+	vv, err = db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+}
+
+func TestEstimateNamespaceSize(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.resultsPageSize = 64
+
+	// values of seven sizes in turn, so that the sample of every fourth document holds about as many of each size
+	batch := statedb.NewUpdateBatch()
+	for i := 0; i < 500; i++ {
+		value := fmt.Sprintf(`{"asset_name":"%s"}`, strings.Repeat("m", 100*(i%7)))
+		batch.Put("ns1", fmt.Sprintf("key%03d", i), []byte(value), version.NewHeight(1, uint64(i+1)))
+	}
+	for i := 0; i < 10; i++ {
+		batch.Put("ns2", fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"asset_name":"%d"}`, i)), version.NewHeight(1, 501))
+	}
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 501)), "")
+
+	exactSize := func(namespace string) int64 {
+		ids, err := db.db.ReadDocIDRange(string(ConstructCompositeKey(namespace, "")),
+			string(constructNamespaceEndKey(namespace)), 1000, 0)
+		testutil.AssertNoError(t, err, "")
+		requests := make([]couchdb.DocRevRequest, len(ids))
+		for i, id := range ids {
+			requests[i] = couchdb.DocRevRequest{ID: id}
+		}
+		results, err := db.db.BulkGet(requests)
+		testutil.AssertNoError(t, err, "")
+		var size int64
+		for _, result := range results {
+			size += int64(len(result.JSONDoc))
+		}
+		return size
+	}
+
+	// the estimate of a namespace larger than the sample is within 10% of its size
+	estimate, err := db.EstimateNamespaceSize("ns1")
+	testutil.AssertNoError(t, err, "")
+	exact := exactSize("ns1")
+	testutil.AssertEquals(t, estimate > exact*9/10 && estimate < exact*11/10, true)
+
+	// the ids are listed in pages starting after the last id of the page before them, no id is skipped by CouchDB
+	queries := mock.requestQueries("GET", "/_all_docs")
+	testutil.AssertEquals(t, len(queries) >= 8, true)
+	for _, query := range queries {
+		testutil.AssertEquals(t, query.Get("skip") == "" || query.Get("skip") == "0", true)
+	}
+
+	// the estimate of a namespace no larger than the sample is exact
+	estimate, err = db.EstimateNamespaceSize("ns2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, estimate, exactSize("ns2"))
+
+	estimate, err = db.EstimateNamespaceSize("ns3")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, estimate, int64(0))
+	_, err = db.EstimateNamespaceSize("")
+	testutil.AssertEquals(t, err, ErrEmptyNamespace)
+}
+
+func TestExpiredPointReads(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+
+	batch := statedb.NewUpdateBatch()
+	batch.PutWithTTL("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1), -time.Minute)
+	batch.PutWithTTL("ns1", "key2", []byte(`{"asset_name":"marble2"}`), version.NewHeight(1, 2), time.Hour)
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 2)), "")
+
+	// the expired value is absent from all the reads of single keys, while the value not expired is present
+	vv, err := db.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	exists, err := db.Exists("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, exists, false)
+	exists, err = db.Exists("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, exists, true)
+
+	vv, _, err = db.GetStateWithKind("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	vv, _, err = db.GetStateWithKind("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+
+	vv, _, err = db.GetStateWithVectorClock("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+	vv, _, err = db.GetStateWithVectorClock("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble2"), true)
+
+	attachments, err := db.GetStateAttachments("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, attachments)
+	attachments, err = db.GetStateAttachments("ns1", "key2")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, attachments, map[string][]byte{})
+
+	vv, _, err = db.GetStateForUpdate("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertNil(t, vv)
+
+	results, err := db.GetStateByRevisions([]KeyRevision{{Namespace: "ns1", Key: "key1"}, {Namespace: "ns1", Key: "key2"}})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, results[0].Err, ErrRevisionNotFound)
+	testutil.AssertNil(t, results[0].VersionedValue)
+	testutil.AssertNoError(t, results[1].Err, "")
+	testutil.AssertEquals(t, strings.Contains(string(results[1].VersionedValue.Value), "marble2"), true)
+}
+
+func TestStartExpirySweeperInvalidInterval(t *testing.T) {
+	_, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+
+	// an interval that is not positive is rejected rather than failing the sweeper
+	for _, interval := range []time.Duration{0, -time.Second} {
+		testutil.AssertError(t, provider.StartExpirySweeper("testdb", interval), "Expected an error for an invalid interval")
+	}
+	testutil.AssertNoError(t, provider.StartExpirySweeper("testdb", time.Hour), "")
+	provider.Close()
+}
+
+func TestDeleteDBNotCreated(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+	defer provider.Close()
+
+	// deleting a database that does not exist is a no-op and does not create the database
+	mock.dbMissing = true
+	testutil.AssertNoError(t, provider.DeleteDB("testdb"), "")
+	testutil.AssertEquals(t, mock.creates, 0)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/testdb"), 0)
+	testutil.AssertEquals(t, mock.countRequests("DELETE", "/testdb"), 1)
+
+	// a database without a handle is dropped without being created first
+	mock.mux.Lock()
+	mock.dbMissing = false
+	mock.mux.Unlock()
+	testutil.AssertNoError(t, provider.DeleteDB("testdb"), "")
+	testutil.AssertEquals(t, mock.creates, 0)
+	testutil.AssertEquals(t, mock.countRequests("DELETE", "/testdb"), 2)
+	testutil.AssertEquals(t, mock.dbMissing, true)
+}
+
+func TestGetSavepointsNotCreated(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+	defer provider.Close()
+
+	// a database that does not exist maps to height 0 and is neither created nor opened
+	mock.dbMissing = true
+	savepoints, err := provider.GetSavepoints([]string{"testdb"})
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, savepoints, map[string]*version.Height{"testdb": version.NewHeight(0, 0)})
+	testutil.AssertEquals(t, mock.creates, 0)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/testdb"), 0)
+	testutil.AssertEquals(t, len(provider.databases), 0)
+}
+
+func TestApplyUpdatesWithProgressRecreatedDB(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	db.recreateMissingDB = true
+
+	batch := statedb.NewUpdateBatch()
+	for i := 0; i < 250; i++ {
+		batch.Put("ns1", fmt.Sprintf("key%03d", i), []byte(`{"asset_name":"marble"}`), version.NewHeight(1, uint64(i)))
+	}
+	// the database goes missing once the first chunk is written, so the writes are retried from the first chunk
+	// once it is recreated, and the chunks written before are not reported again
+	var dones []int
+	progress := func(done int) {
+		dones = append(dones, done)
+		if len(dones) == 1 {
+			mock.mux.Lock()
+			mock.dbMissing = true
+			mock.mux.Unlock()
+		}
+	}
+	testutil.AssertNoError(t, db.applyUpdates(batch, version.NewHeight(1, 250), "", nil, progress), "")
+	testutil.AssertEquals(t, mock.creates, 1)
+	testutil.AssertEquals(t, dones, []int{100, 200, 250})
+	vv, err := db.GetState("ns1", "key249")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, vv.Value, []byte(`{"asset_name":"marble"}`))
+}
+
+func TestTTLUseRecorded(t *testing.T) {
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	provider := newMockProvider(t, server)
+	defer provider.Close()
+
+	db, err := provider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertEquals(t, db.(*VersionedDB).ttlUsed, false)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+ttlDocID), 0)
+
+	// the use of TTL values is recorded once, before the first of them is written
+	for i := uint64(2); i <= 3; i++ {
+		batch = statedb.NewUpdateBatch()
+		batch.PutWithTTL("ns1", "key1", []byte(`{"asset_name":"marble1"}`), version.NewHeight(i, 1), time.Hour)
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(i, 1)), "")
+	}
+	testutil.AssertEquals(t, db.(*VersionedDB).ttlUsed, true)
+	testutil.AssertEquals(t, mock.countRequests("PUT", "/"+ttlDocID), 1)
+
+	// a handle opened later reads the use of TTL values recorded
+	otherProvider := newMockProvider(t, server)
+	defer otherProvider.Close()
+	otherDB, err := otherProvider.GetDBHandle("testdb")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, otherDB.(*VersionedDB).ttlUsed, true)
+}
+
+func TestQueryLimitAndSkip(t *testing.T) {
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		env := NewTestVDBEnv(t)
+		defer env.Cleanup()
+		db, err := env.DBProvider.GetDBHandle("testdb")
+		testutil.AssertNoError(t, err, "")
+		vdb := db.(*VersionedDB)
+		vdb.queryLimit = 5
+		vdb.resultsPageSize = 4
+
+		batch := statedb.NewUpdateBatch()
+		for i := 0; i < 30; i++ {
+			batch.Put("ns1", fmt.Sprintf("key%03d", i), []byte(`{"owner":"tom"}`), version.NewHeight(1, uint64(i+1)))
+		}
+		testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 30)), "")
+		queryKeys := func(query string, limit int) []string {
+			itr, err := vdb.ExecuteQueryWithLimit(query, limit)
+			testutil.AssertNoError(t, err, "")
+			defer itr.Close()
+			keys := []string{}
+			for {
+				queryResult, err := itr.Next()
+				testutil.AssertNoError(t, err, "")
+				if queryResult == nil {
+					return keys
+				}
+				keys = append(keys, queryResult.(*statedb.VersionedQueryRecord).Key)
+			}
+		}
+		keyRange := func(start, end int) []string {
+			keys := []string{}
+			for i := start; i < end; i++ {
+				keys = append(keys, fmt.Sprintf("key%03d", i))
+			}
+			return keys
+		}
+
+		// the configured query limit cuts off the results of a query matching more documents
+		itr, err := vdb.ExecuteQuery(`{"selector":{"owner":"tom"}}`)
+		testutil.AssertNoError(t, err, "")
+		count := 0
+		for queryResult, _ := itr.Next(); queryResult != nil; queryResult, _ = itr.Next() {
+			count++
+		}
+		itr.Close()
+		testutil.AssertEquals(t, count, 5)
+
+		// a lower limit and a skip set in the query are kept by the limited queries
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"},"limit":3}`, 5), keyRange(0, 3))
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"},"limit":10}`, 5), keyRange(0, 5))
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"},"skip":27}`, 5), keyRange(27, 30))
+
+		// the unlimited queries page from the skip set in the query, up to the limit set in the query
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"}}`, Unlimited), keyRange(0, 30))
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"},"limit":10,"skip":5}`, Unlimited), keyRange(5, 15))
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"},"skip":25}`, Unlimited), keyRange(25, 30))
+		testutil.AssertEquals(t, queryKeys(`{"selector":{"owner":"tom"},"limit":3}`, Unlimited), keyRange(0, 3))
+
+		_, err = vdb.ExecuteQueryWithLimit(`{"selector":{"owner":"tom"},"limit":"ten"}`, Unlimited)
+		testutil.AssertError(t, err, "Expected an error for a limit that is not a number")
+
+	}
+}
+
+func TestInvalidUTF8KeyPolicyResolvedAtOpen(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "reject")
+	invalidKey := "key\xff\xfe1"
+
+	// the keys are escaped with the policy configured when the database is opened
+	viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "base64")
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "hex")
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", invalidKey, []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00"+escapedKeyMarker+"base64:"+base64.StdEncoding.EncodeToString([]byte(invalidKey))))
+	vv, err := db.GetState("ns1", invalidKey)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+}
+
+func TestOrderedKeysResolvedAtOpen(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+	invalidKey := "key\xff"
+
+	// the keys are encoded with the encoding configured when the database is opened
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", true)
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", invalidKey, []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00"+encodeOrderedKey(invalidKey)))
+	vv, err := db.GetState("ns1", invalidKey)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+	itr, err := db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+	queryResult, err := itr.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, queryResult.(*statedb.VersionedKV).Key, invalidKey)
+}
+
+func TestMaxKeyIDLengthResolvedAtOpen(t *testing.T) {
+	defer viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 0)
+	longKey := strings.Repeat("a", 200)
+
+	// the ids are hashed beyond the maximum length configured when the database is opened
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 128)
+	mock, server := newMockCouchDB()
+	defer server.Close()
+	db := newMockVersionedDB(t, server, "testdb")
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 0)
+
+	batch := statedb.NewUpdateBatch()
+	batch.Put("ns1", longKey, []byte(`{"asset_name":"marble1"}`), version.NewHeight(1, 1))
+	testutil.AssertNoError(t, db.ApplyUpdates(batch, version.NewHeight(1, 1)), "")
+	testutil.AssertNil(t, mock.getDoc("ns1\x00"+longKey))
+	hash := sha256.Sum256([]byte(longKey))
+	testutil.AssertNotNil(t, mock.getDoc("ns1\x00"+longKey[:128]+hex.EncodeToString(hash[:])))
+	vv, err := db.GetState("ns1", longKey)
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, strings.Contains(string(vv.Value), "marble1"), true)
+	itr, err := db.GetStateRangeScanIterator("ns1", "", "")
+	testutil.AssertNoError(t, err, "")
+	defer itr.Close()
+	queryResult, err := itr.Next()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, queryResult.(*statedb.VersionedKV).Key, longKey)
+}
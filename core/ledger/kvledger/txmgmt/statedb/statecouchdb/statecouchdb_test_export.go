@@ -41,19 +41,24 @@ func NewTestVDBEnv(t testing.TB) *TestVDBEnv {
 
 	dbProvider, _ := NewVersionedDBProvider()
 	testVDBEnv := &TestVDBEnv{t, dbProvider}
-	testVDBEnv.Cleanup()
+	cleanupDBs()
 	return testVDBEnv
 }
 
 // Cleanup drops the test couch databases and closes the db provider
 func (env *TestVDBEnv) Cleanup() {
 	env.t.Logf("Cleaningup TestVDBEnv")
+	cleanupDBs()
+	env.DBProvider.Close()
+
+}
+
+func cleanupDBs() {
 	cleanupDB("testdb")
 	cleanupDB("testdb1")
 	cleanupDB("testdb2")
-	env.DBProvider.Close()
-
 }
+
 func cleanupDB(dbName string) {
 	//create a new connection
 	couchInstance, _ := couchdb.CreateCouchInstance(connectURL, username, password)
@@ -0,0 +1,104 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+)
+
+// StateHasher computes the hash of the state changes of a batch, which is recorded with the savepoint of the batch
+type StateHasher func(batch *statedb.UpdateBatch) ([]byte, error)
+
+// The kinds of update that HashUpdateBatch tells apart
+const (
+	hashedPut    = 'p'
+	hashedMerge  = 'm'
+	hashedDelete = 'd'
+)
+
+// HashUpdateBatch is a StateHasher returning the SHA-256 hash of the updates of the batch, in order of namespace then
+// key. Each update is hashed as its namespace, its key, its kind (put, merge patch or delete), its value and its
+// version, so that the same batch hashes the same on every peer, whatever the order the updates were added in.
+// The merge patches are hashed as patches, not as the values they are merged into
+func HashUpdateBatch(batch *statedb.UpdateBatch) ([]byte, error) {
+	h := sha256.New()
+	for _, ck := range sortedCompositeKeys(batch) {
+		vv := batch.KVs[ck]
+		kind := byte(hashedPut)
+		switch {
+		case vv.Value == nil:
+			kind = hashedDelete
+		case batch.Merges[ck]:
+			kind = hashedMerge
+		}
+		writeHashField(h, []byte(ck.Namespace))
+		writeHashField(h, []byte(ck.Key))
+		writeHashField(h, []byte{kind})
+		writeHashField(h, vv.Value)
+		writeHashField(h, heightBytes(vv.Version))
+	}
+	return h.Sum(nil), nil
+}
+
+// writeHashField writes a field to the hash prefixed with its length, so that the boundaries of the fields are
+// part of the hash
+func writeHashField(h hash.Hash, field []byte) {
+	var length [binary.MaxVarintLen64]byte
+	h.Write(length[:binary.PutUvarint(length[:], uint64(len(field)))])
+	h.Write(field)
+}
+
+// heightBytes returns the encoding of the height, nil for a nil height
+func heightBytes(height *version.Height) []byte {
+	if height == nil {
+		return nil
+	}
+	return height.ToBytes()
+}
+
+// SetStateHasher sets the hasher of the batches applied, or disables the state hash if nil, which it is by
+// default. Once a batch is applied, its hash is recorded with the savepoint of its height, and is returned by
+// GetLatestSavePointWithStateHash along with the savepoint, so that the peers can compare the state changes of
+// each block. As the savepoint is only recorded every savepointBlockInterval blocks, the hash of the blocks in
+// between is not recorded
+func (vdb *VersionedDB) SetStateHasher(hasher StateHasher) {
+	vdb.stateHasher = hasher
+}
+
+// hashState returns the state hash of the batch, nil if the state hash is disabled
+func (vdb *VersionedDB) hashState(batch *statedb.UpdateBatch) ([]byte, error) {
+	if vdb.stateHasher == nil {
+		return nil, nil
+	}
+	return vdb.stateHasher(batch)
+}
+
+// GetLatestSavePointWithStateHash is like GetLatestSavePoint, but also returns the state hash recorded with the
+// savepoint, which is the hash of the batch applied at the height of the savepoint, see SetStateHasher. The state
+// hash is nil if none is recorded
+func (vdb *VersionedDB) GetLatestSavePointWithStateHash() (*version.Height, []byte, error) {
+	savepointDoc, err := vdb.readSavepoint()
+	if err != nil {
+		return &version.Height{BlockNum: 0, TxNum: 0}, nil, err
+	}
+	return savepointDoc.height(), savepointDoc.StateHash, nil
+}
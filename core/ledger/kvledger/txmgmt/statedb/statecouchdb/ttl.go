@@ -0,0 +1,234 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/util/couchdb"
+)
+
+// expiryField is the reserved field of a document holding the time its value expires at, in milliseconds since
+// the epoch, if the value was written with a TTL
+const expiryField = "~expiry"
+
+// ttlDocID is the id of the internal document recording that values are written with a TTL in the database
+const ttlDocID = "statedb_ttl"
+
+// loadTTLUse reads whether values are written with a TTL in the database, as recorded in the TTL document
+func (vdb *VersionedDB) loadTTLUse() error {
+	ttlJSON, _, err := vdb.db.ReadDoc(ttlDocID)
+	if err != nil {
+		return err
+	}
+	vdb.ttlMux.Lock()
+	defer vdb.ttlMux.Unlock()
+	vdb.ttlUsed = vdb.ttlUsed || ttlJSON != nil
+	return nil
+}
+
+// recordTTLUse records in the TTL document that values are written with a TTL in the database, before the first
+// of them is written through the handle. The reads that do not read the values, i.e. Exists, check the expiry of
+// the values only in a database where values are written with a TTL
+func (vdb *VersionedDB) recordTTLUse() error {
+	vdb.ttlMux.Lock()
+	defer vdb.ttlMux.Unlock()
+	if vdb.ttlUsed {
+		return nil
+	}
+	if _, err := vdb.db.SaveDoc(ttlDocID, "", []byte(`{"ttl":true}`), nil); err != nil {
+		// a conflict is the document recorded already, e.g. through another handle
+		if _, ok := err.(*couchdb.ErrDocumentConflict); !ok {
+			vdb.logger.Errorf("Failed to record the use of TTL values: %s", err.Error())
+			return err
+		}
+	}
+	vdb.logger.Debugf("Recorded the use of TTL values")
+	vdb.ttlUsed = true
+	return nil
+}
+
+// isTTLUsed returns true if values are written with a TTL in the database
+func (vdb *VersionedDB) isTTLUsed() bool {
+	vdb.ttlMux.Lock()
+	defer vdb.ttlMux.Unlock()
+	return vdb.ttlUsed
+}
+
+// addExpiryField returns the JSON document, an empty document if nil, with the expiry stored in the expiry field
+func addExpiryField(jsonDoc []byte, expiry time.Time) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if jsonDoc != nil {
+		var err error
+		if fields, err = decodeJSONFields(jsonDoc); err != nil {
+			return nil, err
+		}
+	}
+	fields[expiryField] = expiry.UnixNano() / int64(time.Millisecond)
+	return json.Marshal(fields)
+}
+
+// removeExpiryField returns the JSON document without the expiry field, along with the expiry it held. The expiry
+// is the zero time if the document has no expiry field
+func removeExpiryField(jsonDoc []byte) ([]byte, time.Time, error) {
+	if !bytes.Contains(jsonDoc, []byte(expiryField)) {
+		return jsonDoc, time.Time{}, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(jsonDoc, &fields); err != nil {
+		return nil, time.Time{}, err
+	}
+	storedExpiry, ok := fields[expiryField]
+	if !ok {
+		return jsonDoc, time.Time{}, nil
+	}
+	expiry, err := decodeExpiry(storedExpiry)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	jsonDoc, err = removeField(jsonDoc, expiryField)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return jsonDoc, expiry, nil
+}
+
+// decodeExpiry decodes the expiry stored in the expiry field
+func decodeExpiry(storedExpiry json.RawMessage) (time.Time, error) {
+	var millis int64
+	if err := json.Unmarshal(storedExpiry, &millis); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid expiry %s stored in document: %s", storedExpiry, err.Error())
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)), nil
+}
+
+// isExpired returns true if the value stored in the JSON document has an expiry that is reached
+func isExpired(jsonDoc []byte) (bool, error) {
+	_, expiry, err := removeExpiryField(jsonDoc)
+	if err != nil {
+		return false, err
+	}
+	return !expiry.IsZero() && !time.Now().Before(expiry), nil
+}
+
+// SweepExpired deletes the documents of the values written with a TTL whose expiry is reached, as found by a scan
+// of the database in pages, and returns the number of documents deleted. A value rewritten since it was scanned is
+// not deleted. The expired values that are not swept yet are not returned by GetState and the other reads of
+// single keys, but are still returned by the range scans and the queries
+func (vdb *VersionedDB) SweepExpired() (int, error) {
+	vdb.beginOperation()
+	defer vdb.endOperation()
+
+	swept := 0
+	startID := ""
+	for {
+		docs, err := vdb.db.ReadDocFieldRange(startID, "", expiryField, vdb.resultsPageSize)
+		if err != nil {
+			vdb.logger.Debugf("Error calling ReadDocFieldRange(): %s\n", err.Error())
+			return swept, err
+		}
+		now := time.Now()
+		var expired []couchdb.DocRevRequest
+		for _, doc := range docs {
+			if doc.Value == nil || isInternalDocID(doc.ID) {
+				continue
+			}
+			expiry, err := decodeExpiry(doc.Value)
+			if err != nil {
+				vdb.logger.Warningf("Skipping the sweep of document [%s]: %s", doc.ID, err.Error())
+				continue
+			}
+			if !now.Before(expiry) {
+				expired = append(expired, couchdb.DocRevRequest{ID: doc.ID, Rev: doc.Rev})
+			}
+		}
+		if len(expired) > 0 {
+			deleted, err := vdb.db.BulkDeleteDocs(expired)
+			if err != nil {
+				return swept, err
+			}
+			swept += len(deleted)
+		}
+		if len(docs) < vdb.resultsPageSize {
+			break
+		}
+		startID = docs[len(docs)-1].ID + "\x00"
+	}
+	vdb.logger.Debugf("Swept %d expired values", swept)
+	return swept, nil
+}
+
+// expirySweeper periodically deletes the expired values of a database
+type expirySweeper struct {
+	vdb      *VersionedDB
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// StartExpirySweeper starts a sweeper deleting the expired values of the named database every interval, see
+// SweepExpired. The sweeper runs until the provider is closed or the database is deleted. Only one sweeper can be
+// started per database, and the interval must be positive
+func (provider *VersionedDBProvider) StartExpirySweeper(dbName string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid expiry sweeper interval %v, the interval must be positive", interval)
+	}
+	db, err := provider.GetDBHandle(dbName)
+	if err != nil {
+		return err
+	}
+	vdb := db.(*VersionedDB)
+	vdb.sweeperMux.Lock()
+	defer vdb.sweeperMux.Unlock()
+	if vdb.sweeper != nil {
+		return fmt.Errorf("Expiry sweeper already started for db %s", vdb.dbName)
+	}
+	vdb.sweeper = &expirySweeper{vdb: vdb, interval: interval, stop: make(chan struct{}), done: make(chan struct{})}
+	go vdb.sweeper.run()
+	return nil
+}
+
+// stopSweeper stops the expiry sweeper of the database, if any, and waits for it to exit
+func (vdb *VersionedDB) stopSweeper() {
+	vdb.sweeperMux.Lock()
+	defer vdb.sweeperMux.Unlock()
+	if vdb.sweeper == nil {
+		return
+	}
+	close(vdb.sweeper.stop)
+	<-vdb.sweeper.done
+	vdb.sweeper = nil
+}
+
+func (sweeper *expirySweeper) run() {
+	defer close(sweeper.done)
+	ticker := time.NewTicker(sweeper.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sweeper.stop:
+			return
+		case <-ticker.C:
+			if _, err := sweeper.vdb.SweepExpired(); err != nil {
+				sweeper.vdb.logger.Warningf("Expiry sweeper failed to sweep the expired values: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+)
+
+// versionField is the reserved field of a document holding the version of its value, as "blockNum:txNum"
+const versionField = "~version"
+
+// vectorClockField is the reserved field of a document holding the vector clock of its value, if it has one
+const vectorClockField = "~vclock"
+
+// versionBackfillDocID is the id of the internal document recording that the versions of the documents
+// written before the versions were stored have been backfilled
+const versionBackfillDocID = "statedb_version_backfill"
+
+// legacyVersion is the version of the values stored without a version
+var legacyVersion = version.NewHeight(1, 1)
+
+// addVersionField returns the JSON document, an empty document if nil, with the version stored in the version field
+func addVersionField(jsonDoc []byte, ver *version.Height) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if jsonDoc != nil {
+		var err error
+		if fields, err = decodeJSONFields(jsonDoc); err != nil {
+			return nil, err
+		}
+	}
+	fields[versionField] = fmt.Sprintf("%d:%d", ver.BlockNum, ver.TxNum)
+	return json.Marshal(fields)
+}
+
+// removeVersionField returns the JSON document without the version field, along with the version it held.
+// The version is nil if the document has no version field
+func removeVersionField(jsonDoc []byte) ([]byte, *version.Height, error) {
+	if !bytes.Contains(jsonDoc, []byte(versionField)) {
+		return jsonDoc, nil, nil
+	}
+	fields, err := decodeJSONFields(jsonDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	storedVersion, ok := fields[versionField]
+	if !ok {
+		return jsonDoc, nil, nil
+	}
+	ver := &version.Height{}
+	if _, err := fmt.Sscanf(fmt.Sprint(storedVersion), "%d:%d", &ver.BlockNum, &ver.TxNum); err != nil {
+		return nil, nil, fmt.Errorf("Invalid version [%v] stored in document: %s", storedVersion, err.Error())
+	}
+	delete(fields, versionField)
+	jsonDoc, err = json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonDoc, ver, nil
+}
+
+// addVectorClockField returns the JSON document, an empty document if nil, with the vector clock stored in
+// the vector clock field
+func addVectorClockField(jsonDoc []byte, clock statedb.VectorClock) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if jsonDoc != nil {
+		var err error
+		if fields, err = decodeJSONFields(jsonDoc); err != nil {
+			return nil, err
+		}
+	}
+	fields[vectorClockField] = clock
+	return json.Marshal(fields)
+}
+
+// removeVectorClockField returns the JSON document without the vector clock field, along with the vector
+// clock it held. The vector clock is nil if the document has no vector clock field
+func removeVectorClockField(jsonDoc []byte) ([]byte, statedb.VectorClock, error) {
+	if !bytes.Contains(jsonDoc, []byte(vectorClockField)) {
+		return jsonDoc, nil, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(jsonDoc, &fields); err != nil {
+		return nil, nil, err
+	}
+	storedClock, ok := fields[vectorClockField]
+	if !ok {
+		return jsonDoc, nil, nil
+	}
+	clock := statedb.VectorClock{}
+	if err := json.Unmarshal(storedClock, &clock); err != nil {
+		return nil, nil, fmt.Errorf("Invalid vector clock %s stored in document: %s", storedClock, err.Error())
+	}
+	jsonDoc, err := removeField(jsonDoc, vectorClockField)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonDoc, clock, nil
+}
+
+// decodeStoredValue returns a value read by a range scan or a query without the internal fields of its
+// document, along with its version, legacyVersion if the document has no version. The range scans return
+// the binary values without their document, so these values are returned with legacyVersion too
+func decodeStoredValue(storedValue []byte) ([]byte, *version.Height, error) {
+	value, err := removeNamespaceField(storedValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	if value, err = removeField(value, keyField); err != nil {
+		return nil, nil, err
+	}
+	if value, _, err = removeVectorClockField(value); err != nil {
+		return nil, nil, err
+	}
+	if value, _, err = removeExpiryField(value); err != nil {
+		return nil, nil, err
+	}
+	value, ver, err := removeVersionField(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ver == nil {
+		ver = legacyVersion
+	}
+	return value, ver, nil
+}
+
+// backfillVersions stores the height of the savepoint as the version of the documents written before the
+// versions were stored, which is the latest height any of them can have been written at. The backfill is
+// best-effort: a failure is logged, and the backfill is attempted again when the database is next opened.
+// Once all the documents are backfilled, the backfill is recorded so that later opens skip it
+func (vdb *VersionedDB) backfillVersions() {
+	backfillDoc, _, err := vdb.db.ReadDoc(versionBackfillDocID)
+	if err != nil {
+		vdb.logger.Warningf("Failed to read the version backfill record: %s", err.Error())
+		return
+	}
+	if backfillDoc != nil {
+		return
+	}
+	savepoint, err := vdb.readSavepoint()
+	if err != nil {
+		vdb.logger.Warningf("Version backfill failed to read the savepoint: %s", err.Error())
+		return
+	}
+
+	updated := 0
+	// without a savepoint, no value was committed before the versions were stored
+	if savepoint.BlockNum != 0 || savepoint.TxNum != 0 {
+		if updated, err = vdb.backfillVersionsAt(savepoint.height()); err != nil {
+			vdb.logger.Warningf("Version backfill failed after updating %d documents: %s", updated, err.Error())
+			return
+		}
+	}
+	if _, err := vdb.db.SaveDoc(versionBackfillDocID, "", []byte(fmt.Sprintf(`{"updated":%d}`, updated)), nil); err != nil {
+		vdb.logger.Warningf("Failed to record the version backfill: %s", err.Error())
+		return
+	}
+	vdb.logger.Infof("Backfilled the version of %d documents at savepoint height %v", updated, savepoint.height())
+}
+
+// backfillVersionsAt stores the version in the documents of the state that have no version, and returns the
+// number of documents updated
+func (vdb *VersionedDB) backfillVersionsAt(ver *version.Height) (int, error) {
+	stream, err := vdb.db.StreamDocRange("", "", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	updated := 0
+	for {
+		result, err := stream.Next()
+		if err != nil {
+			return updated, err
+		}
+		if result == nil {
+			return updated, nil
+		}
+		if isInternalDocID(result.ID) || bytes.Contains(result.Value, []byte(versionField)) {
+			continue
+		}
+		jsonDoc, attachments, rev, err := vdb.db.ReadDocAttachments(result.ID, "")
+		if err != nil {
+			return updated, err
+		}
+		if jsonDoc == nil && attachments == nil {
+			continue
+		}
+		// the fields maintained by CouchDB are not saved back
+		fields := map[string]interface{}{}
+		if jsonDoc != nil {
+			if fields, err = decodeJSONFields(jsonDoc); err != nil {
+				return updated, err
+			}
+		}
+		if _, ok := fields[versionField]; ok {
+			continue
+		}
+		delete(fields, "_id")
+		delete(fields, "_rev")
+		delete(fields, "_attachments")
+		fields[versionField] = fmt.Sprintf("%d:%d", ver.BlockNum, ver.TxNum)
+		versionedDoc, err := json.Marshal(fields)
+		if err != nil {
+			return updated, err
+		}
+		if len(attachments) == 0 {
+			attachments = nil
+		}
+		if _, err := vdb.db.SaveDoc(result.ID, rev, versionedDoc, attachments); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statecouchdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// ExpectedHeightFunc returns the height, in blocks, that the state database of a ledger is expected to have
+// reached, e.g. the height of the block store of the ledger
+type ExpectedHeightFunc func() (uint64, error)
+
+// heightWatchdog periodically compares the height of the recorded savepoint of a database to the expected
+// height. The difference is reported by the gauge statedb.<dbName>.height.lag, and each check finding the
+// heights diverged by more than the threshold logs a warning and increments the counter
+// statedb.<dbName>.height.divergences
+type heightWatchdog struct {
+	vdb            *VersionedDB
+	expectedHeight ExpectedHeightFunc
+	interval       time.Duration
+	threshold      uint64
+	lag            metrics.Gauge
+	divergences    metrics.Counter
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+// StartHeightWatchdog starts a watchdog checking every interval that the height of the recorded savepoint of the
+// named database is within threshold blocks of the expected height. The watchdog runs until the provider is closed
+// or the database is deleted. Only one watchdog can be started per database
+func (provider *VersionedDBProvider) StartHeightWatchdog(dbName string, expectedHeight ExpectedHeightFunc,
+	interval time.Duration, threshold uint64) error {
+
+	db, err := provider.GetDBHandle(dbName)
+	if err != nil {
+		return err
+	}
+	vdb := db.(*VersionedDB)
+	vdb.watchdogMux.Lock()
+	defer vdb.watchdogMux.Unlock()
+	if vdb.watchdog != nil {
+		return fmt.Errorf("Height watchdog already started for db %s", vdb.dbName)
+	}
+	vdb.watchdog = &heightWatchdog{vdb: vdb, expectedHeight: expectedHeight, interval: interval, threshold: threshold,
+		lag:         metrics.GetOrRegisterGauge(fmt.Sprintf("statedb.%s.height.lag", vdb.dbName), metrics.DefaultRegistry),
+		divergences: metrics.GetOrRegisterCounter(fmt.Sprintf("statedb.%s.height.divergences", vdb.dbName), metrics.DefaultRegistry),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{})}
+	go vdb.watchdog.run()
+	return nil
+}
+
+// stopWatchdog stops the height watchdog of the database, if any, and waits for it to exit
+func (vdb *VersionedDB) stopWatchdog() {
+	vdb.watchdogMux.Lock()
+	defer vdb.watchdogMux.Unlock()
+	if vdb.watchdog == nil {
+		return
+	}
+	close(vdb.watchdog.stop)
+	<-vdb.watchdog.done
+	vdb.watchdog = nil
+}
+
+func (watchdog *heightWatchdog) run() {
+	defer close(watchdog.done)
+	ticker := time.NewTicker(watchdog.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watchdog.stop:
+			return
+		case <-ticker.C:
+			watchdog.check()
+		}
+	}
+}
+
+// check compares the heights once. A failure to read either height is logged and skips the check
+func (watchdog *heightWatchdog) check() {
+	vdb := watchdog.vdb
+	expectedHeight, err := watchdog.expectedHeight()
+	if err != nil {
+		vdb.logger.Warningf("Height watchdog failed to get the expected height: %s", err.Error())
+		return
+	}
+	savepoint, err := vdb.GetLatestSavePoint()
+	if err != nil {
+		vdb.logger.Warningf("Height watchdog failed to read the savepoint: %s", err.Error())
+		return
+	}
+
+	// a savepoint at height (0,0) means that no savepoint is recorded, otherwise the block of the savepoint is committed
+	var stateHeight uint64
+	if !version.AreSame(savepoint, version.NewHeight(0, 0)) {
+		stateHeight = savepoint.BlockNum + 1
+	}
+	lag := int64(expectedHeight) - int64(stateHeight)
+	watchdog.lag.Update(lag)
+	if lag > int64(watchdog.threshold) || -lag > int64(watchdog.threshold) {
+		vdb.logger.Warningf("State database height %d diverged from the expected height %d", stateHeight, expectedHeight)
+		watchdog.divergences.Inc(1)
+	}
+}
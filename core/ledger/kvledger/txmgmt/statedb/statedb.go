@@ -16,12 +16,24 @@ limitations under the License.
 
 package statedb
 
-import "github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+import (
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+)
+
+// ErrReadOnly is returned by the methods of a read-only VersionedDB handle that would modify the state
+var ErrReadOnly = errors.New("VersionedDB handle is read-only")
 
 // VersionedDBProvider provides an instance of an versioned DB
 type VersionedDBProvider interface {
 	// GetDBHandle returns a handle to a VersionedDB
 	GetDBHandle(id string) (VersionedDB, error)
+	// GetReadOnlyDBHandle returns a handle to a VersionedDB that does not allow to modify the state
+	GetReadOnlyDBHandle(id string) (VersionedDB, error)
+	// DeleteDB deletes the VersionedDB with the given id along with all its data
+	DeleteDB(id string) error
 	// Close closes all the VersionedDB instances and releases any resources held by VersionedDBProvider
 	Close()
 }
@@ -30,7 +42,8 @@ type VersionedDBProvider interface {
 type VersionedDB interface {
 	// GetState gets the value for given namespace and key. For a chaincode, the namespace corresponds to the chaincodeId
 	GetState(namespace string, key string) (*VersionedValue, error)
-	// GetStateMultipleKeys gets the values for multiple keys in a single call
+	// GetStateMultipleKeys gets the values for multiple keys in a single call. The values are returned at the
+	// positions of their keys, and a key passed several times is read once, so that its positions hold the same value
 	GetStateMultipleKeys(namespace string, keys []string) ([]*VersionedValue, error)
 	// GetStateRangeScanIterator returns an iterator that contains all the key-values between given key ranges.
 	// startKey is inclusive
@@ -52,6 +65,23 @@ type VersionedDB interface {
 	Close()
 }
 
+// readOnlyVersionedDB is a VersionedDB handle whose ApplyUpdates returns ErrReadOnly
+type readOnlyVersionedDB struct {
+	VersionedDB
+}
+
+// NewReadOnlyVersionedDB returns a read-only handle to the given VersionedDB. The handle only exposes the
+// methods of the VersionedDB interface, so that the state cannot be modified through methods specific to
+// the implementation either
+func NewReadOnlyVersionedDB(db VersionedDB) VersionedDB {
+	return &readOnlyVersionedDB{db}
+}
+
+// ApplyUpdates implements method in VersionedDB interface
+func (db *readOnlyVersionedDB) ApplyUpdates(batch *UpdateBatch, height *version.Height) error {
+	return ErrReadOnly
+}
+
 // CompositeKey encloses Namespace and Key components
 type CompositeKey struct {
 	Namespace string
@@ -90,11 +120,24 @@ type QueryResult interface{}
 // UpdateBatch encloses the details of multiple `updates`
 type UpdateBatch struct {
 	KVs map[CompositeKey]*VersionedValue
+	// Attachments holds the named attachments stored along with the values, by name. The attachments are
+	// stored by the CouchDB state database only
+	Attachments map[CompositeKey]map[string][]byte
+	// VectorClocks holds the vector clocks stored along with the values. The values without a vector clock
+	// are versioned by their height only. The vector clocks are stored by the CouchDB state database only
+	VectorClocks map[CompositeKey]VectorClock
+	// Expiries holds the times the values written with a TTL expire at. The values without an expiry never
+	// expire. The expiries are stored by the CouchDB state database only
+	Expiries map[CompositeKey]time.Time
+	// Merges holds the keys whose value is a JSON merge patch, as defined by RFC 7396, to apply to the current
+	// value rather than a value replacing it. The merges are applied by the CouchDB state database only
+	Merges map[CompositeKey]bool
 }
 
 // NewUpdateBatch constructs an instance of a Batch
 func NewUpdateBatch() *UpdateBatch {
-	return &UpdateBatch{make(map[CompositeKey]*VersionedValue)}
+	return &UpdateBatch{make(map[CompositeKey]*VersionedValue), make(map[CompositeKey]map[string][]byte),
+		make(map[CompositeKey]VectorClock), make(map[CompositeKey]time.Time), make(map[CompositeKey]bool)}
 }
 
 // Put adds a VersionedKV
@@ -103,11 +146,54 @@ func (batch *UpdateBatch) Put(ns string, key string, value []byte, version *vers
 		panic("Nil value not allowed")
 	}
 	batch.KVs[CompositeKey{ns, key}] = &VersionedValue{value, version}
+	delete(batch.Attachments, CompositeKey{ns, key})
+	delete(batch.VectorClocks, CompositeKey{ns, key})
+	delete(batch.Expiries, CompositeKey{ns, key})
+	delete(batch.Merges, CompositeKey{ns, key})
+}
+
+// PutWithAttachments adds a VersionedKV along with named attachments, which replace the attachments
+// previously stored with the key
+func (batch *UpdateBatch) PutWithAttachments(ns string, key string, value []byte, version *version.Height,
+	attachments map[string][]byte) {
+	batch.Put(ns, key, value, version)
+	if len(attachments) > 0 {
+		batch.Attachments[CompositeKey{ns, key}] = attachments
+	}
+}
+
+// PutWithVectorClock adds a VersionedKV along with the vector clock of the value, in addition to its height
+func (batch *UpdateBatch) PutWithVectorClock(ns string, key string, value []byte, version *version.Height,
+	clock VectorClock) {
+	batch.Put(ns, key, value, version)
+	if len(clock) > 0 {
+		batch.VectorClocks[CompositeKey{ns, key}] = clock
+	}
+}
+
+// PutWithTTL adds a VersionedKV whose value expires once the TTL elapsed from now. The expiry is set by the
+// clock of the peer writing the value, so that the values written with a TTL are not meant for the state that
+// is to be consistent across the peers
+func (batch *UpdateBatch) PutWithTTL(ns string, key string, value []byte, version *version.Height, ttl time.Duration) {
+	batch.Put(ns, key, value, version)
+	batch.Expiries[CompositeKey{ns, key}] = time.Now().Add(ttl)
+}
+
+// PutMerge adds a JSON merge patch to apply to the current value of the key, so that only the fields of the
+// patch are updated, and the fields set to null in the patch are removed. The key is created from the patch if
+// it has no value
+func (batch *UpdateBatch) PutMerge(ns string, key string, patch []byte, version *version.Height) {
+	batch.Put(ns, key, patch, version)
+	batch.Merges[CompositeKey{ns, key}] = true
 }
 
 // Delete deletes a Key and associated value
 func (batch *UpdateBatch) Delete(ns string, key string, version *version.Height) {
 	batch.KVs[CompositeKey{ns, key}] = &VersionedValue{nil, version}
+	delete(batch.Attachments, CompositeKey{ns, key})
+	delete(batch.VectorClocks, CompositeKey{ns, key})
+	delete(batch.Expiries, CompositeKey{ns, key})
+	delete(batch.Merges, CompositeKey{ns, key})
 }
 
 // Exists checks whether the given key exists in the batch
@@ -66,6 +66,38 @@ func (provider *VersionedDBProvider) GetDBHandle(dbName string) (statedb.Version
 	return vdb, nil
 }
 
+// GetReadOnlyDBHandle gets a read-only handle to a named database
+func (provider *VersionedDBProvider) GetReadOnlyDBHandle(dbName string) (statedb.VersionedDB, error) {
+	db, err := provider.GetDBHandle(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return statedb.NewReadOnlyVersionedDB(db), nil
+}
+
+// DeleteDB deletes all the keys of the named database, including its savepoint, from the shared db
+func (provider *VersionedDBProvider) DeleteDB(dbName string) error {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+	startKey := append([]byte(dbName), compositeKeySep...)
+	endKey := append([]byte(dbName), lastKeyIndicator)
+	levelBatch := &leveldb.Batch{}
+	itr := provider.db.GetIterator(startKey, endKey)
+	for itr.Next() {
+		levelBatch.Delete(append([]byte{}, itr.Key()...))
+	}
+	itr.Release()
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	levelBatch.Delete(constructSavepointKey(dbName))
+	if err := provider.db.WriteBatch(levelBatch, true); err != nil {
+		return err
+	}
+	delete(provider.databases, dbName)
+	return nil
+}
+
 // Close closes the underlying db
 func (provider *VersionedDBProvider) Close() {
 	provider.db.Close()
@@ -108,13 +140,19 @@ func (vdb *VersionedDB) GetState(namespace string, key string) (*statedb.Version
 	return &statedb.VersionedValue{Value: val, Version: ver}, nil
 }
 
-// GetStateMultipleKeys implements method in VersionedDB interface
+// GetStateMultipleKeys implements method in VersionedDB interface. A key passed several times is read
+// once, and its positions share the value read
 func (vdb *VersionedDB) GetStateMultipleKeys(namespace string, keys []string) ([]*statedb.VersionedValue, error) {
 	vals := make([]*statedb.VersionedValue, len(keys))
+	read := make(map[string]*statedb.VersionedValue, len(keys))
 	for i, key := range keys {
-		val, err := vdb.GetState(namespace, key)
-		if err != nil {
-			return nil, err
+		val, ok := read[key]
+		if !ok {
+			var err error
+			if val, err = vdb.GetState(namespace, key); err != nil {
+				return nil, err
+			}
+			read[key] = val
 		}
 		vals[i] = val
 	}
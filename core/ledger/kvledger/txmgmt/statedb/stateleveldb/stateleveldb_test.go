@@ -43,6 +43,12 @@ func TestMultiDBBasicRW(t *testing.T) {
 	commontests.TestMultiDBBasicRW(t, env.DBProvider)
 }
 
+func TestReadOnlyHandle(t *testing.T) {
+	env := NewTestVDBEnv(t)
+	defer env.Cleanup()
+	commontests.TestReadOnlyHandle(t, env.DBProvider)
+}
+
 func TestDeletes(t *testing.T) {
 	env := NewTestVDBEnv(t)
 	defer env.Cleanup()
@@ -55,6 +61,12 @@ func TestIterator(t *testing.T) {
 	commontests.TestIterator(t, env.DBProvider)
 }
 
+func TestGetStateMultipleKeysDuplicates(t *testing.T) {
+	env := NewTestVDBEnv(t)
+	defer env.Cleanup()
+	commontests.TestGetStateMultipleKeysDuplicates(t, env.DBProvider)
+}
+
 func TestEncodeDecodeValueAndVersion(t *testing.T) {
 	testValueAndVersionEncodeing(t, []byte("value1"), version.NewHeight(1, 2))
 	testValueAndVersionEncodeing(t, []byte{}, version.NewHeight(50, 50))
@@ -0,0 +1,49 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statedb
+
+// VectorClock holds a counter per writer of a value, which a writer increments on each update it makes. Stored
+// along with the version of the value, it allows to detect the updates made concurrently by several writers
+type VectorClock map[string]uint64
+
+// Descends returns true if the clock records all the updates recorded by other, i.e. if none of the counters
+// of other is greater than the counter of the same writer in the clock
+func (clock VectorClock) Descends(other VectorClock) bool {
+	for writer, counter := range other {
+		if clock[writer] < counter {
+			return false
+		}
+	}
+	return true
+}
+
+// ConcurrentWith returns true if neither of the clocks descends from the other, i.e. if each of them records
+// an update that the other does not
+func (clock VectorClock) ConcurrentWith(other VectorClock) bool {
+	return !clock.Descends(other) && !other.Descends(clock)
+}
+
+// Increment returns a copy of the clock with the counter of the writer incremented, for an update of the writer
+// made after the updates recorded by the clock
+func (clock VectorClock) Increment(writer string) VectorClock {
+	incremented := make(VectorClock, len(clock)+1)
+	for w, counter := range clock {
+		incremented[w] = counter
+	}
+	incremented[writer]++
+	return incremented
+}
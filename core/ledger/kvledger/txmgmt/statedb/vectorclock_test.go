@@ -0,0 +1,44 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statedb
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/ledger/testutil"
+)
+
+func TestVectorClock(t *testing.T) {
+	var initial VectorClock
+	clock1 := initial.Increment("peer1")
+	testutil.AssertEquals(t, clock1, VectorClock{"peer1": 1})
+	testutil.AssertNil(t, initial)
+
+	// an update made after another descends from it
+	clock2 := clock1.Increment("peer2")
+	testutil.AssertEquals(t, clock2, VectorClock{"peer1": 1, "peer2": 1})
+	testutil.AssertEquals(t, clock2.Descends(clock1), true)
+	testutil.AssertEquals(t, clock1.Descends(clock2), false)
+	testutil.AssertEquals(t, clock2.ConcurrentWith(clock1), false)
+	testutil.AssertEquals(t, clock1.Descends(clock1), true)
+
+	// the updates made by two writers from the same state are concurrent
+	clock3 := clock1.Increment("peer3")
+	testutil.AssertEquals(t, clock2.ConcurrentWith(clock3), true)
+	testutil.AssertEquals(t, clock3.ConcurrentWith(clock2), true)
+	testutil.AssertEquals(t, clock2.Descends(initial), true)
+}
@@ -53,6 +53,8 @@ type PeerLedgerProvider interface {
 	Exists(ledgerID string) (bool, error)
 	// List lists the ids of the existing ledgers
 	List() ([]string, error)
+	// Delete deletes the ledger with given id along with all its persistent data. The ledger is expected to be closed
+	Delete(ledgerID string) error
 	// Close closes the PeerLedgerProvider
 	Close()
 }
@@ -18,6 +18,7 @@ package ledgerconfig
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -30,9 +31,11 @@ var historyDatabase = true
 
 // CouchDBDef contains parameters
 type CouchDBDef struct {
-	URL      string
-	Username string
-	Password string
+	URL             string
+	Username        string
+	Password        string
+	MaxIdleConns    int
+	MaxConnsPerHost int
 }
 
 //IsCouchDBEnabled exposes the useCouchDB variable
@@ -77,6 +80,34 @@ func GetMaxBlockfileSize() int {
 	return 0
 }
 
+// GetMaxOpenLedgers returns the maximum number of ledgers opened at a time by ledger management, 0 if unlimited
+func GetMaxOpenLedgers() int {
+	maxOpenLedgers := viper.GetInt("ledger.maxOpenLedgers")
+	if maxOpenLedgers < 0 {
+		return 0
+	}
+	return maxOpenLedgers
+}
+
+// GetIdleLedgerSoftLimit returns the number of open ledgers down to which ledger management closes the ledgers
+// idle for the idle ledger timeout, the least recently accessed first, 0 if the idle ledgers are not closed
+func GetIdleLedgerSoftLimit() int {
+	softLimit := viper.GetInt("ledger.idleLedgerSoftLimit")
+	if softLimit < 0 {
+		return 0
+	}
+	return softLimit
+}
+
+// GetIdleLedgerTimeout returns the time since its last access after which an open ledger is idle
+func GetIdleLedgerTimeout() time.Duration {
+	timeout := viper.GetDuration("ledger.idleLedgerTimeout")
+	if timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
 //GetCouchDBDefinition exposes the useCouchDB variable
 func GetCouchDBDefinition() *CouchDBDef {
 
@@ -84,7 +115,200 @@ func GetCouchDBDefinition() *CouchDBDef {
 	username = viper.GetString("ledger.state.couchDBConfig.username")
 	password = viper.GetString("ledger.state.couchDBConfig.password")
 
-	return &CouchDBDef{couchDBAddress, username, password}
+	maxIdleConns := viper.GetInt("ledger.state.couchDBConfig.maxIdleConns")
+	maxConnsPerHost := viper.GetInt("ledger.state.couchDBConfig.maxConnsPerHost")
+
+	return &CouchDBDef{couchDBAddress, username, password, maxIdleConns, maxConnsPerHost}
+}
+
+//GetCouchDBQueryLimit returns the maximum number of results of a query or a range scan on CouchDB, 1000 if not
+//configured.  A limit of 0 or less means unlimited
+func GetCouchDBQueryLimit() int {
+	if !viper.IsSet("ledger.state.couchDBConfig.queryLimit") {
+		return 1000
+	}
+	return viper.GetInt("ledger.state.couchDBConfig.queryLimit")
+}
+
+//GetCouchDBSavepointBlockInterval returns the number of blocks committed between savepoint writes
+func GetCouchDBSavepointBlockInterval() int {
+	interval := viper.GetInt("ledger.state.couchDBConfig.savepointBlockInterval")
+	if interval < 1 {
+		return 1
+	}
+	return interval
+}
+
+//GetCouchDBSavepointTimeInterval returns the maximum time between savepoint writes, 0 if not limited
+func GetCouchDBSavepointTimeInterval() time.Duration {
+	return viper.GetDuration("ledger.state.couchDBConfig.savepointTimeInterval")
+}
+
+//GetCouchDBSlowQueryThreshold returns the duration at or above which the CouchDB operations of the state
+//databases are logged as slow, 0 if the slow-query log is disabled
+func GetCouchDBSlowQueryThreshold() time.Duration {
+	threshold := viper.GetDuration("ledger.state.couchDBConfig.slowQueryThreshold")
+	if threshold < 0 {
+		return 0
+	}
+	return threshold
+}
+
+//GetCouchDBCompressionThreshold returns the size in bytes at or above which JSON values are
+//compressed before being stored in CouchDB, 0 if compression is disabled
+func GetCouchDBCompressionThreshold() int {
+	compressionThreshold := viper.GetInt("ledger.state.couchDBConfig.compressionThreshold")
+	if compressionThreshold < 0 {
+		return 0
+	}
+	return compressionThreshold
+}
+
+//IsCouchDBChecksumEnabled returns true if a checksum of each value is stored in CouchDB and verified on read
+func IsCouchDBChecksumEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.checksums")
+}
+
+//IsCouchDBNamespaceFieldEnabled returns true if the namespace of each JSON value is stored in an indexed field
+//of its CouchDB document
+func IsCouchDBNamespaceFieldEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.namespaceField")
+}
+
+//GetCouchDBInvalidUTF8KeyPolicy returns how keys that are not valid UTF-8 are handled by CouchDB, which is
+//"hex" or "base64" to escape the keys in that encoding, or "reject" to fail the updates writing such keys
+func GetCouchDBInvalidUTF8KeyPolicy() string {
+	policy := viper.GetString("ledger.state.couchDBConfig.invalidUTF8Keys")
+	if policy != "hex" && policy != "base64" {
+		return "reject"
+	}
+	return policy
+}
+
+//IsCouchDBOrderedKeysEnabled returns true if the keys are stored in CouchDB in an order-preserving encoding, so that
+//range scans return all the keys in byte order
+func IsCouchDBOrderedKeysEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.orderedKeys")
+}
+
+//MinCouchDBMaxKeyIDLength is the least length beyond which the keys are stored in CouchDB under a hashed document id
+const MinCouchDBMaxKeyIDLength = 128
+
+//GetCouchDBMaxKeyIDLength returns the length in bytes beyond which the keys are stored in CouchDB under a hashed
+//document id, so that the length of the ids is bounded, or 0 if all the keys are stored under their own id.
+//A length below MinCouchDBMaxKeyIDLength is raised to it
+func GetCouchDBMaxKeyIDLength() int {
+	maxLength := viper.GetInt("ledger.state.couchDBConfig.maxKeyIDLength")
+	if maxLength <= 0 {
+		return 0
+	}
+	if maxLength < MinCouchDBMaxKeyIDLength {
+		return MinCouchDBMaxKeyIDLength
+	}
+	return maxLength
+}
+
+//IsCouchDBRecreateMissingDatabasesEnabled returns true if a CouchDB state database found missing by a read or an
+//update is recreated before the operation is retried
+func IsCouchDBRecreateMissingDatabasesEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.recreateMissingDatabases")
+}
+
+//IsCouchDBReplicated returns true if the CouchDB state databases are replicated to other CouchDB servers, in which
+//case the deleted documents must not be purged
+func IsCouchDBReplicated() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.replicated")
+}
+
+//GetCouchDBReservedNamespacePolicy returns how namespaces starting with an underscore are handled by CouchDB,
+//which is "escape" to store their keys under escaped document ids, or "reject" to fail their reads and updates
+func GetCouchDBReservedNamespacePolicy() string {
+	if viper.GetString("ledger.state.couchDBConfig.reservedNamespaces") == "escape" {
+		return "escape"
+	}
+	return "reject"
+}
+
+//GetCouchDBNonJSONWritePolicy returns how the values that are not JSON are handled by CouchDB, which is "store"
+//to store them as attachments, "warn" to also log and count their writes, or "skip" to log and count their writes
+//without storing them
+func GetCouchDBNonJSONWritePolicy() string {
+	policy := viper.GetString("ledger.state.couchDBConfig.nonJSONWrites")
+	if policy != "warn" && policy != "skip" {
+		return "store"
+	}
+	return policy
+}
+
+//IsCouchDBRejectCommitsWhilePausedEnabled returns true if the commits to a paused CouchDB state database fail,
+//rather than wait until the database is resumed
+func IsCouchDBRejectCommitsWhilePausedEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.rejectCommitsWhilePaused")
+}
+
+//GetCouchDBWriteConcurrency returns the number of documents of a batch written to CouchDB concurrently, at least 1
+func GetCouchDBWriteConcurrency() int {
+	writeConcurrency := viper.GetInt("ledger.state.couchDBConfig.writeConcurrency")
+	if writeConcurrency < 1 {
+		return 1
+	}
+	return writeConcurrency
+}
+
+//GetCouchDBAsyncCommitQueueSize returns the number of batches that can be queued for asynchronous
+//commit to CouchDB, 0 if updates are applied synchronously
+func GetCouchDBAsyncCommitQueueSize() int {
+	asyncCommitQueueSize := viper.GetInt("ledger.state.couchDBConfig.asyncCommitQueueSize")
+	if asyncCommitQueueSize < 0 {
+		return 0
+	}
+	return asyncCommitQueueSize
+}
+
+//GetCouchDBShards returns the number of shards (q) of state databases created in a CouchDB cluster,
+//0 for the cluster default
+func GetCouchDBShards() int {
+	return viper.GetInt("ledger.state.couchDBConfig.shards")
+}
+
+//GetCouchDBReplicas returns the number of replicas (n) of state databases created in a CouchDB cluster,
+//0 for the cluster default
+func GetCouchDBReplicas() int {
+	return viper.GetInt("ledger.state.couchDBConfig.replicas")
+}
+
+//IsCouchDBQuorumSavepointReadsEnabled returns true if the savepoints of the state databases are read from a
+//quorum of the replicas of a CouchDB cluster
+func IsCouchDBQuorumSavepointReadsEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.quorumSavepointReads")
+}
+
+//IsCouchDBBulkReadsEnabled returns true if the keys read together from the state databases are read in a single
+//bulk read
+func IsCouchDBBulkReadsEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.bulkReads")
+}
+
+//IsCouchDBQueryRangeFallbackEnabled returns true if the queries whose selector reduces to a range of document ids
+//are run as a range scan filtered in process rather than as a Mango query
+func IsCouchDBQueryRangeFallbackEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.queryRangeFallback")
+}
+
+//IsCouchDBSavepointMirrorEnabled returns true if the savepoints of the state databases are mirrored to a local
+//LevelDB
+func IsCouchDBSavepointMirrorEnabled() bool {
+	return viper.GetBool("ledger.state.couchDBConfig.savepointMirror")
+}
+
+//GetCouchDBAttachmentCacheSize returns the maximum total size in bytes of the binary values cached by each state
+//database, 0 if the cache is disabled
+func GetCouchDBAttachmentCacheSize() int {
+	attachmentCacheSize := viper.GetInt("ledger.state.couchDBConfig.attachmentCacheSize")
+	if attachmentCacheSize < 0 {
+		return 0
+	}
+	return attachmentCacheSize
 }
 
 //IsHistoryDBEnabled exposes the historyDatabase variable
@@ -18,6 +18,7 @@ package ledgerconfig
 
 import (
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric/core/ledger/testutil"
 	"github.com/spf13/viper"
@@ -53,6 +54,278 @@ func TestGetCouchDBDefinition(t *testing.T) {
 	testutil.AssertEquals(t, couchDBDef.URL, "127.0.0.1:5984")
 	testutil.AssertEquals(t, couchDBDef.Username, "")
 	testutil.AssertEquals(t, couchDBDef.Password, "")
+	testutil.AssertEquals(t, couchDBDef.MaxIdleConns, 100)
+	testutil.AssertEquals(t, couchDBDef.MaxConnsPerHost, 0)
+}
+
+func TestGetCouchDBSavepointIntervals(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBSavepointBlockInterval(), 1)
+	testutil.AssertEquals(t, GetCouchDBSavepointTimeInterval(), time.Duration(0))
+
+	defer viper.Set("ledger.state.couchDBConfig.savepointBlockInterval", 1)
+	defer viper.Set("ledger.state.couchDBConfig.savepointTimeInterval", "0s")
+	viper.Set("ledger.state.couchDBConfig.savepointBlockInterval", 10)
+	viper.Set("ledger.state.couchDBConfig.savepointTimeInterval", "30s")
+	testutil.AssertEquals(t, GetCouchDBSavepointBlockInterval(), 10)
+	testutil.AssertEquals(t, GetCouchDBSavepointTimeInterval(), 30*time.Second)
+
+	viper.Set("ledger.state.couchDBConfig.savepointBlockInterval", 0)
+	testutil.AssertEquals(t, GetCouchDBSavepointBlockInterval(), 1)
+}
+
+func TestGetCouchDBSlowQueryThreshold(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBSlowQueryThreshold(), time.Duration(0))
+
+	defer viper.Set("ledger.state.couchDBConfig.slowQueryThreshold", "0s")
+	viper.Set("ledger.state.couchDBConfig.slowQueryThreshold", "500ms")
+	testutil.AssertEquals(t, GetCouchDBSlowQueryThreshold(), 500*time.Millisecond)
+
+	viper.Set("ledger.state.couchDBConfig.slowQueryThreshold", "-1s")
+	testutil.AssertEquals(t, GetCouchDBSlowQueryThreshold(), time.Duration(0))
+}
+
+func TestGetCouchDBCompressionThreshold(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBCompressionThreshold(), 0)
+
+	defer viper.Set("ledger.state.couchDBConfig.compressionThreshold", 0)
+	viper.Set("ledger.state.couchDBConfig.compressionThreshold", 4096)
+	testutil.AssertEquals(t, GetCouchDBCompressionThreshold(), 4096)
+
+	viper.Set("ledger.state.couchDBConfig.compressionThreshold", -1)
+	testutil.AssertEquals(t, GetCouchDBCompressionThreshold(), 0)
+}
+
+func TestIsCouchDBChecksumEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBChecksumEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.checksums", false)
+	viper.Set("ledger.state.couchDBConfig.checksums", true)
+	testutil.AssertEquals(t, IsCouchDBChecksumEnabled(), true)
+}
+
+func TestIsCouchDBNamespaceFieldEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBNamespaceFieldEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.namespaceField", false)
+	viper.Set("ledger.state.couchDBConfig.namespaceField", true)
+	testutil.AssertEquals(t, IsCouchDBNamespaceFieldEnabled(), true)
+}
+
+func TestGetCouchDBInvalidUTF8KeyPolicy(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBInvalidUTF8KeyPolicy(), "reject")
+
+	defer viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "reject")
+	viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "base64")
+	testutil.AssertEquals(t, GetCouchDBInvalidUTF8KeyPolicy(), "base64")
+	viper.Set("ledger.state.couchDBConfig.invalidUTF8Keys", "unknown")
+	testutil.AssertEquals(t, GetCouchDBInvalidUTF8KeyPolicy(), "reject")
+}
+
+func TestGetCouchDBQueryLimit(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBQueryLimit(), 1000)
+
+	defer viper.Set("ledger.state.couchDBConfig.queryLimit", 1000)
+	viper.Set("ledger.state.couchDBConfig.queryLimit", 0)
+	testutil.AssertEquals(t, GetCouchDBQueryLimit(), 0)
+	viper.Set("ledger.state.couchDBConfig.queryLimit", 50)
+	testutil.AssertEquals(t, GetCouchDBQueryLimit(), 50)
+}
+
+func TestIsCouchDBOrderedKeysEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBOrderedKeysEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.orderedKeys", false)
+	viper.Set("ledger.state.couchDBConfig.orderedKeys", true)
+	testutil.AssertEquals(t, IsCouchDBOrderedKeysEnabled(), true)
+}
+
+func TestGetCouchDBMaxKeyIDLength(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBMaxKeyIDLength(), 0)
+
+	defer viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 0)
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 512)
+	testutil.AssertEquals(t, GetCouchDBMaxKeyIDLength(), 512)
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", 16)
+	testutil.AssertEquals(t, GetCouchDBMaxKeyIDLength(), MinCouchDBMaxKeyIDLength)
+	viper.Set("ledger.state.couchDBConfig.maxKeyIDLength", -1)
+	testutil.AssertEquals(t, GetCouchDBMaxKeyIDLength(), 0)
+}
+
+func TestIsCouchDBRecreateMissingDatabasesEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBRecreateMissingDatabasesEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.recreateMissingDatabases", false)
+	viper.Set("ledger.state.couchDBConfig.recreateMissingDatabases", true)
+	testutil.AssertEquals(t, IsCouchDBRecreateMissingDatabasesEnabled(), true)
+}
+
+func TestIsCouchDBReplicated(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBReplicated(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.replicated", false)
+	viper.Set("ledger.state.couchDBConfig.replicated", true)
+	testutil.AssertEquals(t, IsCouchDBReplicated(), true)
+}
+
+func TestIsCouchDBQuorumSavepointReadsEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBQuorumSavepointReadsEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.quorumSavepointReads", false)
+	viper.Set("ledger.state.couchDBConfig.quorumSavepointReads", true)
+	testutil.AssertEquals(t, IsCouchDBQuorumSavepointReadsEnabled(), true)
+}
+
+func TestIsCouchDBBulkReadsEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBBulkReadsEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.bulkReads", false)
+	viper.Set("ledger.state.couchDBConfig.bulkReads", true)
+	testutil.AssertEquals(t, IsCouchDBBulkReadsEnabled(), true)
+}
+
+func TestIsCouchDBQueryRangeFallbackEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBQueryRangeFallbackEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.queryRangeFallback", false)
+	viper.Set("ledger.state.couchDBConfig.queryRangeFallback", true)
+	testutil.AssertEquals(t, IsCouchDBQueryRangeFallbackEnabled(), true)
+}
+
+func TestIsCouchDBSavepointMirrorEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBSavepointMirrorEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.savepointMirror", false)
+	viper.Set("ledger.state.couchDBConfig.savepointMirror", true)
+	testutil.AssertEquals(t, IsCouchDBSavepointMirrorEnabled(), true)
+}
+
+func TestGetCouchDBAttachmentCacheSize(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBAttachmentCacheSize(), 0)
+
+	defer viper.Set("ledger.state.couchDBConfig.attachmentCacheSize", 0)
+	viper.Set("ledger.state.couchDBConfig.attachmentCacheSize", 1048576)
+	testutil.AssertEquals(t, GetCouchDBAttachmentCacheSize(), 1048576)
+
+	viper.Set("ledger.state.couchDBConfig.attachmentCacheSize", -1)
+	testutil.AssertEquals(t, GetCouchDBAttachmentCacheSize(), 0)
+}
+
+func TestGetMaxOpenLedgers(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetMaxOpenLedgers(), 0)
+
+	defer viper.Set("ledger.maxOpenLedgers", 0)
+	viper.Set("ledger.maxOpenLedgers", 100)
+	testutil.AssertEquals(t, GetMaxOpenLedgers(), 100)
+
+	viper.Set("ledger.maxOpenLedgers", -1)
+	testutil.AssertEquals(t, GetMaxOpenLedgers(), 0)
+}
+
+func TestGetIdleLedgerSoftLimit(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetIdleLedgerSoftLimit(), 0)
+
+	defer viper.Set("ledger.idleLedgerSoftLimit", 0)
+	viper.Set("ledger.idleLedgerSoftLimit", 10)
+	testutil.AssertEquals(t, GetIdleLedgerSoftLimit(), 10)
+
+	viper.Set("ledger.idleLedgerSoftLimit", -1)
+	testutil.AssertEquals(t, GetIdleLedgerSoftLimit(), 0)
+}
+
+func TestGetIdleLedgerTimeout(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetIdleLedgerTimeout(), 10*time.Minute)
+
+	defer viper.Set("ledger.idleLedgerTimeout", "10m")
+	viper.Set("ledger.idleLedgerTimeout", "30s")
+	testutil.AssertEquals(t, GetIdleLedgerTimeout(), 30*time.Second)
+
+	viper.Set("ledger.idleLedgerTimeout", "-1s")
+	testutil.AssertEquals(t, GetIdleLedgerTimeout(), time.Duration(0))
+}
+
+func TestGetCouchDBReservedNamespacePolicy(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBReservedNamespacePolicy(), "reject")
+
+	defer viper.Set("ledger.state.couchDBConfig.reservedNamespaces", "reject")
+	viper.Set("ledger.state.couchDBConfig.reservedNamespaces", "escape")
+	testutil.AssertEquals(t, GetCouchDBReservedNamespacePolicy(), "escape")
+	viper.Set("ledger.state.couchDBConfig.reservedNamespaces", "unknown")
+	testutil.AssertEquals(t, GetCouchDBReservedNamespacePolicy(), "reject")
+}
+
+func TestGetCouchDBNonJSONWritePolicy(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBNonJSONWritePolicy(), "store")
+
+	defer viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "store")
+	viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "warn")
+	testutil.AssertEquals(t, GetCouchDBNonJSONWritePolicy(), "warn")
+	viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "skip")
+	testutil.AssertEquals(t, GetCouchDBNonJSONWritePolicy(), "skip")
+	viper.Set("ledger.state.couchDBConfig.nonJSONWrites", "unknown")
+	testutil.AssertEquals(t, GetCouchDBNonJSONWritePolicy(), "store")
+}
+
+func TestIsCouchDBRejectCommitsWhilePausedEnabled(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, IsCouchDBRejectCommitsWhilePausedEnabled(), false)
+
+	defer viper.Set("ledger.state.couchDBConfig.rejectCommitsWhilePaused", false)
+	viper.Set("ledger.state.couchDBConfig.rejectCommitsWhilePaused", true)
+	testutil.AssertEquals(t, IsCouchDBRejectCommitsWhilePausedEnabled(), true)
+}
+
+func TestGetCouchDBWriteConcurrency(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBWriteConcurrency(), 1)
+
+	defer viper.Set("ledger.state.couchDBConfig.writeConcurrency", 1)
+	viper.Set("ledger.state.couchDBConfig.writeConcurrency", 8)
+	testutil.AssertEquals(t, GetCouchDBWriteConcurrency(), 8)
+	viper.Set("ledger.state.couchDBConfig.writeConcurrency", 0)
+	testutil.AssertEquals(t, GetCouchDBWriteConcurrency(), 1)
+}
+
+func TestGetCouchDBAsyncCommitQueueSize(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBAsyncCommitQueueSize(), 0)
+
+	defer viper.Set("ledger.state.couchDBConfig.asyncCommitQueueSize", 0)
+	viper.Set("ledger.state.couchDBConfig.asyncCommitQueueSize", 10)
+	testutil.AssertEquals(t, GetCouchDBAsyncCommitQueueSize(), 10)
+}
+
+func TestGetCouchDBShardsAndReplicas(t *testing.T) {
+	setUpCoreYAMLConfig()
+	testutil.AssertEquals(t, GetCouchDBShards(), 0)
+	testutil.AssertEquals(t, GetCouchDBReplicas(), 0)
+
+	defer viper.Set("ledger.state.couchDBConfig.shards", 0)
+	defer viper.Set("ledger.state.couchDBConfig.replicas", 0)
+	viper.Set("ledger.state.couchDBConfig.shards", 16)
+	viper.Set("ledger.state.couchDBConfig.replicas", 3)
+	testutil.AssertEquals(t, GetCouchDBShards(), 16)
+	testutil.AssertEquals(t, GetCouchDBReplicas(), 3)
 }
 
 func TestIsHistoryDBEnabledDefault(t *testing.T) {
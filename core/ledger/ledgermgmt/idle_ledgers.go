@@ -0,0 +1,328 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ledgermgmt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/protos/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// minIdleLedgerSweepInterval is the minimum interval between two sweeps of the idle ledgers
+const minIdleLedgerSweepInterval = 50 * time.Millisecond
+
+// idleLedgerSweepInterval returns the interval between two sweeps of the idle ledgers, so that a ledger is closed
+// at most half the idle ledger timeout after it became idle
+func idleLedgerSweepInterval() time.Duration {
+	interval := idleLedgerTimeout / 2
+	if interval < minIdleLedgerSweepInterval {
+		return minIdleLedgerSweepInterval
+	}
+	return interval
+}
+
+// sweepIdleLedgers closes the idle ledgers at every interval until stop is closed
+func sweepIdleLedgers(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			lock.Lock()
+			if initialized {
+				evictIdleLedgers()
+			}
+			lock.Unlock()
+		}
+	}
+}
+
+// residentLedgers returns the number of ledgers opened read-write and not closed as idle.
+// The caller is expected to hold the lock
+func residentLedgers() int {
+	resident := 0
+	for _, l := range openedLedgers {
+		if !l.(*ClosableLedger).evicted {
+			resident++
+		}
+	}
+	return resident
+}
+
+// evictIdleLedgers closes the actual ledgers of the ledgers opened read-write that are idle, i.e. with no operation
+// in progress and not accessed for the idle ledger timeout, the least recently accessed first, until at most the
+// idle ledger soft limit of them are open. A ledger closed as idle stays opened for ledger management, and is
+// reopened transparently on its next access. The ledgers opened read-only are never closed as idle.
+// The caller is expected to hold the lock
+func evictIdleLedgers() {
+	if idleLedgerSoftLimit <= 0 {
+		return
+	}
+	resident := residentLedgers()
+	if resident <= idleLedgerSoftLimit {
+		return
+	}
+	now := time.Now()
+	var idle byLastAccess
+	for _, l := range openedLedgers {
+		l := l.(*ClosableLedger)
+		if !l.evicted && l.inFlight == 0 && now.Sub(l.lastAccess) >= idleLedgerTimeout {
+			idle = append(idle, l)
+		}
+	}
+	sort.Sort(idle)
+	for _, l := range idle {
+		if resident <= idleLedgerSoftLimit {
+			break
+		}
+		logger.Infof("Closing leadger with id = %s, idle since %s", l.id, l.lastAccess)
+		l.PeerLedger.Close()
+		l.evicted = true
+		resident--
+	}
+}
+
+// byLastAccess sorts the ledgers by their last access, the least recent first
+type byLastAccess []*ClosableLedger
+
+func (ledgers byLastAccess) Len() int      { return len(ledgers) }
+func (ledgers byLastAccess) Swap(i, j int) { ledgers[i], ledgers[j] = ledgers[j], ledgers[i] }
+func (ledgers byLastAccess) Less(i, j int) bool {
+	return ledgers[i].lastAccess.Before(ledgers[j].lastAccess)
+}
+
+// acquire returns the actual ledger, reopened if it was closed as idle, and records an operation in progress on
+// it until release is called
+func (l *ClosableLedger) acquire() (ledger.PeerLedger, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	// a ledger closed by its Close method is not reopened
+	if l.evicted && openedLedgers[l.id] == l {
+		if err := checkOpenLedgerLimit(); err != nil {
+			return nil, err
+		}
+		actual, err := ledgerProvider.Open(l.id)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Reopened leadger with id = %s", l.id)
+		l.PeerLedger = actual
+		l.evicted = false
+	}
+	l.inFlight++
+	l.lastAccess = time.Now()
+	return l.PeerLedger, nil
+}
+
+// release records the end of an operation recorded by acquire
+func (l *ClosableLedger) release() {
+	lock.Lock()
+	defer lock.Unlock()
+	l.inFlight--
+	l.lastAccess = time.Now()
+}
+
+// GetBlockchainInfo returns basic info about blockchain
+func (l *ClosableLedger) GetBlockchainInfo() (*pb.BlockchainInfo, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return actual.GetBlockchainInfo()
+}
+
+// GetBlockByNumber returns block at a given height
+func (l *ClosableLedger) GetBlockByNumber(blockNumber uint64) (*common.Block, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return actual.GetBlockByNumber(blockNumber)
+}
+
+// GetBlocksIterator returns an iterator that starts from startBlockNumber. The ledger is not closed as idle until
+// the iterator is closed
+func (l *ClosableLedger) GetBlocksIterator(startBlockNumber uint64) (ledger.ResultsIterator, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	itr, err := actual.GetBlocksIterator(startBlockNumber)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &trackedResultsIterator{ResultsIterator: itr, ledger: l}, nil
+}
+
+// GetTransactionByID retrieves a transaction by id
+func (l *ClosableLedger) GetTransactionByID(txID string) (*pb.Transaction, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return actual.GetTransactionByID(txID)
+}
+
+// GetBlockByHash returns a block given it's hash
+func (l *ClosableLedger) GetBlockByHash(blockHash []byte) (*common.Block, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return actual.GetBlockByHash(blockHash)
+}
+
+// NewTxSimulator gives handle to a transaction simulator. The ledger is not closed as idle until the simulator is done
+func (l *ClosableLedger) NewTxSimulator() (ledger.TxSimulator, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	simulator, err := actual.NewTxSimulator()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &trackedTxSimulator{TxSimulator: simulator, ledger: l}, nil
+}
+
+// NewQueryExecutor gives handle to a query executor. The ledger is not closed as idle until the executor is done
+func (l *ClosableLedger) NewQueryExecutor() (ledger.QueryExecutor, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	executor, err := actual.NewQueryExecutor()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &trackedQueryExecutor{QueryExecutor: executor, ledger: l}, nil
+}
+
+// NewHistoryQueryExecutor gives handle to a history query executor. As a history query executor has no Done method,
+// the executor alone does not keep the ledger from being closed as idle: each query runs on the ledger as open
+// when the query starts, reopened if it was closed as idle, and the ledger is not closed as idle until the
+// iterator of the query is closed
+func (l *ClosableLedger) NewHistoryQueryExecutor() (ledger.HistoryQueryExecutor, error) {
+	actual, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	if _, err := actual.NewHistoryQueryExecutor(); err != nil {
+		return nil, err
+	}
+	return &trackedHistoryQueryExecutor{ledger: l}, nil
+}
+
+// Commit commits block into the ledger
+func (l *ClosableLedger) Commit(block *common.Block) error {
+	actual, err := l.acquire()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	return actual.Commit(block)
+}
+
+// Prune prunes the blocks/transactions that satisfy the given policy
+func (l *ClosableLedger) Prune(policy ledger.PrunePolicy) error {
+	actual, err := l.acquire()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	return actual.Prune(policy)
+}
+
+// trackedQueryExecutor is a query executor whose ledger is not closed as idle until it is done
+type trackedQueryExecutor struct {
+	ledger.QueryExecutor
+	ledger *ClosableLedger
+	once   sync.Once
+}
+
+// Done releases resources occupied by the QueryExecutor and ends the operation on the ledger
+func (e *trackedQueryExecutor) Done() {
+	e.QueryExecutor.Done()
+	e.once.Do(e.ledger.release)
+}
+
+// trackedHistoryQueryExecutor is a history query executor whose queries run on the ledger as open when they start,
+// and whose ledger is not closed as idle until the iterators of the queries are closed
+type trackedHistoryQueryExecutor struct {
+	ledger *ClosableLedger
+}
+
+// GetTransactionsForKey retrieves the set of transactons that updated this key by doing a key range query
+func (e *trackedHistoryQueryExecutor) GetTransactionsForKey(namespace string, key string, includeValues bool,
+	includeTransactions bool) (ledger.ResultsIterator, error) {
+	actual, err := e.ledger.acquire()
+	if err != nil {
+		return nil, err
+	}
+	// the executor of the actual ledger is obtained for each query, as the ledger may be reopened in between
+	executor, err := actual.NewHistoryQueryExecutor()
+	if err != nil {
+		e.ledger.release()
+		return nil, err
+	}
+	itr, err := executor.GetTransactionsForKey(namespace, key, includeValues, includeTransactions)
+	if err != nil {
+		e.ledger.release()
+		return nil, err
+	}
+	return &trackedResultsIterator{ResultsIterator: itr, ledger: e.ledger}, nil
+}
+
+// trackedTxSimulator is a transaction simulator whose ledger is not closed as idle until it is done
+type trackedTxSimulator struct {
+	ledger.TxSimulator
+	ledger *ClosableLedger
+	once   sync.Once
+}
+
+// Done releases resources occupied by the TxSimulator and ends the operation on the ledger
+func (s *trackedTxSimulator) Done() {
+	s.TxSimulator.Done()
+	s.once.Do(s.ledger.release)
+}
+
+// trackedResultsIterator is an iterator whose ledger is not closed as idle until it is closed
+type trackedResultsIterator struct {
+	ledger.ResultsIterator
+	ledger *ClosableLedger
+	once   sync.Once
+}
+
+// Close releases resources occupied by the iterator and ends the operation on the ledger
+func (itr *trackedResultsIterator) Close() {
+	itr.ResultsIterator.Close()
+	itr.once.Do(itr.ledger.release)
+}
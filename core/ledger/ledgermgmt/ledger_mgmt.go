@@ -19,11 +19,14 @@ package ledgermgmt
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"fmt"
 
 	"github.com/hyperledger/fabric/core/ledger"
 	"github.com/hyperledger/fabric/core/ledger/kvledger"
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/protos/common"
 	logging "github.com/op/go-logging"
 )
 
@@ -32,10 +35,34 @@ var logger = logging.MustGetLogger("ledgermgmt")
 // ErrLedgerAlreadyOpened is thrown by a CreateLedger call if a ledger with the given id is already opened
 var ErrLedgerAlreadyOpened = errors.New("Ledger already opened")
 
+// ErrLedgerInUse is thrown by a DeleteLedger call if the ledger with the given id is opened
+var ErrLedgerInUse = errors.New("Ledger is opened")
+
 // ErrLedgerMgmtNotInitialized is thrown when ledger mgmt is used before initializing this
 var ErrLedgerMgmtNotInitialized = errors.New("ledger mgmt should be initialized before using")
 
+// ErrLedgerOpenedReadOnly is thrown by an OpenLedger or CreateLedger call if the ledger with the given id is opened read-only
+var ErrLedgerOpenedReadOnly = errors.New("Ledger already opened read-only")
+
+// ErrReadOnly is thrown by the methods of a ledger opened read-only that would modify the ledger
+var ErrReadOnly = errors.New("Ledger is opened read-only")
+
+// ErrTooManyOpenLedgers is thrown by a CreateLedger, OpenLedger or OpenLedgerReadOnly call if the configured maximum
+// number of ledgers are opened, read-write or read-only
+type ErrTooManyOpenLedgers struct {
+	Limit int
+}
+
+func (e *ErrTooManyOpenLedgers) Error() string {
+	return fmt.Sprintf("Too many open ledgers, the limit of %d open ledgers is reached", e.Limit)
+}
+
 var openedLedgers map[string]ledger.PeerLedger
+var readOnlyLedgers map[string]ledger.PeerLedger
+var maxOpenLedgers int
+var idleLedgerSoftLimit int
+var idleLedgerTimeout time.Duration
+var stopIdleLedgerSweeper chan struct{}
 var ledgerProvider ledger.PeerLedgerProvider
 var lock sync.Mutex
 var initialized bool
@@ -54,21 +81,62 @@ func initialize() {
 	defer lock.Unlock()
 	initialized = true
 	openedLedgers = make(map[string]ledger.PeerLedger)
+	readOnlyLedgers = make(map[string]ledger.PeerLedger)
+	maxOpenLedgers = ledgerconfig.GetMaxOpenLedgers()
+	idleLedgerSoftLimit = ledgerconfig.GetIdleLedgerSoftLimit()
+	idleLedgerTimeout = ledgerconfig.GetIdleLedgerTimeout()
 	provider, err := kvledger.NewProvider()
 	if err != nil {
 		panic(fmt.Errorf("Error in instantiating ledger provider: %s", err))
 	}
 	ledgerProvider = provider
+	if idleLedgerSoftLimit > 0 {
+		stopIdleLedgerSweeper = make(chan struct{})
+		go sweepIdleLedgers(idleLedgerSweepInterval(), stopIdleLedgerSweeper)
+	}
 	logger.Info("ledger mgmt initialized")
 }
 
+// IsInitialized returns true if ledger mgmt has been initialized and not closed since
+func IsInitialized() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return initialized
+}
+
+// checkInitialized returns ErrLedgerMgmtNotInitialized if ledger mgmt is not initialized.
+// The caller is expected to hold the lock
+func checkInitialized() error {
+	if !initialized {
+		return ErrLedgerMgmtNotInitialized
+	}
+	return nil
+}
+
+// checkOpenLedgerLimit returns ErrTooManyOpenLedgers if the maximum number of open ledgers is reached, once the
+// idle ledgers are closed. The ledgers closed as idle do not count. The caller is expected to hold the lock
+func checkOpenLedgerLimit() error {
+	evictIdleLedgers()
+	if maxOpenLedgers > 0 && residentLedgers()+len(readOnlyLedgers) >= maxOpenLedgers {
+		logger.Warningf("Cannot open more than %d ledgers", maxOpenLedgers)
+		return &ErrTooManyOpenLedgers{maxOpenLedgers}
+	}
+	return nil
+}
+
 // CreateLedger creates a new ledger with the given id
 func CreateLedger(id string) (ledger.PeerLedger, error) {
 	logger.Infof("Creating leadger with id = %s", id)
 	lock.Lock()
 	defer lock.Unlock()
-	if !initialized {
-		return nil, ErrLedgerMgmtNotInitialized
+	if err := checkInitialized(); err != nil {
+		return nil, err
+	}
+	if _, ok := readOnlyLedgers[id]; ok {
+		return nil, ErrLedgerOpenedReadOnly
+	}
+	if err := checkOpenLedgerLimit(); err != nil {
+		return nil, err
 	}
 	l, err := ledgerProvider.Create(id)
 	if err != nil {
@@ -85,13 +153,19 @@ func OpenLedger(id string) (ledger.PeerLedger, error) {
 	logger.Infof("Opening leadger with id = %s", id)
 	lock.Lock()
 	defer lock.Unlock()
-	if !initialized {
-		return nil, ErrLedgerMgmtNotInitialized
+	if err := checkInitialized(); err != nil {
+		return nil, err
 	}
 	l, ok := openedLedgers[id]
 	if ok {
 		return nil, ErrLedgerAlreadyOpened
 	}
+	if _, ok := readOnlyLedgers[id]; ok {
+		return nil, ErrLedgerOpenedReadOnly
+	}
+	if err := checkOpenLedgerLimit(); err != nil {
+		return nil, err
+	}
 	l, err := ledgerProvider.Open(id)
 	if err != nil {
 		return nil, err
@@ -102,16 +176,85 @@ func OpenLedger(id string) (ledger.PeerLedger, error) {
 	return l, nil
 }
 
+// OpenLedgerReadOnly returns a ledger for the given id whose methods that would modify the ledger, i.e. Commit,
+// NewTxSimulator and Prune, return ErrReadOnly, e.g. for analytics and audit tooling. The read-only opens are tracked
+// apart from the read-write ones, and a ledger is opened either read-write or read-only at a time, as both would hold
+// the same block store and state database: OpenLedgerReadOnly returns ErrLedgerAlreadyOpened if the ledger is opened,
+// either way, and OpenLedger returns ErrLedgerOpenedReadOnly if the ledger is opened read-only.
+// The ledger is opened as by OpenLedger, so a state database that is behind the block store is recovered
+func OpenLedgerReadOnly(id string) (ledger.PeerLedger, error) {
+	logger.Infof("Opening leadger with id = %s read-only", id)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := checkInitialized(); err != nil {
+		return nil, err
+	}
+	if _, ok := openedLedgers[id]; ok {
+		return nil, ErrLedgerAlreadyOpened
+	}
+	if _, ok := readOnlyLedgers[id]; ok {
+		return nil, ErrLedgerAlreadyOpened
+	}
+	if err := checkOpenLedgerLimit(); err != nil {
+		return nil, err
+	}
+	l, err := ledgerProvider.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	l = &ReadOnlyLedger{id, l}
+	readOnlyLedgers[id] = l
+	logger.Infof("Opened leadger with id = %s read-only", id)
+	return l, nil
+}
+
 // GetLedgerIDs returns the ids of the ledgers created
 func GetLedgerIDs() ([]string, error) {
 	lock.Lock()
 	defer lock.Unlock()
-	if !initialized {
-		return nil, ErrLedgerMgmtNotInitialized
+	if err := checkInitialized(); err != nil {
+		return nil, err
 	}
 	return ledgerProvider.List()
 }
 
+// DeleteLedger deletes the ledger with the given id along with all its persistent data, i.e. the block store,
+// its indexes and the state database. A ledger that is opened is not deleted, see ForceDeleteLedger
+func DeleteLedger(id string) error {
+	return deleteLedger(id, false)
+}
+
+// ForceDeleteLedger deletes the ledger with the given id like DeleteLedger, closing the ledger first if it is opened
+func ForceDeleteLedger(id string) error {
+	return deleteLedger(id, true)
+}
+
+func deleteLedger(id string, force bool) error {
+	logger.Infof("Deleting leadger with id = %s", id)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := checkInitialized(); err != nil {
+		return err
+	}
+	if l, ok := openedLedgers[id]; ok {
+		if !force {
+			return ErrLedgerInUse
+		}
+		l.(*ClosableLedger).closeWithoutLock()
+	}
+	if l, ok := readOnlyLedgers[id]; ok {
+		if !force {
+			return ErrLedgerInUse
+		}
+		l.(*ReadOnlyLedger).closeWithoutLock()
+	}
+	if err := ledgerProvider.Delete(id); err != nil {
+		return err
+	}
+	logger.Infof("Deleted leadger with id = %s", id)
+	return nil
+}
+
 // Close closes all the opened ledgers and any resources held for ledger management
 func Close() {
 	logger.Infof("Closing ledger mgmt")
@@ -120,22 +263,39 @@ func Close() {
 	if !initialized {
 		return
 	}
+	if stopIdleLedgerSweeper != nil {
+		close(stopIdleLedgerSweeper)
+		stopIdleLedgerSweeper = nil
+	}
 	for _, l := range openedLedgers {
 		l.(*ClosableLedger).closeWithoutLock()
 	}
+	for _, l := range readOnlyLedgers {
+		l.(*ReadOnlyLedger).closeWithoutLock()
+	}
 	ledgerProvider.Close()
 	openedLedgers = nil
+	readOnlyLedgers = nil
+	initialized = false
 	logger.Infof("ledger mgmt closed")
 }
 
 func wrapLedger(id string, l ledger.PeerLedger) ledger.PeerLedger {
-	return &ClosableLedger{id, l}
+	return &ClosableLedger{id: id, PeerLedger: l, lastAccess: time.Now()}
 }
 
-// ClosableLedger extends from actual validated ledger and overwrites the Close method
+// ClosableLedger extends from actual validated ledger and overwrites the Close method. It also overwrites the
+// other methods to track the accesses to the ledger, so that the actual ledger is closed once idle and reopened
+// on the next access, see evictIdleLedgers. The fields other than id are guarded by the lock
 type ClosableLedger struct {
 	id string
 	ledger.PeerLedger
+	// lastAccess is the time the last operation on the ledger started or ended
+	lastAccess time.Time
+	// inFlight is the number of operations in progress on the ledger, which is not closed as idle until they end
+	inFlight int
+	// evicted tells whether the actual ledger is closed as idle
+	evicted bool
 }
 
 // Close closes the actual ledger and removes the entries from opened ledgers map
@@ -146,6 +306,42 @@ func (l *ClosableLedger) Close() {
 }
 
 func (l *ClosableLedger) closeWithoutLock() {
-	l.PeerLedger.Close()
+	if !l.evicted {
+		l.PeerLedger.Close()
+	}
 	delete(openedLedgers, l.id)
 }
+
+// ReadOnlyLedger extends from actual validated ledger and overwrites the methods that would modify the ledger and
+// the Close method
+type ReadOnlyLedger struct {
+	id string
+	ledger.PeerLedger
+}
+
+// NewTxSimulator returns ErrReadOnly
+func (l *ReadOnlyLedger) NewTxSimulator() (ledger.TxSimulator, error) {
+	return nil, ErrReadOnly
+}
+
+// Commit returns ErrReadOnly
+func (l *ReadOnlyLedger) Commit(block *common.Block) error {
+	return ErrReadOnly
+}
+
+// Prune returns ErrReadOnly
+func (l *ReadOnlyLedger) Prune(policy ledger.PrunePolicy) error {
+	return ErrReadOnly
+}
+
+// Close closes the actual ledger and removes the entries from read-only ledgers map
+func (l *ReadOnlyLedger) Close() {
+	lock.Lock()
+	defer lock.Unlock()
+	l.closeWithoutLock()
+}
+
+func (l *ReadOnlyLedger) closeWithoutLock() {
+	l.PeerLedger.Close()
+	delete(readOnlyLedgers, l.id)
+}
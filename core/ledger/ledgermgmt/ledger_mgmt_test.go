@@ -19,9 +19,12 @@ package ledgermgmt
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric/core/ledger"
 	"github.com/hyperledger/fabric/core/ledger/testutil"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/spf13/viper"
 )
 
 func TestLedgerMgmt(t *testing.T) {
@@ -57,6 +60,304 @@ func TestLedgerMgmt(t *testing.T) {
 	Close()
 }
 
+func TestDeleteLedger(t *testing.T) {
+	InitializeTestEnv()
+	defer CleanupTestEnv()
+
+	ledgers := make([]ledger.PeerLedger, 3)
+	for i := 0; i < 3; i++ {
+		l, err := CreateLedger(constructTestLedgerID(i))
+		testutil.AssertNoError(t, err, "")
+		ledgers[i] = l
+	}
+	ledgerID := constructTestLedgerID(1)
+	testutil.AssertEquals(t, DeleteLedger(ledgerID), ErrLedgerInUse)
+
+	testutil.AssertNoError(t, ForceDeleteLedger(ledgerID), "")
+	ledgerIDs, err := GetLedgerIDs()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, ledgerIDs, []string{constructTestLedgerID(0), constructTestLedgerID(2)})
+	_, err = OpenLedger(ledgerID)
+	testutil.AssertError(t, err, "Deleted ledger should not be opened")
+
+	// a closed ledger is deleted without force and can be created afresh
+	ledgers[2].Close()
+	testutil.AssertNoError(t, DeleteLedger(constructTestLedgerID(2)), "")
+	ledgerIDs, _ = GetLedgerIDs()
+	testutil.AssertEquals(t, ledgerIDs, []string{constructTestLedgerID(0)})
+	l, err := CreateLedger(constructTestLedgerID(2))
+	testutil.AssertNoError(t, err, "")
+	height, _ := l.GetBlockchainInfo()
+	testutil.AssertEquals(t, height.Height, uint64(0))
+}
+
+func TestOpenLedgerReadOnly(t *testing.T) {
+	InitializeTestEnv()
+	defer CleanupTestEnv()
+
+	ledgerID := constructTestLedgerID(0)
+	l, err := CreateLedger(ledgerID)
+	testutil.AssertNoError(t, err, "")
+	simulator, _ := l.NewTxSimulator()
+	simulator.SetState("ns1", "key1", []byte("value1"))
+	simulator.Done()
+	simRes, _ := simulator.GetTxSimulationResults()
+	bg := testutil.NewBlockGenerator(t)
+	testutil.AssertNoError(t, l.Commit(bg.NextBlock([][]byte{simRes}, false)), "")
+
+	// a ledger opened read-write is not opened read-only
+	_, err = OpenLedgerReadOnly(ledgerID)
+	testutil.AssertEquals(t, err, ErrLedgerAlreadyOpened)
+	l.Close()
+
+	roLedger, err := OpenLedgerReadOnly(ledgerID)
+	testutil.AssertNoError(t, err, "")
+	info, err := roLedger.GetBlockchainInfo()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, info.Height, uint64(1))
+	queryExecutor, err := roLedger.NewQueryExecutor()
+	testutil.AssertNoError(t, err, "")
+	value, err := queryExecutor.GetState("ns1", "key1")
+	queryExecutor.Done()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, value, []byte("value1"))
+
+	_, err = roLedger.NewTxSimulator()
+	testutil.AssertEquals(t, err, ErrReadOnly)
+	testutil.AssertEquals(t, roLedger.Commit(bg.NextBlock([][]byte{simRes}, false)), ErrReadOnly)
+	testutil.AssertEquals(t, roLedger.Prune(nil), ErrReadOnly)
+
+	// a ledger opened read-only is neither opened again nor deleted without force
+	_, err = OpenLedgerReadOnly(ledgerID)
+	testutil.AssertEquals(t, err, ErrLedgerAlreadyOpened)
+	_, err = OpenLedger(ledgerID)
+	testutil.AssertEquals(t, err, ErrLedgerOpenedReadOnly)
+	testutil.AssertEquals(t, DeleteLedger(ledgerID), ErrLedgerInUse)
+
+	// once closed, the ledger is opened read-write again
+	roLedger.Close()
+	l, err = OpenLedger(ledgerID)
+	testutil.AssertNoError(t, err, "")
+	info, _ = l.GetBlockchainInfo()
+	testutil.AssertEquals(t, info.Height, uint64(1))
+}
+
+func TestMaxOpenLedgers(t *testing.T) {
+	defer viper.Set("ledger.maxOpenLedgers", 0)
+	viper.Set("ledger.maxOpenLedgers", 3)
+	InitializeTestEnv()
+	defer CleanupTestEnv()
+
+	// the ledgers opened read-write and read-only count up to the limit
+	ledgers := make([]ledger.PeerLedger, 3)
+	for i := 0; i < 2; i++ {
+		l, err := CreateLedger(constructTestLedgerID(i))
+		testutil.AssertNoError(t, err, "")
+		ledgers[i] = l
+	}
+	l, err := CreateLedger(constructTestLedgerID(2))
+	testutil.AssertNoError(t, err, "")
+	l.Close()
+	ledgers[2], err = OpenLedgerReadOnly(constructTestLedgerID(2))
+	testutil.AssertNoError(t, err, "")
+
+	// past the limit, the ledgers are neither created nor opened
+	_, err = CreateLedger(constructTestLedgerID(3))
+	testutil.AssertEquals(t, err, &ErrTooManyOpenLedgers{Limit: 3})
+	ledgerIDs, _ := GetLedgerIDs()
+	testutil.AssertEquals(t, len(ledgerIDs), 3)
+	ledgers[1].Close()
+	ledgers[2].Close()
+	ledgers[1], err = OpenLedger(constructTestLedgerID(1))
+	testutil.AssertNoError(t, err, "")
+	ledgers[2], err = OpenLedger(constructTestLedgerID(2))
+	testutil.AssertNoError(t, err, "")
+	_, err = OpenLedgerReadOnly(constructTestLedgerID(3))
+	testutil.AssertEquals(t, err, &ErrTooManyOpenLedgers{Limit: 3})
+
+	// a ledger is opened once another one is closed
+	ledgers[0].Close()
+	_, err = CreateLedger(constructTestLedgerID(3))
+	testutil.AssertNoError(t, err, "")
+	_, err = OpenLedger(constructTestLedgerID(0))
+	testutil.AssertEquals(t, err, &ErrTooManyOpenLedgers{Limit: 3})
+	testutil.AssertEquals(t, err.Error(), "Too many open ledgers, the limit of 3 open ledgers is reached")
+}
+
+func TestIdleLedgers(t *testing.T) {
+	defer viper.Set("ledger.idleLedgerSoftLimit", 0)
+	defer viper.Set("ledger.idleLedgerTimeout", "10m")
+	viper.Set("ledger.idleLedgerSoftLimit", 1)
+	viper.Set("ledger.idleLedgerTimeout", "200ms")
+	InitializeTestEnv()
+	defer CleanupTestEnv()
+
+	ledgers := make([]ledger.PeerLedger, 2)
+	for i := 0; i < 2; i++ {
+		l, err := CreateLedger(constructTestLedgerID(i))
+		testutil.AssertNoError(t, err, "")
+		ledgers[i] = l
+	}
+	simulator, _ := ledgers[0].NewTxSimulator()
+	simulator.SetState("ns1", "key1", []byte("value1"))
+	simulator.Done()
+	simRes, _ := simulator.GetTxSimulationResults()
+	bg := testutil.NewBlockGenerator(t)
+	testutil.AssertNoError(t, ledgers[0].Commit(bg.NextBlock([][]byte{simRes}, false)), "")
+	ledgers[1].GetBlockchainInfo()
+
+	// past the timeout, the least recently accessed ledger is closed down to the soft limit
+	time.Sleep(500 * time.Millisecond)
+	testutil.AssertEquals(t, isEvicted(ledgers[0]), true)
+	testutil.AssertEquals(t, isEvicted(ledgers[1]), false)
+
+	// a ledger closed as idle stays opened, and is reopened on its next access
+	_, err := OpenLedger(constructTestLedgerID(0))
+	testutil.AssertEquals(t, err, ErrLedgerAlreadyOpened)
+	info, err := ledgers[0].GetBlockchainInfo()
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, info.Height, uint64(1))
+	testutil.AssertEquals(t, isEvicted(ledgers[0]), false)
+
+	// a ledger with a query executor in progress is not closed, however long it is idle
+	queryExecutor, err := ledgers[0].NewQueryExecutor()
+	testutil.AssertNoError(t, err, "")
+	time.Sleep(500 * time.Millisecond)
+	testutil.AssertEquals(t, isEvicted(ledgers[0]), false)
+	testutil.AssertEquals(t, isEvicted(ledgers[1]), true)
+	value, err := queryExecutor.GetState("ns1", "key1")
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, value, []byte("value1"))
+	queryExecutor.Done()
+
+	// once done, the ledger is closed again when the other ledger is accessed after it
+	_, err = ledgers[1].GetBlockchainInfo()
+	testutil.AssertNoError(t, err, "")
+	time.Sleep(500 * time.Millisecond)
+	testutil.AssertEquals(t, isEvicted(ledgers[0]), true)
+	testutil.AssertEquals(t, isEvicted(ledgers[1]), false)
+	queryExecutor, err = ledgers[0].NewQueryExecutor()
+	testutil.AssertNoError(t, err, "")
+	value, _ = queryExecutor.GetState("ns1", "key1")
+	queryExecutor.Done()
+	testutil.AssertEquals(t, value, []byte("value1"))
+	ledgers[1].Close()
+	ledgers[1], err = OpenLedger(constructTestLedgerID(1))
+	testutil.AssertNoError(t, err, "")
+	testutil.AssertEquals(t, isEvicted(ledgers[1]), false)
+}
+
+func TestIdleLedgerHistoryQuery(t *testing.T) {
+	lock.Lock()
+	defer func(ledgers map[string]ledger.PeerLedger, softLimit int, timeout time.Duration) {
+		lock.Lock()
+		openedLedgers, idleLedgerSoftLimit, idleLedgerTimeout = ledgers, softLimit, timeout
+		lock.Unlock()
+	}(openedLedgers, idleLedgerSoftLimit, idleLedgerTimeout)
+	ledgers := []*ClosableLedger{{id: "ledger1", PeerLedger: &historyLedger{}}, {id: "ledger2", PeerLedger: &historyLedger{}}}
+	openedLedgers = map[string]ledger.PeerLedger{"ledger1": ledgers[0], "ledger2": ledgers[1]}
+	idleLedgerSoftLimit, idleLedgerTimeout = 1, 0
+	lock.Unlock()
+	evict := func() {
+		lock.Lock()
+		evictIdleLedgers()
+		lock.Unlock()
+	}
+
+	// the ledger is not closed as idle while the iterator of a history query is open
+	executor, err := ledgers[0].NewHistoryQueryExecutor()
+	testutil.AssertNoError(t, err, "")
+	itr, err := executor.GetTransactionsForKey("ns1", "key1", true, false)
+	testutil.AssertNoError(t, err, "")
+	_, err = ledgers[1].GetBlockchainInfo()
+	testutil.AssertNoError(t, err, "")
+	evict()
+	testutil.AssertEquals(t, isEvicted(ledgers[0]), false)
+	testutil.AssertEquals(t, isEvicted(ledgers[1]), true)
+	_, err = itr.Next()
+	testutil.AssertNoError(t, err, "")
+
+	// once the iterator is closed, the ledger is closed as idle
+	itr.Close()
+	itr.Close()
+	lock.Lock()
+	testutil.AssertEquals(t, ledgers[0].inFlight, 0)
+	// the other ledger is made resident again without a provider to reopen it
+	ledgers[1].evicted = false
+	lock.Unlock()
+	_, err = ledgers[1].GetBlockchainInfo()
+	testutil.AssertNoError(t, err, "")
+	evict()
+	testutil.AssertEquals(t, isEvicted(ledgers[0]), true)
+	testutil.AssertEquals(t, ledgers[0].PeerLedger.(*historyLedger).closed, true)
+}
+
+// historyLedger is a ledger whose history queries fail once it is closed
+type historyLedger struct {
+	ledger.PeerLedger
+	closed bool
+}
+
+func (l *historyLedger) NewHistoryQueryExecutor() (ledger.HistoryQueryExecutor, error) {
+	return &historyQueryExecutor{l}, nil
+}
+
+func (l *historyLedger) GetBlockchainInfo() (*pb.BlockchainInfo, error) {
+	return &pb.BlockchainInfo{}, nil
+}
+
+func (l *historyLedger) Close() {
+	l.closed = true
+}
+
+type historyQueryExecutor struct {
+	ledger *historyLedger
+}
+
+func (e *historyQueryExecutor) GetTransactionsForKey(namespace string, key string, includeValues bool,
+	includeTransactions bool) (ledger.ResultsIterator, error) {
+	return &historyIterator{e.ledger}, nil
+}
+
+type historyIterator struct {
+	ledger *historyLedger
+}
+
+func (itr *historyIterator) Next() (ledger.QueryResult, error) {
+	if itr.ledger.closed {
+		return nil, fmt.Errorf("ledger closed")
+	}
+	return nil, nil
+}
+
+func (itr *historyIterator) Close() {}
+
+func isEvicted(l ledger.PeerLedger) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return l.(*ClosableLedger).evicted
+}
+
+func TestIsInitialized(t *testing.T) {
+	testutil.AssertEquals(t, IsInitialized(), false)
+	_, err := CreateLedger(constructTestLedgerID(0))
+	testutil.AssertEquals(t, err, ErrLedgerMgmtNotInitialized)
+	_, err = OpenLedger(constructTestLedgerID(0))
+	testutil.AssertEquals(t, err, ErrLedgerMgmtNotInitialized)
+	_, err = GetLedgerIDs()
+	testutil.AssertEquals(t, err, ErrLedgerMgmtNotInitialized)
+
+	InitializeTestEnv()
+	testutil.AssertEquals(t, IsInitialized(), true)
+	_, err = CreateLedger(constructTestLedgerID(0))
+	testutil.AssertNoError(t, err, "")
+
+	CleanupTestEnv()
+	testutil.AssertEquals(t, IsInitialized(), false)
+	_, err = OpenLedger(constructTestLedgerID(0))
+	testutil.AssertEquals(t, err, ErrLedgerMgmtNotInitialized)
+}
+
 func constructTestLedgerID(i int) string {
 	return fmt.Sprintf("ledger_%06d", i)
 }
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -31,11 +32,16 @@ import (
 	"net/textproto"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
 	logging "github.com/op/go-logging"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 var logger = logging.MustGetLogger("couchdb")
@@ -115,9 +121,106 @@ type CouchConnectionDef struct {
 	Password string
 }
 
+//inFlightRequests is the number of requests to CouchDB awaiting a response
+var inFlightRequests int64
+
+//inFlightRequestsGauge reports inFlightRequests in the default metrics registry
+var inFlightRequestsGauge = metrics.NewRegisteredFunctionalGauge("couchdb.requests.inflight", metrics.DefaultRegistry, InFlightRequests)
+
+//InFlightRequests returns the number of requests to CouchDB awaiting a response.  A count
+//reaching the connection limit of the instances indicates that the connection pool is saturated
+func InFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
+
+//ConnectionLimits contains the limits of the connection pool of a CouchDB instance.
+//A zero value leaves the limit to the net/http default
+type ConnectionLimits struct {
+	MaxIdleConns    int //maximum number of idle connections kept for reuse
+	MaxConnsPerHost int //maximum number of connections, requests beyond the limit wait for a connection
+}
+
 //CouchInstance represents a CouchDB instance
 type CouchInstance struct {
-	conf CouchConnectionDef //connection configuration
+	conf        CouchConnectionDef //connection configuration
+	credentials *credentials       //shared by the copies of the instance, so that all of them see updated credentials
+	client      *http.Client       //shared by the copies of the instance, so that they share the connection pool
+	server      *serverVersion     //shared by the copies of the instance, so that the version is read once
+	closed      *int32             //shared by the copies of the instance, so that all of them see it closed
+	limits      *serverLimits      //shared by the copies of the instance, so that the limits are read once
+}
+
+//ErrInstanceClosed is returned for the requests made through a CouchDB instance once it is closed
+var ErrInstanceClosed = errors.New("CouchDB instance is closed")
+
+//serverVersion holds the version of the CouchDB server, once read
+type serverVersion struct {
+	mux     sync.Mutex
+	version string
+}
+
+//ServerLimits holds the limits that the CouchDB server imposes on the size of the documents and of the
+//requests, in bytes.  A limit is 0 if it is unknown
+type ServerLimits struct {
+	MaxDocumentSize    int64
+	MaxHTTPRequestSize int64
+}
+
+//serverLimits holds the limits of the CouchDB server, once read
+type serverLimits struct {
+	mux    sync.Mutex
+	limits *ServerLimits
+}
+
+//serverInfo is the response of the root endpoint of CouchDB
+type serverInfo struct {
+	CouchDB string `json:"couchdb"`
+	Version string `json:"version"`
+}
+
+//credentials holds the username and password used to authenticate to CouchDB
+type credentials struct {
+	mux      sync.RWMutex
+	username string
+	password string
+}
+
+//UpdateCredentials updates the username and password used by the instance, and by the databases
+//created from it, to authenticate subsequent requests
+func (couchInstance *CouchInstance) UpdateCredentials(username, password string) {
+	couchInstance.credentials.mux.Lock()
+	defer couchInstance.credentials.mux.Unlock()
+	couchInstance.credentials.username = username
+	couchInstance.credentials.password = password
+}
+
+//getCredentials returns the username and password currently used to authenticate
+func (couchInstance *CouchInstance) getCredentials() (string, string) {
+	if couchInstance.credentials == nil {
+		return couchInstance.conf.Username, couchInstance.conf.Password
+	}
+	couchInstance.credentials.mux.RLock()
+	defer couchInstance.credentials.mux.RUnlock()
+	return couchInstance.credentials.username, couchInstance.credentials.password
+}
+
+//Close closes the instance, along with the copies of the instance and the databases created from it.  The idle
+//connections of the pool are closed, and subsequent requests fail with ErrInstanceClosed
+func (couchInstance *CouchInstance) Close() {
+	if couchInstance.closed != nil {
+		atomic.StoreInt32(couchInstance.closed, 1)
+	}
+	if couchInstance.client == nil {
+		return
+	}
+	if transport, ok := couchInstance.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+//isClosed returns true once the instance is closed
+func (couchInstance *CouchInstance) isClosed() bool {
+	return couchInstance.closed != nil && atomic.LoadInt32(couchInstance.closed) == 1
 }
 
 //CouchDatabase represents a database within a CouchDB instance
@@ -126,6 +229,13 @@ type CouchDatabase struct {
 	dbName        string
 }
 
+//DatabaseOptions contains the cluster parameters of a database, applied when the database is created.
+//A zero value leaves the parameter to the cluster default
+type DatabaseOptions struct {
+	Shards   int //number of shards (q)
+	Replicas int //number of replicas of each shard (n)
+}
+
 //DBReturn contains an error reported by CouchDB
 type DBReturn struct {
 	StatusCode int    `json:"status_code"`
@@ -133,6 +243,36 @@ type DBReturn struct {
 	Reason     string `json:"reason"`
 }
 
+//ErrRequestTooLarge is returned for a request that CouchDB rejects with 413 because it exceeds its
+//max_http_request_size.  The request succeeds once the batch or chunk size, or the size of the values, is reduced
+type ErrRequestTooLarge struct {
+	Reason string
+}
+
+func (e *ErrRequestTooLarge) Error() string {
+	return fmt.Sprintf("Couch DB Error: request too large, reduce the batch or chunk size, or raise max_http_request_size: %s", e.Reason)
+}
+
+//ErrDatabaseNotFound is returned for a request on a database that does not exist, e.g. because the database
+//was deleted after the CouchDatabase was created
+type ErrDatabaseNotFound struct {
+	DBName string
+}
+
+func (e *ErrDatabaseNotFound) Error() string {
+	return fmt.Sprintf("Couch DB Error: database %s does not exist", e.DBName)
+}
+
+//ErrDocumentConflict is returned for a write that CouchDB rejects with 409 because the document is not at the
+//revision given, e.g. because it was updated concurrently.  The write succeeds once retried at the current revision
+type ErrDocumentConflict struct {
+	Reason string
+}
+
+func (e *ErrDocumentConflict) Error() string {
+	return fmt.Sprintf("Couch DB Error: %s", e.Reason)
+}
+
 //Attachment contains the definition for an attached file for couchdb
 type Attachment struct {
 	Name            string
@@ -183,6 +323,12 @@ func CreateConnectionDefinition(couchDBAddress, username, password string) (*Cou
 
 //CreateDatabaseIfNotExist method provides function to create database
 func (dbclient *CouchDatabase) CreateDatabaseIfNotExist() (*DBOperationResponse, error) {
+	return dbclient.CreateDatabaseIfNotExistWithOptions(DatabaseOptions{})
+}
+
+//CreateDatabaseIfNotExistWithOptions method provides function to create database with the given
+//cluster options if the database does not exist yet.  The options of an existing database are not changed
+func (dbclient *CouchDatabase) CreateDatabaseIfNotExistWithOptions(options DatabaseOptions) (*DBOperationResponse, error) {
 
 	logger.Debugf("Entering CreateDatabaseIfNotExist()")
 
@@ -197,6 +343,20 @@ func (dbclient *CouchDatabase) CreateDatabaseIfNotExist() (*DBOperationResponse,
 
 		logger.Debugf("Database %s does not exist.", dbclient.dbName)
 
+		//take the create lock, so that only one of the peers sharing the CouchDB creates the database
+		release, err := acquireLock(dbclient.couchInstance, dbclient.dbName)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		//the database may have been created by another peer while waiting for the lock
+		dbInfo, _, err = dbclient.GetDatabaseInfo()
+		if err == nil && dbInfo != nil {
+			logger.Debugf("Database %s was created concurrently", dbclient.dbName)
+			return nil, nil
+		}
+
 		connectURL, err := url.Parse(dbclient.couchInstance.conf.URL)
 		if err != nil {
 			logger.Errorf("URL parse error: %s", err.Error())
@@ -204,6 +364,15 @@ func (dbclient *CouchDatabase) CreateDatabaseIfNotExist() (*DBOperationResponse,
 		}
 		connectURL.Path = dbclient.dbName
 
+		queryParms := connectURL.Query()
+		if options.Shards > 0 {
+			queryParms.Add("q", strconv.Itoa(options.Shards))
+		}
+		if options.Replicas > 0 {
+			queryParms.Add("n", strconv.Itoa(options.Replicas))
+		}
+		connectURL.RawQuery = queryParms.Encode()
+
 		//process the URL with a PUT, creates the database
 		resp, _, err := dbclient.handleRequest(http.MethodPut, connectURL.String(), nil, "", "")
 		if err != nil {
@@ -233,6 +402,263 @@ func (dbclient *CouchDatabase) CreateDatabaseIfNotExist() (*DBOperationResponse,
 
 }
 
+//ServerVersion returns the version reported by the root endpoint of the CouchDB server, e.g. 1.6.1 or 2.1.0.
+//The version is read on the first call and then reused, a failure to read it is retried on the next call
+func (couchInstance *CouchInstance) ServerVersion() (string, error) {
+
+	if couchInstance.server != nil {
+		couchInstance.server.mux.Lock()
+		defer couchInstance.server.mux.Unlock()
+		if couchInstance.server.version != "" {
+			return couchInstance.server.version, nil
+		}
+	}
+
+	connectURL, err := url.Parse(couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return "", err
+	}
+	connectURL.Path = "/"
+
+	dbclient := &CouchDatabase{couchInstance: *couchInstance}
+	resp, _, err := dbclient.handleRequest(http.MethodGet, connectURL.String(), nil, "", "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	info := &serverInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return "", err
+	}
+	if info.Version == "" {
+		return "", fmt.Errorf("CouchDB server did not report its version")
+	}
+	logger.Debugf("CouchDB server version: %s", info.Version)
+
+	if couchInstance.server != nil {
+		couchInstance.server.version = info.Version
+	}
+	return info.Version, nil
+
+}
+
+//GetServerLimits returns the limits configured on the CouchDB server, read from the _node/_local/_config
+//endpoint of a cluster or the _config endpoint of a 1.x server.  The configuration is only accessible to the
+//admins of the server: if the access is forbidden, the limits are returned unknown rather than failing.  The
+//limits are read on the first call and then reused, and the bulk reads of the databases of the instance are
+//then split in requests within MaxHTTPRequestSize
+func (couchInstance *CouchInstance) GetServerLimits() (*ServerLimits, error) {
+
+	if couchInstance.limits != nil {
+		couchInstance.limits.mux.Lock()
+		defer couchInstance.limits.mux.Unlock()
+		if couchInstance.limits.limits != nil {
+			return couchInstance.limits.limits, nil
+		}
+	}
+
+	clustered, err := couchInstance.IsClustered()
+	if err != nil {
+		return nil, err
+	}
+	connectURL, err := url.Parse(couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	connectURL.Path = "_config"
+	if clustered {
+		connectURL.Path = "_node/_local/_config"
+	}
+
+	limits := &ServerLimits{}
+	dbclient := &CouchDatabase{couchInstance: *couchInstance}
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodGet, connectURL.String(), nil, "", "")
+	if err != nil {
+		if couchDBReturn == nil || (couchDBReturn.StatusCode != http.StatusUnauthorized && couchDBReturn.StatusCode != http.StatusForbidden) {
+			return nil, err
+		}
+		logger.Warningf("The CouchDB configuration is not accessible, the server limits are unknown: %s", err.Error())
+	} else {
+		defer resp.Body.Close()
+		config := map[string]json.RawMessage{}
+		if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+			return nil, err
+		}
+		limits.MaxDocumentSize = configLimit(config, "couchdb", "max_document_size")
+		//the clustered interface of CouchDB 2.x is configured in the chttpd section
+		if limits.MaxHTTPRequestSize = configLimit(config, "chttpd", "max_http_request_size"); limits.MaxHTTPRequestSize == 0 {
+			limits.MaxHTTPRequestSize = configLimit(config, "httpd", "max_http_request_size")
+		}
+	}
+	logger.Debugf("CouchDB server limits: max_document_size=%d max_http_request_size=%d", limits.MaxDocumentSize, limits.MaxHTTPRequestSize)
+
+	if couchInstance.limits != nil {
+		couchInstance.limits.limits = limits
+	}
+	return limits, nil
+
+}
+
+//configLimit returns the limit configured by a key of a section of the CouchDB configuration, 0 if it is not set
+func configLimit(config map[string]json.RawMessage, section string, key string) int64 {
+	values := map[string]string{}
+	if err := json.Unmarshal(config[section], &values); err != nil {
+		return 0
+	}
+	limit, err := strconv.ParseInt(values[key], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return limit
+}
+
+//knownServerLimits returns the limits of the server if they were read by GetServerLimits, or nil
+func (couchInstance *CouchInstance) knownServerLimits() *ServerLimits {
+	if couchInstance.limits == nil {
+		return nil
+	}
+	couchInstance.limits.mux.Lock()
+	defer couchInstance.limits.mux.Unlock()
+	return couchInstance.limits.limits
+}
+
+//IsClustered returns true if the CouchDB server is version 2.x or later, which runs as a cluster.  A cluster
+//acknowledges writes once written to a quorum of the replicas, and ignores _ensure_full_commit
+func (couchInstance *CouchInstance) IsClustered() (bool, error) {
+	serverVersion, err := couchInstance.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	major, err := strconv.Atoi(strings.SplitN(serverVersion, ".", 2)[0])
+	if err != nil {
+		return false, fmt.Errorf("Unexpected CouchDB server version %s", serverVersion)
+	}
+	return major >= 2, nil
+}
+
+//ClusterStatus is the health of a CouchDB cluster, as reported by the node serving the requests
+type ClusterStatus struct {
+	//ClusterNodes are the nodes the cluster is configured with
+	ClusterNodes []string
+	//ConnectedNodes are the nodes the node serving the requests is connected to, itself included
+	ConnectedNodes []string
+	//Up tells whether the node serving the requests is up, rather than in maintenance mode
+	Up bool
+}
+
+//NodeCount returns the number of nodes the cluster is configured with
+func (status *ClusterStatus) NodeCount() int {
+	return len(status.ClusterNodes)
+}
+
+//Healthy returns true if the node serving the requests is up and connected to all the nodes of the cluster.
+//While nodes are added or removed, the shards are moved and the reads of a quorum of the replicas may not
+//return the latest revisions
+func (status *ClusterStatus) Healthy() bool {
+	if !status.Up {
+		return false
+	}
+	connected := make(map[string]bool)
+	for _, node := range status.ConnectedNodes {
+		connected[node] = true
+	}
+	for _, node := range status.ClusterNodes {
+		if !connected[node] {
+			return false
+		}
+	}
+	return true
+}
+
+//ClusterStatus returns the status of the CouchDB cluster, read from the _membership and _up endpoints.  A 1.x
+//server, which does not run as a cluster, is reported as a healthy cluster of a single node
+func (couchInstance *CouchInstance) ClusterStatus() (*ClusterStatus, error) {
+
+	logger.Debugf("Entering ClusterStatus()")
+
+	clustered, err := couchInstance.IsClustered()
+	if err != nil {
+		return nil, err
+	}
+	if !clustered {
+		return &ClusterStatus{ClusterNodes: []string{couchInstance.conf.URL}, ConnectedNodes: []string{couchInstance.conf.URL}, Up: true}, nil
+	}
+
+	connectURL, err := url.Parse(couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	connectURL.Path = "_membership"
+
+	dbclient := &CouchDatabase{couchInstance: *couchInstance}
+	resp, _, err := dbclient.handleRequest(http.MethodGet, connectURL.String(), nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	membership := &struct {
+		AllNodes     []string `json:"all_nodes"`
+		ClusterNodes []string `json:"cluster_nodes"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(membership); err != nil {
+		return nil, err
+	}
+	status := &ClusterStatus{ClusterNodes: membership.ClusterNodes, ConnectedNodes: membership.AllNodes}
+
+	//_up fails with 404 while the node is in maintenance mode
+	connectURL.Path = "_up"
+	upResp, couchDBReturn, err := dbclient.handleRequest(http.MethodGet, connectURL.String(), nil, "", "")
+	if err != nil {
+		if couchDBReturn == nil || couchDBReturn.StatusCode != http.StatusNotFound {
+			return nil, err
+		}
+	} else {
+		upResp.Body.Close()
+		status.Up = true
+	}
+
+	logger.Debugf("Exiting ClusterStatus()")
+
+	return status, nil
+
+}
+
+//GetAllDatabases method provides function to retrieve the names of all databases in the CouchDB instance,
+//including system databases and databases created by other clients
+func (couchInstance *CouchInstance) GetAllDatabases() ([]string, error) {
+
+	logger.Debugf("Entering GetAllDatabases()")
+
+	connectURL, err := url.Parse(couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	connectURL.Path = "_all_dbs"
+
+	dbclient := &CouchDatabase{couchInstance: *couchInstance}
+	resp, _, err := dbclient.handleRequest(http.MethodGet, connectURL.String(), nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	dbNames := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&dbNames); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Exiting GetAllDatabases()")
+
+	return dbNames, nil
+
+}
+
 //GetDatabaseInfo method provides function to retrieve database information
 func (dbclient *CouchDatabase) GetDatabaseInfo() (*DBInfo, *DBReturn, error) {
 
@@ -301,6 +727,11 @@ func (dbclient *CouchDatabase) DropDatabase() (*DBOperationResponse, error) {
 
 }
 
+//IsClustered returns true if the CouchDB server of the database is version 2.x or later, see CouchInstance.IsClustered
+func (dbclient *CouchDatabase) IsClustered() (bool, error) {
+	return dbclient.couchInstance.IsClustered()
+}
+
 // EnsureFullCommit calls _ensure_full_commit for explicit fsync
 func (dbclient *CouchDatabase) EnsureFullCommit() (*DBOperationResponse, error) {
 
@@ -333,6 +764,52 @@ func (dbclient *CouchDatabase) EnsureFullCommit() (*DBOperationResponse, error)
 	return dbResponse, fmt.Errorf("Error syncing database")
 }
 
+//CompactDatabase method provides function to start the compaction of the database, which removes the old
+//revisions of the documents from the database file.  CouchDB compacts the database in the background, see
+//the CompactRunning field of DBInfo
+func (dbclient *CouchDatabase) CompactDatabase() (*DBOperationResponse, error) {
+	return dbclient.compact("")
+}
+
+//CompactViews method provides function to start the compaction of the views, such as the Mango indexes,
+//of the given design document, in the background
+func (dbclient *CouchDatabase) CompactViews(designDoc string) (*DBOperationResponse, error) {
+	return dbclient.compact(strings.TrimPrefix(designDoc, "_design/"))
+}
+
+func (dbclient *CouchDatabase) compact(designDoc string) (*DBOperationResponse, error) {
+
+	logger.Debugf("Entering Compact()  designDoc=%s", designDoc)
+
+	compactURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	compactURL.Path = dbclient.dbName + "/_compact"
+	if designDoc != "" {
+		compactURL.Path += "/" + designDoc
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodPost, compactURL.String(), nil, "", "")
+	if err != nil {
+		logger.Errorf("Failed to invoke _compact Error: %s\n", err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	dbResponse := &DBOperationResponse{}
+	json.NewDecoder(resp.Body).Decode(&dbResponse)
+
+	logger.Debugf("Exiting Compact()")
+
+	if dbResponse.Ok != true {
+		return dbResponse, fmt.Errorf("Error compacting database %s", dbclient.dbName)
+	}
+	return dbResponse, nil
+
+}
+
 //SaveDoc method provides a function to save a document, id and byte array
 func (dbclient *CouchDatabase) SaveDoc(id string, rev string, bytesDoc []byte, attachments []Attachment) (string, error) {
 
@@ -382,7 +859,7 @@ func (dbclient *CouchDatabase) SaveDoc(id string, rev string, bytesDoc []byte, a
 	} else { // there are attachments
 
 		//attachments are included, create the multipart definition
-		multipartData, multipartBoundary, err3 := createAttachmentPart(*data, attachments, defaultBoundary)
+		multipartData, multipartBoundary, err3 := createAttachmentPart(*data, bytesDoc, attachments, defaultBoundary)
 		if err3 != nil {
 			return "", err3
 		}
@@ -408,13 +885,20 @@ func (dbclient *CouchDatabase) SaveDoc(id string, rev string, bytesDoc []byte, a
 		return "", err
 	}
 
+	//an empty revision does not tell that the write persisted, e.g. the response of a proxy rather than CouchDB
+	if revision == "" {
+		return "", fmt.Errorf("Couch DB Error: no revision returned for the save of document %s", id)
+	}
+
 	logger.Debugf("Exiting SaveDoc()")
 
 	return revision, nil
 
 }
 
-func createAttachmentPart(data bytes.Buffer, attachments []Attachment, defaultBoundary string) (bytes.Buffer, string, error) {
+//createAttachmentPart creates the multipart definition of a document with attachments.  The fields
+//of bytesDoc, if provided, are stored in the document along with the attachments
+func createAttachmentPart(data bytes.Buffer, bytesDoc []byte, attachments []Attachment, defaultBoundary string) (bytes.Buffer, string, error) {
 
 	// read the attachment and save as an attachment
 	writer := multipart.NewWriter(&data)
@@ -428,8 +912,13 @@ func createAttachmentPart(data bytes.Buffer, attachments []Attachment, defaultBo
 		fileAttachments[attachment.Name] = FileDetails{true, attachment.ContentType, len(attachment.AttachmentBytes)}
 	}
 
-	attachmentJSONMap := map[string]interface{}{
-		"_attachments": fileAttachments}
+	attachmentJSONMap := map[string]interface{}{}
+	if bytesDoc != nil {
+		if err := json.Unmarshal(bytesDoc, &attachmentJSONMap); err != nil {
+			return data, defaultBoundary, fmt.Errorf("JSON format is not valid")
+		}
+	}
+	attachmentJSONMap["_attachments"] = fileAttachments
 
 	filesForUpload, _ := json.Marshal(attachmentJSONMap)
 	logger.Debugf(string(filesForUpload))
@@ -445,14 +934,24 @@ func createAttachmentPart(data bytes.Buffer, attachments []Attachment, defaultBo
 
 	part.Write(filesForUpload)
 
+	//CouchDB matches the parts to the attachments in the order they are listed in the document,
+	//which is the order of their names once marshalled
+	names := make([]string, 0, len(attachments))
+	attachmentBytes := map[string][]byte{}
 	for _, attachment := range attachments {
+		names = append(names, attachment.Name)
+		attachmentBytes[attachment.Name] = attachment.AttachmentBytes
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
 
 		header := make(textproto.MIMEHeader)
 		part, err2 := writer.CreatePart(header)
 		if err2 != nil {
 			return data, defaultBoundary, err2
 		}
-		part.Write(attachment.AttachmentBytes)
+		part.Write(attachmentBytes[name])
 
 	}
 
@@ -481,307 +980,1714 @@ func getRevisionHeader(resp *http.Response) (string, error) {
 
 //ReadDoc method provides function to retrieve a document from the database by id
 func (dbclient *CouchDatabase) ReadDoc(id string) ([]byte, string, error) {
+	return dbclient.ReadDocRevision(id, "")
+}
+
+//ReadDocRevision method provides function to retrieve a specific revision of a document from the database by id.
+//The latest revision is retrieved if rev is empty.  A revision that does not exist, or was removed
+//by compaction, results in a nil value just like a non-existent document
+func (dbclient *CouchDatabase) ReadDocRevision(id string, rev string) ([]byte, string, error) {
+	return documentValue(dbclient.readDocAttachments(id, rev, 0))
+}
+
+//ReadDocWithQuorum method provides function to retrieve a document from the database by id like ReadDoc, the
+//document being read from quorum replicas (r) of a CouchDB cluster.  The most recent revision of the replicas
+//is returned, so that a document just written is not read from a replica it was not replicated to yet
+func (dbclient *CouchDatabase) ReadDocWithQuorum(id string, quorum int) ([]byte, string, error) {
+	return documentValue(dbclient.readDocAttachments(id, "", quorum))
+}
+
+//ReadDocRev method provides function to retrieve the latest revision of a document by id with a HEAD request,
+//without reading the document, from quorum replicas (r) of a CouchDB cluster if quorum is greater than 0.
+//A non-existent document results in an empty revision
+func (dbclient *CouchDatabase) ReadDocRev(id string, quorum int) (string, error) {
 
-	logger.Debugf("Entering ReadDoc()  id=%s", id)
+	logger.Debugf("Entering ReadDocRev()  id=%s", id)
 
 	readURL, err := url.Parse(dbclient.couchInstance.conf.URL)
 	if err != nil {
 		logger.Errorf("URL parse error: %s", err.Error())
-		return nil, "", err
+		return "", err
 	}
 	readURL.Path = dbclient.dbName + "/" + id
 
-	query := readURL.Query()
-	query.Add("attachments", "true")
-
-	readURL.RawQuery = query.Encode()
+	if quorum > 0 {
+		query := readURL.Query()
+		query.Add("r", strconv.Itoa(quorum))
+		readURL.RawQuery = query.Encode()
+	}
 
-	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodGet, readURL.String(), nil, "", "")
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodHead, readURL.String(), nil, "", "")
 	if err != nil {
-		fmt.Printf("couchDBReturn=%v", couchDBReturn)
+		//the response to a HEAD request has no body, so a missing database is not told from a missing document
 		if couchDBReturn != nil && couchDBReturn.StatusCode == 404 {
-			logger.Debug("Document not found (404), returning nil value instead of 404 error")
-			// non-existent document should return nil value instead of a 404 error
-			// for details see https://github.com/hyperledger-archives/fabric/issues/936
-			return nil, "", nil
+			logger.Debug("Document not found (404), returning empty revision")
+			return "", nil
 		}
-		return nil, "", err
+		return "", err
 	}
 	defer resp.Body.Close()
 
-	//Get the media type from the Content-Type header
-	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	//Get the revision from header
 	revision, err := getRevisionHeader(resp)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 
-	//check to see if the is multipart,  handle as attachment if multipart is detected
-	if strings.HasPrefix(mediaType, "multipart/") {
+	logger.Debugf("Exiting ReadDocRev()  revision=%s", revision)
 
-		//Set up the multipart reader based on the boundary
-		multipartReader := multipart.NewReader(resp.Body, params["boundary"])
-		for {
+	return revision, nil
 
-			p, err := multipartReader.NextPart()
+}
 
-			if err == io.EOF {
-				return nil, "", err
-			}
+//documentValue returns the value of a document read by readDocAttachments, which is the valueBytes
+//attachment for a document stored as binary data
+func documentValue(jsonDoc []byte, attachments []Attachment, revision string, err error) ([]byte, string, error) {
+	if err != nil || attachments == nil {
+		return jsonDoc, revision, err
+	}
 
-			if err != nil {
-				return nil, "", err
-			}
+	//the document was stored as binary data, return the valueBytes attachment
+	for _, attachment := range attachments {
+		if attachment.Name == "valueBytes" {
+			return attachment.AttachmentBytes, revision, nil
+		}
+	}
 
-			logger.Debugf("part header=%s", p.Header)
+	return nil, "", io.EOF
+
+}
+
+//ReadDocAttachments method provides function to retrieve a document along with all of its attachments from
+//the database by id.  The latest revision is retrieved if rev is empty.  For a document without attachments
+//the returned attachments are nil.  A non-existent document results in a nil document and nil attachments
+func (dbclient *CouchDatabase) ReadDocAttachments(id string, rev string) ([]byte, []Attachment, string, error) {
+	return dbclient.readDocAttachments(id, rev, 0)
+}
+
+//readDocAttachments reads a document along with all of its attachments, see ReadDocAttachments, from quorum
+//replicas if quorum is greater than 0
+func (dbclient *CouchDatabase) readDocAttachments(id string, rev string, quorum int) ([]byte, []Attachment, string, error) {
+
+	logger.Debugf("Entering ReadDoc()  id=%s rev=%s", id, rev)
+
+	readURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, nil, "", err
+	}
+	readURL.Path = dbclient.dbName + "/" + id
+
+	query := readURL.Query()
+	query.Add("attachments", "true")
+	if rev != "" {
+		query.Add("rev", rev)
+	}
+	if quorum > 0 {
+		query.Add("r", strconv.Itoa(quorum))
+	}
+
+	readURL.RawQuery = query.Encode()
+
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodGet, readURL.String(), nil, "", "")
+	if err != nil {
+		fmt.Printf("couchDBReturn=%v", couchDBReturn)
+		if couchDBReturn != nil && couchDBReturn.StatusCode == 404 && !isDatabaseNotFound(couchDBReturn) {
+			logger.Debug("Document not found (404), returning nil value instead of 404 error")
+			// non-existent document should return nil value instead of a 404 error
+			// for details see https://github.com/hyperledger-archives/fabric/issues/936
+			return nil, nil, "", nil
+		}
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+
+	//Get the media type from the Content-Type header
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Get the revision from header
+	revision, err := getRevisionHeader(resp)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	//check to see if the is multipart,  handle as attachment if multipart is detected
+	if strings.HasPrefix(mediaType, "multipart/") {
+
+		var jsonDoc []byte
+		attachments := []Attachment{}
+
+		//Set up the multipart reader based on the boundary
+		multipartReader := multipart.NewReader(resp.Body, params["boundary"])
+		for {
+
+			p, err := multipartReader.NextPart()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, nil, "", err
+			}
+
+			logger.Debugf("part header=%s", p.Header)
+
+			var partdata []byte
 
 			//See if the part is gzip encoded
 			switch p.Header.Get("Content-Encoding") {
 			case "gzip":
 
-				var respBody []byte
+				gr, err := gzip.NewReader(p)
+				if err != nil {
+					return nil, nil, "", err
+				}
+				partdata, err = ioutil.ReadAll(gr)
+				if err != nil {
+					return nil, nil, "", err
+				}
+
+			default:
+
+				//retrieve the data,  this is not gzip
+				partdata, err = ioutil.ReadAll(p)
+				if err != nil {
+					return nil, nil, "", err
+				}
+
+			}
+
+			//the part without a file name is the JSON document itself
+			if p.FileName() == "" {
+				jsonDoc = partdata
+				continue
+			}
+
+			logger.Debugf("Retrieved attachment data")
+
+			attachments = append(attachments, Attachment{
+				Name:            p.FileName(),
+				ContentType:     p.Header.Get("Content-Type"),
+				Length:          uint64(len(partdata)),
+				AttachmentBytes: partdata})
+
+		}
+
+		logger.Debugf("Exiting ReadDoc()")
+
+		return jsonDoc, attachments, revision, nil
+
+	}
+
+	//handle as JSON document
+	jsonDoc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	logger.Debugf("Read document, id=%s, value=%s", id, string(jsonDoc))
+
+	logger.Debugf("Exiting ReadDoc()")
+
+	return jsonDoc, nil, revision, nil
+
+}
+
+//AttachmentStub describes an attachment of a document read without the data of its attachments.  The digest
+//changes whenever the data of the attachment does
+type AttachmentStub struct {
+	ContentType string `json:"content_type"`
+	Digest      string `json:"digest"`
+	Length      uint64 `json:"length"`
+}
+
+//ReadDocStubs method provides function to retrieve the latest revision of a document by id without the data of
+//its attachments, which are described by their stubs keyed by attachment name.  The stubs are nil for a document
+//without attachments.  A non-existent document results in a nil document
+func (dbclient *CouchDatabase) ReadDocStubs(id string) ([]byte, map[string]AttachmentStub, string, error) {
+
+	logger.Debugf("Entering ReadDocStubs()  id=%s", id)
+
+	readURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, nil, "", err
+	}
+	readURL.Path = dbclient.dbName + "/" + id
+
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodGet, readURL.String(), nil, "", "")
+	if err != nil {
+		if couchDBReturn != nil && couchDBReturn.StatusCode == 404 && !isDatabaseNotFound(couchDBReturn) {
+			logger.Debug("Document not found (404), returning nil value instead of 404 error")
+			return nil, nil, "", nil
+		}
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+
+	revision, err := getRevisionHeader(resp)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	jsonDoc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	stubs := &struct {
+		Attachments map[string]AttachmentStub `json:"_attachments"`
+	}{}
+	if err := json.Unmarshal(jsonDoc, stubs); err != nil {
+		return nil, nil, "", err
+	}
+
+	logger.Debugf("Exiting ReadDocStubs()  attachments=%d", len(stubs.Attachments))
+
+	return jsonDoc, stubs.Attachments, revision, nil
+
+}
+
+//ReadAttachment method provides function to retrieve the named attachment of the given revision of a document,
+//or of the latest revision if rev is empty.  A non-existent attachment or revision results in a nil attachment
+func (dbclient *CouchDatabase) ReadAttachment(id string, name string, rev string) (*Attachment, error) {
+
+	logger.Debugf("Entering ReadAttachment()  id=%s name=%s rev=%s", id, name, rev)
+
+	readURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	readURL.Path = dbclient.dbName + "/" + id + "/" + name
+
+	if rev != "" {
+		query := readURL.Query()
+		query.Add("rev", rev)
+		readURL.RawQuery = query.Encode()
+	}
+
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodGet, readURL.String(), nil, "", "")
+	if err != nil {
+		if couchDBReturn != nil && couchDBReturn.StatusCode == 404 && !isDatabaseNotFound(couchDBReturn) {
+			logger.Debug("Attachment not found (404), returning nil attachment instead of 404 error")
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	attachmentBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Exiting ReadAttachment()  length=%d", len(attachmentBytes))
+
+	return &Attachment{
+		Name:            name,
+		ContentType:     resp.Header.Get("Content-Type"),
+		Length:          uint64(len(attachmentBytes)),
+		AttachmentBytes: attachmentBytes}, nil
+
+}
+
+//DocRevRequest identifies a revision of a document to read with BulkGet, an empty Rev requests the
+//latest revision
+type DocRevRequest struct {
+	ID  string
+	Rev string
+}
+
+//DocRevResult is the revision of a document read by BulkGet, or the error reading it.  Error holds
+//the CouchDB error, e.g. not_found for a document or revision that does not exist
+type DocRevResult struct {
+	ID          string
+	Rev         string
+	JSONDoc     []byte
+	Attachments []Attachment
+	Error       string
+	Reason      string
+}
+
+//bulkGetResponse is the response of a _bulk_get request
+type bulkGetResponse struct {
+	Results []struct {
+		ID   string `json:"id"`
+		Docs []struct {
+			OK    json.RawMessage `json:"ok"`
+			Error *struct {
+				Rev    string `json:"rev"`
+				Error  string `json:"error"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"docs"`
+	} `json:"results"`
+}
+
+//BulkGet method provides function to read the requested revisions of documents in a single call to
+//the _bulk_get endpoint.  The results are returned in the order of the requests, and the failure to
+//read a revision is reported in its result rather than failing the whole call.  If the limits of the server
+//are known, the requests are read in chunks within its max_http_request_size.  If the request is still too
+//large for CouchDB, the requests are split in two halves that are read in turn, recursively
+func (dbclient *CouchDatabase) BulkGet(requests []DocRevRequest) ([]DocRevResult, error) {
+
+	if chunks := dbclient.chunkBulkGetRequests(requests); len(chunks) > 1 {
+		logger.Debugf("_bulk_get of %d documents is read in %d chunks within the server limits", len(requests), len(chunks))
+		results := make([]DocRevResult, 0, len(requests))
+		for _, chunk := range chunks {
+			chunkResults, err := dbclient.BulkGet(chunk)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, chunkResults...)
+		}
+		return results, nil
+	}
+
+	results, err := dbclient.bulkGet(requests)
+	if _, tooLarge := err.(*ErrRequestTooLarge); !tooLarge || len(requests) < 2 {
+		return results, err
+	}
+
+	logger.Warningf("_bulk_get of %d documents is too large for CouchDB, retrying in two halves", len(requests))
+	half := len(requests) / 2
+	results, err = dbclient.BulkGet(requests[:half])
+	if err != nil {
+		return nil, err
+	}
+	secondResults, err := dbclient.BulkGet(requests[half:])
+	if err != nil {
+		return nil, err
+	}
+	return append(results, secondResults...), nil
+
+}
+
+//bulkGetOverhead is the size of the body of a _bulk_get request besides the requested documents
+const bulkGetOverhead = len(`{"docs":[]}`)
+
+//chunkBulkGetRequests splits the requests of a bulk read in chunks whose _bulk_get request body is within the
+//max_http_request_size of the server.  The requests are returned as a single chunk if the limit is unknown
+func (dbclient *CouchDatabase) chunkBulkGetRequests(requests []DocRevRequest) [][]DocRevRequest {
+	limits := dbclient.couchInstance.knownServerLimits()
+	if limits == nil || limits.MaxHTTPRequestSize <= 0 {
+		return [][]DocRevRequest{requests}
+	}
+	var chunks [][]DocRevRequest
+	start := 0
+	size := int64(bulkGetOverhead)
+	for i, request := range requests {
+		docJSON, _ := json.Marshal(bulkGetDoc(request))
+		//the documents are separated by a comma
+		docSize := int64(len(docJSON) + 1)
+		if i > start && size+docSize > limits.MaxHTTPRequestSize {
+			chunks = append(chunks, requests[start:i])
+			start = i
+			size = int64(bulkGetOverhead)
+		}
+		size += docSize
+	}
+	return append(chunks, requests[start:])
+}
+
+//bulkGetDoc returns the document of a _bulk_get request body identifying the requested revision
+func bulkGetDoc(request DocRevRequest) map[string]string {
+	doc := map[string]string{"id": request.ID}
+	if request.Rev != "" {
+		doc["rev"] = request.Rev
+	}
+	return doc
+}
+
+func (dbclient *CouchDatabase) bulkGet(requests []DocRevRequest) ([]DocRevResult, error) {
+
+	logger.Debugf("Entering BulkGet()  requests=%d", len(requests))
+
+	bulkGetURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	bulkGetURL.Path = dbclient.dbName + "/_bulk_get"
+	queryParms := bulkGetURL.Query()
+	queryParms.Set("attachments", "true")
+	bulkGetURL.RawQuery = queryParms.Encode()
+
+	docs := []map[string]string{}
+	for _, request := range requests {
+		docs = append(docs, bulkGetDoc(request))
+	}
+	requestJSON, err := json.Marshal(map[string]interface{}{"docs": docs})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodPost, bulkGetURL.String(), bytes.NewReader(requestJSON), "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonResponse := &bulkGetResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+	if len(jsonResponse.Results) != len(requests) {
+		return nil, fmt.Errorf("Expected %d results from _bulk_get, got %d", len(requests), len(jsonResponse.Results))
+	}
+
+	results := make([]DocRevResult, len(requests))
+	for i, result := range jsonResponse.Results {
+		results[i] = DocRevResult{ID: result.ID, Rev: requests[i].Rev}
+		if len(result.Docs) == 0 {
+			results[i].Error = "not_found"
+			continue
+		}
+		doc := result.Docs[0]
+		if doc.Error != nil {
+			results[i].Error = doc.Error.Error
+			results[i].Reason = doc.Error.Reason
+			continue
+		}
+		if err := decodeBulkGetDoc(doc.OK, &results[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Debugf("Exiting BulkGet()")
+
+	return results, nil
+
+}
+
+//decodeBulkGetDoc sets the revision, the JSON document and the attachments, which _bulk_get returns
+//inline and base64 encoded, of the result
+func decodeBulkGetDoc(jsonDoc json.RawMessage, result *DocRevResult) error {
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(jsonDoc, &fields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields["_rev"], &result.Rev); err != nil {
+		return err
+	}
+
+	inlineAttachments, ok := fields["_attachments"]
+	if !ok {
+		result.JSONDoc = jsonDoc
+		return nil
+	}
+
+	attachments := map[string]struct {
+		ContentType string `json:"content_type"`
+		Data        []byte `json:"data"`
+	}{}
+	if err := json.Unmarshal(inlineAttachments, &attachments); err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attachment := attachments[name]
+		result.Attachments = append(result.Attachments, Attachment{
+			Name:            name,
+			ContentType:     attachment.ContentType,
+			Length:          uint64(len(attachment.Data)),
+			AttachmentBytes: attachment.Data})
+	}
+
+	delete(fields, "_attachments")
+	var err error
+	result.JSONDoc, err = json.Marshal(fields)
+	return err
+
+}
+
+//bulkDocsResult is the result of the write of a document in the response of a _bulk_docs request
+type bulkDocsResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+//BulkSaveRevisions method provides function to write the given revisions of documents, such as those read by
+//BulkGet, in a single call to the _bulk_docs endpoint.  The revisions are written as they are, rather than as new
+//revisions, as done by the replication, so that writing a revision that the database already has is a no-op.
+//The attachments of the revisions are written inline.  The failure to write any revision fails the call
+func (dbclient *CouchDatabase) BulkSaveRevisions(docs []DocRevResult) error {
+
+	logger.Debugf("Entering BulkSaveRevisions()  docs=%d", len(docs))
+
+	//without new edits, CouchDB only returns the results of the failed writes
+	results, err := dbclient.bulkDocs(docs, false)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			return fmt.Errorf("Couch DB Error: failed to save document %s: %s %s", result.ID, result.Error, result.Reason)
+		}
+	}
+
+	logger.Debugf("Exiting BulkSaveRevisions()")
+
+	return nil
+
+}
+
+//BulkSaveDocs method provides function to write new revisions of documents in a single call to the _bulk_docs
+//endpoint, as SaveDoc writes a single document.  Each document is written on top of its revision given as Rev,
+//which is empty for a document that does not exist, and its attachments are written inline.  The revisions
+//written are returned in the order of the documents.  The failure to write any document fails the call, although
+//the other documents of the call may have been written
+func (dbclient *CouchDatabase) BulkSaveDocs(docs []DocRevResult) ([]string, error) {
+
+	logger.Debugf("Entering BulkSaveDocs()  docs=%d", len(docs))
+
+	//with new edits, CouchDB returns the result of each write in the order of the documents
+	results, err := dbclient.bulkDocs(docs, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(docs) {
+		return nil, fmt.Errorf("Couch DB Error: %d results returned for the write of %d documents", len(results), len(docs))
+	}
+	revs := make([]string, len(results))
+	for i, result := range results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("Couch DB Error: failed to save document %s: %s %s", result.ID, result.Error, result.Reason)
+		}
+		if result.Rev == "" {
+			return nil, fmt.Errorf("Couch DB Error: no revision returned for the save of document %s", result.ID)
+		}
+		revs[i] = result.Rev
+	}
+
+	logger.Debugf("Exiting BulkSaveDocs()")
+
+	return revs, nil
+
+}
+
+//BulkDeleteDocs method provides function to delete documents in a single call to the _bulk_docs endpoint.  Each
+//document is deleted if it is still at the given revision, and is left as is if it was updated or deleted since,
+//which is not a failure.  The ids of the documents deleted are returned.  The failure to delete any other document
+//fails the call
+func (dbclient *CouchDatabase) BulkDeleteDocs(revs []DocRevRequest) ([]string, error) {
+
+	logger.Debugf("Entering BulkDeleteDocs()  docs=%d", len(revs))
+
+	docs := make([]DocRevResult, len(revs))
+	for i, rev := range revs {
+		docs[i] = DocRevResult{ID: rev.ID, Rev: rev.Rev, JSONDoc: []byte(`{"_deleted":true}`)}
+	}
+	results, err := dbclient.bulkDocs(docs, true)
+	if err != nil {
+		return nil, err
+	}
+	deleted := []string{}
+	for _, result := range results {
+		switch result.Error {
+		case "":
+			deleted = append(deleted, result.ID)
+		case "conflict":
+			logger.Debugf("Document %s changed since it was read, not deleted", result.ID)
+		default:
+			return nil, fmt.Errorf("Couch DB Error: failed to delete document %s: %s %s", result.ID, result.Error, result.Reason)
+		}
+	}
+
+	logger.Debugf("Exiting BulkDeleteDocs()  deleted=%d", len(deleted))
+
+	return deleted, nil
+
+}
+
+//bulkDocs writes the documents in a single call to the _bulk_docs endpoint, as new revisions if newEdits is set,
+//and returns the results of the writes listed by the response
+func (dbclient *CouchDatabase) bulkDocs(docs []DocRevResult, newEdits bool) ([]bulkDocsResult, error) {
+
+	bulkDocsURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	bulkDocsURL.Path = dbclient.dbName + "/_bulk_docs"
+
+	jsonDocs := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		jsonDoc := map[string]interface{}{}
+		if err := json.Unmarshal(doc.JSONDoc, &jsonDoc); err != nil {
+			return nil, err
+		}
+		jsonDoc["_id"] = doc.ID
+		if doc.Rev != "" {
+			jsonDoc["_rev"] = doc.Rev
+		}
+		if len(doc.Attachments) > 0 {
+			attachments := map[string]interface{}{}
+			for _, attachment := range doc.Attachments {
+				attachments[attachment.Name] = map[string]interface{}{
+					"content_type": attachment.ContentType, "data": attachment.AttachmentBytes}
+			}
+			jsonDoc["_attachments"] = attachments
+		}
+		jsonDocs[i] = jsonDoc
+	}
+	requestJSON, err := json.Marshal(map[string]interface{}{"docs": jsonDocs, "new_edits": newEdits})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodPost, bulkDocsURL.String(), bytes.NewReader(requestJSON), "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	results := []bulkDocsResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+
+}
+
+//ReadDocRange method provides function to a range of documents based on the start and end keys
+//startKey and endKey can also be empty strings.  If startKey and endKey are empty, all documents are returned
+//TODO This function provides a limit option to specify the max number of entries.   This will
+//need to be added to configuration options.  Skip will not be used by Fabric since a consistent
+//result set is required
+func (dbclient *CouchDatabase) ReadDocRange(startKey, endKey string, limit, skip int) (*[]QueryResult, error) {
+
+	results, err := dbclient.ReadDocRangePartial(startKey, endKey, limit, skip)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+
+}
+
+//ReadDocRangePartial is like ReadDocRange, but if a document of the range fails to be read or decoded, the
+//documents read before it are returned along with the error.  If the range itself fails to be read, the
+//returned results are nil
+func (dbclient *CouchDatabase) ReadDocRangePartial(startKey, endKey string, limit, skip int) (*[]QueryResult, error) {
+
+	logger.Debugf("Entering ReadDocRange()  startKey=%s, endKey=%s", startKey, endKey)
+
+	var results []QueryResult
+
+	rangeURL, err := dbclient.constructRangeURL(startKey, endKey, limit, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if logger.IsEnabledFor(logging.DEBUG) {
+		dump, err2 := httputil.DumpResponse(resp, true)
+		if err2 != nil {
+			log.Fatal(err2)
+		}
+		logger.Debugf("%s", dump)
+	}
+
+	//handle as JSON document
+	jsonResponseRaw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonResponse = &RangeQueryResponse{}
+	err2 := json.Unmarshal(jsonResponseRaw, &jsonResponse)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	logger.Debugf("Total Rows: %d", jsonResponse.TotalRows)
+
+	for _, row := range jsonResponse.Rows {
+
+		var jsonDoc = &Doc{}
+		err3 := json.Unmarshal(row.Doc, &jsonDoc)
+		if err3 != nil {
+			return &results, err3
+		}
+
+		if jsonDoc.Attachments != nil {
+
+			logger.Debugf("Adding binary docment for id: %s", jsonDoc.ID)
+
+			binaryDocument, _, err := dbclient.ReadDoc(jsonDoc.ID)
+			if err != nil {
+				return &results, err
+			}
+
+			var addDocument = &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), binaryDocument}
+
+			results = append(results, *addDocument)
+
+		} else {
+
+			logger.Debugf("Adding json docment for id: %s", jsonDoc.ID)
+
+			var addDocument = &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), row.Doc}
+
+			results = append(results, *addDocument)
+
+		}
+
+	}
+
+	logger.Debugf("Exiting ReadDocRange()")
+
+	return &results, nil
+
+}
+
+//constructRangeURL returns the _all_docs URL retrieving the documents of the range, with an exclusive end key.
+//The limit is omitted if it is not positive
+func (dbclient *CouchDatabase) constructRangeURL(startKey, endKey string, limit, skip int) (string, error) {
+	rangeURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return "", err
+	}
+	rangeURL.Path = dbclient.dbName + "/_all_docs"
+
+	queryParms := rangeURL.Query()
+	if limit > 0 {
+		queryParms.Set("limit", strconv.Itoa(limit))
+	}
+	queryParms.Add("skip", strconv.Itoa(skip))
+	queryParms.Add("include_docs", "true")
+	queryParms.Add("inclusive_end", "false") // endkey should be exclusive to be consistent with goleveldb
+
+	addRangeKeys(queryParms, startKey, endKey)
+
+	rangeURL.RawQuery = queryParms.Encode()
+	return rangeURL.String(), nil
+}
+
+//RangeQueryStream iterates over the results of a range query, decoding each row from the response
+//body as it is requested instead of reading the whole response in memory. Close must be called to
+//release the response body
+type RangeQueryStream struct {
+	dbclient *CouchDatabase
+	body     io.ReadCloser
+	decoder  *json.Decoder
+}
+
+//rangeQueryRow is a row of a range query response
+type rangeQueryRow struct {
+	ID  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+//StreamDocRange method provides function to iterate over a range of documents based on the start and
+//end keys provided, like ReadDocRange, without reading the whole range in memory.  The end key is
+//exclusive, and all the documents of the range are returned if limit is not positive
+func (dbclient *CouchDatabase) StreamDocRange(startKey, endKey string, limit, skip int) (*RangeQueryStream, error) {
+
+	logger.Debugf("Entering StreamDocRange()  startKey=%s, endKey=%s", startKey, endKey)
+
+	rangeURL, err := dbclient.constructRangeURL(startKey, endKey, limit, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	//position the decoder at the first row, the rows follow the total_rows and offset fields
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if token == "rows" {
+			break
+		}
+	}
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected range query response, rows is not an array")
+	}
+
+	logger.Debugf("Exiting StreamDocRange()")
+
+	return &RangeQueryStream{dbclient, resp.Body, decoder}, nil
+
+}
+
+//Next returns the next document of the range, or nil once all the documents are returned
+func (stream *RangeQueryStream) Next() (*QueryResult, error) {
+
+	if !stream.decoder.More() {
+		return nil, nil
+	}
+
+	row := &rangeQueryRow{}
+	if err := stream.decoder.Decode(row); err != nil {
+		return nil, err
+	}
+
+	var jsonDoc = &Doc{}
+	if err := json.Unmarshal(row.Doc, &jsonDoc); err != nil {
+		return nil, err
+	}
+
+	if jsonDoc.Attachments != nil {
+
+		logger.Debugf("Adding binary docment for id: %s", jsonDoc.ID)
+
+		binaryDocument, _, err := stream.dbclient.ReadDoc(jsonDoc.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), binaryDocument}, nil
+
+	}
+
+	logger.Debugf("Adding json docment for id: %s", jsonDoc.ID)
+
+	return &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), row.Doc}, nil
+
+}
+
+//Close releases the response body of the range query
+func (stream *RangeQueryStream) Close() error {
+	return stream.body.Close()
+}
+
+//DocAttachmentStubs is a document of a range read by ReadAttachmentStubRange, with the content types of its
+//attachments by attachment name.  ContentTypes is empty for a document without attachments
+type DocAttachmentStubs struct {
+	ID           string
+	ContentTypes map[string]string
+}
+
+//ReadAttachmentStubRange method provides function to retrieve a range of documents based on the start and end
+//keys provided, like ReadDocRange, along with the content types of their attachments but without the data of
+//the attachments, which is not read.  The end key is exclusive
+func (dbclient *CouchDatabase) ReadAttachmentStubRange(startKey, endKey string, limit int) ([]DocAttachmentStubs, error) {
+
+	logger.Debugf("Entering ReadAttachmentStubRange()  startKey=%s, endKey=%s", startKey, endKey)
+
+	rangeURL, err := dbclient.constructRangeURL(startKey, endKey, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonResponse := &struct {
+		Rows []struct {
+			ID  string `json:"id"`
+			Doc struct {
+				Attachments map[string]struct {
+					ContentType string `json:"content_type"`
+				} `json:"_attachments"`
+			} `json:"doc"`
+		} `json:"rows"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+
+	docs := make([]DocAttachmentStubs, len(jsonResponse.Rows))
+	for i, row := range jsonResponse.Rows {
+		docs[i] = DocAttachmentStubs{ID: row.ID, ContentTypes: make(map[string]string, len(row.Doc.Attachments))}
+		for name, attachment := range row.Doc.Attachments {
+			docs[i].ContentTypes[name] = attachment.ContentType
+		}
+	}
+
+	logger.Debugf("Exiting ReadAttachmentStubRange()  docs=%d", len(docs))
+
+	return docs, nil
+
+}
+
+//ReadDocStubRange method provides function to retrieve a range of documents based on the start and end keys
+//provided, like ReadDocRange, but the documents with attachments are returned as read by the range, with the
+//stubs of their attachments rather than their data, which is not read.  The end key is exclusive
+func (dbclient *CouchDatabase) ReadDocStubRange(startKey, endKey string, limit int) ([]QueryResult, error) {
+
+	logger.Debugf("Entering ReadDocStubRange()  startKey=%s, endKey=%s", startKey, endKey)
+
+	rangeURL, err := dbclient.constructRangeURL(startKey, endKey, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonResponse := &struct {
+		Rows []rangeQueryRow `json:"rows"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+
+	results := make([]QueryResult, len(jsonResponse.Rows))
+	for i, row := range jsonResponse.Rows {
+		results[i] = QueryResult{row.ID, version.NewHeight(1, 1), row.Doc}
+	}
+
+	logger.Debugf("Exiting ReadDocStubRange()  docs=%d", len(results))
+
+	return results, nil
+
+}
+
+//DocField is a document of a range read by ReadDocFieldRange, with its revision and the JSON of a field of the
+//document.  Value is nil for a document without the field
+type DocField struct {
+	ID    string
+	Rev   string
+	Value json.RawMessage
+}
+
+//ReadDocFieldRange method provides function to retrieve the revisions of a range of documents based on the start
+//and end keys provided, like ReadDocRevisionRange, along with the value of the given top-level field of each
+//document.  The data of the attachments is not read.  The end key is exclusive
+func (dbclient *CouchDatabase) ReadDocFieldRange(startKey, endKey string, field string, limit int) ([]DocField, error) {
+
+	logger.Debugf("Entering ReadDocFieldRange()  startKey=%s, endKey=%s, field=%s", startKey, endKey, field)
+
+	rangeURL, err := dbclient.constructRangeURL(startKey, endKey, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonResponse := &struct {
+		Rows []struct {
+			ID  string                     `json:"id"`
+			Doc map[string]json.RawMessage `json:"doc"`
+		} `json:"rows"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+
+	docs := make([]DocField, len(jsonResponse.Rows))
+	for i, row := range jsonResponse.Rows {
+		docs[i] = DocField{ID: row.ID, Value: row.Doc[field]}
+		if err := json.Unmarshal(row.Doc["_rev"], &docs[i].Rev); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Debugf("Exiting ReadDocFieldRange()  docs=%d", len(docs))
+
+	return docs, nil
+
+}
+
+//ReadDocIDRange method provides function to retrieve a range of document ids, without the documents,
+//based on the start and end keys provided.  The end key is exclusive
+func (dbclient *CouchDatabase) ReadDocIDRange(startKey, endKey string, limit, skip int) ([]string, error) {
+
+	logger.Debugf("Entering ReadDocIDRange()  startKey=%s, endKey=%s", startKey, endKey)
+
+	rangeURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	rangeURL.Path = dbclient.dbName + "/_all_docs"
+
+	queryParms := rangeURL.Query()
+	queryParms.Set("limit", strconv.Itoa(limit))
+	queryParms.Add("skip", strconv.Itoa(skip))
+	queryParms.Add("inclusive_end", "false") // endkey should be exclusive to be consistent with goleveldb
+
+	addRangeKeys(queryParms, startKey, endKey)
+
+	rangeURL.RawQuery = queryParms.Encode()
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL.String(), nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonResponseRaw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonResponse = &RangeQueryResponse{}
+	err = json.Unmarshal(jsonResponseRaw, &jsonResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, row := range jsonResponse.Rows {
+		ids = append(ids, row.ID)
+	}
+
+	logger.Debugf("Exiting ReadDocIDRange()")
+
+	return ids, nil
+
+}
+
+//revisionRangeResponse is the response of an _all_docs request listing the revisions of a range of documents
+type revisionRangeResponse struct {
+	Rows []struct {
+		ID    string `json:"id"`
+		Value struct {
+			Rev string `json:"rev"`
+		} `json:"value"`
+	} `json:"rows"`
+	UpdateSeq json.RawMessage `json:"update_seq"`
+}
+
+//ReadDocRevisionRange method provides function to retrieve the ids and the current revisions of up to limit
+//documents of a range, or all of them if limit is 0 or less, without the documents, along with the update
+//sequence of the database that the revisions were read at.  The range is read in a single request, so that the
+//revisions are those of a single update sequence of the database.  The end key is exclusive
+func (dbclient *CouchDatabase) ReadDocRevisionRange(startKey, endKey string, limit int) ([]DocRevRequest, string, error) {
+
+	logger.Debugf("Entering ReadDocRevisionRange()  startKey=%s, endKey=%s", startKey, endKey)
+
+	rangeURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, "", err
+	}
+	rangeURL.Path = dbclient.dbName + "/_all_docs"
+
+	queryParms := rangeURL.Query()
+	queryParms.Set("inclusive_end", "false") // endkey should be exclusive to be consistent with goleveldb
+	queryParms.Set("update_seq", "true")
+	if limit > 0 {
+		queryParms.Set("limit", strconv.Itoa(limit))
+	}
+
+	addRangeKeys(queryParms, startKey, endKey)
+
+	rangeURL.RawQuery = queryParms.Encode()
+
+	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL.String(), nil, "", "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	jsonResponse := &revisionRangeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, "", err
+	}
+
+	updateSeq := decodeUpdateSeq(jsonResponse.UpdateSeq)
+	revs := make([]DocRevRequest, len(jsonResponse.Rows))
+	for i, row := range jsonResponse.Rows {
+		revs[i] = DocRevRequest{ID: row.ID, Rev: row.Value.Rev}
+	}
+
+	logger.Debugf("Exiting ReadDocRevisionRange()  revisions=%d, updateSeq=%s", len(revs), updateSeq)
+
+	return revs, updateSeq, nil
+
+}
+
+//ReadDocRevisions method provides function to retrieve the current revisions of the documents with the given ids,
+//without the documents, in a single call to the _all_docs endpoint.  The revisions are returned by document id,
+//the documents that do not exist or are deleted are not listed
+func (dbclient *CouchDatabase) ReadDocRevisions(ids []string) (map[string]string, error) {
+
+	logger.Debugf("Entering ReadDocRevisions()  ids=%d", len(ids))
+
+	allDocsURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	allDocsURL.Path = dbclient.dbName + "/_all_docs"
+
+	requestJSON, err := json.Marshal(map[string]interface{}{"keys": ids})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := dbclient.handleRequest(http.MethodPost, allDocsURL.String(), bytes.NewReader(requestJSON), "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	//the ids that do not exist are listed with a not_found error, and the deleted documents as deleted
+	jsonResponse := &struct {
+		Rows []struct {
+			ID    string `json:"id"`
+			Error string `json:"error"`
+			Value struct {
+				Rev     string `json:"rev"`
+				Deleted bool   `json:"deleted"`
+			} `json:"value"`
+		} `json:"rows"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+
+	revs := make(map[string]string)
+	for _, row := range jsonResponse.Rows {
+		if row.Error != "" || row.Value.Deleted {
+			continue
+		}
+		revs[row.ID] = row.Value.Rev
+	}
+
+	logger.Debugf("Exiting ReadDocRevisions()  revisions=%d", len(revs))
+
+	return revs, nil
+
+}
+
+//decodeUpdateSeq returns an update sequence as a string.  The sequences are numbers in CouchDB 1.x, and opaque
+//strings from CouchDB 2.0
+func decodeUpdateSeq(rawSeq json.RawMessage) string {
+	var seq string
+	if err := json.Unmarshal(rawSeq, &seq); err == nil {
+		return seq
+	}
+	return string(rawSeq)
+}
+
+//addRangeKeys adds the start and end keys of a range request to the query parameters, if provided
+func addRangeKeys(queryParms url.Values, startKey, endKey string) {
+
+	//The keys are JSON strings, in which the control characters, such as the 0x00 separator of the state
+	//composite keys, are escaped as \u sequences
+
+	//Append the startKey if provided
+	if startKey != "" {
+		startKeyJSON, _ := json.Marshal(startKey)
+		queryParms.Add("startkey", string(startKeyJSON))
+	}
+
+	//Append the endKey if provided
+	if endKey != "" {
+		endKeyJSON, _ := json.Marshal(endKey)
+		queryParms.Add("endkey", string(endKeyJSON))
+	}
+
+}
+
+//QueryDocuments method provides function for processing a query
+func (dbclient *CouchDatabase) QueryDocuments(query string, limit, skip int) (*[]QueryResult, error) {
+	results, _, err := dbclient.QueryDocumentsWithWarning(query, limit, skip)
+	return results, err
+}
+
+//QueryDocumentsWithWarning method provides function for processing a query like QueryDocuments, along with
+//the warning CouchDB returns with the results, e.g. that no index matches the query, or "" if none
+func (dbclient *CouchDatabase) QueryDocumentsWithWarning(query string, limit, skip int) (*[]QueryResult, string, error) {
+
+	logger.Debugf("Entering QueryDocuments()  query=%s", query)
+
+	var results []QueryResult
+
+	queryURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, "", err
+	}
+
+	queryURL.Path = dbclient.dbName + "/_find"
+
+	queryParms := queryURL.Query()
+	queryParms.Set("limit", strconv.Itoa(limit))
+	queryParms.Add("skip", strconv.Itoa(skip))
+
+	queryURL.RawQuery = queryParms.Encode()
+
+	//Set up a buffer for the data to be pushed to couchdb
+	data := new(bytes.Buffer)
+
+	data.ReadFrom(bytes.NewReader([]byte(query)))
+
+	resp, _, err := dbclient.handleRequest(http.MethodPost, queryURL.String(), data, "", "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if logger.IsEnabledFor(logging.DEBUG) {
+		dump, err2 := httputil.DumpResponse(resp, true)
+		if err2 != nil {
+			log.Fatal(err2)
+		}
+		logger.Debugf("%s", dump)
+	}
+
+	//handle as JSON document
+	jsonResponseRaw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
 
-				gr, err := gzip.NewReader(p)
-				if err != nil {
-					return nil, "", err
-				}
-				respBody, err = ioutil.ReadAll(gr)
-				if err != nil {
-					return nil, "", err
-				}
+	var jsonResponse = &QueryResponse{}
 
-				logger.Debugf("Retrieved attachment data")
+	err2 := json.Unmarshal(jsonResponseRaw, &jsonResponse)
+	if err2 != nil {
+		return nil, "", err2
+	}
 
-				if p.Header.Get("Content-Disposition") == "attachment; filename=\"valueBytes\"" {
+	for _, row := range jsonResponse.Docs {
 
-					return respBody, revision, nil
+		//a row without an _id, e.g. projected away by the fields of the query, or that is not a
+		//document, is returned with an empty ID
+		var jsonDoc = &DocID{}
+		err3 := json.Unmarshal(row, jsonDoc)
+		if _, isTypeError := err3.(*json.UnmarshalTypeError); err3 != nil && !isTypeError {
+			return nil, "", err3
+		}
 
-				}
+		logger.Debugf("Adding row to resultset: %s", row)
 
-			default:
+		//TODO Replace the temporary NewHeight version when available
+		var addDocument = &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), row}
 
-				//retrieve the data,  this is not gzip
-				partdata, err := ioutil.ReadAll(p)
-				if err != nil {
-					return nil, "", err
-				}
-				logger.Debugf("Retrieved attachment data")
+		results = append(results, *addDocument)
+
+	}
 
-				if p.Header.Get("Content-Disposition") == "attachment; filename=\"valueBytes\"" {
+	logger.Debugf("Exiting QueryDocuments()")
 
-					return partdata, revision, nil
+	return &results, jsonResponse.Warning, nil
 
-				}
+}
 
-			}
+//ExplainQuery method provides function for retrieving the query plan CouchDB would use for a query,
+//including the index chosen.  A query that can not use an index reports the special _all_docs index
+func (dbclient *CouchDatabase) ExplainQuery(query string) (string, error) {
 
-		}
+	logger.Debugf("Entering ExplainQuery()  query=%s", query)
 
-	} else {
+	explainURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return "", err
+	}
 
-		//handle as JSON document
-		jsonDoc, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, "", err
-		}
+	explainURL.Path = dbclient.dbName + "/_explain"
 
-		logger.Debugf("Read document, id=%s, value=%s", id, string(jsonDoc))
+	//Set up a buffer for the data to be pushed to couchdb
+	data := new(bytes.Buffer)
 
-		logger.Debugf("Exiting ReadDoc()")
+	data.ReadFrom(bytes.NewReader([]byte(query)))
 
-		return jsonDoc, revision, nil
+	resp, _, err := dbclient.handleRequest(http.MethodPost, explainURL.String(), data, "", "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
+	jsonResponseRaw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
 
+	logger.Debugf("Exiting ExplainQuery()")
+
+	return string(jsonResponseRaw), nil
+
 }
 
-//ReadDocRange method provides function to a range of documents based on the start and end keys
-//startKey and endKey can also be empty strings.  If startKey and endKey are empty, all documents are returned
-//TODO This function provides a limit option to specify the max number of entries.   This will
-//need to be added to configuration options.  Skip will not be used by Fabric since a consistent
-//result set is required
-func (dbclient *CouchDatabase) ReadDocRange(startKey, endKey string, limit, skip int) (*[]QueryResult, error) {
+//ChangesOptions are the parameters of a request to the changes feed of a database.  Since is the sequence
+//after which changes are returned, all changes if empty.  Feed is "normal" if empty, or "longpoll" to wait
+//up to Timeout for a change.  SeqInterval makes CouchDB compute the sequence of only one change in
+//SeqInterval, which reduces the cost of the feed of clustered databases.  Parameters with a zero value are
+//not passed, leaving the CouchDB defaults
+type ChangesOptions struct {
+	Since       string
+	Limit       int
+	Feed        string
+	SeqInterval int
+	Timeout     time.Duration
+}
 
-	logger.Debugf("Entering ReadDocRange()  startKey=%s, endKey=%s", startKey, endKey)
+//Change is a change of a document returned by the changes feed, identified by its latest revision
+type Change struct {
+	ID      string
+	Rev     string
+	Deleted bool
+}
 
-	var results []QueryResult
+//Changes are the changes returned by the changes feed, and the sequence to read the next changes from
+type Changes struct {
+	Results []Change
+	LastSeq string
+}
 
-	rangeURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+//changesResponse is the response of a _changes request
+type changesResponse struct {
+	Results []struct {
+		ID      string `json:"id"`
+		Deleted bool   `json:"deleted"`
+		Changes []struct {
+			Rev string `json:"rev"`
+		} `json:"changes"`
+	} `json:"results"`
+	LastSeq json.RawMessage `json:"last_seq"`
+}
+
+//ReadChanges method provides function to read the changes of the documents of the database from the
+//changes feed
+func (dbclient *CouchDatabase) ReadChanges(options ChangesOptions) (*Changes, error) {
+
+	logger.Debugf("Entering ReadChanges()  since=%s", options.Since)
+
+	changesURL, err := url.Parse(dbclient.couchInstance.conf.URL)
 	if err != nil {
 		logger.Errorf("URL parse error: %s", err.Error())
 		return nil, err
 	}
-	rangeURL.Path = dbclient.dbName + "/_all_docs"
-
-	queryParms := rangeURL.Query()
-	queryParms.Set("limit", strconv.Itoa(limit))
-	queryParms.Add("skip", strconv.Itoa(skip))
-	queryParms.Add("include_docs", "true")
-	queryParms.Add("inclusive_end", "false") // endkey should be exclusive to be consistent with goleveldb
+	changesURL.Path = dbclient.dbName + "/_changes"
 
-	//Append the startKey if provided
-	if startKey != "" {
-		startKey = strconv.QuoteToGraphic(startKey)
-		startKey = strings.Replace(startKey, "\\x00", "\\u0000", 1)
-		queryParms.Add("startkey", startKey)
+	queryParms := changesURL.Query()
+	if options.Since != "" {
+		queryParms.Set("since", options.Since)
 	}
-
-	//Append the endKey if provided
-	if endKey != "" {
-		endKey = strconv.QuoteToGraphic(endKey)
-		endKey = strings.Replace(endKey, "\\x00", "\\u0000", 1)
-		endKey = strings.Replace(endKey, "\\x01", "\\u0001", 1) //TODO add general unicode support instead of special cases
-		queryParms.Add("endkey", endKey)
+	if options.Limit > 0 {
+		queryParms.Set("limit", strconv.Itoa(options.Limit))
 	}
+	if options.Feed != "" {
+		queryParms.Set("feed", options.Feed)
+	}
+	if options.SeqInterval > 0 {
+		queryParms.Set("seq_interval", strconv.Itoa(options.SeqInterval))
+	}
+	if options.Timeout > 0 {
+		queryParms.Set("timeout", strconv.FormatInt(int64(options.Timeout/time.Millisecond), 10))
+	}
+	changesURL.RawQuery = queryParms.Encode()
 
-	rangeURL.RawQuery = queryParms.Encode()
-
-	resp, _, err := dbclient.handleRequest(http.MethodGet, rangeURL.String(), nil, "", "")
+	resp, _, err := dbclient.handleRequest(http.MethodGet, changesURL.String(), nil, "", "")
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if logger.IsEnabledFor(logging.DEBUG) {
-		dump, err2 := httputil.DumpResponse(resp, true)
-		if err2 != nil {
-			log.Fatal(err2)
+	jsonResponse := &changesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+
+	//the sequences are numbers in CouchDB 1.x, and opaque strings from CouchDB 2.0
+	changes := &Changes{LastSeq: string(jsonResponse.LastSeq)}
+	var lastSeq string
+	if err := json.Unmarshal(jsonResponse.LastSeq, &lastSeq); err == nil {
+		changes.LastSeq = lastSeq
+	}
+	for _, result := range jsonResponse.Results {
+		change := Change{ID: result.ID, Deleted: result.Deleted}
+		if len(result.Changes) > 0 {
+			change.Rev = result.Changes[0].Rev
 		}
-		logger.Debugf("%s", dump)
+		changes.Results = append(changes.Results, change)
 	}
 
-	//handle as JSON document
-	jsonResponseRaw, err := ioutil.ReadAll(resp.Body)
+	logger.Debugf("Exiting ReadChanges()  changes=%d, lastSeq=%s", len(changes.Results), changes.LastSeq)
+
+	return changes, nil
+
+}
+
+//CreateIndexResponse is the response of a request creating an index.  Result is "created", or "exists"
+//if the index was already defined
+type CreateIndexResponse struct {
+	Result string `json:"result"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+}
+
+//CreateIndex method provides a function to create a Mango index from its JSON definition, as expected by
+//the _index endpoint.  Creating an index that already exists is not an error
+func (dbclient *CouchDatabase) CreateIndex(indexDefinition string) (*CreateIndexResponse, error) {
+
+	logger.Debugf("Entering CreateIndex()  indexDefinition=%s", indexDefinition)
+
+	indexURL, err := url.Parse(dbclient.couchInstance.conf.URL)
 	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
 		return nil, err
 	}
 
-	var jsonResponse = &RangeQueryResponse{}
-	err2 := json.Unmarshal(jsonResponseRaw, &jsonResponse)
-	if err2 != nil {
-		return nil, err2
-	}
-
-	logger.Debugf("Total Rows: %d", jsonResponse.TotalRows)
-
-	for _, row := range jsonResponse.Rows {
+	indexURL.Path = dbclient.dbName + "/_index"
 
-		var jsonDoc = &Doc{}
-		err3 := json.Unmarshal(row.Doc, &jsonDoc)
-		if err3 != nil {
-			return nil, err3
-		}
+	resp, _, err := dbclient.handleRequest(http.MethodPost, indexURL.String(), bytes.NewReader([]byte(indexDefinition)), "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-		if jsonDoc.Attachments != nil {
+	indexResponse := &CreateIndexResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(indexResponse); err != nil {
+		return nil, err
+	}
 
-			logger.Debugf("Adding binary docment for id: %s", jsonDoc.ID)
+	logger.Debugf("Exiting CreateIndex()  result=%s", indexResponse.Result)
 
-			binaryDocument, _, err := dbclient.ReadDoc(jsonDoc.ID)
-			if err != nil {
-				return nil, err
-			}
+	return indexResponse, nil
 
-			var addDocument = &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), binaryDocument}
+}
 
-			results = append(results, *addDocument)
+//IndexInfo describes an index of a database as listed by the _index endpoint.  DesignDoc is the id of the
+//design document holding the index, and Definition the definition of the index, e.g. its fields
+type IndexInfo struct {
+	DesignDoc  string          `json:"ddoc"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Definition json.RawMessage `json:"def"`
+}
 
-		} else {
+//ListIndexes method provides a function to list the indexes of the database, including the special
+//_all_docs index which has no design document
+func (dbclient *CouchDatabase) ListIndexes() ([]IndexInfo, error) {
 
-			logger.Debugf("Adding json docment for id: %s", jsonDoc.ID)
+	logger.Debugf("Entering ListIndexes()")
 
-			var addDocument = &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), row.Doc}
+	indexURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
 
-			results = append(results, *addDocument)
+	indexURL.Path = dbclient.dbName + "/_index"
 
-		}
+	resp, _, err := dbclient.handleRequest(http.MethodGet, indexURL.String(), nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
+	indexResponse := &struct {
+		Indexes []IndexInfo `json:"indexes"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(indexResponse); err != nil {
+		return nil, err
 	}
 
-	logger.Debugf("Exiting ReadDocRange()")
+	logger.Debugf("Exiting ListIndexes()  indexes=%d", len(indexResponse.Indexes))
 
-	return &results, nil
+	return indexResponse.Indexes, nil
 
 }
 
-//QueryDocuments method provides function for processing a query
-func (dbclient *CouchDatabase) QueryDocuments(query string, limit, skip int) (*[]QueryResult, error) {
+//DesignDocInfo is the state of the view index of a design document, such as the design document of a Mango
+//index.  UpdateSeq is the update sequence of the database the index is built up to
+type DesignDocInfo struct {
+	Name           string
+	UpdaterRunning bool
+	CompactRunning bool
+	UpdateSeq      string
+}
 
-	logger.Debugf("Entering QueryDocuments()  query=%s", query)
+//ReadDesignDocInfo method provides a function to retrieve the state of the view index of the given design
+//document, e.g. whether CouchDB is building the index
+func (dbclient *CouchDatabase) ReadDesignDocInfo(designDoc string) (*DesignDocInfo, error) {
 
-	var results []QueryResult
+	logger.Debugf("Entering ReadDesignDocInfo()  designDoc=%s", designDoc)
 
-	queryURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	infoURL, err := url.Parse(dbclient.couchInstance.conf.URL)
 	if err != nil {
 		logger.Errorf("URL parse error: %s", err.Error())
 		return nil, err
 	}
+	infoURL.Path = dbclient.dbName + "/_design/" + strings.TrimPrefix(designDoc, "_design/") + "/_info"
 
-	queryURL.Path = dbclient.dbName + "/_find"
+	resp, _, err := dbclient.handleRequest(http.MethodGet, infoURL.String(), nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	queryParms := queryURL.Query()
-	queryParms.Set("limit", strconv.Itoa(limit))
-	queryParms.Add("skip", strconv.Itoa(skip))
+	jsonResponse := &struct {
+		Name      string `json:"name"`
+		ViewIndex struct {
+			UpdaterRunning bool            `json:"updater_running"`
+			CompactRunning bool            `json:"compact_running"`
+			UpdateSeq      json.RawMessage `json:"update_seq"`
+		} `json:"view_index"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
 
-	queryURL.RawQuery = queryParms.Encode()
+	info := &DesignDocInfo{
+		Name:           jsonResponse.Name,
+		UpdaterRunning: jsonResponse.ViewIndex.UpdaterRunning,
+		CompactRunning: jsonResponse.ViewIndex.CompactRunning,
+		UpdateSeq:      decodeUpdateSeq(jsonResponse.ViewIndex.UpdateSeq)}
 
-	//Set up a buffer for the data to be pushed to couchdb
-	data := new(bytes.Buffer)
+	logger.Debugf("Exiting ReadDesignDocInfo()  updaterRunning=%t, updateSeq=%s", info.UpdaterRunning, info.UpdateSeq)
 
-	data.ReadFrom(bytes.NewReader([]byte(query)))
+	return info, nil
 
-	resp, _, err := dbclient.handleRequest(http.MethodPost, queryURL.String(), data, "", "")
+}
+
+//ViewRow is a row of the result of a view query: the key and the value emitted by the view or, for a reduced
+//query, the group key and the value reduced by the reduce function of the view for the group
+type ViewRow struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+//QueryReducedView method provides a function to query a view of a design document reduced by the reduce
+//function of the view.  The rows emitted with an array key are grouped by the first groupLevel elements of the
+//key, and a single row reduces all the rows of the view if groupLevel is 0.  The groups are returned in the order
+//of their keys
+func (dbclient *CouchDatabase) QueryReducedView(designDoc string, view string, groupLevel int) ([]ViewRow, error) {
+
+	logger.Debugf("Entering QueryReducedView()  designDoc=%s  view=%s  groupLevel=%d", designDoc, view, groupLevel)
+
+	viewURL, err := url.Parse(dbclient.couchInstance.conf.URL)
 	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
 		return nil, err
 	}
-	defer resp.Body.Close()
+	viewURL.Path = dbclient.dbName + "/_design/" + strings.TrimPrefix(designDoc, "_design/") + "/_view/" + view
 
-	if logger.IsEnabledFor(logging.DEBUG) {
-		dump, err2 := httputil.DumpResponse(resp, true)
-		if err2 != nil {
-			log.Fatal(err2)
-		}
-		logger.Debugf("%s", dump)
+	queryParms := viewURL.Query()
+	queryParms.Set("reduce", "true")
+	if groupLevel > 0 {
+		queryParms.Set("group_level", strconv.Itoa(groupLevel))
 	}
+	viewURL.RawQuery = queryParms.Encode()
 
-	//handle as JSON document
-	jsonResponseRaw, err := ioutil.ReadAll(resp.Body)
+	resp, _, err := dbclient.handleRequest(http.MethodGet, viewURL.String(), nil, "", "")
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	var jsonResponse = &QueryResponse{}
+	jsonResponse := &struct {
+		Rows []ViewRow `json:"rows"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
 
-	err2 := json.Unmarshal(jsonResponseRaw, &jsonResponse)
-	if err2 != nil {
-		return nil, err2
+	logger.Debugf("Exiting QueryReducedView()  rows=%d", len(jsonResponse.Rows))
+
+	return jsonResponse.Rows, nil
+
+}
+
+//DeleteIndex method provides a function to delete the index with the given design document and name,
+//as listed by ListIndexes
+func (dbclient *CouchDatabase) DeleteIndex(designDoc string, name string) error {
+
+	logger.Debugf("Entering DeleteIndex()  designDoc=%s  name=%s", designDoc, name)
+
+	indexURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return err
 	}
 
-	for _, row := range jsonResponse.Docs {
+	indexURL.Path = dbclient.dbName + "/_index/" + designDoc + "/json/" + name
 
-		var jsonDoc = &DocID{}
-		err3 := json.Unmarshal(row, &jsonDoc)
-		if err3 != nil {
-			return nil, err3
-		}
+	resp, _, err := dbclient.handleRequest(http.MethodDelete, indexURL.String(), nil, "", "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-		logger.Debugf("Adding row to resultset: %s", row)
+	logger.Debugf("Exiting DeleteIndex()")
 
-		//TODO Replace the temporary NewHeight version when available
-		var addDocument = &QueryResult{jsonDoc.ID, version.NewHeight(1, 1), row}
+	return nil
 
-		results = append(results, *addDocument)
+}
+
+//ErrPurgeNotSupported is returned by PurgeDocuments if the server does not support purging the documents, as
+//CouchDB 2.0 to 2.2 which answer 501 Not Implemented
+var ErrPurgeNotSupported = errors.New("Couch DB Error: purge is not supported by the server")
 
+//purgeResponse is the response of a _purge request
+type purgeResponse struct {
+	Purged map[string][]string `json:"purged"`
+}
+
+//PurgeDocuments method provides function to purge revisions of documents, given by document id, which removes
+//them from the database as if they never existed.  A purge is irreversible and is not replicated.  The revisions
+//purged are returned by document id
+func (dbclient *CouchDatabase) PurgeDocuments(revs map[string][]string) (map[string][]string, error) {
+
+	logger.Debugf("Entering PurgeDocuments()  documents=%d", len(revs))
+
+	purgeURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
 	}
+	purgeURL.Path = dbclient.dbName + "/_purge"
 
-	logger.Debugf("Exiting QueryDocuments()")
+	requestJSON, err := json.Marshal(revs)
+	if err != nil {
+		return nil, err
+	}
 
-	return &results, nil
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodPost, purgeURL.String(), bytes.NewReader(requestJSON), "", "")
+	if err != nil {
+		if couchDBReturn != nil && couchDBReturn.StatusCode == http.StatusNotImplemented {
+			return nil, ErrPurgeNotSupported
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonResponse := &purgeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Exiting PurgeDocuments()  purged=%d", len(jsonResponse.Purged))
+
+	return jsonResponse.Purged, nil
+
+}
 
+//isDatabaseNotFound tells if CouchDB reported that the database of a request does not exist, rather than a document
+//of the database.  The reason is "Database does not exist." for CouchDB 2.x and no_db_file for CouchDB 1.x
+func isDatabaseNotFound(couchDBReturn *DBReturn) bool {
+	return couchDBReturn.StatusCode == http.StatusNotFound && couchDBReturn.Error == "not_found" &&
+		(couchDBReturn.Reason == "Database does not exist." || couchDBReturn.Reason == "no_db_file")
 }
 
 //handleRequest method is a generic http request handler
@@ -789,6 +2695,10 @@ func (dbclient *CouchDatabase) handleRequest(method, connectURL string, data io.
 
 	logger.Debugf("Entering handleRequest()  method=%s  url=%v", method, connectURL)
 
+	if dbclient.couchInstance.isClosed() {
+		return nil, nil, ErrInstanceClosed
+	}
+
 	//Create request based on URL for couchdb operation
 	req, err := http.NewRequest(method, connectURL, data)
 	if err != nil {
@@ -823,8 +2733,8 @@ func (dbclient *CouchDatabase) handleRequest(method, connectURL string, data io.
 	}
 
 	//If username and password are set the use basic auth
-	if dbclient.couchInstance.conf.Username != "" && dbclient.couchInstance.conf.Password != "" {
-		req.SetBasicAuth(dbclient.couchInstance.conf.Username, dbclient.couchInstance.conf.Password)
+	if username, password := dbclient.couchInstance.getCredentials(); username != "" && password != "" {
+		req.SetBasicAuth(username, password)
 	}
 
 	if logger.IsEnabledFor(logging.DEBUG) {
@@ -842,15 +2752,20 @@ func (dbclient *CouchDatabase) handleRequest(method, connectURL string, data io.
 		}
 	}
 
-	//Create the http client
-	client := &http.Client{}
+	//Use the http client of the instance, or create one
+	client := dbclient.couchInstance.client
+	if client == nil {
+		client = &http.Client{}
 
-	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
-	transport.DisableCompression = false
-	client.Transport = transport
+		transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+		transport.DisableCompression = false
+		client.Transport = transport
+	}
 
 	//Execute http request
+	atomic.AddInt64(&inFlightRequests, 1)
 	resp, err := client.Do(req)
+	atomic.AddInt64(&inFlightRequests, -1)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -865,8 +2780,9 @@ func (dbclient *CouchDatabase) handleRequest(method, connectURL string, data io.
 	//in this case, the http request succeeded but CouchDB is reporing an error
 	if resp.StatusCode >= 400 {
 
+		//CouchDB may close the connection of a request too large before the error is read
 		jsonError, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
+		if err != nil && resp.StatusCode != http.StatusRequestEntityTooLarge {
 			return nil, nil, err
 		}
 
@@ -876,6 +2792,16 @@ func (dbclient *CouchDatabase) handleRequest(method, connectURL string, data io.
 
 		json.Unmarshal(errorBytes, &couchDBReturn)
 
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return nil, couchDBReturn, &ErrRequestTooLarge{Reason: couchDBReturn.Reason}
+		}
+		if isDatabaseNotFound(couchDBReturn) {
+			return nil, couchDBReturn, &ErrDatabaseNotFound{DBName: dbclient.dbName}
+		}
+		if resp.StatusCode == http.StatusConflict {
+			return nil, couchDBReturn, &ErrDocumentConflict{Reason: couchDBReturn.Reason}
+		}
+
 		return nil, couchDBReturn, fmt.Errorf("Couch DB Error: %s", couchDBReturn.Reason)
 
 	}
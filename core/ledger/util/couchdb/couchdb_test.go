@@ -17,9 +17,16 @@ limitations under the License.
 package couchdb
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
 	"github.com/hyperledger/fabric/core/ledger/testutil"
@@ -255,3 +262,971 @@ func TestDBSaveAttachment(t *testing.T) {
 
 	}
 }
+
+func TestDBExplainQuery(t *testing.T) {
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		cleanup()
+		defer cleanup()
+
+		//create a new instance and database object
+		couchInstance, err := CreateCouchInstance(connectURL, username, password)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create couch instance"))
+		db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+		//create a new database
+		_, errdb := db.CreateDatabaseIfNotExist()
+		testutil.AssertNoError(t, errdb, fmt.Sprintf("Error when trying to create database"))
+
+		//create an index on the owner field
+		indexURL := fmt.Sprintf("%s/%s/_index", couchInstance.conf.URL, database)
+		indexDef := []byte(`{"index":{"fields":["owner"]},"name":"indexOwner","type":"json"}`)
+		resp, _, err := db.handleRequest(http.MethodPost, indexURL, bytes.NewReader(indexDef), "", "")
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create an index"))
+		resp.Body.Close()
+
+		type explainResponse struct {
+			Index struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"index"`
+		}
+
+		//an indexed query reports the index
+		explain, err := db.ExplainQuery(`{"selector":{"owner":"jerry"}}`)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to explain an indexed query"))
+		indexedPlan := &explainResponse{}
+		err = json.Unmarshal([]byte(explain), indexedPlan)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to parse the query plan"))
+		testutil.AssertEquals(t, indexedPlan.Index.Name, "indexOwner")
+		testutil.AssertEquals(t, indexedPlan.Index.Type, "json")
+
+		//a non-indexed query reports the _all_docs full scan
+		explain, err = db.ExplainQuery(`{"selector":{"color":"blue"}}`)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to explain a non-indexed query"))
+		fullScanPlan := &explainResponse{}
+		err = json.Unmarshal([]byte(explain), fullScanPlan)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to parse the query plan"))
+		testutil.AssertEquals(t, fullScanPlan.Index.Name, "_all_docs")
+		testutil.AssertEquals(t, fullScanPlan.Index.Type, "special")
+
+	}
+}
+
+func TestDBReadDocRevision(t *testing.T) {
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		cleanup()
+		defer cleanup()
+
+		//create a new instance and database object
+		couchInstance, err := CreateCouchInstance(connectURL, username, password)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create couch instance"))
+		db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+		//create a new database
+		_, errdb := db.CreateDatabaseIfNotExist()
+		testutil.AssertNoError(t, errdb, fmt.Sprintf("Error when trying to create database"))
+
+		//Save the test document twice
+		rev1, saveerr := db.SaveDoc("1", "", assetJSON, nil)
+		testutil.AssertNoError(t, saveerr, fmt.Sprintf("Error when trying to save a document"))
+		_, saveerr = db.SaveDoc("1", "", []byte(`{"asset_name":"marble1","color":"blue","size":"35","owner":"bob"}`), nil)
+		testutil.AssertNoError(t, saveerr, fmt.Sprintf("Error when trying to save the updated document"))
+
+		//Retrieve the first revision
+		dbGetResp, rev, geterr := db.ReadDocRevision("1", rev1)
+		testutil.AssertNoError(t, geterr, fmt.Sprintf("Error when trying to retrieve a document revision"))
+		testutil.AssertEquals(t, rev, rev1)
+		assetResp := &Asset{}
+		json.Unmarshal(dbGetResp, &assetResp)
+		testutil.AssertEquals(t, assetResp.Owner, "jerry")
+
+		//A non-existent revision results in a nil value
+		dbGetResp, _, geterr = db.ReadDocRevision("1", "1-0123456789abcdef")
+		testutil.AssertNoError(t, geterr, fmt.Sprintf("Error when trying to retrieve a non-existent document revision"))
+		testutil.AssertNil(t, dbGetResp)
+
+	}
+}
+
+func TestStreamDocRange(t *testing.T) {
+
+	//the mock writes the rows of a huge range one at a time, until the client goes away
+	totalRows := 100000
+	value := strings.Repeat("x", 2048)
+	written := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.AssertEquals(t, r.URL.Query().Get("limit"), "")
+		fmt.Fprintf(w, `{"total_rows":%d,"offset":0,"rows":[`, totalRows)
+		rows := 0
+		for ; rows < totalRows; rows++ {
+			separator := ","
+			if rows == 0 {
+				separator = ""
+			}
+			_, err := fmt.Fprintf(w, `%s{"id":"key%06d","key":"key%06d","value":{"rev":"1-a"},"doc":{"_id":"key%06d","_rev":"1-a","value":"%s"}}`,
+				separator, rows, rows, rows, value)
+			if err != nil {
+				break
+			}
+			w.(http.Flusher).Flush()
+		}
+		if rows == totalRows {
+			fmt.Fprint(w, `]}`)
+		}
+		written <- rows
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	stream, err := db.StreamDocRange("", "", 0, 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to stream the range"))
+	for i := 0; i < 1000; i++ {
+		result, err := stream.Next()
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the next row"))
+		testutil.AssertEquals(t, result.ID, fmt.Sprintf("key%06d", i))
+	}
+
+	//only the rows read are held in memory, not the 200MB range
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	testutil.AssertEquals(t, after.HeapAlloc < before.HeapAlloc+32*1024*1024, true)
+
+	//Close releases the response, the mock stops writing the rows
+	testutil.AssertNoError(t, stream.Close(), fmt.Sprintf("Error when trying to close the stream"))
+	select {
+	case rows := <-written:
+		testutil.AssertEquals(t, rows < totalRows, true)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Response was not released by Close")
+	}
+
+}
+
+func TestStreamDocRangeAllRows(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_rows":2,"offset":0,"rows":[
+			{"id":"key1","key":"key1","value":{"rev":"1-a"},"doc":{"_id":"key1","_rev":"1-a","rows":"value1"}},
+			{"id":"key2","key":"key2","value":{"rev":"1-a"},"doc":{"_id":"key2","_rev":"1-a","rows":"value2"}}]}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	stream, err := db.StreamDocRange("key1", "key3", 0, 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to stream the range"))
+	defer stream.Close()
+	for _, id := range []string{"key1", "key2"} {
+		result, err := stream.Next()
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the next row"))
+		testutil.AssertEquals(t, result.ID, id)
+		testutil.AssertEquals(t, strings.Contains(string(result.Value), "value"), true)
+	}
+	result, err := stream.Next()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read past the last row"))
+	testutil.AssertNil(t, result)
+
+}
+
+func TestDBBulkGet(t *testing.T) {
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		cleanup()
+		defer cleanup()
+
+		//create a new instance and database object
+		couchInstance, err := CreateCouchInstance(connectURL, username, password)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create couch instance"))
+		db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+		//create a new database
+		_, errdb := db.CreateDatabaseIfNotExist()
+		testutil.AssertNoError(t, errdb, fmt.Sprintf("Error when trying to create database"))
+
+		//Save a JSON document twice and a binary document
+		rev1, saveerr := db.SaveDoc("1", "", assetJSON, nil)
+		testutil.AssertNoError(t, saveerr, fmt.Sprintf("Error when trying to save a document"))
+		rev2, saveerr := db.SaveDoc("1", "", []byte(`{"asset_name":"marble1","color":"blue","size":"35","owner":"bob"}`), nil)
+		testutil.AssertNoError(t, saveerr, fmt.Sprintf("Error when trying to save the updated document"))
+		attachment := Attachment{Name: "valueBytes", ContentType: "application/octet-stream", AttachmentBytes: []byte("binary value")}
+		_, saveerr = db.SaveDoc("2", "", nil, []Attachment{attachment})
+		testutil.AssertNoError(t, saveerr, fmt.Sprintf("Error when trying to save a binary document"))
+
+		results, err := db.BulkGet([]DocRevRequest{{"1", rev1}, {"1", rev2}, {"2", ""}, {"1", "1-0123456789abcdef"}, {"3", ""}})
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to bulk get the documents"))
+		testutil.AssertEquals(t, len(results), 5)
+
+		//the revisions are returned in the order requested
+		assetResp := &Asset{}
+		json.Unmarshal(results[0].JSONDoc, &assetResp)
+		testutil.AssertEquals(t, results[0].Rev, rev1)
+		testutil.AssertEquals(t, assetResp.Owner, "jerry")
+		json.Unmarshal(results[1].JSONDoc, &assetResp)
+		testutil.AssertEquals(t, results[1].Rev, rev2)
+		testutil.AssertEquals(t, assetResp.Owner, "bob")
+		testutil.AssertEquals(t, results[2].Error, "")
+		testutil.AssertEquals(t, len(results[2].Attachments), 1)
+		testutil.AssertEquals(t, results[2].Attachments[0].AttachmentBytes, []byte("binary value"))
+
+		//a pruned revision and a missing document fail individually
+		testutil.AssertEquals(t, results[3].ID, "1")
+		testutil.AssertEquals(t, results[3].Error, "not_found")
+		testutil.AssertNil(t, results[3].JSONDoc)
+		testutil.AssertEquals(t, results[4].ID, "3")
+		testutil.AssertEquals(t, results[4].Error, "not_found")
+
+	}
+}
+
+func TestDBCreateIndex(t *testing.T) {
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		cleanup()
+		defer cleanup()
+
+		//create a new instance and database object
+		couchInstance, err := CreateCouchInstance(connectURL, username, password)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create couch instance"))
+		db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+		//create a new database
+		_, errdb := db.CreateDatabaseIfNotExist()
+		testutil.AssertNoError(t, errdb, fmt.Sprintf("Error when trying to create database"))
+
+		indexDefinition := `{"index":{"fields":["owner"]},"name":"by_owner","ddoc":"indexes","type":"json"}`
+		indexResp, err := db.CreateIndex(indexDefinition)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create an index"))
+		testutil.AssertEquals(t, indexResp.Result, "created")
+		testutil.AssertEquals(t, indexResp.Name, "by_owner")
+
+		//creating the index again is not an error
+		indexResp, err = db.CreateIndex(indexDefinition)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create an existing index"))
+		testutil.AssertEquals(t, indexResp.Result, "exists")
+
+		//queries on the indexed field use the index
+		plan, err := db.ExplainQuery(`{"selector":{"owner":"tom"}}`)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to explain a query"))
+		testutil.AssertEquals(t, strings.Contains(plan, "by_owner"), true)
+
+		//the index is listed along with the special _all_docs index, until it is deleted
+		indexes, err := db.ListIndexes()
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to list the indexes"))
+		testutil.AssertEquals(t, len(indexes), 2)
+		testutil.AssertEquals(t, indexes[1].DesignDoc, "_design/indexes")
+		testutil.AssertEquals(t, indexes[1].Name, "by_owner")
+		err = db.DeleteIndex(indexes[1].DesignDoc, indexes[1].Name)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to delete an index"))
+		indexes, err = db.ListIndexes()
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to list the indexes"))
+		testutil.AssertEquals(t, len(indexes), 1)
+		testutil.AssertEquals(t, indexes[0].Name, "_all_docs")
+
+	}
+}
+
+func TestReadChanges(t *testing.T) {
+
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		fmt.Fprint(w, `{"results":[{"seq":null,"id":"1","changes":[{"rev":"2-b"}]},`+
+			`{"seq":"8-g1AAAA","id":"2","changes":[{"rev":"1-a"}],"deleted":true}],"last_seq":"8-g1AAAA","pending":0}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the parameters tuning the feed are passed through
+	changes, err := db.ReadChanges(ChangesOptions{Since: "5-g1AAAA", Limit: 10, Feed: "longpoll",
+		SeqInterval: 100, Timeout: 30 * time.Second})
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the changes"))
+	testutil.AssertEquals(t, query.Get("since"), "5-g1AAAA")
+	testutil.AssertEquals(t, query.Get("limit"), "10")
+	testutil.AssertEquals(t, query.Get("feed"), "longpoll")
+	testutil.AssertEquals(t, query.Get("seq_interval"), "100")
+	testutil.AssertEquals(t, query.Get("timeout"), "30000")
+	testutil.AssertEquals(t, changes.LastSeq, "8-g1AAAA")
+	testutil.AssertEquals(t, changes.Results, []Change{{ID: "1", Rev: "2-b"}, {ID: "2", Rev: "1-a", Deleted: true}})
+
+	//the parameters not set are left to the CouchDB defaults
+	_, err = db.ReadChanges(ChangesOptions{})
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the changes"))
+	testutil.AssertEquals(t, len(query), 0)
+
+}
+
+func TestReadDocRevisionRange(t *testing.T) {
+
+	var query url.Values
+	updateSeq := `"8-g1AAAA"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		fmt.Fprintf(w, `{"total_rows":2,"offset":0,"rows":[{"id":"1","key":"1","value":{"rev":"2-b"}},`+
+			`{"id":"2","key":"2","value":{"rev":"1-a"}}],"update_seq":%s}`, updateSeq)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the whole range is read in a single request, along with the update sequence
+	revs, seq, err := db.ReadDocRevisionRange("1", "3", 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the revisions of the range"))
+	testutil.AssertEquals(t, query.Get("update_seq"), "true")
+	testutil.AssertEquals(t, query.Get("limit"), "")
+	testutil.AssertEquals(t, query.Get("include_docs"), "")
+	testutil.AssertEquals(t, seq, "8-g1AAAA")
+	testutil.AssertEquals(t, revs, []DocRevRequest{{ID: "1", Rev: "2-b"}, {ID: "2", Rev: "1-a"}})
+
+	//the numeric sequences of CouchDB 1.x are returned as strings
+	updateSeq = "8"
+	_, seq, err = db.ReadDocRevisionRange("1", "3", 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the revisions of the range"))
+	testutil.AssertEquals(t, seq, "8")
+
+}
+
+func TestReadDocRev(t *testing.T) {
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.URL.RawQuery)
+		if r.URL.Path == "/"+database+"/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Etag", `"2-abc"`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the revision is read with a HEAD request, from quorum replicas if requested
+	rev, err := db.ReadDocRev("doc", 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the revision"))
+	testutil.AssertEquals(t, rev, "2-abc")
+	rev, err = db.ReadDocRev("doc", 2)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the revision"))
+	testutil.AssertEquals(t, rev, "2-abc")
+
+	//a missing document has no revision
+	rev, err = db.ReadDocRev("missing", 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the revision of a missing document"))
+	testutil.AssertEquals(t, rev, "")
+	testutil.AssertEquals(t, requests, []string{
+		"HEAD /" + database + "/doc ",
+		"HEAD /" + database + "/doc r=2",
+		"HEAD /" + database + "/missing "})
+
+}
+
+func TestReadAttachmentStubRange(t *testing.T) {
+
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		fmt.Fprint(w, `{"total_rows":2,"offset":0,"rows":[{"id":"1","key":"1","value":{"rev":"1-a"},"doc":{"_id":"1","_rev":"1-a","a":1}},`+
+			`{"id":"2","key":"2","value":{"rev":"1-b"},"doc":{"_id":"2","_rev":"1-b","_attachments":`+
+			`{"valueBytes":{"content_type":"application/octet-stream","stub":true,"length":3}}}}]}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the attachments are listed with their content type, their data is not requested
+	docs, err := db.ReadAttachmentStubRange("1", "3", 10)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the attachment stubs of the range"))
+	testutil.AssertEquals(t, query.Get("include_docs"), "true")
+	testutil.AssertEquals(t, query.Get("attachments"), "")
+	testutil.AssertEquals(t, query.Get("limit"), "10")
+	testutil.AssertEquals(t, docs, []DocAttachmentStubs{
+		{ID: "1", ContentTypes: map[string]string{}},
+		{ID: "2", ContentTypes: map[string]string{"valueBytes": "application/octet-stream"}}})
+
+}
+
+func TestReadDocStubRange(t *testing.T) {
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		fmt.Fprint(w, `{"total_rows":2,"offset":0,"rows":[{"id":"1","key":"1","value":{"rev":"1-a"},"doc":{"_id":"1","_rev":"1-a","a":1}},`+
+			`{"id":"2","key":"2","value":{"rev":"1-b"},"doc":{"_id":"2","_rev":"1-b","_attachments":`+
+			`{"valueBytes":{"content_type":"application/octet-stream","stub":true,"length":3}}}}]}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the document with an attachment is returned with its stub, the attachment is not read
+	results, err := db.ReadDocStubRange("1", "3", 10)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the documents of the range"))
+	testutil.AssertEquals(t, requests, []string{"/" + database + "/_all_docs"})
+	testutil.AssertEquals(t, len(results), 2)
+	testutil.AssertEquals(t, results[0].ID, "1")
+	testutil.AssertEquals(t, string(results[0].Value), `{"_id":"1","_rev":"1-a","a":1}`)
+	testutil.AssertEquals(t, results[1].ID, "2")
+	testutil.AssertEquals(t, strings.Contains(string(results[1].Value), `"stub":true`), true)
+
+}
+
+func TestReadDocFieldRange(t *testing.T) {
+
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		fmt.Fprint(w, `{"total_rows":2,"offset":0,"rows":[{"id":"1","key":"1","value":{"rev":"1-a"},"doc":{"_id":"1","_rev":"1-a","a":1,"~expiry":1500000000000}},`+
+			`{"id":"2","key":"2","value":{"rev":"1-b"},"doc":{"_id":"2","_rev":"1-b","_attachments":`+
+			`{"valueBytes":{"content_type":"application/octet-stream","stub":true,"length":3}}}}]}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the documents are listed with their revision and the field, if they have it
+	docs, err := db.ReadDocFieldRange("1", "3", "~expiry", 10)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the field of the range"))
+	testutil.AssertEquals(t, query.Get("include_docs"), "true")
+	testutil.AssertEquals(t, query.Get("limit"), "10")
+	testutil.AssertEquals(t, docs, []DocField{
+		{ID: "1", Rev: "1-a", Value: json.RawMessage("1500000000000")},
+		{ID: "2", Rev: "1-b"}})
+
+}
+
+func TestCompactDatabase(t *testing.T) {
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the database and the views of a design document are compacted with JSON requests
+	_, err = db.CompactDatabase()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to compact the database"))
+	_, err = db.CompactViews("_design/fabric_namespace")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to compact the views"))
+	testutil.AssertEquals(t, requests, []string{
+		"POST /" + database + "/_compact application/json",
+		"POST /" + database + "/_compact/fabric_namespace application/json"})
+
+}
+
+func TestBulkSaveRevisions(t *testing.T) {
+
+	var request map[string]interface{}
+	response := `[]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the revisions are written as they are, with their attachments inline
+	docs := []DocRevResult{{ID: "1", Rev: "2-b", JSONDoc: []byte(`{"_id":"1","_rev":"2-b","asset_name":"marble1"}`)},
+		{ID: "2", Rev: "1-a", JSONDoc: []byte(`{"_id":"2","_rev":"1-a"}`),
+			Attachments: []Attachment{{Name: "valueBytes", ContentType: "application/octet-stream", AttachmentBytes: []byte("value")}}}}
+	err = db.BulkSaveRevisions(docs)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to save the revisions"))
+	testutil.AssertEquals(t, request["new_edits"], false)
+	savedDocs := request["docs"].([]interface{})
+	testutil.AssertEquals(t, savedDocs[0], map[string]interface{}{"_id": "1", "_rev": "2-b", "asset_name": "marble1"})
+	testutil.AssertEquals(t, savedDocs[1], map[string]interface{}{"_id": "2", "_rev": "1-a", "_attachments": map[string]interface{}{
+		"valueBytes": map[string]interface{}{"content_type": "application/octet-stream", "data": "dmFsdWU="}}})
+
+	//the failure to write any revision fails the call
+	response = `[{"id":"2","error":"forbidden","reason":"invalid document"}]`
+	err = db.BulkSaveRevisions(docs)
+	testutil.AssertError(t, err, fmt.Sprintf("Expected an error when a revision is not saved"))
+
+}
+
+func TestBulkSaveDocs(t *testing.T) {
+
+	var request map[string]interface{}
+	response := `[{"ok":true,"id":"1","rev":"3-c"},{"ok":true,"id":"2","rev":"1-d"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the documents are written as new revisions, a new document without a revision
+	docs := []DocRevResult{{ID: "1", Rev: "2-b", JSONDoc: []byte(`{"asset_name":"marble1"}`)},
+		{ID: "2", JSONDoc: []byte(`{}`),
+			Attachments: []Attachment{{Name: "valueBytes", ContentType: "application/octet-stream", AttachmentBytes: []byte("value")}}}}
+	revs, err := db.BulkSaveDocs(docs)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to save the documents"))
+	testutil.AssertEquals(t, revs, []string{"3-c", "1-d"})
+	testutil.AssertEquals(t, request["new_edits"], true)
+	savedDocs := request["docs"].([]interface{})
+	testutil.AssertEquals(t, savedDocs[0], map[string]interface{}{"_id": "1", "_rev": "2-b", "asset_name": "marble1"})
+	testutil.AssertEquals(t, savedDocs[1], map[string]interface{}{"_id": "2", "_attachments": map[string]interface{}{
+		"valueBytes": map[string]interface{}{"content_type": "application/octet-stream", "data": "dmFsdWU="}}})
+
+	//the failure to write any document fails the call
+	response = `[{"ok":true,"id":"1","rev":"3-c"},{"id":"2","error":"conflict","reason":"Document update conflict."}]`
+	_, err = db.BulkSaveDocs(docs)
+	testutil.AssertError(t, err, fmt.Sprintf("Expected an error when a document is not saved"))
+
+}
+
+func TestBulkDeleteDocs(t *testing.T) {
+
+	var request map[string]interface{}
+	response := `[{"ok":true,"id":"1","rev":"3-c"},{"id":"2","error":"conflict","reason":"Document update conflict."}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the documents are deleted at their revision, a document updated since is left as is
+	deleted, err := db.BulkDeleteDocs([]DocRevRequest{{ID: "1", Rev: "2-b"}, {ID: "2", Rev: "1-a"}})
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to delete the documents"))
+	testutil.AssertEquals(t, deleted, []string{"1"})
+	testutil.AssertEquals(t, request["docs"], []interface{}{
+		map[string]interface{}{"_id": "1", "_rev": "2-b", "_deleted": true},
+		map[string]interface{}{"_id": "2", "_rev": "1-a", "_deleted": true}})
+
+	//the failure to delete a document for any other reason fails the call
+	response = `[{"id":"1","error":"forbidden","reason":"invalid document"}]`
+	_, err = db.BulkDeleteDocs([]DocRevRequest{{ID: "1", Rev: "2-b"}})
+	testutil.AssertError(t, err, fmt.Sprintf("Expected an error when a document is not deleted"))
+
+}
+
+func TestReadDocRevisions(t *testing.T) {
+
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		fmt.Fprint(w, `{"total_rows":2,"rows":[{"id":"1","key":"1","value":{"rev":"2-b"}},{"key":"2","error":"not_found"},`+
+			`{"id":"3","key":"3","value":{"rev":"4-d","deleted":true}}]}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the missing and deleted documents are not listed
+	revs, err := db.ReadDocRevisions([]string{"1", "2", "3"})
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the revisions"))
+	testutil.AssertEquals(t, request["keys"], []interface{}{"1", "2", "3"})
+	testutil.AssertEquals(t, revs, map[string]string{"1": "2-b"})
+
+}
+
+func TestQueryReducedView(t *testing.T) {
+
+	var requestURL *url.URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURL = r.URL
+		fmt.Fprint(w, `{"rows":[{"key":["jerry"],"value":1},{"key":["tom"],"value":22}]}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	rows, err := db.QueryReducedView("fabric_agg_ns1", "size_by_owner", 1)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to query the view"))
+	testutil.AssertEquals(t, requestURL.Path, "/"+database+"/_design/fabric_agg_ns1/_view/size_by_owner")
+	testutil.AssertEquals(t, requestURL.Query().Get("reduce"), "true")
+	testutil.AssertEquals(t, requestURL.Query().Get("group_level"), "1")
+	testutil.AssertEquals(t, rows, []ViewRow{{Key: json.RawMessage(`["jerry"]`), Value: json.RawMessage(`1`)},
+		{Key: json.RawMessage(`["tom"]`), Value: json.RawMessage(`22`)}})
+
+	//without a group level, all the rows are reduced
+	_, err = db.QueryReducedView("fabric_agg_ns1", "size_by_owner", 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to query the view"))
+	testutil.AssertEquals(t, requestURL.Query().Get("group_level"), "")
+
+}
+
+func TestRequestTooLarge(t *testing.T) {
+
+	bulkGets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprint(w, `{"error":"too_large","reason":"the request entity is too large"}`)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not_found","reason":"missing"}`)
+			return
+		}
+		//the _bulk_get requests of more than 2 documents are too large
+		bulkGets++
+		request := struct {
+			Docs []struct {
+				ID string `json:"id"`
+			} `json:"docs"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&request)
+		if len(request.Docs) > 2 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprint(w, `{"error":"too_large","reason":"the request entity is too large"}`)
+			return
+		}
+		results := []map[string]interface{}{}
+		for _, doc := range request.Docs {
+			results = append(results, map[string]interface{}{"id": doc.ID,
+				"docs": []map[string]interface{}{{"ok": map[string]string{"_id": doc.ID, "_rev": "1-a", "asset_name": doc.ID}}}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//a write too large returns the typed error
+	_, err = db.SaveDoc("1", "", []byte(`{"asset_name":"marble1"}`), nil)
+	testutil.AssertEquals(t, err, &ErrRequestTooLarge{Reason: "the request entity is too large"})
+
+	//a bulk read too large is split until the requests are accepted
+	requests := []DocRevRequest{{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"}, {ID: "5"}}
+	results, err := db.BulkGet(requests)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the documents in bulk"))
+	testutil.AssertEquals(t, len(results), 5)
+	for i, result := range results {
+		testutil.AssertEquals(t, result.ID, requests[i].ID)
+		testutil.AssertEquals(t, result.Rev, "1-a")
+	}
+	//5 documents, then 2 and 3 documents, then the 3 documents split in 1 and 2
+	testutil.AssertEquals(t, bulkGets, 5)
+
+}
+
+func TestGetServerLimits(t *testing.T) {
+
+	configRequests := 0
+	configStatus := http.StatusOK
+	bulkGets := []int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"couchdb":"Welcome","version":"2.1.0"}`)
+		case "/_node/_local/_config":
+			configRequests++
+			w.WriteHeader(configStatus)
+			if configStatus != http.StatusOK {
+				fmt.Fprint(w, `{"error":"forbidden","reason":"You are not a server admin."}`)
+				return
+			}
+			fmt.Fprint(w, `{"couchdb":{"max_document_size":"4194304","uuid":"a"},"chttpd":{"max_http_request_size":"70","port":"5984"},`+
+				`"httpd":{"max_http_request_size":"67108864"},"log":{"level":"info"}}`)
+		default:
+			request := struct {
+				Docs []struct {
+					ID string `json:"id"`
+				} `json:"docs"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&request)
+			bulkGets = append(bulkGets, len(request.Docs))
+			results := []map[string]interface{}{}
+			for _, doc := range request.Docs {
+				results = append(results, map[string]interface{}{"id": doc.ID,
+					"docs": []map[string]interface{}{{"ok": map[string]string{"_id": doc.ID, "_rev": "1-a"}}}})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+		}
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the bulk reads are not split while the limits are unknown
+	requests := []DocRevRequest{{ID: "document1"}, {ID: "document2"}, {ID: "document3"}, {ID: "document4"}, {ID: "document5"}}
+	_, err = db.BulkGet(requests)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the documents in bulk"))
+	testutil.AssertEquals(t, bulkGets, []int{5})
+
+	//the limits are parsed from the configuration, the clustered interface taking precedence, and read once
+	limits, err := couchInstance.GetServerLimits()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the server limits"))
+	testutil.AssertEquals(t, limits, &ServerLimits{MaxDocumentSize: 4194304, MaxHTTPRequestSize: 70})
+	limits, err = db.couchInstance.GetServerLimits()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the server limits"))
+	testutil.AssertEquals(t, limits.MaxHTTPRequestSize, int64(70))
+	testutil.AssertEquals(t, configRequests, 1)
+
+	//the bulk reads are then split in requests within max_http_request_size, in order
+	bulkGets = nil
+	results, err := db.BulkGet(requests)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the documents in bulk"))
+	testutil.AssertEquals(t, bulkGets, []int{3, 2})
+	for i, result := range results {
+		testutil.AssertEquals(t, result.ID, requests[i].ID)
+	}
+
+	//the limits are unknown if the configuration is forbidden
+	configStatus = http.StatusForbidden
+	couchInstance, err = CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	limits, err = couchInstance.GetServerLimits()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the server limits"))
+	testutil.AssertEquals(t, limits, &ServerLimits{})
+
+}
+
+func TestClusterStatus(t *testing.T) {
+
+	serverVersion := "2.1.0"
+	membership := `{"all_nodes":["couchdb@node1","couchdb@node2","couchdb@node3"],"cluster_nodes":["couchdb@node1","couchdb@node2","couchdb@node3"]}`
+	upStatus := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `{"couchdb":"Welcome","version":"%s"}`, serverVersion)
+		case "/_membership":
+			fmt.Fprint(w, membership)
+		case "/_up":
+			w.WriteHeader(upStatus)
+			if upStatus != http.StatusOK {
+				fmt.Fprint(w, `{"status":"maintenance_mode"}`)
+				return
+			}
+			fmt.Fprint(w, `{"status":"ok"}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	status, err := couchInstance.ClusterStatus()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the cluster status"))
+	testutil.AssertEquals(t, status.NodeCount(), 3)
+	testutil.AssertEquals(t, status.Up, true)
+	testutil.AssertEquals(t, status.Healthy(), true)
+
+	//a node being added is configured but not connected yet
+	membership = `{"all_nodes":["couchdb@node1","couchdb@node2"],"cluster_nodes":["couchdb@node1","couchdb@node2","couchdb@node4"]}`
+	status, err = couchInstance.ClusterStatus()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the cluster status"))
+	testutil.AssertEquals(t, status.NodeCount(), 3)
+	testutil.AssertEquals(t, status.ConnectedNodes, []string{"couchdb@node1", "couchdb@node2"})
+	testutil.AssertEquals(t, status.Healthy(), false)
+
+	//a node in maintenance mode is not up
+	membership = `{"all_nodes":["couchdb@node1"],"cluster_nodes":["couchdb@node1"]}`
+	upStatus = http.StatusNotFound
+	status, err = couchInstance.ClusterStatus()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the cluster status"))
+	testutil.AssertEquals(t, status.NodeCount(), 1)
+	testutil.AssertEquals(t, status.Up, false)
+	testutil.AssertEquals(t, status.Healthy(), false)
+
+	//any other failure is returned
+	upStatus = http.StatusInternalServerError
+	_, err = couchInstance.ClusterStatus()
+	testutil.AssertError(t, err, fmt.Sprintf("Error should have been thrown when the status is unknown"))
+
+	//a 1.x server is a single node
+	serverVersion = "1.6.1"
+	couchInstance, err = CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	status, err = couchInstance.ClusterStatus()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the cluster status"))
+	testutil.AssertEquals(t, status.NodeCount(), 1)
+	testutil.AssertEquals(t, status.Healthy(), true)
+
+}
+
+func TestServerVersion(t *testing.T) {
+
+	requests := 0
+	serverVersion := "1.6.1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"couchdb":"Welcome","version":"%s"}`, serverVersion)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	clustered, err := couchInstance.IsClustered()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to detect the server version"))
+	testutil.AssertEquals(t, clustered, false)
+
+	//the version is read once per instance, and shared with its databases
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+	clustered, err = db.IsClustered()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to detect the server version"))
+	testutil.AssertEquals(t, clustered, false)
+	testutil.AssertEquals(t, requests, 1)
+
+	serverVersion = "2.1.0"
+	couchInstance, err = CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	version, err := couchInstance.ServerVersion()
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to detect the server version"))
+	testutil.AssertEquals(t, version, "2.1.0")
+	clustered, _ = couchInstance.IsClustered()
+	testutil.AssertEquals(t, clustered, true)
+
+}
+
+func TestQueryDocumentsWithoutID(t *testing.T) {
+
+	database := "testquerywithoutid"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"couchdb":"Welcome","version":"2.1.0"}`)
+		case "/" + database + "/_find":
+			fmt.Fprint(w, `{"docs":[{"_id":"ns1\u0000key1","owner":"tom"},{"owner":"jerry"},{"_id":5,"owner":"bob"},null,["owner"]]}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the rows whose _id is projected away, or that are not documents, are returned with an empty ID
+	results, err := db.QueryDocuments(`{"selector":{"owner":{"$exists":true}},"fields":["owner"]}`, 10, 0)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to query documents"))
+	testutil.AssertEquals(t, len(*results), 5)
+	testutil.AssertEquals(t, (*results)[0].ID, "ns1\x00key1")
+	for _, result := range (*results)[1:] {
+		testutil.AssertEquals(t, result.ID, "")
+	}
+	testutil.AssertEquals(t, string((*results)[1].Value), `{"owner":"jerry"}`)
+
+}
+
+func TestSaveDocConflict(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			w.Header().Set("Etag", `"2-b"`)
+			fmt.Fprint(w, `{"_id":"1","_rev":"2-b","asset_name":"marble1"}`)
+		case r.Header.Get("If-Match") != "2-b":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":"conflict","reason":"Document update conflict."}`)
+		default:
+			w.Header().Set("Etag", `"3-c"`)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"ok":true,"id":"1","rev":"3-c"}`)
+		}
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//a write at another revision returns the typed error, with the message of the untyped error
+	_, err = db.SaveDoc("1", "1-a", []byte(`{"asset_name":"marble1"}`), nil)
+	testutil.AssertEquals(t, err, &ErrDocumentConflict{Reason: "Document update conflict."})
+	testutil.AssertEquals(t, err.Error(), "Couch DB Error: Document update conflict.")
+
+	//a write at the current revision succeeds
+	rev, err := db.SaveDoc("1", "", []byte(`{"asset_name":"marble1"}`), nil)
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to save a document"))
+	testutil.AssertEquals(t, rev, "3-c")
+
+}
+
+func TestSaveDocEmptyRevision(t *testing.T) {
+
+	response := `[{"ok":true,"id":"1","rev":""}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not_found","reason":"missing"}`)
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, response)
+		default:
+			//a successful response whose revision is empty
+			w.Header().Set("Etag", `""`)
+			fmt.Fprint(w, `{"ok":true,"id":"1","rev":""}`)
+		}
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	//the write is not taken as persisted
+	_, err = db.SaveDoc("1", "", []byte(`{"asset_name":"marble1"}`), nil)
+	testutil.AssertError(t, err, fmt.Sprintf("Expected an error for an empty revision"))
+	testutil.AssertEquals(t, err.Error(), "Couch DB Error: no revision returned for the save of document 1")
+
+	//nor is a bulk write
+	_, err = db.BulkSaveDocs([]DocRevResult{{ID: "1", JSONDoc: []byte(`{"asset_name":"marble1"}`)}})
+	testutil.AssertError(t, err, fmt.Sprintf("Expected an error for an empty revision"))
+	testutil.AssertEquals(t, err.Error(), "Couch DB Error: no revision returned for the save of document 1")
+
+	response = `[{"ok":true,"id":"1","rev":"1-a"}]`
+	revs, err := db.BulkSaveDocs([]DocRevResult{{ID: "1", JSONDoc: []byte(`{"asset_name":"marble1"}`)}})
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to save the documents"))
+	testutil.AssertEquals(t, revs, []string{"1-a"})
+
+}
@@ -0,0 +1,168 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package couchdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//lockDBName is the database holding the advisory locks of the peers sharing a CouchDB.
+//Channel names cannot contain an underscore, so it does not clash with a ledger database
+const lockDBName = "fabric_locks"
+
+//lockExpiry is the time after which a lock that was not released, e.g. by a crashed peer, can be taken over
+var lockExpiry = 60 * time.Second
+
+//lockRetryInterval is the time between attempts to take a lock held by another owner
+var lockRetryInterval = 100 * time.Millisecond
+
+//lockDoc is the document representing a held lock
+type lockDoc struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+//acquireLock takes the advisory lock with the given name, waiting while the lock is held by another owner.
+//The lock document is created with a revision check, so only one owner can hold the lock at a time.
+//The returned function releases the lock
+func acquireLock(couchInstance CouchInstance, name string) (func(), error) {
+
+	logger.Debugf("Entering acquireLock()  name=%s", name)
+
+	lockDB := &CouchDatabase{couchInstance: couchInstance, dbName: lockDBName}
+	if err := lockDB.createLockDB(); err != nil {
+		return nil, err
+	}
+
+	owner, err := newLockOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	lockURL, err := url.Parse(couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return nil, err
+	}
+	lockURL.Path = lockDBName + "/" + name
+
+	rev := ""
+	for {
+		lockJSON, err := json.Marshal(&lockDoc{Owner: owner, Expires: time.Now().Add(lockExpiry)})
+		if err != nil {
+			return nil, err
+		}
+
+		resp, couchDBReturn, err := lockDB.handleRequest(http.MethodPut, lockURL.String(), bytes.NewReader(lockJSON), rev, "")
+		if err == nil {
+			lockRev, err := getRevisionHeader(resp)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			logger.Debugf("Exiting acquireLock()  name=%s owner=%s", name, owner)
+			return func() { lockDB.releaseLock(name, lockRev) }, nil
+		}
+		if couchDBReturn == nil || couchDBReturn.StatusCode != 409 {
+			return nil, err
+		}
+
+		//the lock is held, take it over if it has expired, or wait for it to be released
+		heldJSON, heldRev, err := lockDB.ReadDoc(name)
+		if err != nil {
+			return nil, err
+		}
+		if heldJSON == nil {
+			//released meanwhile
+			rev = ""
+			continue
+		}
+		held := &lockDoc{}
+		if err := json.Unmarshal(heldJSON, held); err != nil {
+			return nil, err
+		}
+		if time.Now().After(held.Expires) {
+			logger.Warningf("Taking over expired lock %s of owner %s", name, held.Owner)
+			rev = heldRev
+			continue
+		}
+		rev = ""
+		time.Sleep(lockRetryInterval)
+	}
+
+}
+
+//releaseLock deletes the lock document of the given revision.  A lock that was
+//taken over after expiring has a newer revision and is left to its new owner
+func (dbclient *CouchDatabase) releaseLock(name string, rev string) {
+
+	lockURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return
+	}
+	lockURL.Path = lockDBName + "/" + name
+	query := lockURL.Query()
+	query.Add("rev", rev)
+	lockURL.RawQuery = query.Encode()
+
+	resp, _, err := dbclient.handleRequest(http.MethodDelete, lockURL.String(), nil, "", "")
+	if err != nil {
+		logger.Warningf("Error releasing lock %s: %s", name, err.Error())
+		return
+	}
+	resp.Body.Close()
+
+}
+
+//createLockDB creates the lock database if it does not exist.  It is created without taking
+//a lock, an error reporting that another peer created it concurrently is ignored
+func (dbclient *CouchDatabase) createLockDB() error {
+
+	connectURL, err := url.Parse(dbclient.couchInstance.conf.URL)
+	if err != nil {
+		logger.Errorf("URL parse error: %s", err.Error())
+		return err
+	}
+	connectURL.Path = dbclient.dbName
+
+	resp, couchDBReturn, err := dbclient.handleRequest(http.MethodPut, connectURL.String(), nil, "", "")
+	if err != nil {
+		if couchDBReturn != nil && couchDBReturn.StatusCode == 412 {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+
+}
+
+//newLockOwner returns a random identifier of a lock owner
+func newLockOwner() (string, error) {
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(owner), nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
+	"github.com/hyperledger/fabric/core/ledger/testutil"
+)
+
+func cleanupLocks() {
+	couchInstance, _ := CreateCouchInstance(connectURL, username, password)
+	lockDB := CouchDatabase{couchInstance: *couchInstance, dbName: lockDBName}
+	lockDB.DropDatabase()
+}
+
+func TestDBConcurrentCreate(t *testing.T) {
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		cleanup()
+		defer cleanup()
+		defer cleanupLocks()
+
+		//two peers sharing the CouchDB create the same database concurrently
+		var wg sync.WaitGroup
+		responses := make([]*DBOperationResponse, 2)
+		errs := make([]error, 2)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				couchInstance, err := CreateCouchInstance(connectURL, username, password)
+				testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create couch instance"))
+				db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+				responses[i], errs[i] = db.CreateDatabaseIfNotExist()
+			}(i)
+		}
+		wg.Wait()
+
+		//both succeed, only one of them creates the database
+		testutil.AssertNoError(t, errs[0], fmt.Sprintf("Error when trying to create database"))
+		testutil.AssertNoError(t, errs[1], fmt.Sprintf("Error when trying to create database"))
+		creates := 0
+		for _, response := range responses {
+			if response != nil && response.Ok {
+				creates++
+			}
+		}
+		testutil.AssertEquals(t, creates, 1)
+
+	}
+}
+
+func TestDBCreateWithExpiredLock(t *testing.T) {
+
+	if ledgerconfig.IsCouchDBEnabled() == true {
+
+		cleanup()
+		defer cleanup()
+		defer cleanupLocks()
+
+		couchInstance, err := CreateCouchInstance(connectURL, username, password)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create couch instance"))
+
+		//a crashed peer left the create lock behind
+		lockDB := CouchDatabase{couchInstance: *couchInstance, dbName: lockDBName}
+		testutil.AssertNoError(t, lockDB.createLockDB(), fmt.Sprintf("Error when trying to create lock database"))
+		expiredLock, _ := json.Marshal(&lockDoc{Owner: "crashed", Expires: time.Now().Add(-time.Second)})
+		_, err = lockDB.SaveDoc(database, "", expiredLock, nil)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to save the lock"))
+
+		//the expired lock is taken over and released after the create
+		db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+		dbResp, err := db.CreateDatabaseIfNotExist()
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to create database"))
+		testutil.AssertEquals(t, dbResp.Ok, true)
+		lockJSON, _, err := lockDB.ReadDoc(database)
+		testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to read the lock"))
+		testutil.AssertNil(t, lockJSON)
+
+	}
+}
@@ -16,8 +16,15 @@ limitations under the License.
 
 package couchdb
 
+import "net/http"
+
 //CreateCouchInstance creates a CouchDB instance
 func CreateCouchInstance(couchDBConnectURL string, id string, pw string) (*CouchInstance, error) {
+	return CreateCouchInstanceWithLimits(couchDBConnectURL, id, pw, ConnectionLimits{})
+}
+
+//CreateCouchInstanceWithLimits creates a CouchDB instance whose requests share a connection pool with the given limits
+func CreateCouchInstanceWithLimits(couchDBConnectURL string, id string, pw string, limits ConnectionLimits) (*CouchInstance, error) {
 	couchConf, err := CreateConnectionDefinition(couchDBConnectURL,
 		id,
 		pw)
@@ -26,16 +33,36 @@ func CreateCouchInstance(couchDBConnectURL string, id string, pw string) (*Couch
 		return nil, err
 	}
 
-	return &CouchInstance{conf: *couchConf}, nil
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	transport.DisableCompression = false
+	if limits.MaxIdleConns > 0 {
+		//all the connections of the pool are to the same host
+		transport.MaxIdleConns = limits.MaxIdleConns
+		transport.MaxIdleConnsPerHost = limits.MaxIdleConns
+	}
+	transport.MaxConnsPerHost = limits.MaxConnsPerHost
+
+	return &CouchInstance{conf: *couchConf,
+		credentials: &credentials{username: couchConf.Username, password: couchConf.Password},
+		client:      &http.Client{Transport: transport},
+		server:      &serverVersion{},
+		closed:      new(int32),
+		limits:      &serverLimits{}}, nil
 }
 
 //CreateCouchDatabase creates a CouchDB database object, as well as the underlying database if it does not exist
 func CreateCouchDatabase(couchInstance CouchInstance, dbName string) (*CouchDatabase, error) {
+	return CreateCouchDatabaseWithOptions(couchInstance, dbName, DatabaseOptions{})
+}
+
+//CreateCouchDatabaseWithOptions creates a CouchDB database object, as well as the underlying database
+//with the given cluster options if it does not exist
+func CreateCouchDatabaseWithOptions(couchInstance CouchInstance, dbName string, options DatabaseOptions) (*CouchDatabase, error) {
 
 	couchDBDatabase := CouchDatabase{couchInstance: couchInstance, dbName: dbName}
 
 	// Create CouchDB database upon ledger startup, if it doesn't already exist
-	_, err := couchDBDatabase.CreateDatabaseIfNotExist()
+	_, err := couchDBDatabase.CreateDatabaseIfNotExistWithOptions(options)
 	if err != nil {
 		logger.Errorf("Error during CouchDB CreateDatabaseIfNotExist() for dbName: %s  error: %s\n", dbName, err.Error())
 		return nil, err
@@ -43,3 +70,9 @@ func CreateCouchDatabase(couchInstance CouchInstance, dbName string) (*CouchData
 
 	return &couchDBDatabase, nil
 }
+
+//NewCouchDatabase creates a CouchDB database object for a database that may or may not exist, without creating
+//the underlying database. Requests on a database that does not exist fail with ErrDatabaseNotFound
+func NewCouchDatabase(couchInstance CouchInstance, dbName string) *CouchDatabase {
+	return &CouchDatabase{couchInstance: couchInstance, dbName: dbName}
+}
@@ -18,10 +18,13 @@ package couchdb
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/hyperledger/fabric/core/ledger/ledgerconfig"
 	"github.com/hyperledger/fabric/core/ledger/testutil"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 //Unit test of couch db util functionality
@@ -43,3 +46,52 @@ func TestCreateCouchDBConnectionAndDB(t *testing.T) {
 	}
 
 }
+
+func TestCreateCouchInstanceWithLimits(t *testing.T) {
+
+	couchInstance, err := CreateCouchInstanceWithLimits(connectURL, "", "", ConnectionLimits{MaxIdleConns: 50, MaxConnsPerHost: 20})
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstanceWithLimits"))
+
+	transport := couchInstance.client.Transport.(*http.Transport)
+	testutil.AssertEquals(t, transport.MaxIdleConns, 50)
+	testutil.AssertEquals(t, transport.MaxIdleConnsPerHost, 50)
+	testutil.AssertEquals(t, transport.MaxConnsPerHost, 20)
+
+	//the copies of the instance share the client
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+	testutil.AssertEquals(t, db.couchInstance.client == couchInstance.client, true)
+
+}
+
+func TestInFlightRequests(t *testing.T) {
+
+	release := make(chan struct{})
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"db_name":"testdb1"}`)
+	}))
+	defer server.Close()
+
+	couchInstance, err := CreateCouchInstance(server.Listener.Addr().String(), "", "")
+	testutil.AssertNoError(t, err, fmt.Sprintf("Error when trying to CreateCouchInstance"))
+	db := CouchDatabase{couchInstance: *couchInstance, dbName: database}
+
+	done := make(chan struct{})
+	go func() {
+		db.GetDatabaseInfo()
+		close(done)
+	}()
+
+	//the request awaiting its response is counted, and reported by the gauge
+	<-received
+	testutil.AssertEquals(t, InFlightRequests(), int64(1))
+	gauge := metrics.DefaultRegistry.Get("couchdb.requests.inflight").(metrics.Gauge)
+	testutil.AssertEquals(t, gauge.Value(), int64(1))
+
+	close(release)
+	<-done
+	testutil.AssertEquals(t, InFlightRequests(), int64(0))
+
+}